@@ -12,6 +12,7 @@ package main
 import (
 	"context"
 	"embed"
+	"flag"
 	"fmt"
 	"github.com/lmittmann/tint"
 	"github.com/telebroad/fileserver/filesystem"
@@ -25,6 +26,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -36,6 +38,10 @@ var (
 )
 
 func main() {
+	// `sign` mints a signed share link and exits, the server isn't started
+	if len(os.Args) > 1 && os.Args[1] == "sign" {
+		os.Exit(signCommand(os.Args[2:]))
+	}
 
 	// setting up the slog logger
 	logger := setupLogger()
@@ -52,7 +58,19 @@ func main() {
 	u := GetUsers(logger)
 
 	// file system
-	localFS := filesystem.NewLocalFS(env.FtpServerRoot)
+	diskFS := filesystem.NewLocalFS(env.FtpServerRoot)
+	// uploads are renamed into place once complete, watchers never see partial files
+	diskFS.AtomicWrites = true
+	var localFS filesystem.NewFSWithReadWriteAt = diskFS
+	// SEARCH_INDEX keeps the files in memory for the searches, the writes of all the servers update it
+	if index, _ := strconv.ParseBool(os.Getenv("SEARCH_INDEX")); index {
+		indexedFS, err := filesystem.NewIndexedFS(diskFS)
+		if err != nil {
+			logger.Error("Error indexing the files, searches walk the directories", "error", err)
+		} else {
+			localFS = indexedFS
+		}
+	}
 
 	// ftp server
 	ftpServer, err := ftp.NewServer(env.FtpAddr, localFS, u)
@@ -129,7 +147,27 @@ func main() {
 	// add mime types
 	addMimTypes()
 
-	router.Handle("/static/{pathname...}", httphandler.NewFileServerHandler("/static", localFS, u))
+	// the file server and the uploads accept JWTs and API keys too, webdav clients only use basic auth
+	auth := GetAuthenticator(logger, u)
+	fileServer := httphandler.NewFileServerHandler("/static", localFS, auth)
+	// signed share links, SIGNING_KEYS is `id:secret,id:secret` and the first key signs,
+	// there is no default key, links are only enabled with configured keys
+	if signer, err := GetSigner(); err != nil {
+		logger.Error("Error loading the signing keys, share links are disabled", "error", err)
+	} else if signer == nil {
+		logger.Info("SIGNING_KEYS is not set, share links are disabled")
+	} else {
+		fileServer.(*httphandler.FileServer).SetSigner(signer)
+	}
+	router.Handle("/static/{pathname...}", fileServer)
+	// webdav to mount the files as a network drive
+	router.Handle("/dav/", httphandler.NewWebDAVHandler("/dav/", localFS, u))
+	// resumable uploads with the tus protocol, the unfinished uploads are kept outside the served files
+	if staging, err := GetTusStaging(env.FtpServerRoot); err != nil {
+		logger.Error("Error creating the tus upload directory, resumable uploads are disabled", "error", err)
+	} else {
+		router.Handle("/uploads/", httphandler.NewTusHandler("/uploads/", localFS, staging, auth))
+	}
 	httpServer := &httphandler.Server{
 		Server: &http.Server{
 			Addr:    os.Getenv("HTTP_SERVER_ADDR"),
@@ -167,9 +205,9 @@ func main() {
 	<-stopChan
 	ftpServer.Close(fmt.Errorf("ftp server closed by signal"))
 	ftpsServer.Close(fmt.Errorf("ftps server closed by signal"))
-	sftpServer.Close()
 	ctx, cancel := context.WithTimeoutCause(context.Background(), 5*time.Second, fmt.Errorf("http server closed by signal"))
 	defer cancel()
+	sftpServer.Shutdown(ctx)
 	httpServer.Shutdown(ctx)
 	httpsServer.Shutdown(ctx)
 }
@@ -214,7 +252,6 @@ func GetUsers(logger *slog.Logger) *users.LocalUsers {
 	DefaultIp := os.Getenv("DEFAULT_IP")
 	DefaultIps := strings.Split(DefaultIp, ",")
 	logger.Debug("DEFAULT_USER is", "username", DefaultUser)
-	logger.Debug("DEFAULT_PASS is", "password", DefaultPass)
 	logger.Debug("DEFAULT_IP is", "Allowed form origin IPs", DefaultIp)
 	if DefaultUser == "" || DefaultPass == "" {
 		logger.Info("DEFAULT_USER or DEFAULT_PASS is empty, not creating default user")
@@ -232,6 +269,103 @@ func GetUsers(logger *slog.Logger) *users.LocalUsers {
 	return Users
 }
 
+// GetAuthenticator returns the authenticator of the users, JWTs of the JWKS_FILE and the API_KEYS,
+// API_KEYS is `name:key:read+write+delete,name:key:read`
+func GetAuthenticator(logger *slog.Logger, u *users.LocalUsers) *users.Authenticator {
+	auth := &users.Authenticator{Users: u}
+	auth.SetLogger(logger)
+	if jwksFile := os.Getenv("JWKS_FILE"); jwksFile != "" {
+		verifier, err := users.NewJWTVerifier(jwksFile, os.Getenv("JWT_ISSUER"), os.Getenv("JWT_AUDIENCE"))
+		if err != nil {
+			logger.Error("Error loading the JWKS, JWTs are not accepted", "file", jwksFile, "error", err)
+		} else {
+			auth.JWT = verifier
+		}
+	}
+	if apiKeys := os.Getenv("API_KEYS"); apiKeys != "" {
+		keys, err := users.ParseAPIKeys(apiKeys)
+		if err != nil {
+			logger.Error("Error parsing the API keys, API keys are not accepted", "error", err)
+		} else {
+			auth.APIKeys = keys
+		}
+	}
+	return auth
+}
+
+// GetSigner returns the signer of the SIGNING_KEYS, nil if there are no keys
+func GetSigner() (*httphandler.Signer, error) {
+	keys, err := httphandler.ParseSigningKeys(os.Getenv("SIGNING_KEYS"))
+	if err != nil || len(keys) == 0 {
+		return nil, err
+	}
+	return httphandler.NewSigner(keys...)
+}
+
+// GetTusStaging returns the file system of the unfinished tus uploads in TUS_UPLOAD_DIR,
+// by default a directory in the temporary directory, it can't be inside the served root
+func GetTusStaging(root string) (*filesystem.LocalFS, error) {
+	dir := os.Getenv("TUS_UPLOAD_DIR")
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "fileserver-uploads")
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if root, err = filepath.Abs(root); err != nil {
+		return nil, err
+	}
+	if rel, err := filepath.Rel(root, dir); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, fmt.Errorf("TUS_UPLOAD_DIR %s is inside the served root %s", dir, root)
+	}
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return filesystem.NewLocalFS(dir), nil
+}
+
+// signCommand prints a signed link of the file server,
+// like `sign -path /static/recording.wav -expires 48h`
+func signCommand(args []string) int {
+	flags := flag.NewFlagSet("sign", flag.ContinueOnError)
+	base := flags.String("base", "http://localhost"+os.Getenv("HTTP_SERVER_ADDR"), "the base url of the server")
+	urlPath := flags.String("path", "", "the url path of the file, like /static/recording.wav")
+	method := flags.String("method", http.MethodGet, "GET to download or PUT to upload")
+	expires := flags.Duration("expires", 24*time.Hour, "the time the link is valid")
+	maxSize := flags.Int64("max-size", 0, "the maximum size of an upload in bytes, 0 is unlimited")
+	ip := flags.String("ip", "", "the address or network allowed to use the link")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *urlPath == "" {
+		fmt.Fprintln(os.Stderr, "the path is required")
+		flags.Usage()
+		return 2
+	}
+	signer, err := GetSigner()
+	if err == nil && signer == nil {
+		err = fmt.Errorf("SIGNING_KEYS is empty")
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error loading the signing keys:", err)
+		return 1
+	}
+	link, err := signer.SignURL(*base, httphandler.SignedLink{
+		Path:    *urlPath,
+		Method:  strings.ToUpper(*method),
+		Expires: time.Now().Add(*expires),
+		MaxSize: *maxSize,
+		IP:      *ip,
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error signing the link:", err)
+		return 1
+	}
+	fmt.Println(link)
+	return 0
+}
+
 // Environment is the environment of the server
 type Environment struct {
 	FtpAddr       string
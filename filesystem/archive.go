@@ -0,0 +1,580 @@
+package filesystem
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"github.com/pkg/sftp"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Ensure that ArchiveFS implements the FtpFS interface
+var _ NewFSWithReadWriteAt = &ArchiveFS{}
+
+// archiveEntry is a file or a directory of an archive
+type archiveEntry struct {
+	info     *fileInfo
+	section  *io.SectionReader             // the content of a stored entry, nil if it is compressed
+	open     func() (io.ReadCloser, error) // streams the content
+	children []string                      // the sorted names of a directory
+}
+
+// ArchiveFS is a read only file system of the files in a zip or tar archive. stored zip entries
+// and the files of an uncompressed tar are read at random offsets, compressed entries are streamed
+// and reading them backwards restarts the stream. links and special files of a tar are skipped.
+// every change fails with a *PermissionError. mount it in a MountFS to browse the archive in a tree.
+type ArchiveFS struct {
+	entries map[string]*archiveEntry // by clean absolute path
+	size    int64                    // the total size of the files
+	closer  io.Closer
+}
+
+// NewZipFS returns the file system of the zip archive
+func NewZipFS(r io.ReaderAt, size int64) (*ArchiveFS, error) {
+	z, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, fmt.Errorf("error reading zip archive: %w", err)
+	}
+	a := newArchiveFS()
+	for _, file := range z.File {
+		if file.FileInfo().IsDir() {
+			a.addDir(file.Name, file.Modified)
+			continue
+		}
+		if !file.Mode().IsRegular() {
+			continue
+		}
+		entry := &archiveEntry{
+			info: &fileInfo{size: int64(file.UncompressedSize64), mode: file.Mode().Perm() &^ 0222, modTime: file.Modified},
+			open: file.Open,
+		}
+		if offset, err := file.DataOffset(); err == nil && file.Method == zip.Store {
+			entry.section = io.NewSectionReader(r, offset, int64(file.UncompressedSize64))
+		}
+		a.addFile(file.Name, entry)
+	}
+	a.index()
+	return a, nil
+}
+
+// NewTarFS returns the file system of the tar archive, gzipped is true for a .tar.gz archive
+func NewTarFS(r io.ReaderAt, size int64, gzipped bool) (*ArchiveFS, error) {
+	// gunzip opens the tar reader of the compressed archive from the start
+	gunzip := func() (*tar.Reader, io.Closer, error) {
+		gz, err := gzip.NewReader(io.NewSectionReader(r, 0, size))
+		if err != nil {
+			return nil, nil, err
+		}
+		return tar.NewReader(gz), gz, nil
+	}
+
+	// the position in an uncompressed archive is the offset of the content after Next
+	counter := &countingReader{r: io.NewSectionReader(r, 0, size)}
+	tr := tar.NewReader(counter)
+	if gzipped {
+		var closer io.Closer
+		var err error
+		if tr, closer, err = gunzip(); err != nil {
+			return nil, fmt.Errorf("error reading tar archive: %w", err)
+		}
+		defer closer.Close()
+	}
+
+	a := newArchiveFS()
+	for index := 0; ; index++ {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading tar archive: %w", err)
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			a.addDir(header.Name, header.ModTime)
+			continue
+		case tar.TypeReg:
+		default:
+			continue
+		}
+
+		entry := &archiveEntry{info: &fileInfo{size: header.Size, mode: fs.FileMode(header.Mode).Perm() &^ 0222, modTime: header.ModTime}}
+		if !gzipped {
+			entry.section = io.NewSectionReader(r, counter.n, header.Size)
+			section := entry.section
+			entry.open = func() (io.ReadCloser, error) {
+				return io.NopCloser(io.NewSectionReader(section, 0, section.Size())), nil
+			}
+		} else {
+			position := index
+			entry.open = func() (io.ReadCloser, error) {
+				tr, closer, err := gunzip()
+				if err != nil {
+					return nil, err
+				}
+				for i := 0; i <= position; i++ {
+					if _, err = tr.Next(); err != nil {
+						closer.Close()
+						return nil, fmt.Errorf("error reading tar archive: %w", err)
+					}
+				}
+				return struct {
+					io.Reader
+					io.Closer
+				}{tr, closer}, nil
+			}
+		}
+		a.addFile(header.Name, entry)
+	}
+	a.index()
+	return a, nil
+}
+
+// OpenArchiveFS opens the archive file by its extension, .zip, .tar, .tar.gz or .tgz, Close closes the file
+func OpenArchiveFS(fileName string) (*ArchiveFS, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	var a *ArchiveFS
+	lower := strings.ToLower(fileName)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		a, err = NewZipFS(file, info.Size())
+	case strings.HasSuffix(lower, ".tar"):
+		a, err = NewTarFS(file, info.Size(), false)
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		a, err = NewTarFS(file, info.Size(), true)
+	default:
+		err = fmt.Errorf("unsupported archive %s, only .zip, .tar, .tar.gz and .tgz", fileName)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	a.closer = file
+	return a, nil
+}
+
+// Close closes the archive file opened by OpenArchiveFS
+func (a *ArchiveFS) Close() error {
+	if a.closer == nil {
+		return nil
+	}
+	return a.closer.Close()
+}
+
+func newArchiveFS() *ArchiveFS {
+	return &ArchiveFS{entries: map[string]*archiveEntry{
+		"/": {info: &fileInfo{name: "/", mode: fs.ModeDir | 0555}},
+	}}
+}
+
+// addDir adds a directory and its parents, a later entry with the same name replaces it
+func (a *ArchiveFS) addDir(name string, modTime time.Time) {
+	name = cleanName(name)
+	if entry, ok := a.entries[name]; ok && entry.info.IsDir() {
+		entry.info.modTime = modTime
+		return
+	}
+	a.entries[name] = &archiveEntry{info: &fileInfo{name: path.Base(name), mode: fs.ModeDir | 0555, modTime: modTime}}
+	a.addParents(name, modTime)
+}
+
+// addFile adds a file and its parents, a later entry with the same name replaces it
+func (a *ArchiveFS) addFile(name string, entry *archiveEntry) {
+	name = cleanName(name)
+	if name == "/" {
+		return
+	}
+	entry.info.name = path.Base(name)
+	if old, ok := a.entries[name]; ok && !old.info.IsDir() {
+		a.size -= old.info.size
+	}
+	a.entries[name] = entry
+	a.size += entry.info.size
+	a.addParents(name, entry.info.modTime)
+}
+
+// addParents adds the missing parent directories of an entry
+func (a *ArchiveFS) addParents(name string, modTime time.Time) {
+	for dir := path.Dir(name); dir != "/"; dir = path.Dir(dir) {
+		if entry, ok := a.entries[dir]; ok && entry.info.IsDir() {
+			return
+		}
+		a.entries[dir] = &archiveEntry{info: &fileInfo{name: path.Base(dir), mode: fs.ModeDir | 0555, modTime: modTime}}
+	}
+}
+
+// index lists the children of the directories
+func (a *ArchiveFS) index() {
+	for name := range a.entries {
+		if name == "/" {
+			continue
+		}
+		// a file replaced by a directory, or a directory replaced by a file, leaves entries without a parent
+		if parent, ok := a.entries[path.Dir(name)]; ok && parent.info.IsDir() {
+			parent.children = append(parent.children, path.Base(name))
+		}
+	}
+	for _, entry := range a.entries {
+		sort.Strings(entry.children)
+	}
+}
+
+// lookup returns the entry of a path
+func (a *ArchiveFS) lookup(op, name string) (*archiveEntry, error) {
+	entry, ok := a.entries[cleanName(name)]
+	if !ok {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return entry, nil
+}
+
+func (a *ArchiveFS) denied(op, name string) error {
+	return &PermissionError{Op: op, Path: name, Reason: "archives are read only"}
+}
+
+// RootDir returns the root of the archive
+func (a *ArchiveFS) RootDir() string {
+	return "/"
+}
+
+// Dir returns the files of the directory
+func (a *ArchiveFS) Dir(folderName string) ([]string, []os.FileInfo, error) {
+	entry, err := a.lookup("open", folderName)
+	if err == nil && !entry.info.IsDir() {
+		err = &fs.PathError{Op: "readdir", Path: folderName, Err: syscall.ENOTDIR}
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading directory: %w", err)
+	}
+	dir := cleanName(folderName)
+	lines := make([]string, len(entry.children))
+	infos := make([]os.FileInfo, len(entry.children))
+	for i, name := range entry.children {
+		infos[i] = a.entries[path.Join(dir, name)].info
+		lines[i] = fileInfoLine(infos[i])
+	}
+	return lines, infos, nil
+}
+
+// CheckDir checks if the directory exists
+func (a *ArchiveFS) CheckDir(folderName string) error {
+	entry, err := a.lookup("stat", folderName)
+	if err != nil {
+		return err
+	}
+	if !entry.info.IsDir() {
+		return fmt.Errorf("%s is not a directory", folderName)
+	}
+	return nil
+}
+
+// MakeDir is denied
+func (a *ArchiveFS) MakeDir(folderName string) error {
+	return a.denied("mkdir", folderName)
+}
+
+// ReadFile streams the file to the writer
+func (a *ArchiveFS) ReadFile(fileName string, w io.Writer) (int64, error) {
+	entry, err := a.lookup("open", fileName)
+	if err == nil && entry.info.IsDir() {
+		err = &fs.PathError{Op: "read", Path: fileName, Err: syscall.EISDIR}
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error reading file: %w", err)
+	}
+	r, err := entry.open()
+	if err != nil {
+		return 0, fmt.Errorf("error reading file: %w", err)
+	}
+	defer r.Close()
+	n, err := io.Copy(w, r)
+	if err != nil {
+		return n, fmt.Errorf("error reading file: %w", err)
+	}
+	return n, nil
+}
+
+// WriteFile is denied
+func (a *ArchiveFS) WriteFile(fileName string, _ io.Reader, _ string, _ bool) error {
+	return a.denied("write", fileName)
+}
+
+// Remove is denied
+func (a *ArchiveFS) Remove(fileName string) error {
+	return a.denied("remove", fileName)
+}
+
+// Rename is denied
+func (a *ArchiveFS) Rename(original string, _ string) error {
+	return a.denied("rename", original)
+}
+
+// ModifyTime is denied
+func (a *ArchiveFS) ModifyTime(filePath string, _ string) error {
+	return a.denied("chtimes", filePath)
+}
+
+// Stat returns the file info
+func (a *ArchiveFS) Stat(fileName string) (string, fs.FileInfo, error) {
+	entry, err := a.lookup("stat", fileName)
+	if err != nil {
+		return "", nil, fmt.Errorf("error getting file info: %w", err)
+	}
+	return fileInfoLine(entry.info), entry.info, nil
+}
+
+// SetStat is denied
+func (a *ArchiveFS) SetStat(fileName string, _ os.FileMode) error {
+	return a.denied("chmod", fileName)
+}
+
+// Lstat returns the file info, archives have no links
+func (a *ArchiveFS) Lstat(fileName string) (string, fs.FileInfo, error) {
+	return a.Stat(fileName)
+}
+
+// Link is denied
+func (a *ArchiveFS) Link(fileName string, _ string) error {
+	return a.denied("link", fileName)
+}
+
+// Symlink is denied
+func (a *ArchiveFS) Symlink(fileName string, _ string) error {
+	return a.denied("symlink", fileName)
+}
+
+// FileWrite is denied
+func (a *ArchiveFS) FileWrite(fileName string, _ int) (io.WriterAt, error) {
+	return nil, a.denied("write", fileName)
+}
+
+// FileRead opens the file for reading, stored entries are read at random offsets and compressed ones are streamed
+func (a *ArchiveFS) FileRead(fileName string, access int) (io.ReaderAt, error) {
+	if access&writeAccess != 0 {
+		return nil, a.denied("open", fileName)
+	}
+	entry, err := a.lookup("open", fileName)
+	if err == nil && entry.info.IsDir() {
+		err = &fs.PathError{Op: "open", Path: fileName, Err: syscall.EISDIR}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return entry.readerAt(), nil
+}
+
+// readerAt returns the reader of the content of a file
+func (e *archiveEntry) readerAt() io.ReaderAt {
+	if e.section != nil {
+		return e.section
+	}
+	return &streamReaderAt{open: e.open}
+}
+
+// StatFS returns the size of the archive, it has no free space
+func (a *ArchiveFS) StatFS(_ string) (*sftp.StatVFS, error) {
+	const blockSize = 4096
+	return &sftp.StatVFS{
+		Bsize:   blockSize,
+		Frsize:  blockSize,
+		Blocks:  uint64((a.size + blockSize - 1) / blockSize),
+		Files:   uint64(len(a.entries)),
+		Flag:    1, // ST_RDONLY
+		Namemax: 255,
+	}, nil
+}
+
+// GetFS returns the fs.FS object of the archive
+func (a *ArchiveFS) GetFS() fs.FS {
+	return archiveIOFS{a: a}
+}
+
+// streamReaderAt reads a compressed file sequentially, a read before the current position restarts the stream
+type streamReaderAt struct {
+	open func() (io.ReadCloser, error)
+
+	lock   sync.Mutex // Protects r and offset
+	r      io.ReadCloser
+	offset int64
+}
+
+func (s *streamReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if off < 0 {
+		return 0, &fs.PathError{Op: "read", Err: fs.ErrInvalid}
+	}
+	if s.r == nil || off < s.offset {
+		if s.r != nil {
+			s.r.Close()
+		}
+		r, err := s.open()
+		if err != nil {
+			s.r = nil
+			return 0, err
+		}
+		s.r, s.offset = r, 0
+	}
+	if off > s.offset {
+		skipped, err := io.CopyN(io.Discard, s.r, off-s.offset)
+		s.offset += skipped
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := io.ReadFull(s.r, p)
+	s.offset += int64(n)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (s *streamReaderAt) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.r == nil {
+		return nil
+	}
+	err := s.r.Close()
+	s.r = nil
+	return err
+}
+
+// countingReader counts the bytes read
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// archiveIOFS opens the files of an archive as fs.FS
+type archiveIOFS struct {
+	a *ArchiveFS
+}
+
+func (f archiveIOFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	entry, err := f.a.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+	file := &archiveFile{entry: entry, dir: cleanName(name), a: f.a}
+	if !entry.info.IsDir() {
+		file.r = entry.readerAt()
+	}
+	return file, nil
+}
+
+// archiveFile is an open file or directory of an archive, it implements fs.ReadDirFile, io.Seeker and io.ReaderAt
+type archiveFile struct {
+	a     *ArchiveFS
+	entry *archiveEntry
+	dir   string
+	r     io.ReaderAt
+
+	lock    sync.Mutex // Protects offset and dirRead
+	offset  int64
+	dirRead int
+}
+
+func (f *archiveFile) Stat() (fs.FileInfo, error) {
+	return f.entry.info, nil
+}
+
+func (f *archiveFile) Read(p []byte) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.r == nil {
+		return 0, &fs.PathError{Op: "read", Path: f.dir, Err: syscall.EISDIR}
+	}
+	if f.offset >= f.entry.info.size {
+		return 0, io.EOF
+	}
+	n, err := f.r.ReadAt(p, f.offset)
+	f.offset += int64(n)
+	if n > 0 && errors.Is(err, io.EOF) {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *archiveFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.r == nil {
+		return 0, &fs.PathError{Op: "read", Path: f.dir, Err: syscall.EISDIR}
+	}
+	return f.r.ReadAt(p, off)
+}
+
+func (f *archiveFile) Seek(offset int64, whence int) (int64, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.entry.info.size
+	default:
+		return 0, &fs.PathError{Op: "seek", Path: f.dir, Err: fs.ErrInvalid}
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.dir, Err: fs.ErrInvalid}
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *archiveFile) ReadDir(count int) ([]fs.DirEntry, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if !f.entry.info.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: f.dir, Err: syscall.ENOTDIR}
+	}
+	names := f.entry.children[f.dirRead:]
+	if count > 0 {
+		if len(names) == 0 {
+			return nil, io.EOF
+		}
+		names = names[:min(count, len(names))]
+	}
+	entries := make([]fs.DirEntry, len(names))
+	for i, name := range names {
+		entries[i] = fs.FileInfoToDirEntry(f.a.entries[path.Join(f.dir, name)].info)
+	}
+	f.dirRead += len(names)
+	return entries, nil
+}
+
+func (f *archiveFile) Close() error {
+	if closer, ok := f.r.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
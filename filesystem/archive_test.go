@@ -0,0 +1,139 @@
+package filesystem
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// archiveFiles are the files of the test archives
+var archiveFiles = map[string]string{
+	"readme.txt":           "hello",
+	"exports/2024/a.csv":   strings.Repeat("a,b,c\n", 1000),
+	"exports/2024/b.csv":   "1,2,3\n",
+	"exports/empty/.keep/": "",
+}
+
+func testZip(t *testing.T) []byte {
+	var buf bytes.Buffer
+	z := zip.NewWriter(&buf)
+	for name, content := range archiveFiles {
+		method := zip.Deflate
+		if name == "readme.txt" {
+			method = zip.Store
+		}
+		w, err := z.CreateHeader(&zip.FileHeader{Name: name, Method: method, Modified: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(content))
+	}
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func testTar(t *testing.T, gzipped bool) []byte {
+	var buf bytes.Buffer
+	var w io.Writer = &buf
+	gz := gzip.NewWriter(&buf)
+	if gzipped {
+		w = gz
+	}
+	tw := tar.NewWriter(w)
+	for name, content := range archiveFiles {
+		header := &tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), ModTime: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), Typeflag: tar.TypeReg}
+		if strings.HasSuffix(name, "/") {
+			header.Typeflag, header.Mode = tar.TypeDir, 0755
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(content))
+	}
+	tw.WriteHeader(&tar.Header{Name: "link", Linkname: "readme.txt", Typeflag: tar.TypeSymlink})
+	tw.Close()
+	gz.Close()
+	return buf.Bytes()
+}
+
+func TestArchiveFS(t *testing.T) {
+	zipData, tarData, tgzData := testZip(t), testTar(t, false), testTar(t, true)
+	archives := map[string]func() (*ArchiveFS, error){
+		"zip":    func() (*ArchiveFS, error) { return NewZipFS(bytes.NewReader(zipData), int64(len(zipData))) },
+		"tar":    func() (*ArchiveFS, error) { return NewTarFS(bytes.NewReader(tarData), int64(len(tarData)), false) },
+		"tar.gz": func() (*ArchiveFS, error) { return NewTarFS(bytes.NewReader(tgzData), int64(len(tgzData)), true) },
+	}
+	for kind, open := range archives {
+		t.Run(kind, func(t *testing.T) {
+			a, err := open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, infos, err := a.Dir("/exports")
+			if err != nil || len(infos) != 2 || infos[0].Name() != "2024" || !infos[1].IsDir() {
+				t.Fatalf("unexpected listing %v %v", infos, err)
+			}
+			if _, _, err = a.Stat("/link"); !errors.Is(err, fs.ErrNotExist) {
+				t.Fatalf("expected the link to be skipped, got %v", err)
+			}
+
+			var buf bytes.Buffer
+			if _, err = a.ReadFile("/exports/2024/a.csv", &buf); err != nil || buf.String() != archiveFiles["exports/2024/a.csv"] {
+				t.Fatalf("read %d bytes, %v", buf.Len(), err)
+			}
+
+			// reading backwards restarts the stream of a compressed file
+			r, err := a.FileRead("/exports/2024/a.csv", os.O_RDONLY)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, off := range []int64{600, 6, 5994} {
+				part := make([]byte, 6)
+				if n, err := r.ReadAt(part, off); n != 6 || string(part) != "a,b,c\n" {
+					t.Fatalf("read at %d: %q %v", off, part[:n], err)
+				}
+			}
+			if n, err := r.ReadAt(make([]byte, 10), 5996); n != 4 || err != io.EOF {
+				t.Fatalf("expected a short read at the end, got %d %v", n, err)
+			}
+			if closer, ok := r.(io.Closer); ok {
+				closer.Close()
+			}
+
+			denied := map[string]error{
+				"WriteFile": a.WriteFile("/new.txt", strings.NewReader("x"), "I", false),
+				"Remove":    a.Remove("/readme.txt"),
+				"MakeDir":   a.MakeDir("/dir"),
+			}
+			_, denied["FileWrite"] = a.FileWrite("/new.txt", os.O_WRONLY|os.O_CREATE)
+			_, denied["FileRead"] = a.FileRead("/readme.txt", os.O_RDWR)
+			for method, err := range denied {
+				if !errors.Is(err, fs.ErrPermission) {
+					t.Errorf("%s: expected a permission error, got %v", method, err)
+				}
+			}
+
+			if err = fstest.TestFS(a.GetFS(), "readme.txt", "exports/2024/a.csv", "exports/2024/b.csv", "exports/empty/.keep"); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+
+	// stored zip entries are read in place
+	a, _ := archives["zip"]()
+	r, _ := a.FileRead("/readme.txt", os.O_RDONLY)
+	if _, ok := r.(*io.SectionReader); !ok {
+		t.Fatal("expected a stored entry to be read at random offsets")
+	}
+}
@@ -0,0 +1,125 @@
+package filesystem
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+// atomicFile is a hidden temporary file next to its destination, it replaces the destination when it is closed
+// so readers never see a partial file. the temporary file is removed if the transfer failed.
+type atomicFile struct {
+	*os.File
+	dest      string
+	exclusive bool // commit fails if the destination was created meanwhile
+
+	lock        sync.Mutex // Protects transferErr and closed
+	transferErr error
+	closed      bool
+}
+
+// createAtomic creates the temporary file of dest, the flags are applied to the destination:
+// O_EXCL fails if it exists, without O_CREATE it must exist, and without O_TRUNC its content is copied first
+func createAtomic(dest string, flag int) (*atomicFile, error) {
+	info, err := os.Stat(dest)
+	switch {
+	case err == nil && info.IsDir():
+		return nil, &fs.PathError{Op: "open", Path: dest, Err: syscall.EISDIR}
+	case err == nil && flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, &fs.PathError{Op: "open", Path: dest, Err: fs.ErrExist}
+	case err != nil && (!errors.Is(err, fs.ErrNotExist) || flag&os.O_CREATE == 0):
+		return nil, err
+	}
+
+	temp, err := os.CreateTemp(filepath.Dir(dest), "."+filepath.Base(dest)+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	f := &atomicFile{File: temp, dest: dest, exclusive: flag&os.O_EXCL != 0}
+
+	mode := os.FileMode(0644)
+	if info != nil {
+		mode = info.Mode().Perm()
+	}
+	err = temp.Chmod(mode)
+	if err == nil && info != nil && flag&os.O_TRUNC == 0 {
+		err = f.copyFrom(dest)
+	}
+	if err != nil {
+		f.abort()
+		return nil, err
+	}
+	return f, nil
+}
+
+// copyFrom copies the current content of the destination, the next Write appends to it
+func (f *atomicFile) copyFrom(dest string) error {
+	src, err := os.Open(dest)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	_, err = io.Copy(f.File, src)
+	return err
+}
+
+// TransferError marks the transfer as failed, Close then removes the temporary file.
+// the sftp request server calls it for the files open when the connection is lost.
+func (f *atomicFile) TransferError(err error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.transferErr == nil {
+		f.transferErr = err
+	}
+}
+
+// abort removes the temporary file unless it was already committed
+func (f *atomicFile) abort() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.closed {
+		return
+	}
+	f.closed = true
+	_ = f.File.Close()
+	_ = os.Remove(f.File.Name())
+}
+
+// Close syncs the temporary file and renames it to the destination
+func (f *atomicFile) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.closed {
+		return fs.ErrClosed
+	}
+	f.closed = true
+	temp := f.File.Name()
+	if f.transferErr != nil {
+		_ = f.File.Close()
+		_ = os.Remove(temp)
+		return fmt.Errorf("transfer of %s failed: %w", f.dest, f.transferErr)
+	}
+
+	err := f.File.Sync()
+	if closeErr := f.File.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && f.exclusive {
+		// a link fails if the destination exists, unlike a rename
+		if err = os.Link(temp, f.dest); err == nil {
+			_ = os.Remove(temp)
+		}
+	} else if err == nil {
+		err = os.Rename(temp, f.dest)
+	}
+	if err != nil {
+		_ = os.Remove(temp)
+		return fmt.Errorf("error saving file: %w", err)
+	}
+	return nil
+}
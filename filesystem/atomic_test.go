@@ -0,0 +1,100 @@
+package filesystem
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// failingReader returns the data and then fails like an aborted transfer
+type failingReader struct {
+	data string
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.data == "" {
+		return 0, io.ErrUnexpectedEOF
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+// dirNames returns the names in a directory including the hidden temporary files
+func dirNames(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, len(entries))
+	for i, entry := range entries {
+		names[i] = entry.Name()
+	}
+	return names
+}
+
+func TestLocalFS_AtomicWrites(t *testing.T) {
+	dir := t.TempDir()
+	l := NewLocalFS(dir)
+	l.AtomicWrites = true
+
+	if err := l.WriteFile("/a.txt", strings.NewReader("hello"), "I", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.WriteFile("/a.txt", strings.NewReader(" world"), "I", true); err != nil {
+		t.Fatal(err)
+	}
+	// a failed upload leaves the previous content and no temporary file
+	if err := l.WriteFile("/a.txt", &failingReader{data: "partial"}, "I", false); err == nil {
+		t.Fatal("expected the upload to fail")
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "a.txt"))
+	if err != nil || string(data) != "hello world" {
+		t.Fatalf("got %q, %v", data, err)
+	}
+	if names := dirNames(t, dir); len(names) != 1 {
+		t.Fatalf("expected only a.txt, got %v", names)
+	}
+
+	w, err := l.FileWrite("/b.bin", os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.WriteAt([]byte("world"), 6)
+	w.WriteAt([]byte("hello "), 0)
+	if _, err = os.Stat(filepath.Join(dir, "b.bin")); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected the file to appear on close, got %v", err)
+	}
+	if err = w.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ = os.ReadFile(filepath.Join(dir, "b.bin")); string(data) != "hello world" {
+		t.Fatalf("got %q", data)
+	}
+
+	// a lost sftp connection discards the upload
+	w, err = l.FileWrite("/b.bin", os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.WriteAt([]byte("partial"), 0)
+	w.(interface{ TransferError(error) }).TransferError(io.ErrUnexpectedEOF)
+	if err = w.(io.Closer).Close(); err == nil {
+		t.Fatal("expected the close to report the failed transfer")
+	}
+	if data, _ = os.ReadFile(filepath.Join(dir, "b.bin")); string(data) != "hello world" {
+		t.Fatalf("got %q", data)
+	}
+
+	if _, err = l.FileWrite("/b.bin", os.O_RDWR|os.O_CREATE|os.O_EXCL); !errors.Is(err, fs.ErrExist) {
+		t.Fatalf("expected an exist error, got %v", err)
+	}
+	if names := dirNames(t, dir); len(names) != 2 {
+		t.Fatalf("expected no temporary files, got %v", names)
+	}
+}
@@ -0,0 +1,827 @@
+package filesystem
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/pkg/sftp"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+)
+
+// Ensure that EncryptedFS implements the FtpFS interface
+var _ NewFSWithReadWriteAt = &EncryptedFS{}
+
+// ErrUnknownKey is returned when the key of an encrypted file isn't known to the KeyProvider
+var ErrUnknownKey = errors.New("filesystem: unknown encryption key")
+
+// ErrNotEncrypted is returned for a file without a valid encryption header or with a chunk failing authentication
+var ErrNotEncrypted = errors.New("filesystem: file is not encrypted or was modified")
+
+// the layout of an encrypted file is a header followed by the chunks of the content,
+// the header is the magic, the key id length, the key id padded to encKeyIDLen bytes and a random file id.
+// every chunk is a random nonce and the AES-GCM sealed chunk of up to encChunkSize bytes,
+// authenticated with the header and its index so chunks can't be moved within or between files.
+// all chunks except the last are full and the last is never full, an empty file or a file of full chunks
+// ends with an empty chunk, so the plaintext size follows from the stored size. the last chunk is
+// authenticated as the last, a file truncated at a chunk boundary fails authentication.
+const (
+	encMagic     = "FSE1"
+	encKeyIDLen  = 32
+	encHeaderLen = len(encMagic) + 1 + encKeyIDLen + 16
+	encChunkSize = 64 * 1024
+	encNonceLen  = 12
+	encOverhead  = encNonceLen + 16
+	encChunkLen  = encChunkSize + encOverhead
+)
+
+// KeyProvider returns the AES keys of an EncryptedFS, the key id is stored in the header of every file
+// so the current key can be rotated while the files encrypted with older keys stay readable
+type KeyProvider interface {
+	// CurrentKey returns the id and the key used to encrypt new files
+	CurrentKey() (id string, key []byte, err error)
+	// Key returns the key with the id to decrypt existing files
+	Key(id string) ([]byte, error)
+}
+
+// StaticKeys is a KeyProvider with a fixed set of keys
+type StaticKeys struct {
+	// Current is the id of the key used for new files
+	Current string
+	// Keys are the 16, 24 or 32 byte AES keys by id, the ids are at most 32 bytes
+	Keys map[string][]byte
+}
+
+// CurrentKey returns the key with the Current id
+func (k StaticKeys) CurrentKey() (string, []byte, error) {
+	key, err := k.Key(k.Current)
+	return k.Current, key, err
+}
+
+// Key returns the key with the id
+func (k StaticKeys) Key(id string) ([]byte, error) {
+	key, ok := k.Keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownKey, id)
+	}
+	return key, nil
+}
+
+// EncryptedFS wraps a file system and encrypts the content of the files with AES-GCM in chunks of 64KiB,
+// so the files can still be read and written at random offsets. Stat and Dir report the plaintext sizes.
+// names, directories and modification times are not encrypted. overwritten files are encrypted with the
+// current key, files changed in place keep their key. files that weren't written by EncryptedFS can't be read.
+type EncryptedFS struct {
+	FS
+	keys KeyProvider
+}
+
+// NewEncryptedFS returns the file system encrypting the files of fsys with the keys
+func NewEncryptedFS(fsys FS, keys KeyProvider) *EncryptedFS {
+	return &EncryptedFS{FS: fsys, keys: keys}
+}
+
+// encPlainSize returns the plaintext size of an encrypted file
+func encPlainSize(size int64) int64 {
+	size -= int64(encHeaderLen)
+	if size <= 0 {
+		return 0
+	}
+	chunks := (size + encChunkLen - 1) / encChunkLen
+	return size - chunks*encOverhead
+}
+
+// encChunkOffset returns the offset of a chunk in the encrypted file
+func encChunkOffset(index int64) int64 {
+	return int64(encHeaderLen) + index*encChunkLen
+}
+
+// newAEAD returns the AES-GCM cipher of the key
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// newHeader returns the header of a new file encrypted with the current key
+func (e *EncryptedFS) newHeader() ([]byte, cipher.AEAD, error) {
+	id, key, err := e.keys.CurrentKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(id) > encKeyIDLen {
+		return nil, nil, fmt.Errorf("the encryption key id %q is longer than %d bytes", id, encKeyIDLen)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	header := make([]byte, encHeaderLen)
+	copy(header, encMagic)
+	header[len(encMagic)] = byte(len(id))
+	copy(header[len(encMagic)+1:], id)
+	if _, err = rand.Read(header[len(encMagic)+1+encKeyIDLen:]); err != nil {
+		return nil, nil, err
+	}
+	return header, aead, nil
+}
+
+// openHeader returns the cipher of a file from its header
+func (e *EncryptedFS) openHeader(header []byte) (cipher.AEAD, error) {
+	if len(header) != encHeaderLen || string(header[:len(encMagic)]) != encMagic || int(header[len(encMagic)]) > encKeyIDLen {
+		return nil, ErrNotEncrypted
+	}
+	id := header[len(encMagic)+1 : len(encMagic)+1+int(header[len(encMagic)])]
+	key, err := e.keys.Key(string(id))
+	if err != nil {
+		return nil, err
+	}
+	return newAEAD(key)
+}
+
+// encLastChunk returns the index of the last chunk of a file of the plaintext size
+func encLastChunk(plainSize int64) int64 {
+	return plainSize / encChunkSize
+}
+
+// chunkData returns the authenticated data of a chunk, the header, its index and if it is the last
+func chunkData(header []byte, index int64, last bool) []byte {
+	data := binary.BigEndian.AppendUint64(bytes.Clone(header), uint64(index))
+	if last {
+		return append(data, 1)
+	}
+	return append(data, 0)
+}
+
+// sealChunk encrypts the plaintext of a chunk
+func sealChunk(aead cipher.AEAD, header []byte, index int64, last bool, plain []byte) ([]byte, error) {
+	out := make([]byte, encNonceLen, encNonceLen+len(plain)+aead.Overhead())
+	if _, err := rand.Read(out); err != nil {
+		return nil, err
+	}
+	return aead.Seal(out, out, plain, chunkData(header, index, last)), nil
+}
+
+// openChunk decrypts a chunk
+func openChunk(aead cipher.AEAD, header []byte, index int64, last bool, chunk []byte) ([]byte, error) {
+	if len(chunk) < encOverhead {
+		return nil, fmt.Errorf("chunk %d: %w", index, ErrNotEncrypted)
+	}
+	plain, err := aead.Open(nil, chunk[:encNonceLen], chunk[encNonceLen:], chunkData(header, index, last))
+	if err != nil {
+		return nil, fmt.Errorf("chunk %d: %w", index, ErrNotEncrypted)
+	}
+	return plain, nil
+}
+
+// plainInfo reports the plaintext size of an encrypted file
+type plainInfo struct {
+	fs.FileInfo
+}
+
+func (i plainInfo) Size() int64 {
+	return encPlainSize(i.FileInfo.Size())
+}
+
+// plainFileInfo returns the info with the plaintext size of a regular file
+func plainFileInfo(info fs.FileInfo) fs.FileInfo {
+	if info == nil || !info.Mode().IsRegular() {
+		return info
+	}
+	return plainInfo{FileInfo: info}
+}
+
+// Dir returns the files of the directory with their plaintext sizes
+func (e *EncryptedFS) Dir(folderName string) ([]string, []os.FileInfo, error) {
+	_, infos, err := e.FS.Dir(folderName)
+	if err != nil {
+		return nil, nil, err
+	}
+	lines := make([]string, len(infos))
+	for i := range infos {
+		infos[i] = plainFileInfo(infos[i])
+		lines[i] = fileInfoLine(infos[i])
+	}
+	return lines, infos, nil
+}
+
+// Stat returns the file info with the plaintext size
+func (e *EncryptedFS) Stat(fileName string) (string, fs.FileInfo, error) {
+	_, info, err := e.FS.Stat(fileName)
+	if err != nil {
+		return "", nil, err
+	}
+	info = plainFileInfo(info)
+	return fileInfoLine(info), info, nil
+}
+
+// Lstat returns the file info with the plaintext size without following the link
+func (e *EncryptedFS) Lstat(fileName string) (string, fs.FileInfo, error) {
+	_, info, err := e.FS.Lstat(fileName)
+	if err != nil {
+		return "", nil, err
+	}
+	info = plainFileInfo(info)
+	return fileInfoLine(info), info, nil
+}
+
+// ReadFile decrypts the file and writes it to the given writer
+func (e *EncryptedFS) ReadFile(fileName string, w io.Writer) (int64, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := e.FS.ReadFile(fileName, pw)
+		pw.CloseWithError(err)
+	}()
+	defer pr.CloseWithError(errors.New("read aborted"))
+
+	header := make([]byte, encHeaderLen)
+	_, err := io.ReadFull(pr, header)
+	if errors.Is(err, io.EOF) {
+		// an empty file that wasn't written yet
+		return 0, nil
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		err = ErrNotEncrypted
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error reading file: %w", err)
+	}
+	aead, err := e.openHeader(header)
+	if err != nil {
+		return 0, fmt.Errorf("error reading file: %w", err)
+	}
+
+	var n int64
+	chunk := make([]byte, encChunkLen)
+	for index := int64(0); ; index++ {
+		size, err := io.ReadFull(pr, chunk)
+		if errors.Is(err, io.EOF) {
+			// the file ends without its last chunk, it was truncated
+			return n, fmt.Errorf("error reading file: chunk %d: %w", index, ErrNotEncrypted)
+		}
+		if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return n, fmt.Errorf("error reading file: %w", err)
+		}
+		// the last chunk is the only chunk that isn't full
+		last := size < encChunkLen
+		plain, err := openChunk(aead, header, index, last, chunk[:size])
+		if err != nil {
+			return n, fmt.Errorf("error reading file: %w", err)
+		}
+		written, err := w.Write(plain)
+		n += int64(written)
+		if err != nil {
+			return n, fmt.Errorf("error reading file: %w", err)
+		}
+		if last {
+			return n, nil
+		}
+	}
+}
+
+// encrypt writes the header and the encrypted chunks of the plaintext
+func (e *EncryptedFS) encrypt(w io.Writer, r io.Reader) error {
+	header, aead, err := e.newHeader()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(header); err != nil {
+		return err
+	}
+	plain := make([]byte, encChunkSize)
+	for index := int64(0); ; index++ {
+		n, err := io.ReadFull(r, plain)
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return err
+		}
+		// a short chunk is the last, it is empty if the data ends with a full chunk
+		last := n < encChunkSize
+		chunk, sealErr := sealChunk(aead, header, index, last, plain[:n])
+		if sealErr != nil {
+			return sealErr
+		}
+		if _, err := w.Write(chunk); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// WriteFile encrypts the data from the reader, appending re-encrypts the last chunk of the file
+func (e *EncryptedFS) WriteFile(fileName string, r io.Reader, transferType string, appendOnly bool) error {
+	if transferType != "I" && transferType != "A" {
+		return fmt.Errorf("unsupported transfer type: %s, only type 'A' (text) or type 'I' (binary)", transferType)
+	}
+	if transferType == "A" {
+		// the line endings are converted before the encryption, like LocalFS does
+		text := r
+		pr, pw := io.Pipe()
+		go func() {
+			scanner := bufio.NewScanner(text)
+			var err error
+			for scanner.Scan() && err == nil {
+				_, err = fmt.Fprintln(pw, scanner.Text())
+			}
+			if err == nil {
+				err = scanner.Err()
+			}
+			pw.CloseWithError(err)
+		}()
+		defer pr.CloseWithError(errors.New("write aborted"))
+		r = pr
+	}
+
+	if appendOnly {
+		return e.appendFile(fileName, r)
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(e.encrypt(pw, r))
+	}()
+	err := e.FS.WriteFile(fileName, pr, "I", false)
+	pr.CloseWithError(errors.New("write aborted"))
+	return err
+}
+
+// appendFile writes the data from the reader at the end of the file
+func (e *EncryptedFS) appendFile(fileName string, r io.Reader) error {
+	w, err := e.FileWrite(fileName, os.O_RDWR|os.O_CREATE)
+	if err != nil {
+		return err
+	}
+	writer := w.(*encryptedWriter)
+	writer.lock.Lock()
+	offset := writer.size
+	writer.lock.Unlock()
+
+	buf := make([]byte, encChunkSize)
+	for err == nil {
+		var n int
+		n, err = r.Read(buf)
+		if n > 0 {
+			_, writeErr := writer.WriteAt(buf[:n], offset)
+			offset += int64(n)
+			if writeErr != nil {
+				err = writeErr
+			}
+		}
+	}
+	if !errors.Is(err, io.EOF) {
+		writer.TransferError(err)
+		writer.Close()
+		return fmt.Errorf("writing file error: %w", err)
+	}
+	return writer.Close()
+}
+
+// FileWrite opens the file for writing, the chunks are encrypted as they are completed and when it is closed
+func (e *EncryptedFS) FileWrite(fileName string, access int) (io.WriterAt, error) {
+	// the chunks are read back to change them, the offsets of the writes are always used
+	access = access&^(os.O_WRONLY|os.O_APPEND) | os.O_RDWR
+	var stored int64
+	if access&os.O_TRUNC == 0 {
+		if _, info, err := e.FS.Stat(fileName); err == nil && info.Mode().IsRegular() {
+			stored = info.Size()
+		}
+	}
+	file, err := fileWrite(e.FS, fileName, access)
+	if err != nil {
+		return nil, err
+	}
+	w := &encryptedWriter{transferErrorForwarder: transferErrorForwarder{w: file}, dirty: map[int64][]byte{}}
+	w.r, _ = file.(io.ReaderAt)
+
+	if stored > 0 {
+		if w.r == nil {
+			err = &fs.PathError{Op: "open", Path: fileName, Err: errors.ErrUnsupported}
+		} else {
+			w.header, w.aead, err = readHeader(e, w.r)
+			w.size = encPlainSize(stored)
+			w.stored = w.size
+			if err == nil {
+				err = w.loadLast(stored)
+			}
+		}
+	} else {
+		w.header, w.aead, err = e.newHeader()
+		if err == nil {
+			_, err = file.WriteAt(w.header, 0)
+		}
+	}
+	if err != nil {
+		if closer, ok := file.(io.Closer); ok {
+			closer.Close()
+		}
+		return nil, fmt.Errorf("error opening encrypted file: %w", err)
+	}
+	return w, nil
+}
+
+// readLastChunk reads and decrypts the last chunk of an encrypted file of the stored size,
+// a truncated file fails authentication
+func readLastChunk(r io.ReaderAt, aead cipher.AEAD, header []byte, size int64) (int64, []byte, error) {
+	index := encLastChunk(encPlainSize(size))
+	offset := encChunkOffset(index)
+	chunk := make([]byte, max(0, min(encChunkLen, size-offset)))
+	if _, err := r.ReadAt(chunk, offset); err != nil && !errors.Is(err, io.EOF) {
+		return 0, nil, err
+	}
+	plain, err := openChunk(aead, header, index, true, chunk)
+	return index, plain, err
+}
+
+// readHeader reads the header of an encrypted file and returns its cipher
+func readHeader(e *EncryptedFS, r io.ReaderAt) ([]byte, cipher.AEAD, error) {
+	header := make([]byte, encHeaderLen)
+	if _, err := r.ReadAt(header, 0); err != nil && !errors.Is(err, io.EOF) {
+		return nil, nil, err
+	}
+	aead, err := e.openHeader(header)
+	return header, aead, err
+}
+
+// FileRead opens the file for reading, the file can only be opened for writing with FileWrite
+func (e *EncryptedFS) FileRead(fileName string, access int) (io.ReaderAt, error) {
+	if access&writeAccess != 0 {
+		return nil, &fs.PathError{Op: "open", Path: fileName, Err: errors.ErrUnsupported}
+	}
+	_, info, err := e.FS.Stat(fileName)
+	if err != nil {
+		return nil, err
+	}
+	file, err := fileRead(e.FS, fileName, access)
+	if err != nil {
+		return nil, err
+	}
+	r, err := newEncryptedReader(e, file, info.Size())
+	if err != nil {
+		if closer, ok := file.(io.Closer); ok {
+			closer.Close()
+		}
+		return nil, fmt.Errorf("error opening encrypted file: %w", err)
+	}
+	return r, nil
+}
+
+// StatFS returns the file system status of the wrapped file system
+func (e *EncryptedFS) StatFS(path string) (*sftp.StatVFS, error) {
+	return statFS(e.FS, path)
+}
+
+// GetFS returns the fs.FS object decrypting the files of the wrapped file system
+func (e *EncryptedFS) GetFS() fs.FS {
+	return encryptedIOFS{fsys: getFS(e.FS), e: e}
+}
+
+// encryptedReader decrypts the chunks of a file at random offsets, the last chunk read is cached
+type encryptedReader struct {
+	r      io.ReaderAt
+	aead   cipher.AEAD
+	header []byte
+	size   int64 // the stored size
+
+	lock  sync.Mutex // Protects index and plain
+	index int64
+	plain []byte
+}
+
+// newEncryptedReader returns the reader of an encrypted file of the stored size
+func newEncryptedReader(e *EncryptedFS, r io.ReaderAt, size int64) (*encryptedReader, error) {
+	reader := &encryptedReader{r: r, size: size, index: -1}
+	if size == 0 {
+		// an empty file that wasn't written yet
+		return reader, nil
+	}
+	var err error
+	reader.header, reader.aead, err = readHeader(e, r)
+	if err != nil {
+		return reader, err
+	}
+	// the last chunk is authenticated first so a truncated file isn't read
+	reader.index, reader.plain, err = readLastChunk(r, reader.aead, reader.header, size)
+	return reader, err
+}
+
+// chunk returns the plaintext of a chunk
+func (r *encryptedReader) chunk(index int64) ([]byte, error) {
+	if index == r.index {
+		return r.plain, nil
+	}
+	offset := encChunkOffset(index)
+	chunk := make([]byte, max(0, min(encChunkLen, r.size-offset)))
+	if _, err := r.r.ReadAt(chunk, offset); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	plain, err := openChunk(r.aead, r.header, index, index == encLastChunk(encPlainSize(r.size)), chunk)
+	if err != nil {
+		return nil, err
+	}
+	r.index, r.plain = index, plain
+	return plain, nil
+}
+
+func (r *encryptedReader) ReadAt(p []byte, off int64) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if off < 0 {
+		return 0, &fs.PathError{Op: "read", Err: fs.ErrInvalid}
+	}
+	n := 0
+	for n < len(p) {
+		if off >= encPlainSize(r.size) {
+			return n, io.EOF
+		}
+		plain, err := r.chunk(off / encChunkSize)
+		if err != nil {
+			return n, err
+		}
+		copied := copy(p[n:], plain[off%encChunkSize:])
+		n += copied
+		off += int64(copied)
+	}
+	return n, nil
+}
+
+func (r *encryptedReader) Close() error {
+	if closer, ok := r.r.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// encryptedWriter encrypts the writes at random offsets, a chunk is stored once it is complete
+// and follows the stored chunks, the other chunks are kept until the file is closed
+type encryptedWriter struct {
+	transferErrorForwarder
+	r      io.ReaderAt // the written file to change stored chunks, nil if it can't be read
+	aead   cipher.AEAD
+	header []byte
+
+	lock        sync.Mutex       // Protects the fields below
+	size        int64            // the plaintext size
+	stored      int64            // the plaintext size of the stored chunks
+	dirty       map[int64][]byte // the plaintext of the changed chunks
+	transferErr error
+	closed      bool
+}
+
+// loadLast authenticates the last chunk of the stored file and keeps its plaintext to change it,
+// it is stored again as a full chunk once the file grows
+func (w *encryptedWriter) loadLast(stored int64) error {
+	index, plain, err := readLastChunk(w.r, w.aead, w.header, stored)
+	if err != nil {
+		return err
+	}
+	if len(plain) > 0 {
+		w.dirty[index] = append(make([]byte, 0, encChunkSize), plain...)
+	}
+	return nil
+}
+
+// chunk returns the plaintext of a chunk to change it
+func (w *encryptedWriter) chunk(index int64) ([]byte, error) {
+	if plain, ok := w.dirty[index]; ok {
+		return plain, nil
+	}
+	plain := make([]byte, 0, encChunkSize)
+	// the stored chunks read are full, the last chunk was loaded when the file was opened
+	if index*encChunkSize < w.stored {
+		if w.r == nil {
+			return nil, fmt.Errorf("changing a stored chunk: %w", errors.ErrUnsupported)
+		}
+		chunk := make([]byte, min(encChunkSize, w.stored-index*encChunkSize)+encOverhead)
+		if _, err := w.r.ReadAt(chunk, encChunkOffset(index)); err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+		stored, err := openChunk(w.aead, w.header, index, false, chunk)
+		if err != nil {
+			return nil, err
+		}
+		plain = append(plain, stored...)
+	}
+	w.dirty[index] = plain
+	return plain, nil
+}
+
+// store encrypts a chunk and writes it, only the last chunk isn't full
+func (w *encryptedWriter) store(index int64, plain []byte) error {
+	chunk, err := sealChunk(w.aead, w.header, index, len(plain) < encChunkSize, plain)
+	if err != nil {
+		return err
+	}
+	if _, err = w.w.WriteAt(chunk, encChunkOffset(index)); err != nil {
+		return err
+	}
+	delete(w.dirty, index)
+	w.stored = max(w.stored, index*encChunkSize+int64(len(plain)))
+	return nil
+}
+
+// storeComplete stores the complete chunks following the stored chunks
+func (w *encryptedWriter) storeComplete(index int64) error {
+	for {
+		plain, ok := w.dirty[index]
+		if !ok || len(plain) < encChunkSize || index*encChunkSize > w.stored {
+			return nil
+		}
+		if err := w.store(index, plain); err != nil {
+			return err
+		}
+		index++
+	}
+}
+
+func (w *encryptedWriter) WriteAt(p []byte, off int64) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.closed {
+		return 0, fs.ErrClosed
+	}
+	if off < 0 {
+		return 0, &fs.PathError{Op: "write", Err: fs.ErrInvalid}
+	}
+	n := 0
+	for n < len(p) {
+		index, start := off/encChunkSize, int(off%encChunkSize)
+		plain, err := w.chunk(index)
+		if err != nil {
+			return n, err
+		}
+		end := min(encChunkSize, start+len(p)-n)
+		if len(plain) < end {
+			plain = plain[:end]
+		}
+		copy(plain[start:end], p[n:])
+		w.dirty[index] = plain
+		n += end - start
+		off += int64(end - start)
+		w.size = max(w.size, off)
+		if err = w.storeComplete(index); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// TransferError discards the changes that weren't stored and forwards the failure to the file
+func (w *encryptedWriter) TransferError(err error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.transferErr == nil {
+		w.transferErr = err
+	}
+	w.transferErrorForwarder.TransferError(err)
+}
+
+// Close stores the remaining chunks and the last chunk, the gaps are filled with zeros
+func (w *encryptedWriter) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.closed {
+		return fs.ErrClosed
+	}
+	w.closed = true
+
+	err := w.transferErr
+	if err != nil && w.stored%encChunkSize == 0 {
+		// the stored chunks are kept and end with an empty last chunk, so the file stays readable
+		if storeErr := w.store(w.stored/encChunkSize, nil); storeErr != nil {
+			err = errors.Join(err, storeErr)
+		}
+	}
+	last := encLastChunk(w.size)
+	for index := w.stored / encChunkSize; err == nil && index <= last; index++ {
+		var plain []byte
+		plain, err = w.chunk(index)
+		if err != nil {
+			break
+		}
+		// zeros up to the end of the chunk or the file
+		length := int(min(encChunkSize, w.size-index*encChunkSize))
+		if len(plain) < length {
+			plain = plain[:length]
+		}
+		err = w.store(index, plain)
+	}
+	if closer, ok := w.w.(io.Closer); ok {
+		if closeErr := closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("error saving encrypted file: %w", err)
+	}
+	return nil
+}
+
+// encryptedIOFS decrypts the files of the fs.FS of the wrapped file system
+type encryptedIOFS struct {
+	fsys fs.FS
+	e    *EncryptedFS
+}
+
+func (f encryptedIOFS) Open(name string) (fs.File, error) {
+	file, err := f.fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if dir, ok := file.(fs.ReadDirFile); ok && info.IsDir() {
+		return encryptedDir{ReadDirFile: dir}, nil
+	}
+	r, ok := file.(io.ReaderAt)
+	if !ok || !info.Mode().IsRegular() {
+		file.Close()
+		return nil, &fs.PathError{Op: "open", Path: name, Err: errors.ErrUnsupported}
+	}
+	reader, err := newEncryptedReader(f.e, r, info.Size())
+	if err != nil {
+		file.Close()
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &encryptedIOFile{file: file, reader: reader, info: plainInfo{FileInfo: info}}, nil
+}
+
+// encryptedDir reports the plaintext sizes of the files in a directory
+type encryptedDir struct {
+	fs.ReadDirFile
+}
+
+func (d encryptedDir) ReadDir(count int) ([]fs.DirEntry, error) {
+	entries, err := d.ReadDirFile.ReadDir(count)
+	for i := range entries {
+		entries[i] = encryptedDirEntry{DirEntry: entries[i]}
+	}
+	return entries, err
+}
+
+// encryptedDirEntry reports the plaintext size of a file
+type encryptedDirEntry struct {
+	fs.DirEntry
+}
+
+func (d encryptedDirEntry) Info() (fs.FileInfo, error) {
+	info, err := d.DirEntry.Info()
+	return plainFileInfo(info), err
+}
+
+// encryptedIOFile is a decrypted file of the fs.FS
+type encryptedIOFile struct {
+	file   fs.File
+	reader *encryptedReader
+	info   fs.FileInfo
+	offset int64
+}
+
+func (f *encryptedIOFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *encryptedIOFile) Read(p []byte) (int, error) {
+	n, err := f.reader.ReadAt(p, f.offset)
+	f.offset += int64(n)
+	if n > 0 && errors.Is(err, io.EOF) {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *encryptedIOFile) ReadAt(p []byte, off int64) (int, error) {
+	return f.reader.ReadAt(p, off)
+}
+
+func (f *encryptedIOFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.info.Size()
+	default:
+		return 0, &fs.PathError{Op: "seek", Path: f.info.Name(), Err: fs.ErrInvalid}
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.info.Name(), Err: fs.ErrInvalid}
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *encryptedIOFile) Close() error {
+	return f.file.Close()
+}
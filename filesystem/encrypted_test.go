@@ -0,0 +1,167 @@
+package filesystem
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestEncryptedFS(t *testing.T) {
+	m := NewMemFS()
+	keys := StaticKeys{Current: "2024", Keys: map[string][]byte{"2024": bytes.Repeat([]byte{1}, 32)}}
+	e := NewEncryptedFS(m, keys)
+
+	audio := make([]byte, 2*encChunkSize+1000)
+	rand.New(rand.NewSource(1)).Read(audio)
+	if err := e.WriteFile("/call.wav", bytes.NewReader(audio), "I", false); err != nil {
+		t.Fatal(err)
+	}
+	stored := readMemFile(t, m, "/call.wav")
+	if strings.Contains(stored, string(audio[:64])) {
+		t.Fatal("the file is stored in plaintext")
+	}
+	if len(stored) != encHeaderLen+len(audio)+3*encOverhead {
+		t.Fatalf("unexpected stored size %d", len(stored))
+	}
+
+	var buf bytes.Buffer
+	if n, err := e.ReadFile("/call.wav", &buf); err != nil || n != int64(len(audio)) || !bytes.Equal(buf.Bytes(), audio) {
+		t.Fatalf("read %d bytes, %v", n, err)
+	}
+	if _, info, err := e.Stat("/call.wav"); err != nil || info.Size() != int64(len(audio)) {
+		t.Fatalf("expected the plaintext size, got %v %v", info, err)
+	}
+	if _, infos, err := e.Dir("/"); err != nil || len(infos) != 1 || infos[0].Size() != int64(len(audio)) {
+		t.Fatalf("expected the plaintext size, got %v %v", infos, err)
+	}
+	if data, err := fs.ReadFile(e.GetFS(), "call.wav"); err != nil || !bytes.Equal(data, audio) {
+		t.Fatalf("fs.FS read %d bytes, %v", len(data), err)
+	}
+
+	r, err := e.FileRead("/call.wav", os.O_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part := make([]byte, 100)
+	if _, err = r.ReadAt(part, encChunkSize-50); err != nil || !bytes.Equal(part, audio[encChunkSize-50:encChunkSize+50]) {
+		t.Fatalf("random access read across chunks failed: %v", err)
+	}
+	r.(io.Closer).Close()
+
+	// out of order writes, a gap and a write changing a stored chunk
+	w, err := e.FileWrite("/random.bin", os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.WriteAt(audio[encChunkSize:], encChunkSize)
+	w.WriteAt(audio[:encChunkSize], 0)
+	w.WriteAt([]byte("patched"), 10)
+	w.WriteAt([]byte("end"), int64(len(audio))+10)
+	if err = w.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+	want := append(bytes.Clone(audio), make([]byte, 10)...)
+	want = append(want, "end"...)
+	copy(want[10:], "patched")
+	buf.Reset()
+	if _, err = e.ReadFile("/random.bin", &buf); err != nil || !bytes.Equal(buf.Bytes(), want) {
+		t.Fatalf("random access write: %v", err)
+	}
+
+	// appending re-encrypts the last chunk, rotating the key keeps the old files readable
+	keys.Keys["2025"] = bytes.Repeat([]byte{2}, 16)
+	keys.Current = "2025"
+	e = NewEncryptedFS(m, keys)
+	if err = e.WriteFile("/call.wav", bytes.NewReader([]byte("more")), "I", true); err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	if _, err = e.ReadFile("/call.wav", &buf); err != nil || !bytes.Equal(buf.Bytes(), append(bytes.Clone(audio), "more"...)) {
+		t.Fatalf("append: %v", err)
+	}
+	if err = e.WriteFile("/new.txt", strings.NewReader("a\r\nb\r\n"), "A", false); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(readMemFile(t, m, "/new.txt"), "2025") {
+		t.Fatal("expected new files to use the current key")
+	}
+	buf.Reset()
+	if _, err = e.ReadFile("/new.txt", &buf); err != nil || buf.String() != "a\nb\n" {
+		t.Fatalf("got %q %v", buf.String(), err)
+	}
+
+	// a changed chunk fails authentication, a file without its key can't be read
+	tampered := []byte(readMemFile(t, m, "/new.txt"))
+	tampered[len(tampered)-1] ^= 1
+	m.WriteFile("/new.txt", bytes.NewReader(tampered), "I", false)
+	if _, err = e.ReadFile("/new.txt", io.Discard); !errors.Is(err, ErrNotEncrypted) {
+		t.Fatalf("expected an authentication error, got %v", err)
+	}
+	delete(keys.Keys, "2024")
+	if _, err = e.ReadFile("/random.bin", io.Discard); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("expected an unknown key error, got %v", err)
+	}
+}
+
+func TestEncryptedFS_truncated(t *testing.T) {
+	m := NewMemFS()
+	e := NewEncryptedFS(m, StaticKeys{Current: "k", Keys: map[string][]byte{"k": bytes.Repeat([]byte{1}, 32)}})
+
+	// a file of full chunks ends with an empty last chunk
+	audio := make([]byte, 2*encChunkSize)
+	rand.New(rand.NewSource(2)).Read(audio)
+	if err := e.WriteFile("/call.wav", bytes.NewReader(audio), "I", false); err != nil {
+		t.Fatal(err)
+	}
+	stored := readMemFile(t, m, "/call.wav")
+	if len(stored) != encHeaderLen+len(audio)+3*encOverhead {
+		t.Fatalf("unexpected stored size %d", len(stored))
+	}
+	if _, info, err := e.Stat("/call.wav"); err != nil || info.Size() != int64(len(audio)) {
+		t.Fatalf("expected the plaintext size, got %v %v", info, err)
+	}
+	if err := e.WriteFile("/call.wav", strings.NewReader("more"), "I", true); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := e.ReadFile("/call.wav", &buf); err != nil || !bytes.Equal(buf.Bytes(), append(bytes.Clone(audio), "more"...)) {
+		t.Fatalf("append to full chunks: %v", err)
+	}
+
+	// the file cut at any chunk boundary, down to the bare header, fails authentication
+	stored = readMemFile(t, m, "/call.wav")
+	for _, size := range []int{encHeaderLen, encHeaderLen + encChunkLen, encHeaderLen + 2*encChunkLen} {
+		m.WriteFile("/cut.wav", strings.NewReader(stored[:size]), "I", false)
+		if _, err := e.ReadFile("/cut.wav", io.Discard); !errors.Is(err, ErrNotEncrypted) {
+			t.Errorf("ReadFile of %d bytes: expected an authentication error, got %v", size, err)
+		}
+		if _, err := e.FileRead("/cut.wav", os.O_RDONLY); !errors.Is(err, ErrNotEncrypted) {
+			t.Errorf("FileRead of %d bytes: expected an authentication error, got %v", size, err)
+		}
+		if _, err := fs.ReadFile(e.GetFS(), "cut.wav"); !errors.Is(err, ErrNotEncrypted) {
+			t.Errorf("fs.FS read of %d bytes: expected an authentication error, got %v", size, err)
+		}
+		if _, err := e.FileWrite("/cut.wav", os.O_WRONLY|os.O_APPEND); !errors.Is(err, ErrNotEncrypted) {
+			t.Errorf("FileWrite of %d bytes: expected an authentication error, got %v", size, err)
+		}
+	}
+
+	// an aborted write keeps the stored chunks readable
+	w, err := e.FileWrite("/aborted.bin", os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.WriteAt(audio, 0)
+	w.WriteAt([]byte("lost"), int64(len(audio)))
+	w.(interface{ TransferError(error) }).TransferError(io.ErrUnexpectedEOF)
+	w.(io.Closer).Close()
+	buf.Reset()
+	if _, err = e.ReadFile("/aborted.bin", &buf); err != nil || !bytes.Equal(buf.Bytes(), audio) {
+		t.Fatalf("expected the stored chunks, got %d bytes, %v", buf.Len(), err)
+	}
+}
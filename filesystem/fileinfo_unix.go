@@ -0,0 +1,47 @@
+//go:build unix
+
+package filesystem
+
+import (
+	"os/user"
+	"strconv"
+	"sync"
+	"syscall"
+)
+
+// userNames and groupNames cache the names of the ids, an unknown id has an empty name
+var userNames, groupNames sync.Map
+
+// systemFacts sets the owner and inode facts of a local file
+func systemFacts(info *FileInfo) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return
+	}
+	info.UID, info.GID = int(stat.Uid), int(stat.Gid)
+	info.Inode, info.Links = uint64(stat.Ino), uint64(stat.Nlink)
+	info.Owner = lookupName(&userNames, strconv.Itoa(info.UID), func(id string) (string, error) {
+		u, err := user.LookupId(id)
+		if err != nil {
+			return "", err
+		}
+		return u.Username, nil
+	})
+	info.Group = lookupName(&groupNames, strconv.Itoa(info.GID), func(id string) (string, error) {
+		g, err := user.LookupGroupId(id)
+		if err != nil {
+			return "", err
+		}
+		return g.Name, nil
+	})
+}
+
+// lookupName returns the cached name of an id
+func lookupName(cache *sync.Map, id string, lookup func(string) (string, error)) string {
+	if name, ok := cache.Load(id); ok {
+		return name.(string)
+	}
+	name, _ := lookup(id)
+	cache.Store(id, name)
+	return name
+}
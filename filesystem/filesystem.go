@@ -0,0 +1,460 @@
+package filesystem
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/pkg/sftp"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+)
+
+// FileSystem is the context aware file system interface, the successor of FS.
+// files are opened as handles that can be read, written and seeked like an *os.File,
+// and the infos are structured instead of preformatted MLSx lines, the protocols format them.
+// canceling the context of Open aborts the transfer of the file, e.g. for the FTP ABOR or a shutdown.
+// the paths are absolute, AdaptFS adapts an existing FS.
+type FileSystem interface {
+	// Open opens the file with the os.OpenFile flags, perm is used when the file is created
+	Open(ctx context.Context, name string, flag int, perm fs.FileMode) (File, error)
+	// Stat returns the file info, following the links
+	Stat(ctx context.Context, name string) (*FileInfo, error)
+	// Lstat returns the file info without following the link
+	Lstat(ctx context.Context, name string) (*FileInfo, error)
+	// ReadDir returns the files of the directory
+	ReadDir(ctx context.Context, name string) ([]*FileInfo, error)
+	// Mkdir creates the directory and its parents
+	Mkdir(ctx context.Context, name string, perm fs.FileMode) error
+	// Remove removes the file or the empty directory
+	Remove(ctx context.Context, name string) error
+	// Rename renames the file or moves it to a different directory
+	Rename(ctx context.Context, oldName, newName string) error
+	// Chmod changes the permissions
+	Chmod(ctx context.Context, name string, mode fs.FileMode) error
+	// Chtimes changes the modification time
+	Chtimes(ctx context.Context, name string, modTime time.Time) error
+	// Link creates newName as a hard link to oldName
+	Link(ctx context.Context, oldName, newName string) error
+	// Symlink creates newName as a symbolic link to oldName
+	Symlink(ctx context.Context, oldName, newName string) error
+	// StatFS returns the status of the file system containing the file
+	StatFS(ctx context.Context, name string) (*sftp.StatVFS, error)
+}
+
+// File is an open file of a FileSystem, the methods fail once the context of Open is canceled
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.WriterAt
+	io.Seeker
+	io.Closer
+	// Name returns the name the file was opened with
+	Name() string
+	// Stat returns the file info
+	Stat() (*FileInfo, error)
+}
+
+// FileInfo is the info of a file with the facts of the protocol listings
+type FileInfo struct {
+	fs.FileInfo
+	// Owner and Group are the names of the owner, empty if unknown
+	Owner string
+	Group string
+	// UID and GID are the ids of the owner, -1 if unknown
+	UID int
+	GID int
+	// Inode identifies the file on its device, 0 if unknown
+	Inode uint64
+	// Links is the number of hard links, 0 if unknown
+	Links uint64
+}
+
+// NewFileInfo returns the info with the owner and inode facts of the system, if the file system has them
+func NewFileInfo(info fs.FileInfo) *FileInfo {
+	fileInfo := &FileInfo{FileInfo: info, UID: -1, GID: -1}
+	systemFacts(fileInfo)
+	return fileInfo
+}
+
+// MLSx returns the MLSx fact line of the file
+func (i *FileInfo) MLSx() string {
+	fileType := "file"
+	if i.IsDir() {
+		fileType = "dir"
+	}
+	owner, group := i.Owner, i.Group
+	if owner == "" {
+		owner = "owner"
+	}
+	if group == "" {
+		group = "group"
+	}
+	line := fmt.Sprintf("Type=%s;Size=%d;Modify=%s;Perm=%s;UNIX.ownername=%s;UNIX.groupname=%s;",
+		fileType, i.Size(), i.ModTime().UTC().Format("20060102150405"), i.Mode().String(), owner, group)
+	if i.UID >= 0 && i.GID >= 0 {
+		line += fmt.Sprintf("UNIX.uid=%d;UNIX.gid=%d;", i.UID, i.GID)
+	}
+	if i.Inode != 0 {
+		line += fmt.Sprintf("Unique=%x;", i.Inode)
+	}
+	return line + " " + i.Name()
+}
+
+// AdaptFS returns the FileSystem of an existing FS. files opened for reading use FileRead when the FS has it
+// and stream ReadFile otherwise, files opened write only with O_TRUNC or O_APPEND stream into WriteFile
+// so the FS keeps its upload semantics, e.g. atomic uploads, and the other writable files use FileWrite.
+func AdaptFS(fsys FS) FileSystem {
+	return &adaptedFS{fsys: fsys}
+}
+
+// adaptedFS is the FileSystem of an FS
+type adaptedFS struct {
+	fsys FS
+}
+
+func (a *adaptedFS) Open(ctx context.Context, name string, flag int, _ fs.FileMode) (File, error) {
+	if err := context.Cause(ctx); err != nil {
+		return nil, err
+	}
+	f := &adaptedFile{ctx: ctx, fsys: a.fsys, name: name}
+	var err error
+	switch {
+	case flag&(os.O_WRONLY|os.O_RDWR) == 0:
+		err = f.openRead(flag)
+	case flag&os.O_WRONLY != 0 && flag&(os.O_TRUNC|os.O_APPEND) != 0 && flag&os.O_EXCL == 0:
+		err = f.openStream(flag)
+	default:
+		err = f.openReadWrite(flag)
+	}
+	if err != nil {
+		return nil, err
+	}
+	f.stop = context.AfterFunc(ctx, f.cancel)
+	return f, nil
+}
+
+func (a *adaptedFS) Stat(ctx context.Context, name string) (*FileInfo, error) {
+	return a.stat(ctx, name, a.fsys.Stat)
+}
+
+func (a *adaptedFS) Lstat(ctx context.Context, name string) (*FileInfo, error) {
+	return a.stat(ctx, name, a.fsys.Lstat)
+}
+
+func (a *adaptedFS) stat(ctx context.Context, name string, stat func(string) (string, fs.FileInfo, error)) (*FileInfo, error) {
+	if err := context.Cause(ctx); err != nil {
+		return nil, err
+	}
+	_, info, err := stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return NewFileInfo(info), nil
+}
+
+func (a *adaptedFS) ReadDir(ctx context.Context, name string) ([]*FileInfo, error) {
+	if err := context.Cause(ctx); err != nil {
+		return nil, err
+	}
+	_, infos, err := a.fsys.Dir(name)
+	if err != nil {
+		return nil, err
+	}
+	fileInfos := make([]*FileInfo, len(infos))
+	for i, info := range infos {
+		fileInfos[i] = NewFileInfo(info)
+	}
+	return fileInfos, nil
+}
+
+func (a *adaptedFS) Mkdir(ctx context.Context, name string, _ fs.FileMode) error {
+	if err := context.Cause(ctx); err != nil {
+		return err
+	}
+	return a.fsys.MakeDir(name)
+}
+
+func (a *adaptedFS) Remove(ctx context.Context, name string) error {
+	if err := context.Cause(ctx); err != nil {
+		return err
+	}
+	return a.fsys.Remove(name)
+}
+
+func (a *adaptedFS) Rename(ctx context.Context, oldName, newName string) error {
+	if err := context.Cause(ctx); err != nil {
+		return err
+	}
+	return a.fsys.Rename(oldName, newName)
+}
+
+func (a *adaptedFS) Chmod(ctx context.Context, name string, mode fs.FileMode) error {
+	if err := context.Cause(ctx); err != nil {
+		return err
+	}
+	return a.fsys.SetStat(name, mode)
+}
+
+func (a *adaptedFS) Chtimes(ctx context.Context, name string, modTime time.Time) error {
+	if err := context.Cause(ctx); err != nil {
+		return err
+	}
+	return a.fsys.ModifyTime(name, modTime.UTC().Format("20060102150405"))
+}
+
+func (a *adaptedFS) Link(ctx context.Context, oldName, newName string) error {
+	if err := context.Cause(ctx); err != nil {
+		return err
+	}
+	return a.fsys.Link(newName, oldName)
+}
+
+func (a *adaptedFS) Symlink(ctx context.Context, oldName, newName string) error {
+	if err := context.Cause(ctx); err != nil {
+		return err
+	}
+	return a.fsys.Symlink(newName, oldName)
+}
+
+func (a *adaptedFS) StatFS(ctx context.Context, name string) (*sftp.StatVFS, error) {
+	if err := context.Cause(ctx); err != nil {
+		return nil, err
+	}
+	return statFS(a.fsys, name)
+}
+
+// adaptedFile is an open file of an adapted FS, it reads with r, writes with w
+// or streams the writes into WriteFile through pipe
+type adaptedFile struct {
+	ctx  context.Context
+	stop func() bool
+	fsys FS
+	name string
+
+	r    io.ReaderAt
+	w    io.WriterAt
+	pipe *io.PipeWriter
+	done chan error // the result of the WriteFile of pipe
+
+	lock   sync.Mutex // Protects offset, size and closed
+	offset int64
+	size   int64 // the size at open, extended by the writes
+	closed bool
+}
+
+// openRead opens the file for reading
+func (f *adaptedFile) openRead(flag int) error {
+	_, info, err := f.fsys.Stat(f.name)
+	if err != nil {
+		return err
+	}
+	f.size = info.Size()
+	if _, ok := f.fsys.(FSWithReadWriteAt); ok {
+		f.r, err = fileRead(f.fsys, f.name, flag)
+		return err
+	}
+	f.r = &streamReaderAt{open: func() (io.ReadCloser, error) {
+		pr, pw := io.Pipe()
+		go func() {
+			_, err := f.fsys.ReadFile(f.name, pw)
+			pw.CloseWithError(err)
+		}()
+		return pr, nil
+	}}
+	return nil
+}
+
+// openStream opens the file for sequential writes with WriteFile, appending starts at the end
+func (f *adaptedFile) openStream(flag int) error {
+	appendOnly := flag&os.O_APPEND != 0
+	if appendOnly {
+		if _, info, err := f.fsys.Stat(f.name); err == nil {
+			f.size = info.Size()
+			f.offset = f.size
+		}
+	}
+	pr, pw := io.Pipe()
+	f.pipe, f.done = pw, make(chan error, 1)
+	go func() {
+		err := f.fsys.WriteFile(f.name, pr, "I", appendOnly)
+		pr.CloseWithError(errors.New("write aborted"))
+		f.done <- err
+	}()
+	return nil
+}
+
+// openReadWrite opens the file for random access writes with FileWrite
+func (f *adaptedFile) openReadWrite(flag int) error {
+	if flag&os.O_TRUNC == 0 {
+		if _, info, err := f.fsys.Stat(f.name); err == nil {
+			f.size = info.Size()
+		}
+	}
+	appendOnly := flag&os.O_APPEND != 0
+	if appendOnly {
+		// the writes of a file opened with O_APPEND can't have an offset
+		flag &^= os.O_APPEND
+		f.offset = f.size
+	}
+	w, err := fileWrite(f.fsys, f.name, flag)
+	if err != nil {
+		return err
+	}
+	f.w = w
+	f.r, _ = w.(io.ReaderAt)
+	return nil
+}
+
+// cancel aborts the transfer when the context is canceled
+func (f *adaptedFile) cancel() {
+	cause := context.Cause(f.ctx)
+	if f.pipe != nil {
+		f.pipe.CloseWithError(cause)
+	}
+	ForwardTransferError(f.w, cause)
+}
+
+// check returns the error of an operation on a closed file or after the context is canceled
+func (f *adaptedFile) check(op string) error {
+	if f.closed {
+		return &fs.PathError{Op: op, Path: f.name, Err: fs.ErrClosed}
+	}
+	if err := context.Cause(f.ctx); err != nil {
+		return &fs.PathError{Op: op, Path: f.name, Err: err}
+	}
+	return nil
+}
+
+func (f *adaptedFile) Name() string {
+	return f.name
+}
+
+func (f *adaptedFile) Stat() (*FileInfo, error) {
+	if err := f.check("stat"); err != nil {
+		return nil, err
+	}
+	_, info, err := f.fsys.Stat(f.name)
+	if err != nil {
+		return nil, err
+	}
+	return NewFileInfo(info), nil
+}
+
+func (f *adaptedFile) Read(p []byte) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	n, err := f.readAt(p, f.offset)
+	f.offset += int64(n)
+	if n > 0 && errors.Is(err, io.EOF) {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *adaptedFile) ReadAt(p []byte, off int64) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.readAt(p, off)
+}
+
+func (f *adaptedFile) readAt(p []byte, off int64) (int, error) {
+	if err := f.check("read"); err != nil {
+		return 0, err
+	}
+	if f.r == nil {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: errors.ErrUnsupported}
+	}
+	return f.r.ReadAt(p, off)
+}
+
+func (f *adaptedFile) Write(p []byte) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	n, err := f.writeAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *adaptedFile) WriteAt(p []byte, off int64) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.writeAt(p, off)
+}
+
+func (f *adaptedFile) writeAt(p []byte, off int64) (int, error) {
+	if err := f.check("write"); err != nil {
+		return 0, err
+	}
+	var n int
+	var err error
+	switch {
+	case f.w != nil:
+		n, err = f.w.WriteAt(p, off)
+	case f.pipe != nil && off == f.size:
+		// WriteFile writes sequentially
+		n, err = f.pipe.Write(p)
+	default:
+		err = &fs.PathError{Op: "write", Path: f.name, Err: errors.ErrUnsupported}
+	}
+	f.size = max(f.size, off+int64(n))
+	return n, err
+}
+
+func (f *adaptedFile) Seek(offset int64, whence int) (int64, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.check("seek"); err != nil {
+		return 0, err
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.size
+	default:
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+// Close finishes the transfer, a file written after the context was canceled is discarded
+func (f *adaptedFile) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.closed {
+		return &fs.PathError{Op: "close", Path: f.name, Err: fs.ErrClosed}
+	}
+	f.closed = true
+	f.stop()
+
+	var err error
+	if f.pipe != nil {
+		f.pipe.CloseWithError(context.Cause(f.ctx))
+		err = <-f.done
+	}
+	closers := []any{f.w}
+	if any(f.r) != any(f.w) {
+		closers = append(closers, f.r)
+	}
+	for _, c := range closers {
+		if closer, ok := c.(io.Closer); ok {
+			if closeErr := closer.Close(); err == nil {
+				err = closeErr
+			}
+		}
+	}
+	if err == nil && (f.w != nil || f.pipe != nil) {
+		// the written file is incomplete
+		err = context.Cause(f.ctx)
+	}
+	return err
+}
@@ -0,0 +1,135 @@
+package filesystem
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"os/user"
+	"strings"
+	"testing"
+)
+
+func TestAdaptFS(t *testing.T) {
+	ctx := context.Background()
+	fsys := AdaptFS(NewMemFS())
+
+	file, err := fsys.Open(ctx, "/a.txt", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.WriteString(file, "hello "); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = file.WriteAt([]byte("x"), 0); !errors.Is(err, errors.ErrUnsupported) {
+		t.Fatalf("expected a streamed file to be written sequentially, got %v", err)
+	}
+	io.WriteString(file, "world")
+	if err = file.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err = fsys.Open(ctx, "/a.txt", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(file, "!")
+	if err = file.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err = fsys.Open(ctx, "/a.txt", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset, err := file.Seek(-6, io.SeekEnd); err != nil || offset != 6 {
+		t.Fatalf("seek to %d, %v", offset, err)
+	}
+	if data, err := io.ReadAll(file); err != nil || string(data) != "world!" {
+		t.Fatalf("read %q, %v", data, err)
+	}
+	part := make([]byte, 5)
+	if n, err := file.ReadAt(part, 0); n != 5 || string(part) != "hello" {
+		t.Fatalf("read %q at 0, %v", part[:n], err)
+	}
+	if _, err = file.Write([]byte("x")); err == nil {
+		t.Fatal("expected a file opened for reading to deny the write")
+	}
+	file.Close()
+	if _, err = file.Read(part); !errors.Is(err, fs.ErrClosed) {
+		t.Fatalf("expected a closed file, got %v", err)
+	}
+
+	// files opened for reading and writing are written at random offsets
+	file, err = fsys.Open(ctx, "/a.txt", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteAt([]byte("J"), 6)
+	if err = file.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := fsys.Stat(ctx, "/a.txt"); err != nil || info.Size() != 12 || info.UID != -1 {
+		t.Fatalf("unexpected info %+v %v", info, err)
+	}
+	if got := readMemFile(t, fsys.(*adaptedFS).fsys.(*MemFS), "/a.txt"); got != "hello Jorld!" {
+		t.Fatalf("got %q", got)
+	}
+
+	infos, err := fsys.ReadDir(ctx, "/")
+	if err != nil || len(infos) != 1 || !strings.HasSuffix(infos[0].MLSx(), "; a.txt") {
+		t.Fatalf("unexpected listing %v %v", infos, err)
+	}
+}
+
+func TestAdaptFSCancel(t *testing.T) {
+	mem := NewMemFS()
+	mem.WriteFile("/a.txt", strings.NewReader("old"), "I", false)
+	fsys := AdaptFS(mem)
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	file, err := fsys.Open(ctx, "/a.txt", os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(file, "new")
+	aborted := errors.New("aborted")
+	cancel(aborted)
+	if _, err = io.WriteString(file, "new"); !errors.Is(err, aborted) {
+		t.Fatalf("expected the write to fail with the cause, got %v", err)
+	}
+	if err = file.Close(); err == nil {
+		t.Fatal("expected the aborted transfer to fail")
+	}
+	if got := readMemFile(t, mem, "/a.txt"); got != "old" {
+		t.Fatalf("expected the aborted upload to be discarded, got %q", got)
+	}
+	if _, err = fsys.Open(ctx, "/a.txt", os.O_RDONLY, 0); !errors.Is(err, aborted) {
+		t.Fatalf("expected a canceled context to deny the open, got %v", err)
+	}
+}
+
+func TestFileInfoFacts(t *testing.T) {
+	dir := t.TempDir()
+	fsys := AdaptFS(NewLocalFS(dir))
+	if err := os.WriteFile(dir+"/a.txt", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(dir+"/a.txt", dir+"/b.txt"); err != nil {
+		t.Skip("hard links are not supported:", err)
+	}
+	info, err := fsys.Stat(context.Background(), "/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.UID < 0 || info.Inode == 0 || info.Links != 2 {
+		t.Skip("the system has no owner facts")
+	}
+	if u, err := user.Current(); err == nil && info.Owner != u.Username {
+		t.Fatalf("expected the owner %s, got %s", u.Username, info.Owner)
+	}
+	if !strings.Contains(info.MLSx(), "UNIX.uid=") || !strings.Contains(info.MLSx(), "Unique=") {
+		t.Fatalf("expected the facts in the line %s", info.MLSx())
+	}
+}
@@ -95,9 +95,12 @@ var _ NewFSWithReadWriteAt = &LocalFS{}
 
 // LocalFS is a local file system that implements the FtpFS interface
 type LocalFS struct {
-	FS          fs.FS
-	localDir    string // local directory to serve as the ftp virtualRoot
-	virtualRoot string // virtualRoot directory that the server is serving normally it is "/", if its deeper then add it to the system "dir/virtualRoot"
+	FS fs.FS
+	// AtomicWrites writes uploads to a hidden temporary file in the same directory and renames it
+	// to the destination once complete, so partial files are never visible and failed uploads are removed
+	AtomicWrites bool
+	localDir     string // local directory to serve as the ftp virtualRoot
+	virtualRoot  string // virtualRoot directory that the server is serving normally it is "/", if its deeper then add it to the system "dir/virtualRoot"
 }
 
 // RootDir returns the Root directory of the file system
@@ -186,8 +189,20 @@ func (FS *LocalFS) File(fileName string, access int) (*os.File, error) {
 	return file, nil
 }
 
+// FileWrite opens the file for writing, with AtomicWrites the writes go to a temporary file renamed on Close
 func (FS *LocalFS) FileWrite(fileName string, access int) (io.WriterAt, error) {
-	return FS.File(fileName, access)
+	if !FS.AtomicWrites || access&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return FS.File(fileName, access)
+	}
+	fileName, err := FS.cleanPath(fileName)
+	if err != nil {
+		return nil, err
+	}
+	file, err := createAtomic(filepath.Join(FS.localDir, fileName), access)
+	if err != nil {
+		return nil, fmt.Errorf("creating file error: %w", err)
+	}
+	return file, nil
 }
 
 func (FS *LocalFS) FileRead(fileName string, access int) (io.ReaderAt, error) {
@@ -214,6 +229,9 @@ func (FS *LocalFS) ReadFile(name string, w io.Writer) (int64, error) {
 
 // WriteFile creates a new file with the given name and writes the data from the reader
 func (FS *LocalFS) WriteFile(fileName string, r io.Reader, transferType string, appendOnly bool) error {
+	if transferType != "I" && transferType != "A" {
+		return fmt.Errorf("unsupported transfer type: %s, only type 'A' (text) or type 'I' (binary)", transferType)
+	}
 	fileName, err := FS.cleanPath(fileName)
 	if err != nil {
 		return err
@@ -226,29 +244,47 @@ func (FS *LocalFS) WriteFile(fileName string, r io.Reader, transferType string,
 		access = os.O_RDWR | os.O_CREATE | os.O_TRUNC
 	}
 
-	file, err := os.OpenFile(fileName, access, 0666)
+	var file *os.File
+	var temp *atomicFile
+	if FS.AtomicWrites {
+		temp, err = createAtomic(fileName, access)
+		if err == nil {
+			// removes the temporary file if the upload fails
+			defer temp.abort()
+			file = temp.File
+		}
+	} else {
+		file, err = os.OpenFile(fileName, access, 0666)
+		if err == nil {
+			defer file.Close()
+		}
+	}
 	if err != nil {
 		return fmt.Errorf("creating file error: %w", err)
 	}
-	defer file.Close()
 
 	if transferType == "I" { // Binary mode
 		_, err = io.Copy(file, r) // Directly copy data without conversion
-	} else if transferType == "A" { // ASCII mode
+	} else { // ASCII mode
 		// Use a bufio.Scanner to handle line endings conversion
 		scanner := bufio.NewScanner(r)
-		for scanner.Scan() {
+		for scanner.Scan() && err == nil {
 			line := scanner.Text()
 			_, err = fmt.Fprintln(file, line) // Append a newline appropriate for the server's OS
 		}
-	} else {
-		return fmt.Errorf("unsupported transfer type: %s, only type 'A' (text) or type 'I' (binary)", transferType)
+		if err == nil {
+			err = scanner.Err()
+		}
 	}
 
 	if err != nil {
 		return fmt.Errorf("writing file error: %w", err)
 	}
-	_ = file.Close()
+	if temp != nil {
+		err = temp.Close()
+	} else {
+		err = file.Close()
+	}
 	if err != nil {
 		return fmt.Errorf("closing and saving file error: %w", err)
 	}
@@ -332,6 +368,11 @@ func (FS *LocalFS) Stat(fileName string) (string, fs.FileInfo, error) {
 		}
 		return "", nil, fmt.Errorf("error getting file info: %w", err)
 	}
+	return fileInfoLine(info), info, nil
+}
+
+// fileInfoLine returns the MLSx fact line of the file
+func fileInfoLine(info fs.FileInfo) string {
 	fileType := "file"
 	if info.IsDir() {
 		fileType = "dir"
@@ -343,7 +384,7 @@ func (FS *LocalFS) Stat(fileName string) (string, fs.FileInfo, error) {
 	// FTP format: permissions, number of links, owner, group, size, modification time, name
 	return fmt.Sprintf("Type=%s;Size=%d;Modify=%s;Perm=%s;UNIX.ownername=%s;UNIX.groupname=%s; %s",
 		fileType, size, modTime, mode.String(), "owner", "group",
-		info.Name()), info, nil
+		info.Name())
 }
 
 // SetStat changes the file info
@@ -373,18 +414,7 @@ func (FS *LocalFS) Lstat(fileName string) (string, fs.FileInfo, error) {
 		return "", nil, fmt.Errorf("error getting file info: %w", err)
 	}
 
-	fileType := "file"
-	if info.IsDir() {
-		fileType = "dir"
-	}
-
-	mode := info.Mode()
-	size := info.Size()
-	modTime := info.ModTime().UTC().Format("20060102150405")
-	// FTP format: permissions, number of links, owner, group, size, modification time, name
-	return fmt.Sprintf("Type=%s;Size=%d;Modify=%s;Perm=%s;UNIX.ownername=%s;UNIX.groupname=%s; %s",
-		fileType, size, modTime, mode.String(), "owner", "group",
-		info.Name()), info, nil
+	return fileInfoLine(info), info, nil
 }
 
 // Link creates a hard link pointing to a file.
@@ -464,3 +494,21 @@ func (FS *LocalFS) cleanPath(pathName string) (string, error) {
 	return pathName, nil
 
 }
+
+// ForwardTransferError tells the file that its transfer failed, e.g. to discard an atomic upload,
+// the writers wrapping a file forward the failure with it
+func ForwardTransferError(file io.WriterAt, err error) {
+	if te, ok := file.(sftp.TransferError); ok {
+		te.TransferError(err)
+	}
+}
+
+// transferErrorForwarder is embedded by the writers wrapping a file to forward the failure of the transfer to it
+type transferErrorForwarder struct {
+	w io.WriterAt
+}
+
+// TransferError forwards the failure of the transfer to the file
+func (f transferErrorForwarder) TransferError(err error) {
+	ForwardTransferError(f.w, err)
+}
@@ -0,0 +1,810 @@
+package filesystem
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/pkg/sftp"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Ensure that MemFS implements the FtpFS interface
+var _ NewFSWithReadWriteAt = &MemFS{}
+
+const (
+	// memBlockSize is the block size reported by MemFS.StatFS
+	memBlockSize = 4096
+	// memMaxSymlinks is the number of symlinks followed before failing with ELOOP
+	memMaxSymlinks = 40
+	// DefaultMemFSCapacity is the capacity of a MemFS when Capacity is 0
+	DefaultMemFSCapacity = 1 << 30
+)
+
+// memNode is a file, directory or symlink, hard links share the node
+type memNode struct {
+	mode    fs.FileMode
+	modTime time.Time
+	data    []byte              // content of a regular file
+	target  string              // absolute target of a symlink
+	entries map[string]*memNode // children of a directory
+	links   int                 // number of directory entries pointing to the node
+}
+
+func (n *memNode) isDir() bool {
+	return n.mode.IsDir()
+}
+
+func (n *memNode) isSymlink() bool {
+	return n.mode&fs.ModeSymlink != 0
+}
+
+// MemFS is a concurrency safe in memory file system, it is useful for tests and for ephemeral scratch shares
+type MemFS struct {
+	// Capacity is the size in bytes reported by StatFS, writes beyond it fail with ENOSPC. 0 uses DefaultMemFSCapacity
+	Capacity int64
+
+	lock  sync.RWMutex
+	root  *memNode
+	used  int64 // bytes used by the files
+	files int64 // number of nodes
+}
+
+// NewMemFS returns an empty in memory file system
+func NewMemFS() *MemFS {
+	return &MemFS{
+		root:  &memNode{mode: fs.ModeDir | 0755, modTime: time.Now(), entries: map[string]*memNode{}, links: 1},
+		files: 1,
+	}
+}
+
+// RootDir returns the Root directory of the file system
+func (m *MemFS) RootDir() string {
+	return "/"
+}
+
+// GetFS returns the fs.FS object
+func (m *MemFS) GetFS() fs.FS {
+	return memIOFS{m: m}
+}
+
+// capacity returns the configured capacity or the default
+func (m *MemFS) capacity() int64 {
+	if m.Capacity > 0 {
+		return m.Capacity
+	}
+	return DefaultMemFSCapacity
+}
+
+// resolve walks to the parent directory of name, symlinks are followed in the directories and in the last element
+// when followLast is set. node is nil if the last element doesn't exist, parent is nil for the root.
+func (m *MemFS) resolve(name string, followLast bool) (parent *memNode, base string, node *memNode, err error) {
+	p := path.Clean("/" + name)
+	for hops := 0; ; hops++ {
+		if hops > memMaxSymlinks {
+			return nil, "", nil, syscall.ELOOP
+		}
+		if p == "/" {
+			return nil, "", m.root, nil
+		}
+		parts := strings.Split(p[1:], "/")
+		dir := m.root
+		for i, part := range parts {
+			if !dir.isDir() {
+				return nil, "", nil, syscall.ENOTDIR
+			}
+			child := dir.entries[part]
+			last := i == len(parts)-1
+			if child != nil && child.isSymlink() && (!last || followLast) {
+				// restart from the root with the target in place of the link
+				p = path.Join(append([]string{child.target}, parts[i+1:]...)...)
+				break
+			}
+			if last {
+				return dir, part, child, nil
+			}
+			if child == nil {
+				return nil, "", nil, fs.ErrNotExist
+			}
+			dir = child
+		}
+	}
+}
+
+// lookup returns the node of an existing file
+func (m *MemFS) lookup(op, name string, followLast bool) (*memNode, error) {
+	_, _, node, err := m.resolve(name, followLast)
+	if err == nil && node == nil {
+		err = fs.ErrNotExist
+	}
+	if err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	return node, nil
+}
+
+// parentDir returns the existing writable parent directory of name and the base name
+func (m *MemFS) parentDir(op, name string) (parent *memNode, base string, node *memNode, err error) {
+	parent, base, node, err = m.resolve(name, false)
+	if err == nil && parent == nil {
+		err = fs.ErrExist
+	}
+	if err == nil && parent.mode&0200 == 0 {
+		err = fs.ErrPermission
+	}
+	if err != nil {
+		return nil, "", nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	return parent, base, node, nil
+}
+
+// resize changes the size of a file's content, growing fails when the capacity is exceeded
+func (m *MemFS) resize(n *memNode, size int64) error {
+	delta := size - int64(len(n.data))
+	if n.links > 0 {
+		if delta > 0 && m.used+delta > m.capacity() {
+			return syscall.ENOSPC
+		}
+		m.used += delta
+	}
+	if size <= int64(cap(n.data)) {
+		clear(n.data[min(int64(len(n.data)), size):size])
+		n.data = n.data[:size]
+		return nil
+	}
+	data := make([]byte, size, size+size/4)
+	copy(data, n.data)
+	n.data = data
+	return nil
+}
+
+// unlink removes a directory entry, the node is released when its last link is removed
+func (m *MemFS) unlink(parent *memNode, base string) {
+	n := parent.entries[base]
+	delete(parent.entries, base)
+	parent.modTime = time.Now()
+	n.links--
+	if n.links == 0 {
+		m.used -= int64(len(n.data))
+		m.files--
+	}
+}
+
+// link adds a directory entry
+func (m *MemFS) link(parent *memNode, base string, n *memNode) {
+	parent.entries[base] = n
+	parent.modTime = time.Now()
+	n.links++
+	if n.links == 1 {
+		m.used += int64(len(n.data))
+		m.files++
+	}
+}
+
+// CheckDir checks if the given directory exists
+func (m *MemFS) CheckDir(dirName string) error {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	n, err := m.lookup("open", dirName, true)
+	if err != nil {
+		return fmt.Errorf("error checking directory: %w", err)
+	}
+	if !n.isDir() {
+		return fmt.Errorf("error checking directory: %w", &fs.PathError{Op: "open", Path: dirName, Err: syscall.ENOTDIR})
+	}
+	return nil
+}
+
+// Dir returns a list of files in the given directory
+func (m *MemFS) Dir(dirName string) ([]string, []os.FileInfo, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	n, err := m.lookup("open", dirName, true)
+	if err == nil && !n.isDir() {
+		err = &fs.PathError{Op: "readdir", Path: dirName, Err: syscall.ENOTDIR}
+	}
+	if err == nil && n.mode&0400 == 0 {
+		err = &fs.PathError{Op: "open", Path: dirName, Err: fs.ErrPermission}
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading directory: %w", err)
+	}
+
+	names := n.sortedNames()
+	lines := make([]string, len(names))
+	fileList := make([]os.FileInfo, len(names))
+	for i, name := range names {
+		entry := n.entries[name]
+		if entry.isSymlink() {
+			// list the target like LocalFS, a broken link is listed as a link
+			if target, err := m.lookup("stat", entry.target, true); err == nil {
+				entry = target
+			}
+		}
+		fileList[i] = entry.info(name)
+		lines[i] = fileInfoLine(fileList[i])
+	}
+	return lines, fileList, nil
+}
+
+// sortedNames returns the names of the directory entries sorted like fs.ReadDir
+func (n *memNode) sortedNames() []string {
+	names := make([]string, 0, len(n.entries))
+	for name := range n.entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// MakeDir creates a new directory with the given name, and the missing parents
+func (m *MemFS) MakeDir(folderName string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	p := path.Clean("/" + folderName)
+	current := "/"
+	for _, part := range strings.Split(p, "/")[1:] {
+		if part == "" {
+			continue
+		}
+		current = path.Join(current, part)
+		parent, base, node, err := m.resolve(current, true)
+		if err != nil {
+			return fmt.Errorf("error creating directory: %w", &fs.PathError{Op: "mkdir", Path: folderName, Err: err})
+		}
+		if node != nil {
+			if !node.isDir() {
+				return fmt.Errorf("error creating directory: %w", &fs.PathError{Op: "mkdir", Path: folderName, Err: syscall.ENOTDIR})
+			}
+			continue
+		}
+		if parent.mode&0200 == 0 {
+			return fmt.Errorf("error creating directory: %w", &fs.PathError{Op: "mkdir", Path: folderName, Err: fs.ErrPermission})
+		}
+		m.link(parent, base, &memNode{mode: fs.ModeDir | 0755, modTime: time.Now(), entries: map[string]*memNode{}})
+	}
+	return nil
+}
+
+// ReadFile reads the file and writes it to the given writer
+func (m *MemFS) ReadFile(name string, w io.Writer) (int64, error) {
+	m.lock.RLock()
+	n, err := m.lookup("open", name, true)
+	if err == nil && n.isDir() {
+		err = &fs.PathError{Op: "read", Path: name, Err: syscall.EISDIR}
+	}
+	if err == nil && n.mode&0400 == 0 {
+		err = &fs.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+	}
+	if err != nil {
+		m.lock.RUnlock()
+		return 0, fmt.Errorf("error opening file: %w", err)
+	}
+	// copy the content so a slow writer doesn't block the file system
+	data := bytes.Clone(n.data)
+	m.lock.RUnlock()
+
+	written, err := w.Write(data)
+	if err != nil {
+		return int64(written), fmt.Errorf("error reading file: %w", err)
+	}
+	return int64(written), nil
+}
+
+// WriteFile creates a new file with the given name and writes the data from the reader
+func (m *MemFS) WriteFile(fileName string, r io.Reader, transferType string, appendOnly bool) error {
+	buf := &bytes.Buffer{}
+	var err error
+	if transferType == "I" { // Binary mode
+		_, err = io.Copy(buf, r)
+	} else if transferType == "A" { // ASCII mode
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			buf.WriteString(scanner.Text())
+			buf.WriteByte('\n')
+		}
+		err = scanner.Err()
+	} else {
+		return fmt.Errorf("unsupported transfer type: %s, only type 'A' (text) or type 'I' (binary)", transferType)
+	}
+	if err != nil {
+		return fmt.Errorf("writing file error: %w", err)
+	}
+
+	flag := os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	if appendOnly {
+		flag = os.O_RDWR | os.O_CREATE | os.O_APPEND
+	}
+	file, err := m.open(fileName, flag)
+	if err != nil {
+		return fmt.Errorf("creating file error: %w", err)
+	}
+	defer file.Close()
+	_, err = file.WriteAt(buf.Bytes(), 0)
+	if err != nil {
+		return fmt.Errorf("writing file error: %w", err)
+	}
+	return nil
+}
+
+// Remove removes the file or the empty directory
+func (m *MemFS) Remove(fileName string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	parent, base, n, err := m.parentDir("remove", fileName)
+	if err == nil && n == nil {
+		err = &fs.PathError{Op: "remove", Path: fileName, Err: fs.ErrNotExist}
+	}
+	if err == nil && n.isDir() && len(n.entries) > 0 {
+		err = &fs.PathError{Op: "remove", Path: fileName, Err: syscall.ENOTEMPTY}
+	}
+	if err != nil {
+		return fmt.Errorf("error removing file: %w", err)
+	}
+	m.unlink(parent, base)
+	return nil
+}
+
+// Rename renames the file or moves it to a different directory, an existing target file is replaced
+func (m *MemFS) Rename(original string, target string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	renameErr := func(err error) error {
+		return fmt.Errorf("error renaming file: %w", &os.LinkError{Op: "rename", Old: original, New: target, Err: err})
+	}
+	srcParent, srcBase, src, err := m.parentDir("rename", original)
+	if err != nil {
+		return fmt.Errorf("error renaming file: %w", err)
+	}
+	if src == nil {
+		return renameErr(fs.ErrNotExist)
+	}
+	dstParent, dstBase, dst, err := m.parentDir("rename", target)
+	if err != nil {
+		return fmt.Errorf("error renaming file: %w", err)
+	}
+	if dst == src {
+		return nil
+	}
+	if src.isDir() && (dstParent == src || src.contains(dstParent)) {
+		return renameErr(syscall.EINVAL)
+	}
+	if dst != nil {
+		switch {
+		case src.isDir() && !dst.isDir():
+			return renameErr(syscall.ENOTDIR)
+		case !src.isDir() && dst.isDir():
+			return renameErr(syscall.EISDIR)
+		case dst.isDir() && len(dst.entries) > 0:
+			return renameErr(syscall.ENOTEMPTY)
+		}
+		m.unlink(dstParent, dstBase)
+	}
+	// move the entry without releasing the node
+	src.links++
+	m.unlink(srcParent, srcBase)
+	dstParent.entries[dstBase] = src
+	dstParent.modTime = time.Now()
+	return nil
+}
+
+// contains reports whether n is a descendant of the directory d
+func (d *memNode) contains(n *memNode) bool {
+	for _, entry := range d.entries {
+		if entry == n || (entry.isDir() && entry.contains(n)) {
+			return true
+		}
+	}
+	return false
+}
+
+// ModifyTime changes the file modification time
+func (m *MemFS) ModifyTime(filePath string, newTime string) error {
+	newTimeP, err := time.Parse("20060102150405", newTime)
+	if err != nil {
+		return fmt.Errorf("501 Invalid time format got '%s' expected 'YYYYMMDDHHMMSS'", newTime)
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	n, err := m.lookup("chtimes", filePath, true)
+	if err != nil {
+		return fmt.Errorf("error getting file info: %w", err)
+	}
+	n.modTime = newTimeP
+	return nil
+}
+
+// Stat returns the file info
+func (m *MemFS) Stat(fileName string) (string, fs.FileInfo, error) {
+	return m.stat("stat", fileName, true)
+}
+
+// Lstat returns the file info without following the link
+func (m *MemFS) Lstat(fileName string) (string, fs.FileInfo, error) {
+	return m.stat("lstat", fileName, false)
+}
+
+func (m *MemFS) stat(op, fileName string, follow bool) (string, fs.FileInfo, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	n, err := m.lookup(op, fileName, follow)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return "", nil, err
+		}
+		return "", nil, fmt.Errorf("error getting file info: %w", err)
+	}
+	name := path.Base(path.Clean("/" + fileName))
+	if name == "/" {
+		name = "."
+	}
+	info := n.info(name)
+	return fileInfoLine(info), info, nil
+}
+
+// SetStat changes the file permissions
+func (m *MemFS) SetStat(fileName string, newPermissions os.FileMode) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	n, err := m.lookup("chmod", fileName, true)
+	if err != nil {
+		return fmt.Errorf("error changing file permissions: %w", err)
+	}
+	n.mode = n.mode&fs.ModeType | newPermissions.Perm()
+	return nil
+}
+
+// Link creates a hard link fileName pointing to the file target.
+func (m *MemFS) Link(fileName string, target string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	linkErr := func(err error) error {
+		return &os.LinkError{Op: "link", Old: target, New: fileName, Err: err}
+	}
+	n, err := m.lookup("link", target, false)
+	if err != nil {
+		return err
+	}
+	if n.isDir() {
+		return linkErr(fs.ErrPermission)
+	}
+	parent, base, existing, err := m.parentDir("link", fileName)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return linkErr(fs.ErrExist)
+	}
+	m.link(parent, base, n)
+	return nil
+}
+
+// Symlink creates a symbolic link fileName pointing to the file or directory target.
+func (m *MemFS) Symlink(fileName string, target string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	parent, base, existing, err := m.parentDir("symlink", fileName)
+	if err != nil {
+		return fmt.Errorf("error cleaning filname path: %w", err)
+	}
+	if existing != nil {
+		return &os.LinkError{Op: "symlink", Old: target, New: fileName, Err: fs.ErrExist}
+	}
+	m.link(parent, base, &memNode{mode: fs.ModeSymlink | 0777, modTime: time.Now(), target: path.Clean("/" + target)})
+	return nil
+}
+
+// FileWrite opens the file for writing with the os.OpenFile flags
+func (m *MemFS) FileWrite(fileName string, access int) (io.WriterAt, error) {
+	return m.open(fileName, access)
+}
+
+// FileRead opens the file for reading with the os.OpenFile flags
+func (m *MemFS) FileRead(fileName string, access int) (io.ReaderAt, error) {
+	return m.open(fileName, access)
+}
+
+// open opens a file with the os.OpenFile flags, directories can only be opened for reading
+func (m *MemFS) open(name string, flag int) (*memFile, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	openErr := func(err error) error {
+		return fmt.Errorf("creating file error: %w", &fs.PathError{Op: "open", Path: name, Err: err})
+	}
+	writable := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	readable := flag&os.O_WRONLY == 0
+
+	parent, base, n, err := m.resolve(name, true)
+	if err != nil {
+		return nil, openErr(err)
+	}
+	switch {
+	case n == nil && flag&os.O_CREATE == 0:
+		return nil, openErr(fs.ErrNotExist)
+	case n == nil:
+		if parent.mode&0200 == 0 {
+			return nil, openErr(fs.ErrPermission)
+		}
+		n = &memNode{mode: 0644, modTime: time.Now()}
+		m.link(parent, base, n)
+	case flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, openErr(fs.ErrExist)
+	case n.isDir() && writable:
+		return nil, openErr(syscall.EISDIR)
+	case readable && n.mode&0400 == 0, writable && n.mode&0200 == 0:
+		return nil, openErr(fs.ErrPermission)
+	}
+
+	if writable && flag&os.O_TRUNC != 0 && len(n.data) > 0 {
+		_ = m.resize(n, 0)
+		n.modTime = time.Now()
+	}
+	if base == "" {
+		base = "."
+	}
+	return &memFile{fs: m, node: n, name: base, readable: readable, writable: writable, append: flag&os.O_APPEND != 0}, nil
+}
+
+// StatFS returns a synthetic file system status based on the Capacity
+func (m *MemFS) StatFS(path string) (*sftp.StatVFS, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	blocks := uint64(m.capacity() / memBlockSize)
+	used := uint64((m.used + memBlockSize - 1) / memBlockSize)
+	free := uint64(0)
+	if used < blocks {
+		free = blocks - used
+	}
+	// allow one node per block
+	files := uint64(0)
+	if uint64(m.files) < blocks {
+		files = blocks - uint64(m.files)
+	}
+	return &sftp.StatVFS{
+		Bsize:   memBlockSize,
+		Frsize:  memBlockSize,
+		Blocks:  blocks,
+		Bfree:   free,
+		Bavail:  free,
+		Files:   blocks,
+		Ffree:   files,
+		Favail:  files,
+		Namemax: 255,
+	}, nil
+}
+
+// info returns the file info of the node
+func (n *memNode) info(name string) *fileInfo {
+	size := int64(len(n.data))
+	if n.isSymlink() {
+		size = int64(len(n.target))
+	}
+	return &fileInfo{name: name, size: size, mode: n.mode, modTime: n.modTime}
+}
+
+// fileInfo is a snapshot of a file implementing fs.FileInfo
+type fileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (i *fileInfo) Name() string       { return i.name }
+func (i *fileInfo) Size() int64        { return i.size }
+func (i *fileInfo) Mode() fs.FileMode  { return i.mode }
+func (i *fileInfo) ModTime() time.Time { return i.modTime }
+func (i *fileInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i *fileInfo) Sys() any           { return nil }
+
+// memFile is an open file of a MemFS, it implements fs.File, fs.ReadDirFile, io.Seeker, io.ReaderAt and io.WriterAt
+type memFile struct {
+	fs       *MemFS
+	node     *memNode
+	name     string
+	readable bool
+	writable bool
+	append   bool
+
+	lock    sync.Mutex // Protects offset, dirRead and closed
+	offset  int64
+	dirRead int
+	closed  bool
+}
+
+func (f *memFile) checkOpen(op string) error {
+	if f.closed {
+		return &fs.PathError{Op: op, Path: f.name, Err: fs.ErrClosed}
+	}
+	return nil
+}
+
+// ReadAt reads from the file content at the offset
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.lock.Lock()
+	err := f.checkOpen("read")
+	f.lock.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	return f.readAt(p, off)
+}
+
+func (f *memFile) readAt(p []byte, off int64) (int, error) {
+	if !f.readable {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: syscall.EBADF}
+	}
+	if f.node.isDir() {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: syscall.EISDIR}
+	}
+	if off < 0 {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: fs.ErrInvalid}
+	}
+
+	f.fs.lock.RLock()
+	defer f.fs.lock.RUnlock()
+	if off >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// WriteAt writes to the file content at the offset, or at the end if the file was opened with O_APPEND
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	f.lock.Lock()
+	err := f.checkOpen("write")
+	f.lock.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	if !f.writable {
+		return 0, &fs.PathError{Op: "write", Path: f.name, Err: syscall.EBADF}
+	}
+	if off < 0 {
+		return 0, &fs.PathError{Op: "write", Path: f.name, Err: fs.ErrInvalid}
+	}
+
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+	if f.append {
+		off = int64(len(f.node.data))
+	}
+	if end := off + int64(len(p)); end > int64(len(f.node.data)) {
+		if err := f.fs.resize(f.node, end); err != nil {
+			return 0, &fs.PathError{Op: "write", Path: f.name, Err: err}
+		}
+	}
+	copy(f.node.data[off:], p)
+	f.node.modTime = time.Now()
+	return len(p), nil
+}
+
+// Read reads from the current offset
+func (f *memFile) Read(p []byte) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.checkOpen("read"); err != nil {
+		return 0, err
+	}
+	n, err := f.readAt(p, f.offset)
+	f.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Seek sets the offset for the next Read
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.checkOpen("seek"); err != nil {
+		return 0, err
+	}
+
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		f.fs.lock.RLock()
+		offset += int64(len(f.node.data))
+		f.fs.lock.RUnlock()
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+// Stat returns the file info
+func (f *memFile) Stat() (fs.FileInfo, error) {
+	f.fs.lock.RLock()
+	defer f.fs.lock.RUnlock()
+	return f.node.info(f.name), nil
+}
+
+// ReadDir reads the directory entries like os.File.ReadDir
+func (f *memFile) ReadDir(count int) ([]fs.DirEntry, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.checkOpen("readdir"); err != nil {
+		return nil, err
+	}
+	if !f.node.isDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: syscall.ENOTDIR}
+	}
+
+	f.fs.lock.RLock()
+	names := f.node.sortedNames()[min(f.dirRead, len(f.node.entries)):]
+	if count > 0 && len(names) > count {
+		names = names[:count]
+	}
+	entries := make([]fs.DirEntry, 0, len(names))
+	for _, name := range names {
+		entries = append(entries, fs.FileInfoToDirEntry(f.node.entries[name].info(name)))
+	}
+	f.fs.lock.RUnlock()
+
+	f.dirRead += len(entries)
+	if count > 0 && len(entries) == 0 {
+		return nil, io.EOF
+	}
+	return entries, nil
+}
+
+// Close closes the file
+func (f *memFile) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.checkOpen("close"); err != nil {
+		return err
+	}
+	f.closed = true
+	return nil
+}
+
+// memIOFS implements fs.FS on top of a MemFS
+type memIOFS struct {
+	m *MemFS
+}
+
+// Open opens the named file for reading
+func (i memIOFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	f, err := i.m.open(name, os.O_RDONLY)
+	if err != nil {
+		var pathErr *fs.PathError
+		if errors.As(err, &pathErr) {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: pathErr.Err}
+		}
+		return nil, err
+	}
+	return f, nil
+}
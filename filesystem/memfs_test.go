@@ -0,0 +1,267 @@
+package filesystem
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"testing/fstest"
+)
+
+func writeMemFile(t *testing.T, m *MemFS, name, data string) {
+	t.Helper()
+	if err := m.WriteFile(name, strings.NewReader(data), "I", false); err != nil {
+		t.Fatalf("write %s: %v", name, err)
+	}
+}
+
+func readMemFile(t *testing.T, m *MemFS, name string) string {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	if _, err := m.ReadFile(name, buf); err != nil {
+		t.Fatalf("read %s: %v", name, err)
+	}
+	return buf.String()
+}
+
+func TestMemFS_GetFS(t *testing.T) {
+	m := NewMemFS()
+	if err := m.MakeDir("/dir/sub"); err != nil {
+		t.Fatal(err)
+	}
+	writeMemFile(t, m, "/a.txt", "hello")
+	writeMemFile(t, m, "/dir/b.txt", "world")
+	writeMemFile(t, m, "/dir/sub/c.txt", "")
+	if err := m.Symlink("/link", "/dir"); err != nil {
+		t.Fatal(err)
+	}
+
+	err := fstest.TestFS(m.GetFS(), "a.txt", "dir/b.txt", "dir/sub/c.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// links are listed as links like os.DirFS, but followed when opened
+	data, err := fs.ReadFile(m.GetFS(), "link/b.txt")
+	if err != nil || string(data) != "world" {
+		t.Fatalf("link/b.txt = %q, %v", data, err)
+	}
+}
+
+func TestMemFS_Files(t *testing.T) {
+	m := NewMemFS()
+	writeMemFile(t, m, "/a.txt", "hello")
+	if err := m.WriteFile("/a.txt", strings.NewReader(" world"), "I", true); err != nil {
+		t.Fatal(err)
+	}
+	if got := readMemFile(t, m, "/a.txt"); got != "hello world" {
+		t.Fatalf("got %q", got)
+	}
+	if err := m.WriteFile("/a.txt", strings.NewReader("line1\r\nline2"), "A", false); err != nil {
+		t.Fatal(err)
+	}
+	if got := readMemFile(t, m, "/a.txt"); got != "line1\nline2\n" {
+		t.Fatalf("got %q", got)
+	}
+	if err := m.WriteFile("/missing/a.txt", strings.NewReader(""), "I", false); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected a not exist error, got %v", err)
+	}
+
+	w, err := m.FileWrite("/b.bin", os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.WriteAt([]byte("world"), 6)
+	w.WriteAt([]byte("hello"), 0)
+	r, err := m.FileRead("/b.bin", os.O_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 11)
+	if n, err := r.ReadAt(buf, 0); n != 11 || (err != nil && err != io.EOF) {
+		t.Fatalf("ReadAt returned %d, %v", n, err)
+	}
+	if string(buf) != "hello\x00world" {
+		t.Fatalf("got %q", buf)
+	}
+	if _, err = m.FileRead("/b.bin", os.O_RDWR|os.O_CREATE|os.O_EXCL); !errors.Is(err, fs.ErrExist) {
+		t.Fatalf("expected an exist error, got %v", err)
+	}
+
+	if err = m.ModifyTime("/b.bin", "20200102030405"); err != nil {
+		t.Fatal(err)
+	}
+	line, info, err := m.Stat("/b.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 11 || info.ModTime().Format("20060102150405") != "20200102030405" {
+		t.Fatalf("unexpected info %v %v", info.Size(), info.ModTime())
+	}
+	if want := "Type=file;Size=11;Modify=20200102030405;Perm=-rw-r--r--;UNIX.ownername=owner;UNIX.groupname=group; b.bin"; line != want {
+		t.Fatalf("got line %q, want %q", line, want)
+	}
+}
+
+func TestMemFS_Dirs(t *testing.T) {
+	m := NewMemFS()
+	if err := m.MakeDir("/a/b/c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.MakeDir("/a/b"); err != nil {
+		t.Fatalf("MakeDir of an existing directory: %v", err)
+	}
+	writeMemFile(t, m, "/a/b/file.txt", "data")
+	if err := m.CheckDir("/a/b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.CheckDir("/a/b/file.txt"); err == nil {
+		t.Fatal("expected CheckDir to fail on a file")
+	}
+
+	lines, infos, err := m.Dir("/a/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 2 || infos[0].Name() != "c" || !infos[0].IsDir() || infos[1].Name() != "file.txt" || len(lines) != 2 {
+		t.Fatalf("unexpected listing %v", lines)
+	}
+
+	if err = m.Remove("/a/b"); !errors.Is(err, syscall.ENOTEMPTY) {
+		t.Fatalf("expected a not empty error, got %v", err)
+	}
+	if err = m.Rename("/a", "/a/b/c/d"); err == nil {
+		t.Fatal("expected moving a directory into itself to fail")
+	}
+	if err = m.Rename("/a/b", "/moved"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readMemFile(t, m, "/moved/file.txt"); got != "data" {
+		t.Fatalf("got %q", got)
+	}
+	if _, _, err = m.Stat("/a/b"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected the old path to be gone, got %v", err)
+	}
+	if err = m.Remove("/../.."); err == nil {
+		t.Fatal("expected removing the root to fail")
+	}
+}
+
+func TestMemFS_Links(t *testing.T) {
+	m := NewMemFS()
+	m.MakeDir("/dir")
+	writeMemFile(t, m, "/dir/a.txt", "original")
+
+	if err := m.Link("/hard.txt", "/dir/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	writeMemFile(t, m, "/hard.txt", "changed")
+	if got := readMemFile(t, m, "/dir/a.txt"); got != "changed" {
+		t.Fatalf("hard link not shared, got %q", got)
+	}
+	if err := m.Remove("/dir/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readMemFile(t, m, "/hard.txt"); got != "changed" {
+		t.Fatalf("hard link lost its content, got %q", got)
+	}
+	if err := m.Link("/dirlink", "/dir"); err == nil {
+		t.Fatal("expected hard linking a directory to fail")
+	}
+
+	if err := m.Symlink("/sym", "dir"); err != nil {
+		t.Fatal(err)
+	}
+	writeMemFile(t, m, "/sym/b.txt", "through the link")
+	if got := readMemFile(t, m, "/dir/b.txt"); got != "through the link" {
+		t.Fatalf("got %q", got)
+	}
+	_, info, err := m.Lstat("/sym")
+	if err != nil || info.Mode()&fs.ModeSymlink == 0 {
+		t.Fatalf("Lstat returned %v, %v", info, err)
+	}
+	_, info, err = m.Stat("/sym")
+	if err != nil || !info.IsDir() {
+		t.Fatalf("Stat returned %v, %v", info, err)
+	}
+
+	m.Symlink("/loop1", "/loop2")
+	m.Symlink("/loop2", "/loop1")
+	if _, _, err = m.Stat("/loop1"); !errors.Is(err, syscall.ELOOP) {
+		t.Fatalf("expected a loop error, got %v", err)
+	}
+}
+
+func TestMemFS_Permissions(t *testing.T) {
+	m := NewMemFS()
+	writeMemFile(t, m, "/a.txt", "secret")
+	if err := m.SetStat("/a.txt", 0200); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.ReadFile("/a.txt", io.Discard); !errors.Is(err, fs.ErrPermission) {
+		t.Fatalf("expected a permission error, got %v", err)
+	}
+	m.MakeDir("/ro")
+	m.SetStat("/ro", 0555)
+	if err := m.WriteFile("/ro/a.txt", strings.NewReader(""), "I", false); !errors.Is(err, fs.ErrPermission) {
+		t.Fatalf("expected a permission error, got %v", err)
+	}
+	_, info, _ := m.Stat("/ro")
+	if info.Mode() != fs.ModeDir|0555 {
+		t.Fatalf("got mode %v", info.Mode())
+	}
+}
+
+func TestMemFS_Capacity(t *testing.T) {
+	m := NewMemFS()
+	m.Capacity = 10 * memBlockSize
+	if err := m.WriteFile("/big", bytes.NewReader(make([]byte, 11*memBlockSize)), "I", false); !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("expected a no space error, got %v", err)
+	}
+	writeMemFile(t, m, "/a", strings.Repeat("x", 4*memBlockSize))
+	stat, err := m.StatFS("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Blocks != 10 || stat.Bfree != 6 {
+		t.Fatalf("unexpected StatFS %+v", stat)
+	}
+	m.Link("/b", "/a")
+	m.Remove("/a")
+	m.Remove("/b")
+	if stat, _ = m.StatFS("/"); stat.Bfree != 10 {
+		t.Fatalf("expected the space to be released, got %+v", stat)
+	}
+}
+
+func TestMemFS_Concurrent(t *testing.T) {
+	m := NewMemFS()
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			dir := fmt.Sprintf("/d%d", i%2)
+			m.MakeDir(dir)
+			for j := 0; j < 50; j++ {
+				name := fmt.Sprintf("%s/f%d-%d", dir, i, j)
+				m.WriteFile(name, strings.NewReader("data"), "I", false)
+				m.Dir(dir)
+				m.Rename(name, name+".done")
+				m.ReadFile(name+".done", io.Discard)
+			}
+		}(i)
+	}
+	wg.Wait()
+	for _, dir := range []string{"/d0", "/d1"} {
+		_, infos, err := m.Dir(dir)
+		if err != nil || len(infos) != 200 {
+			t.Fatalf("%s has %d files, %v", dir, len(infos), err)
+		}
+	}
+}
@@ -0,0 +1,540 @@
+package filesystem
+
+import (
+	"errors"
+	"fmt"
+	"github.com/pkg/sftp"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Ensure that MountFS implements the FtpFS interface
+var _ NewFSWithReadWriteAt = &MountFS{}
+
+// ErrCrossMount is returned for a rename, link or symlink between two mounted file systems
+var ErrCrossMount = errors.New("filesystem: rename or link across mount points")
+
+// mount is a file system mounted at a virtual path
+type mount struct {
+	path    string // the clean absolute mount point
+	fs      FS
+	mounted time.Time
+}
+
+// MountFS composes file systems mounted at virtual paths into one tree, e.g. a LocalFS at /recordings,
+// a read only archive at /archive and a MemFS at /scratch. every method is routed to the file system
+// with the longest mount point containing the path, the listings of directories on the way to a mount point
+// include it. the directories that only lead to mount points are virtual and can't be changed.
+// renames and links across mount points fail with ErrCrossMount.
+type MountFS struct {
+	lock   sync.RWMutex // Protects mounts
+	mounts []mount      // sorted by descending mount point length, the longest prefix first
+}
+
+// NewMountFS returns a file system without mounts, use Mount to add them
+func NewMountFS() *MountFS {
+	return &MountFS{}
+}
+
+// Mount mounts the file system at the virtual path, a path can only be mounted once
+func (m *MountFS) Mount(mountPoint string, fsys FS) error {
+	mountPoint = cleanName(mountPoint)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, mnt := range m.mounts {
+		if mnt.path == mountPoint {
+			return fmt.Errorf("mount %s: %w", mountPoint, fs.ErrExist)
+		}
+	}
+	m.mounts = append(m.mounts, mount{path: mountPoint, fs: fsys, mounted: time.Now()})
+	sort.SliceStable(m.mounts, func(i, j int) bool {
+		return len(m.mounts[i].path) > len(m.mounts[j].path)
+	})
+	return nil
+}
+
+// Unmount removes the file system mounted at the virtual path
+func (m *MountFS) Unmount(mountPoint string) error {
+	mountPoint = cleanName(mountPoint)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for i, mnt := range m.mounts {
+		if mnt.path == mountPoint {
+			m.mounts = append(m.mounts[:i], m.mounts[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("unmount %s: %w", mountPoint, fs.ErrNotExist)
+}
+
+// resolve returns the mount containing the path and the path relative to its mount point
+func (m *MountFS) resolve(name string) (mount, string, bool) {
+	name = cleanName(name)
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	for _, mnt := range m.mounts {
+		if mnt.path == "/" || name == mnt.path || strings.HasPrefix(name, mnt.path+"/") {
+			return mnt, cleanName(strings.TrimPrefix(name, mnt.path)), true
+		}
+	}
+	return mount{}, "", false
+}
+
+// route returns the file system and its path of a file, the path is denied if no file system is mounted at it
+func (m *MountFS) route(op, name string) (FS, string, error) {
+	mnt, rest, ok := m.resolve(name)
+	if !ok {
+		return nil, "", &PermissionError{Op: op, Path: name, Reason: "no file system is mounted at the path"}
+	}
+	return mnt.fs, path.Join(mnt.fs.RootDir(), rest), nil
+}
+
+// children returns the names of the mount points and the virtual directories directly under the directory
+// and the mount mounted at each name, the mount is empty for a virtual directory
+func (m *MountFS) children(dir string) map[string]mount {
+	dir = cleanName(dir)
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	children := map[string]mount{}
+	for _, mnt := range m.mounts {
+		if mnt.path == dir || !strings.HasPrefix(mnt.path, prefix) {
+			continue
+		}
+		name, deeper, _ := strings.Cut(strings.TrimPrefix(mnt.path, prefix), "/")
+		child, ok := children[name]
+		switch {
+		case deeper == "" || !ok:
+			if deeper != "" {
+				mnt.fs = nil
+			}
+			children[name] = mnt
+		case child.fs == nil && mnt.mounted.Before(child.mounted):
+			// a virtual directory has the time of the first mount below it
+			child.mounted = mnt.mounted
+			children[name] = child
+		}
+	}
+	return children
+}
+
+// virtualTime returns the modification time of a virtual directory, the time of the first mount below it
+func (m *MountFS) virtualTime(dir string) time.Time {
+	var modTime time.Time
+	for _, child := range m.children(dir) {
+		if modTime.IsZero() || child.mounted.Before(modTime) {
+			modTime = child.mounted
+		}
+	}
+	return modTime
+}
+
+// protected returns the denied error of an operation changing a mount point, a virtual directory
+// or a directory with mount points below it
+func (m *MountFS) protected(op, name string) error {
+	mnt, rest, ok := m.resolve(name)
+	switch {
+	case !ok:
+		return &PermissionError{Op: op, Path: name, Reason: "no file system is mounted at the path"}
+	case rest == "/" && mnt.path != "/":
+		return &PermissionError{Op: op, Path: name, Reason: "mount points can't be changed"}
+	case len(m.children(name)) > 0:
+		return &PermissionError{Op: op, Path: name, Reason: "the directory contains mount points"}
+	}
+	return nil
+}
+
+// virtualInfo returns the info of a virtual directory
+func virtualInfo(name string, modTime time.Time) fs.FileInfo {
+	return &fileInfo{name: name, mode: fs.ModeDir | 0555, modTime: modTime}
+}
+
+// renamedInfo returns the info of a mount point with its name in the tree
+func renamedInfo(info fs.FileInfo, name string) fs.FileInfo {
+	return &fileInfo{name: name, size: info.Size(), mode: info.Mode(), modTime: info.ModTime()}
+}
+
+// childInfos returns the infos of the mount points and virtual directories under the directory,
+// stat returns the info of the root of a mounted file system
+func (m *MountFS) childInfos(dir string, stat func(mount) (fs.FileInfo, error)) []fs.FileInfo {
+	var infos []fs.FileInfo
+	for name, mnt := range m.children(dir) {
+		var info fs.FileInfo
+		if mnt.fs != nil {
+			if root, err := stat(mnt); err == nil {
+				info = renamedInfo(root, name)
+			}
+		}
+		if info == nil {
+			info = virtualInfo(name, mnt.mounted)
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name() < infos[j].Name()
+	})
+	return infos
+}
+
+// statRoot returns the info of the root of a mounted file system
+func statRoot(mnt mount) (fs.FileInfo, error) {
+	_, info, err := mnt.fs.Stat(mnt.fs.RootDir())
+	return info, err
+}
+
+// RootDir returns the root of the tree
+func (m *MountFS) RootDir() string {
+	return "/"
+}
+
+// Dir returns the files of the directory and the mount points under it
+func (m *MountFS) Dir(folderName string) ([]string, []os.FileInfo, error) {
+	children := m.childInfos(folderName, statRoot)
+	var infos []os.FileInfo
+	if fsys, name, err := m.route("list", folderName); err == nil {
+		_, infos, err = fsys.Dir(name)
+		if err != nil && !(errors.Is(err, fs.ErrNotExist) && len(children) > 0) {
+			return nil, nil, err
+		}
+	} else if cleanName(folderName) != "/" && len(children) == 0 {
+		return nil, nil, fmt.Errorf("error reading directory: %w", &fs.PathError{Op: "open", Path: folderName, Err: fs.ErrNotExist})
+	}
+
+	// the mount points hide the files with the same name
+	hidden := map[string]bool{}
+	for _, child := range children {
+		hidden[child.Name()] = true
+	}
+	merged := children
+	for _, info := range infos {
+		if !hidden[info.Name()] {
+			merged = append(merged, info)
+		}
+	}
+	lines := make([]string, len(merged))
+	for i := range merged {
+		lines[i] = fileInfoLine(merged[i])
+	}
+	return lines, merged, nil
+}
+
+// CheckDir checks if the directory exists
+func (m *MountFS) CheckDir(folderName string) error {
+	_, info, err := m.Stat(folderName)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", folderName)
+	}
+	return nil
+}
+
+// MakeDir creates the directory in its mounted file system
+func (m *MountFS) MakeDir(folderName string) error {
+	fsys, name, err := m.route("mkdir", folderName)
+	if err != nil {
+		if _, _, statErr := m.Stat(folderName); statErr == nil {
+			// a virtual directory exists already
+			return nil
+		}
+		return err
+	}
+	return fsys.MakeDir(name)
+}
+
+// ReadFile reads the file from its mounted file system
+func (m *MountFS) ReadFile(fileName string, w io.Writer) (int64, error) {
+	fsys, name, err := m.route("read", fileName)
+	if err != nil {
+		return 0, err
+	}
+	return fsys.ReadFile(name, w)
+}
+
+// WriteFile writes the file to its mounted file system
+func (m *MountFS) WriteFile(fileName string, r io.Reader, transferType string, appendOnly bool) error {
+	fsys, name, err := m.route("write", fileName)
+	if err != nil {
+		return err
+	}
+	return fsys.WriteFile(name, r, transferType, appendOnly)
+}
+
+// Remove removes the file, mount points and directories containing them can't be removed
+func (m *MountFS) Remove(fileName string) error {
+	if err := m.protected("remove", fileName); err != nil {
+		return err
+	}
+	fsys, name, err := m.route("remove", fileName)
+	if err != nil {
+		return err
+	}
+	return fsys.Remove(name)
+}
+
+// Rename renames the file within its mounted file system
+func (m *MountFS) Rename(original string, target string) error {
+	if err := m.protected("rename", original); err != nil {
+		return err
+	}
+	if !m.sameMount(original, target) {
+		return &os.LinkError{Op: "rename", Old: original, New: target, Err: ErrCrossMount}
+	}
+	if err := m.protected("rename", target); err != nil {
+		return err
+	}
+	fsys, from, err := m.route("rename", original)
+	if err != nil {
+		return err
+	}
+	_, to, err := m.route("rename", target)
+	if err != nil {
+		return err
+	}
+	return fsys.Rename(from, to)
+}
+
+// sameMount reports whether both paths are routed to the same mount
+func (m *MountFS) sameMount(a, b string) bool {
+	mntA, _, okA := m.resolve(a)
+	mntB, _, okB := m.resolve(b)
+	return okA && okB && mntA.path == mntB.path
+}
+
+// ModifyTime changes the modification time in the mounted file system
+func (m *MountFS) ModifyTime(filePath string, newTime string) error {
+	if err := m.protected("chtimes", filePath); err != nil {
+		return err
+	}
+	fsys, name, err := m.route("chtimes", filePath)
+	if err != nil {
+		return err
+	}
+	return fsys.ModifyTime(name, newTime)
+}
+
+// Stat returns the file info, following the links
+func (m *MountFS) Stat(fileName string) (string, fs.FileInfo, error) {
+	return m.stat(fileName, FS.Stat)
+}
+
+// Lstat returns the file info without following the link
+func (m *MountFS) Lstat(fileName string) (string, fs.FileInfo, error) {
+	return m.stat(fileName, FS.Lstat)
+}
+
+func (m *MountFS) stat(fileName string, stat func(FS, string) (string, fs.FileInfo, error)) (string, fs.FileInfo, error) {
+	clean := cleanName(fileName)
+	mnt, rest, ok := m.resolve(clean)
+	var info fs.FileInfo
+	var err error
+	if ok {
+		_, info, err = stat(mnt.fs, path.Join(mnt.fs.RootDir(), rest))
+		if err == nil && rest == "/" && clean != "/" {
+			info = renamedInfo(info, path.Base(clean))
+		}
+	}
+	if !ok || errors.Is(err, fs.ErrNotExist) {
+		if clean != "/" && len(m.children(clean)) == 0 {
+			return "", nil, fmt.Errorf("error getting file info: %w", &fs.PathError{Op: "stat", Path: fileName, Err: fs.ErrNotExist})
+		}
+		info, err = virtualInfo(path.Base(clean), m.virtualTime(clean)), nil
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	return fileInfoLine(info), info, nil
+}
+
+// SetStat changes the permissions in the mounted file system
+func (m *MountFS) SetStat(fileName string, newPermissions os.FileMode) error {
+	if err := m.protected("chmod", fileName); err != nil {
+		return err
+	}
+	fsys, name, err := m.route("chmod", fileName)
+	if err != nil {
+		return err
+	}
+	return fsys.SetStat(name, newPermissions)
+}
+
+// Link creates a hard link within the mounted file system of the file
+func (m *MountFS) Link(fileName string, target string) error {
+	if !m.sameMount(fileName, target) {
+		return &os.LinkError{Op: "link", Old: target, New: fileName, Err: ErrCrossMount}
+	}
+	fsys, name, err := m.route("link", fileName)
+	if err != nil {
+		return err
+	}
+	_, existing, err := m.route("link", target)
+	if err != nil {
+		return err
+	}
+	return fsys.Link(name, existing)
+}
+
+// Symlink creates a symbolic link, an absolute target must be in the same mounted file system
+func (m *MountFS) Symlink(fileName string, target string) error {
+	fsys, name, err := m.route("symlink", fileName)
+	if err != nil {
+		return err
+	}
+	if path.IsAbs(target) {
+		if !m.sameMount(fileName, target) {
+			return &os.LinkError{Op: "symlink", Old: target, New: fileName, Err: ErrCrossMount}
+		}
+		_, target, _ = m.route("symlink", target)
+	}
+	return fsys.Symlink(name, target)
+}
+
+// FileWrite opens the file for writing in its mounted file system
+func (m *MountFS) FileWrite(fileName string, access int) (io.WriterAt, error) {
+	fsys, name, err := m.route("write", fileName)
+	if err != nil {
+		return nil, err
+	}
+	return fileWrite(fsys, name, access)
+}
+
+// FileRead opens the file in its mounted file system
+func (m *MountFS) FileRead(fileName string, access int) (io.ReaderAt, error) {
+	fsys, name, err := m.route("open", fileName)
+	if err != nil {
+		return nil, err
+	}
+	return fileRead(fsys, name, access)
+}
+
+// StatFS returns the file system status of the mounted file system of the path
+func (m *MountFS) StatFS(fileName string) (*sftp.StatVFS, error) {
+	fsys, name, err := m.route("statvfs", fileName)
+	if err != nil {
+		return nil, err
+	}
+	return statFS(fsys, name)
+}
+
+// GetFS returns the fs.FS object of the tree, fs.FS is read only
+func (m *MountFS) GetFS() fs.FS {
+	return mountIOFS{m: m}
+}
+
+// mountIOFS opens the files of the fs.FS of the mounted file systems
+type mountIOFS struct {
+	m *MountFS
+}
+
+// statIORoot returns the info of the root of the fs.FS of a mounted file system
+func statIORoot(mnt mount) (fs.FileInfo, error) {
+	return fs.Stat(getFS(mnt.fs), ".")
+}
+
+func (f mountIOFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	clean := cleanName(name)
+	children := f.m.childInfos(clean, statIORoot)
+	mnt, rest, ok := f.m.resolve(clean)
+
+	var file fs.File
+	var info fs.FileInfo
+	if ok {
+		var err error
+		file, err = getFS(mnt.fs).Open(strings.TrimPrefix(path.Join(".", rest), "/"))
+		if err == nil {
+			info, err = file.Stat()
+		}
+		if err != nil {
+			if file != nil {
+				file.Close()
+			}
+			if !errors.Is(err, fs.ErrNotExist) || len(children) == 0 {
+				return nil, err
+			}
+			file = nil
+		} else if rest == "/" && clean != "/" {
+			info = renamedInfo(info, path.Base(clean))
+		} else if len(children) == 0 {
+			return file, nil
+		}
+	} else if clean != "/" && len(children) == 0 {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	if info == nil {
+		info = virtualInfo(path.Base(clean), f.m.virtualTime(clean))
+	}
+	return &mountDir{file: file, info: info, children: children}, nil
+}
+
+// mountDir is a directory of the fs.FS listing the mount points under it,
+// file is nil for a virtual directory
+type mountDir struct {
+	file     fs.File
+	info     fs.FileInfo
+	children []fs.FileInfo
+
+	entries []fs.DirEntry // nil until the first ReadDir
+	offset  int
+}
+
+func (d *mountDir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *mountDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.Name(), Err: fs.ErrInvalid}
+}
+
+func (d *mountDir) ReadDir(count int) ([]fs.DirEntry, error) {
+	if d.entries == nil {
+		hidden := map[string]bool{}
+		d.entries = []fs.DirEntry{}
+		for _, child := range d.children {
+			hidden[child.Name()] = true
+			d.entries = append(d.entries, fs.FileInfoToDirEntry(child))
+		}
+		if dir, ok := d.file.(fs.ReadDirFile); ok {
+			entries, err := dir.ReadDir(-1)
+			if err != nil {
+				return nil, err
+			}
+			for _, entry := range entries {
+				if !hidden[entry.Name()] {
+					d.entries = append(d.entries, entry)
+				}
+			}
+		}
+		sort.Slice(d.entries, func(i, j int) bool {
+			return d.entries[i].Name() < d.entries[j].Name()
+		})
+	}
+
+	rest := d.entries[d.offset:]
+	if count <= 0 {
+		d.offset = len(d.entries)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	rest = rest[:min(count, len(rest))]
+	d.offset += len(rest)
+	return rest, nil
+}
+
+func (d *mountDir) Close() error {
+	if d.file != nil {
+		return d.file.Close()
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package filesystem
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestMountFS(t *testing.T) {
+	recordings, archive, scratch := NewMemFS(), NewMemFS(), NewMemFS()
+	for name, fsys := range map[string]*MemFS{"/call.wav": recordings, "/2023/old.wav": archive, "/tmp.txt": scratch} {
+		fsys.MakeDir("/2023")
+		if err := fsys.WriteFile(name, strings.NewReader(name), "I", false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m := NewMountFS()
+	for mountPoint, fsys := range map[string]FS{"/recordings": recordings, "/archive": NewReadOnlyFS(archive), "/data/scratch": scratch} {
+		if err := m.Mount(mountPoint, fsys); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.Mount("/recordings", scratch); !errors.Is(err, fs.ErrExist) {
+		t.Fatalf("expected a mount point to be mounted once, got %v", err)
+	}
+
+	_, infos, err := m.Dir("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	if strings.Join(names, ",") != "archive,data,recordings" {
+		t.Fatalf("expected the mount points in the root, got %v", names)
+	}
+
+	// the longest mount point is used
+	var buf bytes.Buffer
+	if _, err = m.ReadFile("/data/scratch/tmp.txt", &buf); err != nil || buf.String() != "/tmp.txt" {
+		t.Fatalf("got %q %v", buf.String(), err)
+	}
+	if err = m.WriteFile("/recordings/new.wav", strings.NewReader("new"), "I", false); err != nil {
+		t.Fatal(err)
+	}
+	if got := readMemFile(t, recordings, "/new.wav"); got != "new" {
+		t.Fatalf("got %q", got)
+	}
+	if err = m.WriteFile("/archive/new.wav", strings.NewReader("new"), "I", false); !errors.Is(err, fs.ErrPermission) {
+		t.Fatalf("expected the read only mount to deny the write, got %v", err)
+	}
+
+	denied := map[string]error{
+		"WriteVirtual":  m.WriteFile("/data/file", strings.NewReader("x"), "I", false),
+		"RemoveMount":   m.Remove("/recordings"),
+		"RemoveVirtual": m.Remove("/data"),
+		"RenameMount":   m.Rename("/recordings", "/recordings2"),
+	}
+	for method, err := range denied {
+		if !errors.Is(err, fs.ErrPermission) {
+			t.Errorf("%s: expected a permission error, got %v", method, err)
+		}
+	}
+	if err = m.Rename("/recordings/new.wav", "/data/scratch/new.wav"); !errors.Is(err, ErrCrossMount) {
+		t.Fatalf("expected a cross mount error, got %v", err)
+	}
+	if err = m.Link("/data/scratch/call.wav", "/recordings/call.wav"); !errors.Is(err, ErrCrossMount) {
+		t.Fatalf("expected a cross mount error, got %v", err)
+	}
+	if err = m.Rename("/recordings/new.wav", "/recordings/2023/new.wav"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, info, err := m.Stat("/data"); err != nil || !info.IsDir() || info.Name() != "data" {
+		t.Fatalf("expected a virtual directory, got %v %v", info, err)
+	}
+	if _, _, err = m.Stat("/missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected a missing file, got %v", err)
+	}
+
+	if err = fstest.TestFS(m.GetFS(), "recordings/call.wav", "recordings/2023/new.wav", "archive/2023/old.wav", "data/scratch/tmp.txt"); err != nil {
+		t.Fatal(err)
+	}
+}
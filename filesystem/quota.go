@@ -0,0 +1,412 @@
+package filesystem
+
+import (
+	"fmt"
+	"github.com/pkg/sftp"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Ensure that QuotaFS implements the FtpFS interface
+var _ NewFSWithReadWriteAt = &QuotaFS{}
+
+// QuotaError is returned when an operation would exceed a quota of a QuotaFS,
+// it matches syscall.ENOSPC so the protocols report it as a full file system
+type QuotaError struct {
+	// Op is the rejected operation, e.g. "write" or "link"
+	Op string
+	// Path is the file of the operation
+	Path string
+	// Resource is the exceeded limit, "bytes" or "files"
+	Resource string
+	// Limit is the quota of the resource
+	Limit int64
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("%s %s: quota exceeded: the limit is %d %s", e.Op, e.Path, e.Limit, e.Resource)
+}
+
+// Is reports whether the target is syscall.ENOSPC
+func (e *QuotaError) Is(target error) bool {
+	return target == syscall.ENOSPC
+}
+
+// QuotaUsage is the usage and the limits of a QuotaFS, a zero limit is unlimited
+type QuotaUsage struct {
+	Bytes    int64
+	Files    int64
+	MaxBytes int64
+	MaxFiles int64
+}
+
+// QuotaFS wraps a file system and limits the bytes and the number of files stored under its root.
+// the usage is counted by a scan of the file system when it is created and then updated by every operation,
+// changes made to the wrapped file system directly are only seen by Scan.
+// uploads are rejected with a *QuotaError as soon as they exceed the quota, the partial file of a new file is removed.
+// directories don't count as files.
+// a QuotaFS served as the file system of a server is shared by all the users, UserQuotas gives a quota to every user.
+type QuotaFS struct {
+	FS
+	maxBytes int64
+	maxFiles int64
+
+	lock  sync.Mutex // Protects bytes and files
+	bytes int64
+	files int64
+}
+
+// NewQuotaFS returns the file system limited to maxBytes and maxFiles, 0 is unlimited.
+// it scans the file system to count the current usage.
+func NewQuotaFS(fsys FS, maxBytes, maxFiles int64) (*QuotaFS, error) {
+	q := &QuotaFS{FS: fsys, maxBytes: maxBytes, maxFiles: maxFiles}
+	if err := q.Scan(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// Scan counts the usage of the file system again
+func (q *QuotaFS) Scan() error {
+	var bytes, files int64
+	var walk func(dir string) error
+	walk = func(dir string) error {
+		_, entries, err := q.FS.Dir(dir)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			name := path.Join(dir, entry.Name())
+			if !entry.IsDir() {
+				bytes += entry.Size()
+				files++
+				continue
+			}
+			// don't follow directory links, they may loop
+			if _, info, err := q.FS.Lstat(name); err == nil && info.Mode()&fs.ModeSymlink != 0 {
+				continue
+			}
+			if err = walk(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(q.FS.RootDir()); err != nil {
+		return fmt.Errorf("error scanning the quota usage: %w", err)
+	}
+
+	q.lock.Lock()
+	q.bytes, q.files = bytes, files
+	q.lock.Unlock()
+	return nil
+}
+
+// Usage returns the current usage and the limits
+func (q *QuotaFS) Usage() QuotaUsage {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return QuotaUsage{Bytes: q.bytes, Files: q.files, MaxBytes: q.maxBytes, MaxFiles: q.maxFiles}
+}
+
+// GetFS returns the fs.FS object of the wrapped file system, fs.FS is read only
+func (q *QuotaFS) GetFS() fs.FS {
+	return getFS(q.FS)
+}
+
+// size returns the size of a file and whether it exists, directories have no size
+func (q *QuotaFS) size(fileName string) (int64, bool) {
+	_, info, err := q.FS.Stat(fileName)
+	if err != nil {
+		return 0, false
+	}
+	if info.IsDir() {
+		return 0, true
+	}
+	return info.Size(), true
+}
+
+// add changes the usage
+func (q *QuotaFS) add(bytes, files int64) {
+	q.lock.Lock()
+	q.bytes += bytes
+	q.files += files
+	q.lock.Unlock()
+}
+
+// reserve adds the bytes and files to the usage if they fit in the quota
+func (q *QuotaFS) reserve(op, fileName string, bytes, files int64) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.maxFiles > 0 && files > 0 && q.files+files > q.maxFiles {
+		return &QuotaError{Op: op, Path: fileName, Resource: "files", Limit: q.maxFiles}
+	}
+	if q.maxBytes > 0 && bytes > 0 && q.bytes+bytes > q.maxBytes {
+		return &QuotaError{Op: op, Path: fileName, Resource: "bytes", Limit: q.maxBytes}
+	}
+	q.bytes += bytes
+	q.files += files
+	return nil
+}
+
+// WriteFile writes the file and fails once the data exceeds the quota.
+// an overwrite that exceeds the quota keeps the previous content only if the wrapped file system writes atomically,
+// e.g. a LocalFS with AtomicWrites, otherwise the file is left truncated to the data that fit in the quota.
+func (q *QuotaFS) WriteFile(fileName string, r io.Reader, transferType string, appendOnly bool) error {
+	oldSize, exists := q.size(fileName)
+	var newFiles int64
+	if !exists {
+		newFiles = 1
+	}
+	if err := q.reserve("write", fileName, 0, newFiles); err != nil {
+		return err
+	}
+	if !appendOnly {
+		// the old content is replaced
+		q.add(-oldSize, 0)
+	}
+
+	counter := &quotaReader{q: q, r: r, name: fileName}
+	err := q.FS.WriteFile(fileName, counter, transferType, appendOnly)
+	if counter.quotaErr != nil && !appendOnly && !exists {
+		// an overwritten file is left in place, an atomic upload keeps the previous content
+		_ = q.FS.Remove(fileName)
+	}
+
+	// replace the counted bytes with the stored size, ASCII conversion may change it
+	counted := counter.n
+	if appendOnly {
+		counted += oldSize
+	}
+	var files int64
+	newSize, stored := q.size(fileName)
+	if !stored {
+		files = -1
+	}
+	q.add(newSize-counted, files)
+
+	if counter.quotaErr != nil {
+		return counter.quotaErr
+	}
+	return err
+}
+
+// Remove removes the file and releases its usage
+func (q *QuotaFS) Remove(fileName string) error {
+	_, info, err := q.FS.Lstat(fileName)
+	if err != nil {
+		return q.FS.Remove(fileName)
+	}
+	if err = q.FS.Remove(fileName); err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		q.add(-info.Size(), -1)
+	}
+	return nil
+}
+
+// Rename renames the file, a replaced file releases its usage
+func (q *QuotaFS) Rename(original string, target string) error {
+	_, targetInfo, err := q.FS.Lstat(target)
+	replaced := err == nil && !targetInfo.IsDir() && path.Clean("/"+original) != path.Clean("/"+target)
+	if err = q.FS.Rename(original, target); err != nil {
+		return err
+	}
+	if replaced {
+		q.add(-targetInfo.Size(), -1)
+	}
+	return nil
+}
+
+// Link creates a hard link, the new name counts as a file
+func (q *QuotaFS) Link(fileName string, target string) error {
+	size, _ := q.size(target)
+	if err := q.reserve("link", fileName, size, 1); err != nil {
+		return err
+	}
+	if err := q.FS.Link(fileName, target); err != nil {
+		q.add(-size, -1)
+		return err
+	}
+	return nil
+}
+
+// Symlink creates a symbolic link, the link counts as a file
+func (q *QuotaFS) Symlink(fileName string, target string) error {
+	if err := q.reserve("symlink", fileName, 0, 1); err != nil {
+		return err
+	}
+	if err := q.FS.Symlink(fileName, target); err != nil {
+		q.add(0, -1)
+		return err
+	}
+	return nil
+}
+
+// FileWrite opens the file for writing, writes fail once the file grows over the quota
+func (q *QuotaFS) FileWrite(fileName string, access int) (io.WriterAt, error) {
+	oldSize, exists := q.size(fileName)
+	var newFiles int64
+	if !exists && access&os.O_CREATE != 0 {
+		newFiles = 1
+	}
+	if err := q.reserve("write", fileName, 0, newFiles); err != nil {
+		return nil, err
+	}
+	file, err := fileWrite(q.FS, fileName, access)
+	if err != nil {
+		q.add(0, -newFiles)
+		return nil, err
+	}
+
+	size := oldSize
+	if access&os.O_TRUNC != 0 {
+		q.add(-oldSize, 0)
+		size = 0
+	}
+	return &quotaWriter{transferErrorForwarder: transferErrorForwarder{w: file}, q: q, name: fileName, size: size, newFiles: newFiles}, nil
+}
+
+// FileRead opens the file of the wrapped file system
+func (q *QuotaFS) FileRead(fileName string, access int) (io.ReaderAt, error) {
+	return fileRead(q.FS, fileName, access)
+}
+
+// StatFS returns the status of the wrapped file system limited to the quota
+func (q *QuotaFS) StatFS(path string) (*sftp.StatVFS, error) {
+	stat, err := statFS(q.FS, path)
+	if err != nil {
+		stat = &sftp.StatVFS{Bsize: 4096, Frsize: 4096, Namemax: 255}
+	}
+	if stat.Frsize == 0 {
+		stat.Frsize = stat.Bsize
+	}
+	usage := q.Usage()
+	if usage.MaxBytes > 0 {
+		blocks := uint64(usage.MaxBytes) / stat.Frsize
+		free := uint64(max(usage.MaxBytes-usage.Bytes, 0)) / stat.Frsize
+		if err == nil {
+			free = min(free, stat.Bavail)
+		}
+		stat.Blocks, stat.Bfree, stat.Bavail = blocks, free, free
+	}
+	if usage.MaxFiles > 0 {
+		free := uint64(max(usage.MaxFiles-usage.Files, 0))
+		stat.Files, stat.Ffree, stat.Favail = uint64(usage.MaxFiles), free, free
+	}
+	return stat, nil
+}
+
+// quotaReader counts the bytes of an upload and fails when they exceed the quota
+type quotaReader struct {
+	q        *QuotaFS
+	r        io.Reader
+	name     string
+	n        int64
+	quotaErr error
+}
+
+func (r *quotaReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if quotaErr := r.q.reserve("write", r.name, int64(n), 0); quotaErr != nil {
+			r.quotaErr = quotaErr
+			return 0, quotaErr
+		}
+		r.n += int64(n)
+	}
+	return n, err
+}
+
+// quotaWriter counts the growth of a file and fails the writes that exceed the quota
+type quotaWriter struct {
+	transferErrorForwarder
+	q        *QuotaFS
+	name     string
+	newFiles int64
+
+	lock   sync.Mutex // Protects size and closed
+	size   int64      // the counted size of the file
+	closed bool
+}
+
+func (w *quotaWriter) WriteAt(p []byte, off int64) (int, error) {
+	w.lock.Lock()
+	end := off + int64(len(p))
+	if end > w.size {
+		if err := w.q.reserve("write", w.name, end-w.size, 0); err != nil {
+			w.lock.Unlock()
+			return 0, err
+		}
+		w.size = end
+	}
+	w.lock.Unlock()
+	return w.w.WriteAt(p, off)
+}
+
+// Close closes the file and corrects the usage with the stored size
+func (w *quotaWriter) Close() error {
+	var err error
+	if closer, ok := w.w.(io.Closer); ok {
+		err = closer.Close()
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.closed {
+		return err
+	}
+	w.closed = true
+	size, exists := w.q.size(w.name)
+	var files int64
+	if !exists {
+		files = -w.newFiles
+	}
+	w.q.add(size-w.size, files)
+	return err
+}
+
+// UserQuotas gives every user a QuotaFS of its own file system, the file system of a user is opened
+// and scanned on its first use and then shared by all its sessions.
+// it is used as the UserFS of the ftp and sftp servers.
+type UserQuotas struct {
+	root     func(user string) (FS, error)
+	maxBytes int64
+	maxFiles int64
+
+	lock   sync.Mutex // Protects quotas
+	quotas map[string]*QuotaFS
+}
+
+// NewUserQuotas returns the quotas of maxBytes and maxFiles per user, 0 is unlimited.
+// root returns the file system of a user, e.g. a LocalFS of its home directory.
+func NewUserQuotas(root func(user string) (FS, error), maxBytes, maxFiles int64) *UserQuotas {
+	return &UserQuotas{root: root, maxBytes: maxBytes, maxFiles: maxFiles, quotas: make(map[string]*QuotaFS)}
+}
+
+// FS returns the file system with the quota of the user
+func (u *UserQuotas) FS(user string) (*QuotaFS, error) {
+	if user == "" || user == "." || user == ".." || strings.ContainsAny(user, `/\`) {
+		return nil, fmt.Errorf("quota of user %q: %w", user, fs.ErrInvalid)
+	}
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if q, ok := u.quotas[user]; ok {
+		return q, nil
+	}
+	fsys, err := u.root(user)
+	if err != nil {
+		return nil, fmt.Errorf("quota of user %q: %w", user, err)
+	}
+	q, err := NewQuotaFS(fsys, u.maxBytes, u.maxFiles)
+	if err != nil {
+		return nil, fmt.Errorf("quota of user %q: %w", user, err)
+	}
+	u.quotas[user] = q
+	return q, nil
+}
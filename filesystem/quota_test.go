@@ -0,0 +1,161 @@
+package filesystem
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestQuotaFS(t *testing.T) {
+	m := NewMemFS()
+	m.MakeDir("/dir")
+	writeMemFile(t, m, "/dir/a.txt", "12345")
+	q, err := NewQuotaFS(m, 20, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage := q.Usage(); usage.Bytes != 5 || usage.Files != 1 {
+		t.Fatalf("unexpected initial usage %+v", usage)
+	}
+
+	if err = q.WriteFile("/b.txt", strings.NewReader("1234567890"), "I", false); err != nil {
+		t.Fatal(err)
+	}
+	// the upload is rejected mid-stream and the partial file removed
+	err = q.WriteFile("/big.txt", bytes.NewReader(make([]byte, 100)), "I", false)
+	var quotaErr *QuotaError
+	if !errors.As(err, &quotaErr) || !errors.Is(err, syscall.ENOSPC) || quotaErr.Resource != "bytes" {
+		t.Fatalf("expected a bytes quota error, got %v", err)
+	}
+	if _, _, err = m.Stat("/big.txt"); err == nil {
+		t.Fatal("expected the partial file to be removed")
+	}
+	if usage := q.Usage(); usage.Bytes != 15 || usage.Files != 2 {
+		t.Fatalf("unexpected usage %+v", usage)
+	}
+
+	// overwriting releases the old content
+	if err = q.WriteFile("/b.txt", strings.NewReader("123456789012345"), "I", false); err != nil {
+		t.Fatal(err)
+	}
+	if err = q.Remove("/dir/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if usage := q.Usage(); usage.Bytes != 15 || usage.Files != 1 {
+		t.Fatalf("unexpected usage %+v", usage)
+	}
+
+	w, err := q.FileWrite("/c.bin", os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.WriteAt([]byte("12345"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.WriteAt([]byte("6"), 5); !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("expected a quota error, got %v", err)
+	}
+	w.(io.Closer).Close()
+	if err = q.Symlink("/link", "/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err = q.WriteFile("/d.txt", strings.NewReader(""), "I", false); !errors.As(err, &quotaErr) || quotaErr.Resource != "files" {
+		t.Fatalf("expected a files quota error, got %v", err)
+	}
+
+	stat, err := q.StatFS("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Files != 3 || stat.Ffree != 0 {
+		t.Fatalf("unexpected StatFS %+v", stat)
+	}
+
+	// a rename replacing a file releases it
+	if err = q.Rename("/c.bin", "/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if usage := q.Usage(); usage.Bytes != 5 || usage.Files != 2 {
+		t.Fatalf("unexpected usage %+v", usage)
+	}
+	// the scan counts the link with the size of its target
+	if err = q.Scan(); err != nil {
+		t.Fatal(err)
+	}
+	if usage := q.Usage(); usage.Bytes != 10 || usage.Files != 2 {
+		t.Fatalf("unexpected usage after a scan %+v", usage)
+	}
+}
+
+func TestQuotaFS_atomicOverwrite(t *testing.T) {
+	dir := t.TempDir()
+	l := NewLocalFS(dir)
+	l.AtomicWrites = true
+	if err := l.WriteFile("/a.txt", strings.NewReader("original"), "I", false); err != nil {
+		t.Fatal(err)
+	}
+	q, err := NewQuotaFS(l, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the rejected upload is discarded and the previous content kept
+	if err = q.WriteFile("/a.txt", bytes.NewReader(make([]byte, 100)), "I", false); !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("expected a quota error, got %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "a.txt"))
+	if err != nil || string(data) != "original" {
+		t.Fatalf("expected the original content, got %q, %v", data, err)
+	}
+	if usage := q.Usage(); usage.Bytes != 8 || usage.Files != 1 {
+		t.Fatalf("unexpected usage %+v", usage)
+	}
+}
+
+func TestUserQuotas(t *testing.T) {
+	dir := t.TempDir()
+	os.Mkdir(filepath.Join(dir, "alice"), 0755)
+	os.WriteFile(filepath.Join(dir, "alice", "a.txt"), []byte("12345"), 0644)
+	os.Mkdir(filepath.Join(dir, "bob"), 0755)
+	opened := 0
+	quotas := NewUserQuotas(func(user string) (FS, error) {
+		opened++
+		return NewLocalFS(filepath.Join(dir, user)), nil
+	}, 10, 0)
+
+	alice, err := quotas.FS("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage := alice.Usage(); usage.Bytes != 5 || usage.Files != 1 {
+		t.Fatalf("unexpected usage of alice %+v", usage)
+	}
+	bob, err := quotas.FS("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every user has the whole quota, the files of another user don't count
+	if err = bob.WriteFile("/b.txt", strings.NewReader("1234567890"), "I", false); err != nil {
+		t.Fatal(err)
+	}
+	if err = alice.WriteFile("/b.txt", strings.NewReader("1234567890"), "I", false); !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("expected the quota of alice to be exceeded, got %v", err)
+	}
+	if again, err := quotas.FS("alice"); err != nil || again != alice || opened != 2 {
+		t.Fatalf("expected the sessions of a user to share its quota, got %v %v %d", again == alice, err, opened)
+	}
+
+	for _, user := range []string{"", ".", "..", "../bob", `a\b`} {
+		if _, err = quotas.FS(user); !errors.Is(err, fs.ErrInvalid) {
+			t.Errorf("user %q: expected an invalid user error, got %v", user, err)
+		}
+	}
+	if opened != 2 {
+		t.Fatalf("expected the invalid users not to open a file system, got %d opens", opened)
+	}
+}
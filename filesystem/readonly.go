@@ -0,0 +1,155 @@
+package filesystem
+
+import (
+	"errors"
+	"fmt"
+	"github.com/pkg/sftp"
+	"io"
+	"io/fs"
+	"os"
+)
+
+// Ensure that ReadOnlyFS implements the FtpFS interface
+var _ NewFSWithReadWriteAt = &ReadOnlyFS{}
+
+// writeAccess are the open flags that modify a file
+const writeAccess = os.O_WRONLY | os.O_RDWR | os.O_CREATE | os.O_TRUNC | os.O_APPEND
+
+// PermissionError is returned for an operation denied by a file system policy like ReadOnlyFS or WORMFS,
+// it matches fs.ErrPermission so the protocols report it as a permission error
+type PermissionError struct {
+	// Op is the denied operation, e.g. "remove" or "rename"
+	Op string
+	// Path is the file the operation was denied on
+	Path string
+	// Reason explains why the operation is denied
+	Reason string
+}
+
+func (e *PermissionError) Error() string {
+	return fmt.Sprintf("%s %s: permission denied: %s", e.Op, e.Path, e.Reason)
+}
+
+// Is reports whether the target is fs.ErrPermission
+func (e *PermissionError) Is(target error) bool {
+	return target == fs.ErrPermission
+}
+
+// ReadOnlyFS wraps a file system and denies every operation that modifies it with a *PermissionError
+type ReadOnlyFS struct {
+	FS
+}
+
+// NewReadOnlyFS returns a read only view of the file system
+func NewReadOnlyFS(fsys FS) *ReadOnlyFS {
+	return &ReadOnlyFS{FS: fsys}
+}
+
+func (r *ReadOnlyFS) denied(op, path string) error {
+	return &PermissionError{Op: op, Path: path, Reason: "read only file system"}
+}
+
+// GetFS returns the fs.FS object of the wrapped file system, fs.FS is read only
+func (r *ReadOnlyFS) GetFS() fs.FS {
+	return getFS(r.FS)
+}
+
+// MakeDir is denied
+func (r *ReadOnlyFS) MakeDir(folderName string) error {
+	return r.denied("mkdir", folderName)
+}
+
+// WriteFile is denied
+func (r *ReadOnlyFS) WriteFile(fileName string, _ io.Reader, _ string, _ bool) error {
+	return r.denied("write", fileName)
+}
+
+// Remove is denied
+func (r *ReadOnlyFS) Remove(fileName string) error {
+	return r.denied("remove", fileName)
+}
+
+// Rename is denied
+func (r *ReadOnlyFS) Rename(original string, _ string) error {
+	return r.denied("rename", original)
+}
+
+// ModifyTime is denied
+func (r *ReadOnlyFS) ModifyTime(filePath string, _ string) error {
+	return r.denied("chtimes", filePath)
+}
+
+// SetStat is denied
+func (r *ReadOnlyFS) SetStat(fileName string, _ os.FileMode) error {
+	return r.denied("chmod", fileName)
+}
+
+// Link is denied
+func (r *ReadOnlyFS) Link(fileName string, _ string) error {
+	return r.denied("link", fileName)
+}
+
+// Symlink is denied
+func (r *ReadOnlyFS) Symlink(fileName string, _ string) error {
+	return r.denied("symlink", fileName)
+}
+
+// FileWrite is denied
+func (r *ReadOnlyFS) FileWrite(fileName string, _ int) (io.WriterAt, error) {
+	return nil, r.denied("write", fileName)
+}
+
+// FileRead opens the file of the wrapped file system, opening it for writing is denied
+func (r *ReadOnlyFS) FileRead(fileName string, access int) (io.ReaderAt, error) {
+	if access&writeAccess != 0 {
+		return nil, r.denied("open", fileName)
+	}
+	return fileRead(r.FS, fileName, access)
+}
+
+// StatFS returns the file system status of the wrapped file system
+func (r *ReadOnlyFS) StatFS(path string) (*sftp.StatVFS, error) {
+	return statFS(r.FS, path)
+}
+
+// getFS returns the fs.FS of a file system implementing NewFS
+func getFS(fsys FS) fs.FS {
+	if newFS, ok := fsys.(NewFS); ok {
+		return newFS.GetFS()
+	}
+	return unsupportedFS{}
+}
+
+// fileRead opens a file of a file system implementing FSWithReadWriteAt
+func fileRead(fsys FS, fileName string, access int) (io.ReaderAt, error) {
+	rw, ok := fsys.(FSWithReadWriteAt)
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: fileName, Err: errors.ErrUnsupported}
+	}
+	return rw.FileRead(fileName, access)
+}
+
+// fileWrite opens a file of a file system implementing FSWithReadWriteAt
+func fileWrite(fsys FS, fileName string, access int) (io.WriterAt, error) {
+	rw, ok := fsys.(FSWithReadWriteAt)
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: fileName, Err: errors.ErrUnsupported}
+	}
+	return rw.FileWrite(fileName, access)
+}
+
+// statFS returns the status of a file system implementing FSWithReadWriteAt
+func statFS(fsys FS, path string) (*sftp.StatVFS, error) {
+	rw, ok := fsys.(FSWithReadWriteAt)
+	if !ok {
+		return nil, &fs.PathError{Op: "statfs", Path: path, Err: errors.ErrUnsupported}
+	}
+	return rw.StatFS(path)
+}
+
+// unsupportedFS is the fs.FS of a wrapped file system that doesn't implement NewFS
+type unsupportedFS struct{}
+
+func (unsupportedFS) Open(name string) (fs.File, error) {
+	return nil, &fs.PathError{Op: "open", Path: name, Err: errors.ErrUnsupported}
+}
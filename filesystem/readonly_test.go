@@ -0,0 +1,50 @@
+package filesystem
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestReadOnlyFS(t *testing.T) {
+	m := NewMemFS()
+	writeMemFile(t, m, "/a.txt", "hello")
+	r := NewReadOnlyFS(m)
+
+	denied := map[string]error{
+		"MakeDir":    r.MakeDir("/dir"),
+		"WriteFile":  r.WriteFile("/b.txt", strings.NewReader(""), "I", false),
+		"Remove":     r.Remove("/a.txt"),
+		"Rename":     r.Rename("/a.txt", "/b.txt"),
+		"ModifyTime": r.ModifyTime("/a.txt", "20200102030405"),
+		"SetStat":    r.SetStat("/a.txt", 0600),
+		"Link":       r.Link("/b.txt", "/a.txt"),
+		"Symlink":    r.Symlink("/b.txt", "/a.txt"),
+	}
+	_, denied["FileWrite"] = r.FileWrite("/a.txt", os.O_WRONLY)
+	_, denied["FileRead"] = r.FileRead("/a.txt", os.O_RDWR)
+	for method, err := range denied {
+		var permErr *PermissionError
+		if !errors.As(err, &permErr) || !errors.Is(err, fs.ErrPermission) {
+			t.Errorf("%s: expected a permission error, got %v", method, err)
+		}
+	}
+
+	if got := readMemFile(t, m, "/a.txt"); got != "hello" {
+		t.Fatalf("the file was changed to %q", got)
+	}
+	reader, err := r.FileRead("/a.txt", os.O_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err = reader.ReadAt(buf, 0); (err != nil && err != io.EOF) || string(buf) != "hello" {
+		t.Fatalf("got %q, %v", buf, err)
+	}
+	if data, err := fs.ReadFile(r.GetFS(), "a.txt"); err != nil || string(data) != "hello" {
+		t.Fatalf("got %q, %v", data, err)
+	}
+}
@@ -0,0 +1,360 @@
+package filesystem
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// s3Client is a minimal S3 client signing the requests with AWS signature version 4, it uses path style urls
+type s3Client struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	http      *http.Client
+	now       func() time.Time
+}
+
+// s3Error is an error response of the S3 api
+type s3Error struct {
+	StatusCode int    `xml:"-"`
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+	Key        string `xml:"Key"`
+}
+
+func (e *s3Error) Error() string {
+	return fmt.Sprintf("s3: %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// Is maps the missing objects to fs.ErrNotExist
+func (e *s3Error) Is(target error) bool {
+	switch target {
+	case fs.ErrNotExist:
+		return e.StatusCode == http.StatusNotFound
+	case fs.ErrPermission:
+		return e.StatusCode == http.StatusForbidden
+	}
+	return false
+}
+
+// s3ListResult is the response of ListObjectsV2
+type s3ListResult struct {
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+	Contents              []struct {
+		Key          string    `xml:"Key"`
+		LastModified time.Time `xml:"LastModified"`
+		Size         int64     `xml:"Size"`
+	} `xml:"Contents"`
+	CommonPrefixes []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+}
+
+// s3Part is an uploaded part of a multipart upload
+type s3Part struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// s3Escape encodes a string like the S3 canonical request, every byte except the unreserved characters is escaped
+func s3Escape(s string, keepSlash bool) string {
+	const hexDigits = "0123456789ABCDEF"
+	b := strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && keepSlash:
+			b.WriteByte(c)
+		default:
+			b.WriteByte('%')
+			b.WriteByte(hexDigits[c>>4])
+			b.WriteByte(hexDigits[c&15])
+		}
+	}
+	return b.String()
+}
+
+// s3CanonicalQuery returns the sorted and encoded query string
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		values := append([]string{}, query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, s3Escape(k, false)+"="+s3Escape(v, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Signature returns the signed headers and the version 4 signature of a request,
+// every header of the request and the host are signed.
+func s3Signature(req *http.Request, region, secretKey, amzDate, payloadHash string) (signedHeaders, scope, signature string) {
+	headers := map[string]string{"host": req.Host}
+	if req.Host == "" {
+		headers["host"] = req.URL.Host
+	}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if name == "authorization" {
+			continue
+		}
+		trimmed := make([]string, len(values))
+		for i, v := range values {
+			trimmed[i] = strings.Join(strings.Fields(v), " ")
+		}
+		headers[name] = strings.Join(trimmed, ",")
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	canonicalHeaders := strings.Builder{}
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders = strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	hash := sha256.Sum256([]byte(canonicalRequest))
+
+	day := amzDate[:8]
+	scope = day + "/" + region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), day)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return signedHeaders, scope, hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+// sign adds the date, payload hash and authorization headers to the request
+func (c *s3Client) sign(req *http.Request, payloadHash string) {
+	amzDate := c.now().UTC().Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	signedHeaders, scope, signature := s3Signature(req, c.region, c.secretKey, amzDate, payloadHash)
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+c.accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+// objectURL returns the path style url of an object, an empty key is the bucket
+func (c *s3Client) objectURL(key string, query url.Values) *url.URL {
+	u := *c.endpoint
+	base := strings.TrimSuffix(u.Path, "/") + "/" + c.bucket
+	u.Path = base
+	u.RawPath = s3Escape(base, true)
+	if key != "" {
+		u.Path += "/" + key
+		u.RawPath += "/" + s3Escape(key, true)
+	}
+	u.RawQuery = s3CanonicalQuery(query)
+	return &u
+}
+
+// do sends a signed request, error responses are returned as *s3Error
+func (c *s3Client) do(method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.objectURL(key, query).String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("s3: creating request: %w", err)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	hash := sha256.Sum256(body)
+	c.sign(req, hex.EncodeToString(hash[:]))
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("s3: %s %s: %w", method, key, err)
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		return nil, readS3Error(resp)
+	}
+	return resp, nil
+}
+
+// readS3Error parses the error body of a response
+func readS3Error(resp *http.Response) error {
+	s3Err := &s3Error{StatusCode: resp.StatusCode, Code: http.StatusText(resp.StatusCode)}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if len(data) > 0 {
+		_ = xml.Unmarshal(data, s3Err)
+	}
+	return s3Err
+}
+
+// doXML sends a request and decodes the xml response into v
+func (c *s3Client) doXML(method, key string, query url.Values, header http.Header, body []byte, v any) error {
+	resp, err := c.do(method, key, query, header, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("s3: reading response: %w", err)
+	}
+	// copy and complete requests may fail after the 200 status was sent
+	if bytes.Contains(data, []byte("<Error>")) {
+		s3Err := &s3Error{StatusCode: http.StatusInternalServerError}
+		if xml.Unmarshal(data, s3Err) == nil {
+			return s3Err
+		}
+	}
+	if v == nil {
+		return nil
+	}
+	if err = xml.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("s3: decoding response: %w", err)
+	}
+	return nil
+}
+
+// headObject returns the size, modification time and the headers of an object
+func (c *s3Client) headObject(key string) (int64, time.Time, http.Header, error) {
+	resp, err := c.do(http.MethodHead, key, nil, nil, nil)
+	if err != nil {
+		return 0, time.Time{}, nil, err
+	}
+	resp.Body.Close()
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if mtime, err := strconv.ParseInt(resp.Header.Get("X-Amz-Meta-Mtime"), 10, 64); err == nil {
+		modTime = time.Unix(mtime, 0)
+	}
+	return resp.ContentLength, modTime, resp.Header, nil
+}
+
+// getObject returns the content of an object from the offset, length < 0 reads to the end
+func (c *s3Client) getObject(key string, offset, length int64) (io.ReadCloser, error) {
+	header := http.Header{}
+	if length >= 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	} else if offset > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := c.do(http.MethodGet, key, nil, header, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// putObject uploads an object in a single request
+func (c *s3Client) putObject(key string, data []byte) error {
+	return c.doXML(http.MethodPut, key, nil, nil, data, nil)
+}
+
+// copyObject copies an object inside the bucket, header can replace the metadata
+func (c *s3Client) copyObject(src, dst string, header http.Header) error {
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set("X-Amz-Copy-Source", "/"+c.bucket+"/"+s3Escape(src, true))
+	return c.doXML(http.MethodPut, dst, nil, header, nil, nil)
+}
+
+// deleteObject deletes an object
+func (c *s3Client) deleteObject(key string) error {
+	return c.doXML(http.MethodDelete, key, nil, nil, nil, nil)
+}
+
+// listObjects lists one page of the objects starting with the prefix
+func (c *s3Client) listObjects(prefix, delimiter, token string, maxKeys int) (*s3ListResult, error) {
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	if delimiter != "" {
+		query.Set("delimiter", delimiter)
+	}
+	if token != "" {
+		query.Set("continuation-token", token)
+	}
+	if maxKeys > 0 {
+		query.Set("max-keys", strconv.Itoa(maxKeys))
+	}
+	result := &s3ListResult{}
+	if err := c.doXML(http.MethodGet, "", query, nil, nil, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// createMultipartUpload starts a multipart upload and returns its id
+func (c *s3Client) createMultipartUpload(key string) (string, error) {
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := c.doXML(http.MethodPost, key, url.Values{"uploads": {""}}, nil, nil, &result); err != nil {
+		return "", err
+	}
+	if result.UploadID == "" {
+		return "", errors.New("s3: missing upload id")
+	}
+	return result.UploadID, nil
+}
+
+// uploadPart uploads a part of a multipart upload
+func (c *s3Client) uploadPart(key, uploadID string, number int, data []byte) (s3Part, error) {
+	query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadID}}
+	resp, err := c.do(http.MethodPut, key, query, nil, data)
+	if err != nil {
+		return s3Part{}, err
+	}
+	resp.Body.Close()
+	return s3Part{PartNumber: number, ETag: resp.Header.Get("ETag")}, nil
+}
+
+// completeMultipartUpload assembles the uploaded parts into the object
+func (c *s3Client) completeMultipartUpload(key, uploadID string, parts []s3Part) error {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return fmt.Errorf("s3: encoding parts: %w", err)
+	}
+	return c.doXML(http.MethodPost, key, url.Values{"uploadId": {uploadID}}, nil, body, nil)
+}
+
+// abortMultipartUpload discards the uploaded parts
+func (c *s3Client) abortMultipartUpload(key, uploadID string) error {
+	return c.doXML(http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil, nil, nil)
+}
@@ -0,0 +1,835 @@
+package filesystem
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/pkg/sftp"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Ensure that S3FS implements the FtpFS interface
+var _ NewFSWithReadWriteAt = &S3FS{}
+
+const (
+	// s3MinPartSize is the smallest part S3 accepts in a multipart upload, except for the last one
+	s3MinPartSize = 5 << 20
+	// s3DefaultPartSize is the part size when S3Config.PartSize is 0
+	s3DefaultPartSize = 8 << 20
+	// s3ReadAhead is the minimum size of the ranged GETs of FileRead
+	s3ReadAhead = 1 << 20
+	// s3MaxPending is the memory held for out of order writes before FileWrite fails
+	s3MaxPending = 64 << 20
+)
+
+// s3DirTime is the modification time of the directories, prefixes have none
+var s3DirTime = time.Unix(0, 0).UTC()
+
+// S3Config is the configuration of an S3 compatible bucket
+type S3Config struct {
+	// Endpoint is the url of the S3 service, e.g. "https://s3.us-east-1.amazonaws.com" or "http://localhost:9000"
+	Endpoint string
+	// Region is the signing region, empty uses "us-east-1"
+	Region string
+	// Bucket is the bucket name, objects are addressed path style
+	Bucket string
+	// Prefix is the key prefix the file system is rooted at, empty serves the whole bucket
+	Prefix string
+	// AccessKey and SecretKey are the credentials
+	AccessKey string
+	SecretKey string
+	// PartSize is the size of the multipart upload parts, at least 5MB, empty uses 8MB
+	PartSize int64
+	// HTTPClient is the client used for the requests, empty uses http.DefaultClient
+	HTTPClient *http.Client
+}
+
+// S3FS is a file system stored in an S3 compatible bucket.
+// directories are emulated with empty "dir/" marker objects, a prefix with objects is a directory as well.
+// the bucket has no links, permissions or atomic renames:
+// Link and Symlink fail with errors.ErrUnsupported, SetStat is accepted and ignored,
+// Rename copies and deletes every object, ModifyTime stores the time in the x-amz-meta-mtime metadata which Stat reports,
+// and FileWrite always rewrites the object from the start.
+type S3FS struct {
+	client   *s3Client
+	prefix   string
+	partSize int64
+}
+
+// NewS3FS returns a file system for the bucket
+func NewS3FS(config S3Config) (*S3FS, error) {
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid s3 endpoint %q: %w", config.Endpoint, err)
+	}
+	if config.Bucket == "" {
+		return nil, errors.New("the s3 bucket is required")
+	}
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+	if config.HTTPClient == nil {
+		config.HTTPClient = http.DefaultClient
+	}
+	if config.PartSize == 0 {
+		config.PartSize = s3DefaultPartSize
+	}
+	if config.PartSize < s3MinPartSize {
+		return nil, fmt.Errorf("the s3 part size must be at least %d bytes", s3MinPartSize)
+	}
+	prefix := strings.Trim(config.Prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return &S3FS{
+		client: &s3Client{
+			endpoint:  endpoint,
+			region:    config.Region,
+			bucket:    config.Bucket,
+			accessKey: config.AccessKey,
+			secretKey: config.SecretKey,
+			http:      config.HTTPClient,
+			now:       time.Now,
+		},
+		prefix:   prefix,
+		partSize: config.PartSize,
+	}, nil
+}
+
+// RootDir returns the Root directory of the file system
+func (s *S3FS) RootDir() string {
+	return "/"
+}
+
+// GetFS returns the fs.FS object
+func (s *S3FS) GetFS() fs.FS {
+	return s3IOFS{s: s}
+}
+
+// cleanName returns the absolute clean path
+func cleanName(name string) string {
+	return path.Clean("/" + name)
+}
+
+// key returns the object key of a file, the root is the prefix
+func (s *S3FS) key(name string) string {
+	name = cleanName(name)
+	if name == "/" {
+		return s.prefix
+	}
+	return s.prefix + name[1:]
+}
+
+// dirKey returns the key prefix of the objects in a directory, it is also the key of the directory marker
+func (s *S3FS) dirKey(name string) string {
+	key := s.key(name)
+	if key == "" || strings.HasSuffix(key, "/") {
+		return key
+	}
+	return key + "/"
+}
+
+// stat returns the info of a file or a directory
+func (s *S3FS) stat(op, name string) (*fileInfo, error) {
+	base := path.Base(cleanName(name))
+	if cleanName(name) == "/" {
+		return &fileInfo{name: ".", mode: fs.ModeDir | 0755, modTime: s3DirTime}, nil
+	}
+
+	size, modTime, _, err := s.client.headObject(s.key(name))
+	if err == nil {
+		return &fileInfo{name: base, size: size, mode: 0644, modTime: modTime}, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+
+	// a directory is a marker object or any object under its prefix
+	result, err := s.client.listObjects(s.dirKey(name), "", "", 1)
+	if err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	if len(result.Contents) == 0 {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return &fileInfo{name: base, mode: fs.ModeDir | 0755, modTime: s3DirTime}, nil
+}
+
+// list returns the files and directories of a directory sorted by name
+func (s *S3FS) list(dirName string) ([]*fileInfo, error) {
+	prefix := s.dirKey(dirName)
+	var infos []*fileInfo
+	token := ""
+	for {
+		result, err := s.client.listObjects(prefix, "/", token, 0)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range result.CommonPrefixes {
+			name := strings.TrimSuffix(strings.TrimPrefix(p.Prefix, prefix), "/")
+			infos = append(infos, &fileInfo{name: name, mode: fs.ModeDir | 0755, modTime: s3DirTime})
+		}
+		for _, object := range result.Contents {
+			if object.Key == prefix {
+				// the marker of the directory itself
+				continue
+			}
+			name := strings.TrimPrefix(object.Key, prefix)
+			// listings have milliseconds, the Last-Modified header of Stat only seconds
+			infos = append(infos, &fileInfo{name: name, size: object.Size, mode: 0644, modTime: object.LastModified.Truncate(time.Second)})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].name < infos[j].name
+	})
+	return infos, nil
+}
+
+// keys returns every object key under the prefix
+func (s *S3FS) keys(prefix string) ([]string, error) {
+	var keys []string
+	token := ""
+	for {
+		result, err := s.client.listObjects(prefix, "", token, 0)
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range result.Contents {
+			keys = append(keys, object.Key)
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return keys, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// CheckDir checks if the given directory exists
+func (s *S3FS) CheckDir(dirName string) error {
+	info, err := s.stat("open", dirName)
+	if err == nil && !info.IsDir() {
+		err = &fs.PathError{Op: "open", Path: dirName, Err: syscall.ENOTDIR}
+	}
+	if err != nil {
+		return fmt.Errorf("error checking directory: %w", err)
+	}
+	return nil
+}
+
+// Dir returns a list of files in the given directory
+func (s *S3FS) Dir(dirName string) ([]string, []os.FileInfo, error) {
+	if err := s.CheckDir(dirName); err != nil {
+		return nil, nil, fmt.Errorf("error reading directory: %w", err)
+	}
+	infos, err := s.list(dirName)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading directory: %w", err)
+	}
+
+	lines := make([]string, len(infos))
+	fileList := make([]os.FileInfo, len(infos))
+	for i, info := range infos {
+		lines[i] = fileInfoLine(info)
+		fileList[i] = info
+	}
+	return lines, fileList, nil
+}
+
+// MakeDir creates the marker objects of the directory and its missing parents
+func (s *S3FS) MakeDir(folderName string) error {
+	current := "/"
+	for _, part := range strings.Split(cleanName(folderName), "/")[1:] {
+		if part == "" {
+			continue
+		}
+		current = path.Join(current, part)
+		info, err := s.stat("mkdir", current)
+		if err == nil && !info.IsDir() {
+			return fmt.Errorf("error creating directory: %w", &fs.PathError{Op: "mkdir", Path: folderName, Err: syscall.ENOTDIR})
+		}
+		if err == nil && info.IsDir() {
+			continue
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("error creating directory: %w", err)
+		}
+		if err = s.client.putObject(s.dirKey(current), nil); err != nil {
+			return fmt.Errorf("error creating directory: %w", err)
+		}
+	}
+	return nil
+}
+
+// ReadFile reads the file and writes it to the given writer
+func (s *S3FS) ReadFile(name string, w io.Writer) (int64, error) {
+	body, err := s.client.getObject(s.key(name), 0, -1)
+	if err != nil {
+		return 0, fmt.Errorf("error opening file: %w", &fs.PathError{Op: "open", Path: name, Err: err})
+	}
+	defer body.Close()
+	n, err := io.Copy(w, body)
+	if err != nil {
+		return n, fmt.Errorf("error reading file: %w", err)
+	}
+	return n, nil
+}
+
+// WriteFile uploads the data from the reader, appending downloads the existing content and uploads it again
+func (s *S3FS) WriteFile(fileName string, r io.Reader, transferType string, appendOnly bool) error {
+	if transferType == "A" { // ASCII mode
+		pr, pw := io.Pipe()
+		go func(r io.Reader) {
+			scanner := bufio.NewScanner(r)
+			w := bufio.NewWriter(pw)
+			for scanner.Scan() {
+				w.WriteString(scanner.Text())
+				w.WriteByte('\n')
+			}
+			err := scanner.Err()
+			if err == nil {
+				err = w.Flush()
+			}
+			pw.CloseWithError(err)
+		}(r)
+		defer pr.Close()
+		r = pr
+	} else if transferType != "I" {
+		return fmt.Errorf("unsupported transfer type: %s, only type 'A' (text) or type 'I' (binary)", transferType)
+	}
+
+	key := s.key(fileName)
+	if appendOnly {
+		existing, err := s.client.getObject(key, 0, -1)
+		if err == nil {
+			defer existing.Close()
+			r = io.MultiReader(existing, r)
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("creating file error: %w", err)
+		}
+	}
+
+	w := s.newWriter(key)
+	if _, err := io.Copy(w, r); err != nil {
+		w.abort()
+		return fmt.Errorf("writing file error: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("closing and saving file error: %w", err)
+	}
+	return nil
+}
+
+// Remove removes the file or the empty directory
+func (s *S3FS) Remove(fileName string) error {
+	info, err := s.stat("remove", fileName)
+	if err != nil {
+		return fmt.Errorf("error removing file: %w", err)
+	}
+	if !info.IsDir() {
+		if err = s.client.deleteObject(s.key(fileName)); err != nil {
+			return fmt.Errorf("error removing file: %w", err)
+		}
+		return nil
+	}
+
+	marker := s.dirKey(fileName)
+	if marker == s.prefix {
+		return fmt.Errorf("error removing file: %w", &fs.PathError{Op: "remove", Path: fileName, Err: fs.ErrPermission})
+	}
+	result, err := s.client.listObjects(marker, "", "", 2)
+	if err != nil {
+		return fmt.Errorf("error removing file: %w", err)
+	}
+	for _, object := range result.Contents {
+		if object.Key != marker {
+			return fmt.Errorf("error removing file: %w", &fs.PathError{Op: "remove", Path: fileName, Err: syscall.ENOTEMPTY})
+		}
+	}
+	if err = s.client.deleteObject(marker); err != nil {
+		return fmt.Errorf("error removing file: %w", err)
+	}
+	return nil
+}
+
+// Rename copies the file or every object of the directory to the new name and deletes the originals, it isn't atomic
+func (s *S3FS) Rename(original string, target string) error {
+	renameErr := func(err error) error {
+		return fmt.Errorf("error renaming file: %w", &os.LinkError{Op: "rename", Old: original, New: target, Err: err})
+	}
+	info, err := s.stat("rename", original)
+	if err != nil {
+		return fmt.Errorf("error renaming file: %w", err)
+	}
+	if cleanName(original) == cleanName(target) {
+		return nil
+	}
+	targetInfo, err := s.stat("rename", target)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("error renaming file: %w", err)
+	}
+
+	if !info.IsDir() {
+		if targetInfo != nil && targetInfo.IsDir() {
+			return renameErr(syscall.EISDIR)
+		}
+		if err = s.client.copyObject(s.key(original), s.key(target), nil); err != nil {
+			return renameErr(err)
+		}
+		if err = s.client.deleteObject(s.key(original)); err != nil {
+			return renameErr(err)
+		}
+		return nil
+	}
+
+	from, to := s.dirKey(original), s.dirKey(target)
+	if from == s.prefix || strings.HasPrefix(to, from) {
+		return renameErr(syscall.EINVAL)
+	}
+	if targetInfo != nil {
+		return renameErr(fs.ErrExist)
+	}
+	keys, err := s.keys(from)
+	if err != nil {
+		return renameErr(err)
+	}
+	for _, key := range keys {
+		if err = s.client.copyObject(key, to+strings.TrimPrefix(key, from), nil); err != nil {
+			return renameErr(err)
+		}
+		if err = s.client.deleteObject(key); err != nil {
+			return renameErr(err)
+		}
+	}
+	return nil
+}
+
+// ModifyTime stores the modification time in the object metadata, directories are ignored
+func (s *S3FS) ModifyTime(filePath string, newTime string) error {
+	newTimeP, err := time.Parse("20060102150405", newTime)
+	if err != nil {
+		return fmt.Errorf("501 Invalid time format got '%s' expected 'YYYYMMDDHHMMSS'", newTime)
+	}
+	info, err := s.stat("chtimes", filePath)
+	if err != nil {
+		return fmt.Errorf("error getting file info: %w", err)
+	}
+	if info.IsDir() {
+		return nil
+	}
+	header := http.Header{}
+	header.Set("X-Amz-Metadata-Directive", "REPLACE")
+	header.Set("X-Amz-Meta-Mtime", strconv.FormatInt(newTimeP.Unix(), 10))
+	if err = s.client.copyObject(s.key(filePath), s.key(filePath), header); err != nil {
+		return fmt.Errorf("error changing file modification time: %w", err)
+	}
+	return nil
+}
+
+// Stat returns the file info
+func (s *S3FS) Stat(fileName string) (string, fs.FileInfo, error) {
+	info, err := s.stat("stat", fileName)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return "", nil, err
+		}
+		return "", nil, fmt.Errorf("error getting file info: %w", err)
+	}
+	return fileInfoLine(info), info, nil
+}
+
+// Lstat returns the file info, objects are never links
+func (s *S3FS) Lstat(fileName string) (string, fs.FileInfo, error) {
+	return s.Stat(fileName)
+}
+
+// SetStat checks the file exists, objects have no permissions so the mode is ignored
+func (s *S3FS) SetStat(fileName string, newPermissions os.FileMode) error {
+	if _, err := s.stat("chmod", fileName); err != nil {
+		return fmt.Errorf("error changing file permissions: %w", err)
+	}
+	return nil
+}
+
+// Link isn't supported, objects can't share their content
+func (s *S3FS) Link(fileName string, target string) error {
+	return &os.LinkError{Op: "link", Old: target, New: fileName, Err: errors.ErrUnsupported}
+}
+
+// Symlink isn't supported, the bucket has no links
+func (s *S3FS) Symlink(fileName string, target string) error {
+	return &os.LinkError{Op: "symlink", Old: target, New: fileName, Err: errors.ErrUnsupported}
+}
+
+// FileWrite returns a writer uploading the file with a multipart upload when it is closed,
+// the object is always rewritten from the start and out of order writes are buffered.
+func (s *S3FS) FileWrite(fileName string, access int) (io.WriterAt, error) {
+	if access&os.O_APPEND != 0 {
+		return nil, fmt.Errorf("creating file error: %w", &fs.PathError{Op: "open", Path: fileName, Err: errors.ErrUnsupported})
+	}
+	info, err := s.stat("open", fileName)
+	switch {
+	case err != nil && !errors.Is(err, fs.ErrNotExist):
+		return nil, fmt.Errorf("creating file error: %w", err)
+	case err != nil && access&os.O_CREATE == 0:
+		return nil, fmt.Errorf("creating file error: %w", err)
+	case err == nil && info.IsDir():
+		return nil, fmt.Errorf("creating file error: %w", &fs.PathError{Op: "open", Path: fileName, Err: syscall.EISDIR})
+	case err == nil && access&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, fmt.Errorf("creating file error: %w", &fs.PathError{Op: "open", Path: fileName, Err: fs.ErrExist})
+	}
+	return s.newWriter(s.key(fileName)), nil
+}
+
+// FileRead returns a reader of the file using ranged GETs
+func (s *S3FS) FileRead(fileName string, access int) (io.ReaderAt, error) {
+	info, err := s.stat("open", fileName)
+	if err == nil && info.IsDir() {
+		err = &fs.PathError{Op: "read", Path: fileName, Err: syscall.EISDIR}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("creating file error: %w", err)
+	}
+	return &s3File{s: s, key: s.key(fileName), path: fileName, info: info}, nil
+}
+
+// StatFS returns a synthetic status, buckets have no size limit
+func (s *S3FS) StatFS(path string) (*sftp.StatVFS, error) {
+	const blocks = 1 << 38 // 1PB of 4KB blocks
+	return &sftp.StatVFS{
+		Bsize:   4096,
+		Frsize:  4096,
+		Blocks:  blocks,
+		Bfree:   blocks,
+		Bavail:  blocks,
+		Files:   blocks,
+		Ffree:   blocks,
+		Favail:  blocks,
+		Namemax: 1024,
+	}, nil
+}
+
+// s3Writer uploads the written data in parts, writes after the end are held until the gap is filled
+type s3Writer struct {
+	s        *S3FS
+	key      string
+	lock     sync.Mutex
+	uploadID string
+	parts    []s3Part
+	uploaded int64            // bytes uploaded in the parts
+	buf      []byte           // contiguous data after the uploaded parts
+	pending  map[int64][]byte // data written after the end of buf
+	held     int              // size of the pending data
+	err      error
+	closed   bool
+}
+
+func (s *S3FS) newWriter(key string) *s3Writer {
+	return &s3Writer{s: s, key: key, pending: map[int64][]byte{}}
+}
+
+// Write appends to the file
+func (w *s3Writer) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	off := w.uploaded + int64(len(w.buf))
+	w.lock.Unlock()
+	return w.WriteAt(p, off)
+}
+
+// WriteAt writes at the offset, the parts already uploaded can't be rewritten
+func (w *s3Writer) WriteAt(p []byte, off int64) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.closed {
+		return 0, fs.ErrClosed
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	end := w.uploaded + int64(len(w.buf))
+	switch {
+	case off < w.uploaded:
+		w.err = fmt.Errorf("s3: offset %d was already uploaded: %w", off, errors.ErrUnsupported)
+		return 0, w.err
+	case off > end:
+		if w.held+len(p) > s3MaxPending {
+			w.err = fmt.Errorf("s3: too much data written out of order: %w", errors.ErrUnsupported)
+			return 0, w.err
+		}
+		w.pending[off] = append([]byte{}, p...)
+		w.held += len(p)
+		return len(p), nil
+	}
+	n := copy(w.buf[off-w.uploaded:], p)
+	w.buf = append(w.buf, p[n:]...)
+
+	// move the pending writes that became contiguous
+	for len(w.pending) > 0 {
+		end = w.uploaded + int64(len(w.buf))
+		moved := false
+		for pendingOff, data := range w.pending {
+			if pendingOff <= end {
+				delete(w.pending, pendingOff)
+				w.held -= len(data)
+				if pendingOff+int64(len(data)) > end {
+					start := pendingOff - w.uploaded
+					n = copy(w.buf[start:], data)
+					w.buf = append(w.buf, data[n:]...)
+				} else {
+					copy(w.buf[pendingOff-w.uploaded:], data)
+				}
+				moved = true
+			}
+		}
+		if !moved {
+			break
+		}
+	}
+
+	for int64(len(w.buf)) >= w.s.partSize {
+		if err := w.uploadPart(w.buf[:w.s.partSize]); err != nil {
+			w.err = err
+			return 0, err
+		}
+		w.buf = append([]byte{}, w.buf[w.s.partSize:]...)
+	}
+	return len(p), nil
+}
+
+func (w *s3Writer) uploadPart(data []byte) error {
+	var err error
+	if w.uploadID == "" {
+		w.uploadID, err = w.s.client.createMultipartUpload(w.key)
+		if err != nil {
+			return err
+		}
+	}
+	part, err := w.s.client.uploadPart(w.key, w.uploadID, len(w.parts)+1, data)
+	if err != nil {
+		return err
+	}
+	w.parts = append(w.parts, part)
+	w.uploaded += int64(len(data))
+	return nil
+}
+
+// abort discards the uploaded parts
+func (w *s3Writer) abort() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.closed = true
+	if w.uploadID != "" {
+		_ = w.s.client.abortMultipartUpload(w.key, w.uploadID)
+	}
+}
+
+// TransferError marks the upload as failed, Close then aborts it and keeps the previous object.
+// the sftp request server calls it for the files open when the connection is lost.
+func (w *s3Writer) TransferError(err error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.err == nil {
+		w.err = fmt.Errorf("s3: transfer of %s failed: %w", w.key, err)
+	}
+}
+
+// Close uploads the remaining data and completes the upload, nothing is stored if a write or the transfer failed
+func (w *s3Writer) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.closed {
+		return fs.ErrClosed
+	}
+	w.closed = true
+
+	err := w.err
+	if err == nil && len(w.pending) > 0 {
+		err = fmt.Errorf("s3: missing data at offset %d", w.uploaded+int64(len(w.buf)))
+	}
+	if err == nil && w.uploadID == "" {
+		return w.s.client.putObject(w.key, w.buf)
+	}
+	if err == nil && len(w.buf) > 0 {
+		err = w.uploadPart(w.buf)
+	}
+	if err == nil {
+		err = w.s.client.completeMultipartUpload(w.key, w.uploadID, w.parts)
+	}
+	if err != nil && w.uploadID != "" {
+		_ = w.s.client.abortMultipartUpload(w.key, w.uploadID)
+	}
+	return err
+}
+
+// s3File is an open file or directory, it implements fs.File, fs.ReadDirFile, io.Seeker and io.ReaderAt
+type s3File struct {
+	s    *S3FS
+	key  string
+	path string
+	info *fileInfo
+
+	lock      sync.Mutex // Protects the fields below
+	window    []byte     // the last ranged GET
+	windowOff int64
+	offset    int64
+	entries   []*fileInfo
+	dirRead   int
+	closed    bool
+}
+
+// ReadAt reads with ranged GETs of at least s3ReadAhead bytes
+func (f *s3File) ReadAt(p []byte, off int64) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.readAt(p, off)
+}
+
+func (f *s3File) readAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, &fs.PathError{Op: "read", Path: f.path, Err: fs.ErrClosed}
+	}
+	if f.info.IsDir() {
+		return 0, &fs.PathError{Op: "read", Path: f.path, Err: syscall.EISDIR}
+	}
+	if off < 0 {
+		return 0, &fs.PathError{Op: "read", Path: f.path, Err: fs.ErrInvalid}
+	}
+	if off >= f.info.size {
+		return 0, io.EOF
+	}
+
+	want := min(int64(len(p)), f.info.size-off)
+	if off < f.windowOff || off+want > f.windowOff+int64(len(f.window)) {
+		length := min(max(want, s3ReadAhead), f.info.size-off)
+		body, err := f.s.client.getObject(f.key, off, length)
+		if err != nil {
+			return 0, &fs.PathError{Op: "read", Path: f.path, Err: err}
+		}
+		window, err := io.ReadAll(body)
+		body.Close()
+		if err != nil {
+			return 0, &fs.PathError{Op: "read", Path: f.path, Err: err}
+		}
+		f.window, f.windowOff = window, off
+	}
+	n := copy(p, f.window[off-f.windowOff:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Read reads from the current offset
+func (f *s3File) Read(p []byte) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	n, err := f.readAt(p, f.offset)
+	f.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Seek sets the offset for the next Read
+func (f *s3File) Seek(offset int64, whence int) (int64, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.info.size
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.path, Err: fs.ErrInvalid}
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+// Stat returns the file info
+func (f *s3File) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+// ReadDir lists the directory like os.File.ReadDir
+func (f *s3File) ReadDir(count int) ([]fs.DirEntry, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.closed {
+		return nil, &fs.PathError{Op: "readdir", Path: f.path, Err: fs.ErrClosed}
+	}
+	if !f.info.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: f.path, Err: syscall.ENOTDIR}
+	}
+	if f.entries == nil {
+		entries, err := f.s.list(f.path)
+		if err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: f.path, Err: err}
+		}
+		f.entries = append([]*fileInfo{}, entries...)
+	}
+
+	infos := f.entries[f.dirRead:]
+	if count > 0 && len(infos) > count {
+		infos = infos[:count]
+	}
+	f.dirRead += len(infos)
+	if count > 0 && len(infos) == 0 {
+		return nil, io.EOF
+	}
+	entries := make([]fs.DirEntry, len(infos))
+	for i, info := range infos {
+		entries[i] = fs.FileInfoToDirEntry(info)
+	}
+	return entries, nil
+}
+
+// Close closes the file
+func (f *s3File) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.closed {
+		return &fs.PathError{Op: "close", Path: f.path, Err: fs.ErrClosed}
+	}
+	f.closed = true
+	f.window = nil
+	return nil
+}
+
+// s3IOFS implements fs.FS on top of an S3FS
+type s3IOFS struct {
+	s *S3FS
+}
+
+// Open opens the named file or directory for reading
+func (i s3IOFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	info, err := i.s.stat("open", name)
+	if err != nil {
+		var pathErr *fs.PathError
+		if errors.As(err, &pathErr) {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: pathErr.Err}
+		}
+		return nil, err
+	}
+	return &s3File{s: i.s, key: i.s.key(name), path: name, info: info}, nil
+}
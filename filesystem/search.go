@@ -0,0 +1,446 @@
+package filesystem
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/sftp"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Ensure that IndexedFS implements the FtpFS interface
+var _ NewFSWithReadWriteAt = &IndexedFS{}
+
+// SearchQuery selects the files of a search, the zero query matches every file
+type SearchQuery struct {
+	// Glob matches the name of the file, like *.wav
+	Glob string
+	// Regexp matches the path of the file relative to the searched directory
+	Regexp *regexp.Regexp
+	// MinSize and MaxSize are the size range in bytes, a MaxSize of 0 is unlimited
+	MinSize int64
+	MaxSize int64
+	// ModifiedAfter and ModifiedBefore are the modification time range, the zero time is unlimited
+	ModifiedAfter  time.Time
+	ModifiedBefore time.Time
+	// Dirs finds the directories too, by default only the files are found
+	Dirs bool
+	// Hidden searches the files and directories starting with a dot
+	Hidden bool
+	// Limit stops the search after the number of results, 0 is unlimited
+	Limit int
+}
+
+// SearchResult is a found file, Path is relative to the searched directory
+type SearchResult struct {
+	Path string
+	Info fs.FileInfo
+}
+
+// Searcher is a file system searching its files itself, like IndexedFS
+type Searcher interface {
+	Search(ctx context.Context, dir string, query SearchQuery) ([]SearchResult, bool, error)
+}
+
+// Match reports if the file at the relative path matches the query
+func (q SearchQuery) Match(rel string, info fs.FileInfo) bool {
+	if info.IsDir() && !q.Dirs {
+		return false
+	}
+	if q.Glob != "" {
+		if matched, _ := path.Match(q.Glob, info.Name()); !matched {
+			return false
+		}
+	}
+	if q.Regexp != nil && !q.Regexp.MatchString(rel) {
+		return false
+	}
+	if !info.IsDir() && (info.Size() < q.MinSize || q.MaxSize > 0 && info.Size() > q.MaxSize) {
+		return false
+	}
+	if !q.ModifiedAfter.IsZero() && !info.ModTime().After(q.ModifiedAfter) {
+		return false
+	}
+	if !q.ModifiedBefore.IsZero() && !info.ModTime().Before(q.ModifiedBefore) {
+		return false
+	}
+	return true
+}
+
+// hidden reports if the relative path has a name starting with a dot
+func hidden(rel string) bool {
+	return strings.HasPrefix(rel, ".") || strings.Contains(rel, "/.")
+}
+
+// Search finds the files of the directory and its subdirectories matching the query, in the order of a
+// depth first walk of the names. it reports true if the limit stopped the search, and stops with the error
+// of the context once canceled. a file system implementing Searcher searches itself, otherwise the directories
+// are walked, subdirectories that can't be read are skipped and symlinks are not followed
+func Search(ctx context.Context, fsys FS, dir string, query SearchQuery) ([]SearchResult, bool, error) {
+	if searcher, ok := fsys.(Searcher); ok {
+		return searcher.Search(ctx, dir, query)
+	}
+	return searchWalk(ctx, dir, query, func(name string) ([]fs.FileInfo, error) {
+		_, infos, err := fsys.Dir(name)
+		return infos, err
+	})
+}
+
+// searchWalk walks the directory depth first in the order of the names and finds the files matching the query,
+// readDir lists a directory, the walk and IndexedFS use it so both find the same files in the same order
+func searchWalk(ctx context.Context, dir string, query SearchQuery, readDir func(name string) ([]fs.FileInfo, error)) ([]SearchResult, bool, error) {
+	if query.Glob != "" {
+		if _, err := path.Match(query.Glob, ""); err != nil {
+			return nil, false, fmt.Errorf("invalid glob: %w", err)
+		}
+	}
+	dir = path.Clean("/" + dir)
+	var results []SearchResult
+	var walk func(name, rel string) (bool, error)
+	walk = func(name, rel string) (bool, error) {
+		if err := context.Cause(ctx); err != nil {
+			return false, err
+		}
+		infos, err := readDir(name)
+		if err != nil {
+			if rel == "" {
+				return false, err
+			}
+			return false, nil
+		}
+		sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+		for _, info := range infos {
+			childRel := path.Join(rel, info.Name())
+			if !query.Hidden && hidden(info.Name()) {
+				continue
+			}
+			if query.Match(childRel, info) {
+				if query.Limit > 0 && len(results) == query.Limit {
+					return true, nil
+				}
+				results = append(results, SearchResult{Path: childRel, Info: info})
+			}
+			if info.IsDir() {
+				if truncated, err := walk(path.Join(name, info.Name()), childRel); truncated || err != nil {
+					return truncated, err
+				}
+			}
+		}
+		return false, nil
+	}
+	truncated, err := walk(dir, "")
+	if err != nil {
+		return nil, false, err
+	}
+	return results, truncated, nil
+}
+
+// dirtyQuiet is the time after the last modification of a file opened for writing
+// that it is considered closed and no longer restated by the searches
+const dirtyQuiet = time.Minute
+
+// IndexedFS wraps a file system and keeps an in memory index of its files, searches use the index
+// instead of walking the directories. the index is updated by the writes through IndexedFS,
+// changes made by other processes are only seen after Reindex
+type IndexedFS struct {
+	FS
+	lock sync.RWMutex // Protects dirs and dirty
+	// dirs are the indexed files by their name in the index of their directory, by the path of the directory,
+	// so removing or renaming a directory only changes its subdirectories
+	dirs map[string]map[string]fs.FileInfo
+	// dirty are the files opened for writing with FileWrite and the time they were opened, the searches restat them
+	dirty map[string]time.Time
+}
+
+// NewIndexedFS returns the indexed file system, the index is built by walking the file system
+func NewIndexedFS(fsys FS) (*IndexedFS, error) {
+	i := &IndexedFS{FS: fsys}
+	if err := i.Reindex(context.Background()); err != nil {
+		return nil, err
+	}
+	return i, nil
+}
+
+// Reindex rebuilds the index by walking the file system
+func (i *IndexedFS) Reindex(ctx context.Context) error {
+	dirs := map[string]map[string]fs.FileInfo{}
+	root := path.Clean("/" + i.FS.RootDir())
+	var walk func(name string) error
+	walk = func(name string) error {
+		if err := context.Cause(ctx); err != nil {
+			return err
+		}
+		_, infos, err := i.FS.Dir(name)
+		if err != nil {
+			if name == root {
+				return fmt.Errorf("error indexing: %w", err)
+			}
+			return nil
+		}
+		files := make(map[string]fs.FileInfo, len(infos))
+		dirs[name] = files
+		for _, info := range infos {
+			files[info.Name()] = info
+			if info.IsDir() {
+				if err = walk(path.Join(name, info.Name())); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err := walk(root); err != nil {
+		return err
+	}
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	i.dirs, i.dirty = dirs, map[string]time.Time{}
+	return nil
+}
+
+// restat updates the index entry of the file, a file that doesn't exist is removed
+func (i *IndexedFS) restat(name string) fs.FileInfo {
+	name = path.Clean("/" + name)
+	_, info, err := i.FS.Lstat(name)
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	if err != nil {
+		i.removeLocked(name)
+		return nil
+	}
+	i.setLocked(name, info)
+	return info
+}
+
+// setLocked indexes the file in its directory, a directory gets its own index
+func (i *IndexedFS) setLocked(name string, info fs.FileInfo) {
+	if name == path.Dir(name) {
+		// the root isn't in a directory
+		return
+	}
+	if old, ok := i.dirs[path.Dir(name)][path.Base(name)]; ok && old.IsDir() && !info.IsDir() {
+		i.removeLocked(name)
+	}
+	files, ok := i.dirs[path.Dir(name)]
+	if !ok {
+		files = map[string]fs.FileInfo{}
+		i.dirs[path.Dir(name)] = files
+	}
+	files[path.Base(name)] = info
+	if _, ok = i.dirs[name]; info.IsDir() && !ok {
+		i.dirs[name] = map[string]fs.FileInfo{}
+	}
+}
+
+// restatParents indexes the directories created for the file
+func (i *IndexedFS) restatParents(name string) {
+	root := path.Clean("/" + i.FS.RootDir())
+	for dir := path.Dir(path.Clean("/" + name)); dir != root && dir != "/" && dir != "."; dir = path.Dir(dir) {
+		i.lock.RLock()
+		_, ok := i.dirs[dir]
+		i.lock.RUnlock()
+		if ok {
+			return
+		}
+		i.restat(dir)
+	}
+}
+
+// removeLocked removes the file from the index of its directory, and the index of a directory with its subdirectories
+func (i *IndexedFS) removeLocked(name string) {
+	delete(i.dirs[path.Dir(name)], path.Base(name))
+	i.removeTreeLocked(name)
+}
+
+// removeTreeLocked removes the index of the directory and of its subdirectories
+func (i *IndexedFS) removeTreeLocked(dir string) {
+	delete(i.dirty, dir)
+	files, ok := i.dirs[dir]
+	if !ok {
+		return
+	}
+	delete(i.dirs, dir)
+	for name := range files {
+		i.removeTreeLocked(path.Join(dir, name))
+	}
+}
+
+// Search finds the indexed files of the directory matching the query, like the Search function
+func (i *IndexedFS) Search(ctx context.Context, dir string, query SearchQuery) ([]SearchResult, bool, error) {
+	dir = path.Clean("/" + dir)
+	if _, info, err := i.FS.Stat(dir); err != nil {
+		return nil, false, err
+	} else if !info.IsDir() {
+		return nil, false, &fs.PathError{Op: "search", Path: dir, Err: fmt.Errorf("not a directory")}
+	}
+	i.lock.RLock()
+	dirty := make(map[string]time.Time, len(i.dirty))
+	for name, opened := range i.dirty {
+		dirty[name] = opened
+	}
+	i.lock.RUnlock()
+	// a file not modified for a while after it was opened is considered closed, it isn't restated anymore
+	for name, opened := range dirty {
+		info := i.restat(name)
+		if info == nil || time.Since(opened) > dirtyQuiet && time.Since(info.ModTime()) > dirtyQuiet {
+			i.lock.Lock()
+			delete(i.dirty, name)
+			i.lock.Unlock()
+		}
+	}
+
+	return searchWalk(ctx, dir, query, func(name string) ([]fs.FileInfo, error) {
+		i.lock.RLock()
+		defer i.lock.RUnlock()
+		files, ok := i.dirs[name]
+		if !ok {
+			return nil, &fs.PathError{Op: "search", Path: name, Err: fs.ErrNotExist}
+		}
+		infos := make([]fs.FileInfo, 0, len(files))
+		for _, info := range files {
+			infos = append(infos, info)
+		}
+		return infos, nil
+	})
+}
+
+// GetFS returns the fs.FS object of the wrapped file system
+func (i *IndexedFS) GetFS() fs.FS {
+	return getFS(i.FS)
+}
+
+// MakeDir creates the directory and indexes it with its parents
+func (i *IndexedFS) MakeDir(folderName string) error {
+	if err := i.FS.MakeDir(folderName); err != nil {
+		return err
+	}
+	i.restatParents(folderName)
+	i.restat(folderName)
+	return nil
+}
+
+// WriteFile writes the file and indexes it
+func (i *IndexedFS) WriteFile(fileName string, r io.Reader, transferType string, appendOnly bool) error {
+	err := i.FS.WriteFile(fileName, r, transferType, appendOnly)
+	// a failed write can leave a partial file
+	i.restatParents(fileName)
+	i.restat(fileName)
+	return err
+}
+
+// Remove removes the file from the file system and the index
+func (i *IndexedFS) Remove(fileName string) error {
+	if err := i.FS.Remove(fileName); err != nil {
+		return err
+	}
+	i.restat(fileName)
+	return nil
+}
+
+// Rename moves the file and its indexed children
+func (i *IndexedFS) Rename(original string, target string) error {
+	if err := i.FS.Rename(original, target); err != nil {
+		return err
+	}
+	original, target = path.Clean("/"+original), path.Clean("/"+target)
+	i.lock.Lock()
+	moved := map[string]map[string]fs.FileInfo{}
+	i.moveTreeLocked(original, target, moved)
+	i.removeLocked(original)
+	i.removeLocked(target)
+	for dir, files := range moved {
+		i.dirs[dir] = files
+	}
+	i.lock.Unlock()
+	i.restat(target)
+	return nil
+}
+
+// moveTreeLocked collects the indexes of the directory and its subdirectories under their new paths
+func (i *IndexedFS) moveTreeLocked(dir, target string, moved map[string]map[string]fs.FileInfo) {
+	files, ok := i.dirs[dir]
+	if !ok {
+		return
+	}
+	moved[target] = files
+	for name, info := range files {
+		if info.IsDir() {
+			i.moveTreeLocked(path.Join(dir, name), path.Join(target, name), moved)
+		}
+	}
+}
+
+// ModifyTime changes the modification time and indexes it
+func (i *IndexedFS) ModifyTime(filePath string, value string) error {
+	if err := i.FS.ModifyTime(filePath, value); err != nil {
+		return err
+	}
+	i.restat(filePath)
+	return nil
+}
+
+// SetStat changes the mode and indexes it
+func (i *IndexedFS) SetStat(fileName string, mode os.FileMode) error {
+	if err := i.FS.SetStat(fileName, mode); err != nil {
+		return err
+	}
+	i.restat(fileName)
+	return nil
+}
+
+// Link creates the hard link fileName of the target and indexes it
+func (i *IndexedFS) Link(fileName string, target string) error {
+	if err := i.FS.Link(fileName, target); err != nil {
+		return err
+	}
+	i.restatParents(fileName)
+	i.restat(fileName)
+	return nil
+}
+
+// Symlink creates the symlink fileName to the target and indexes it
+func (i *IndexedFS) Symlink(fileName string, target string) error {
+	if err := i.FS.Symlink(fileName, target); err != nil {
+		return err
+	}
+	i.restatParents(fileName)
+	i.restat(fileName)
+	return nil
+}
+
+// FileWrite opens the file of the wrapped file system, the file is indexed by the next search
+func (i *IndexedFS) FileWrite(fileName string, access int) (io.WriterAt, error) {
+	w, err := fileWrite(i.FS, fileName, access)
+	if err == nil {
+		i.markDirty(fileName)
+	}
+	return w, err
+}
+
+// FileRead opens the file of the wrapped file system, a file opened for writing is indexed by the next search
+func (i *IndexedFS) FileRead(fileName string, access int) (io.ReaderAt, error) {
+	r, err := fileRead(i.FS, fileName, access)
+	if err == nil && access&writeAccess != 0 {
+		i.markDirty(fileName)
+	}
+	return r, err
+}
+
+func (i *IndexedFS) markDirty(fileName string) {
+	i.restatParents(fileName)
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	i.dirty[path.Clean("/"+fileName)] = time.Now()
+}
+
+// StatFS returns the file system status of the wrapped file system
+func (i *IndexedFS) StatFS(path string) (*sftp.StatVFS, error) {
+	return statFS(i.FS, path)
+}
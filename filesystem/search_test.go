@@ -0,0 +1,171 @@
+package filesystem
+
+import (
+	"context"
+	"errors"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func searchPaths(results []SearchResult) string {
+	var paths []string
+	for _, result := range results {
+		paths = append(paths, result.Path)
+	}
+	return strings.Join(paths, ",")
+}
+
+func newSearchFS(t *testing.T) *MemFS {
+	mem := NewMemFS()
+	for _, dir := range []string{"/calls/2024", "/calls/2025", "/.uploads"} {
+		if err := mem.MakeDir(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeMemFile(t, mem, "/calls/2024/a.wav", "aaaa")
+	writeMemFile(t, mem, "/calls/2025/b.wav", "bbbbbbbb")
+	writeMemFile(t, mem, "/calls/2025/b.txt", "b")
+	writeMemFile(t, mem, "/.uploads/c.wav", "c")
+	if err := mem.ModifyTime("/calls/2024/a.wav", "20240101120000"); err != nil {
+		t.Fatal(err)
+	}
+	return mem
+}
+
+func TestSearch(t *testing.T) {
+	ctx := context.Background()
+	mem := newSearchFS(t)
+	indexed, err := NewIndexedFS(mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fsys := range []FS{mem, indexed} {
+		tests := []struct {
+			dir   string
+			query SearchQuery
+			want  string
+		}{
+			{"/", SearchQuery{Glob: "*.wav"}, "calls/2024/a.wav,calls/2025/b.wav"},
+			{"/", SearchQuery{Glob: "*.wav", Hidden: true}, ".uploads/c.wav,calls/2024/a.wav,calls/2025/b.wav"},
+			{"/calls", SearchQuery{Regexp: regexp.MustCompile(`^2025/`)}, "2025/b.txt,2025/b.wav"},
+			{"/", SearchQuery{MinSize: 2, MaxSize: 4}, "calls/2024/a.wav"},
+			{"/", SearchQuery{ModifiedAfter: time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)}, "calls/2025/b.txt,calls/2025/b.wav"},
+			{"/", SearchQuery{ModifiedBefore: time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)}, "calls/2024/a.wav"},
+			{"/", SearchQuery{Glob: "20*", Dirs: true}, "calls/2024,calls/2025"},
+		}
+		for _, test := range tests {
+			results, truncated, err := Search(ctx, fsys, test.dir, test.query)
+			if err != nil || truncated || searchPaths(results) != test.want {
+				t.Errorf("%T %+v: got %s %v %v, want %s", fsys, test.query, searchPaths(results), truncated, err, test.want)
+			}
+		}
+		results, truncated, err := Search(ctx, fsys, "/", SearchQuery{Limit: 2})
+		if err != nil || !truncated || searchPaths(results) != "calls/2024/a.wav,calls/2025/b.txt" {
+			t.Errorf("%T: expected the limit to truncate the search, got %s %v %v", fsys, searchPaths(results), truncated, err)
+		}
+		if _, _, err = Search(ctx, fsys, "/", SearchQuery{Glob: "["}); err == nil {
+			t.Errorf("%T: expected an invalid glob to fail", fsys)
+		}
+		canceled, cancel := context.WithCancel(ctx)
+		cancel()
+		if _, _, err = Search(canceled, fsys, "/", SearchQuery{}); !errors.Is(err, context.Canceled) {
+			t.Errorf("%T: expected the canceled search to fail, got %v", fsys, err)
+		}
+	}
+}
+
+func TestSearchOrder(t *testing.T) {
+	mem := NewMemFS()
+	mem.MakeDir("/a")
+	writeMemFile(t, mem, "/a/b", "b")
+	writeMemFile(t, mem, "/a.txt", "a")
+	indexed, err := NewIndexedFS(mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the files of a directory come before the next name, with or without the index, so a limit truncates the same
+	for _, fsys := range []FS{mem, indexed} {
+		results, truncated, err := Search(context.Background(), fsys, "/", SearchQuery{Limit: 1})
+		if err != nil || !truncated || searchPaths(results) != "a/b" {
+			t.Errorf("%T: expected the walk order, got %s %v %v", fsys, searchPaths(results), truncated, err)
+		}
+	}
+}
+
+func TestIndexedFS(t *testing.T) {
+	ctx := context.Background()
+	indexed, err := NewIndexedFS(newSearchFS(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	search := func(query SearchQuery) string {
+		t.Helper()
+		results, _, err := indexed.Search(ctx, "/", query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return searchPaths(results)
+	}
+
+	if err = indexed.MakeDir("/new/deep"); err != nil {
+		t.Fatal(err)
+	}
+	if err = indexed.WriteFile("/new/deep/d.wav", strings.NewReader("dd"), "I", false); err != nil {
+		t.Fatal(err)
+	}
+	if got := search(SearchQuery{Glob: "d*", Dirs: true}); got != "new/deep,new/deep/d.wav" {
+		t.Fatalf("expected the written files to be indexed, got %s", got)
+	}
+	if err = indexed.Rename("/new", "/moved"); err != nil {
+		t.Fatal(err)
+	}
+	if got := search(SearchQuery{Glob: "d.wav"}); got != "moved/deep/d.wav" {
+		t.Fatalf("expected the renamed children to be indexed, got %s", got)
+	}
+	if err = indexed.Remove("/calls/2025/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if got := search(SearchQuery{Glob: "b.*"}); got != "calls/2025/b.wav" {
+		t.Fatalf("expected the removed file to leave the index, got %s", got)
+	}
+
+	// files written at offsets are restated by the next search
+	w, err := indexed.FileWrite("/calls/2025/b.wav", os.O_WRONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.WriteAt([]byte("bigger"), 100); err != nil {
+		t.Fatal(err)
+	}
+	if got := search(SearchQuery{MinSize: 100}); got != "calls/2025/b.wav" {
+		t.Fatalf("expected the written size to be indexed, got %s", got)
+	}
+
+	// the links are indexed by their own name
+	if err = indexed.Link("/calls/2025/link.wav", "/calls/2024/a.wav"); err != nil {
+		t.Fatal(err)
+	}
+	if err = indexed.Symlink("/calls/2025/symlink.wav", "/calls/2024/a.wav"); err != nil {
+		t.Fatal(err)
+	}
+	if got := search(SearchQuery{Glob: "*link.wav"}); got != "calls/2025/link.wav,calls/2025/symlink.wav" {
+		t.Fatalf("expected the links to be indexed, got %s", got)
+	}
+
+	// changes made around the index are only seen after a reindex
+	if err = indexed.FS.WriteFile("/calls/e.wav", strings.NewReader("e"), "I", false); err != nil {
+		t.Fatal(err)
+	}
+	if got := search(SearchQuery{Glob: "e.wav"}); got != "" {
+		t.Fatalf("expected the unindexed file to be missing, got %s", got)
+	}
+	if err = indexed.Reindex(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := search(SearchQuery{Glob: "e.wav"}); got != "calls/e.wav" {
+		t.Fatalf("expected the reindexed file, got %s", got)
+	}
+}
@@ -0,0 +1,422 @@
+package filesystem
+
+import (
+	"errors"
+	"fmt"
+	"github.com/pkg/sftp"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Ensure that TrashFS implements the FtpFS interface
+var _ NewFSWithReadWriteAt = &TrashFS{}
+
+// TrashDir is the directory of the deleted files and the previous versions of a TrashFS
+const TrashDir = "/.trash"
+
+const (
+	// TrashDeleted is the kind of trash entry of a removed file
+	TrashDeleted = "deleted"
+	// TrashVersion is the kind of trash entry of an overwritten file
+	TrashVersion = "version"
+)
+
+// trashTimeFormat is the sortable time prefix of the trash entry ids
+const trashTimeFormat = "20060102T150405.000000000Z"
+
+// trashPurgeInterval limits how often the expired entries are purged automatically
+const trashPurgeInterval = time.Minute
+
+// TrashEntry is a deleted file or a previous version of a file
+type TrashEntry struct {
+	// ID identifies the entry for TrashFS.Restore
+	ID string `json:"id"`
+	// Path is the original path of the file
+	Path string `json:"path"`
+	// Kind is TrashDeleted or TrashVersion
+	Kind string `json:"kind"`
+	// Time is when the file was deleted or overwritten
+	Time time.Time `json:"time"`
+	// Size is the size of the file
+	Size int64 `json:"size"`
+}
+
+// TrashFS wraps a file system and keeps what is deleted or overwritten under TrashDir in its root.
+// removed files are moved to the trash, overwritten files keep up to Versions previous versions,
+// and the entries older than Retention are purged. a file is stored at "/.trash/<path>/<id>".
+// the trash is hidden from the listing of the root, it can be read but only changed by Restore and Purge.
+type TrashFS struct {
+	FS
+	// Versions is the number of previous versions kept per file, 0 keeps none
+	Versions int
+	// Retention is how long the entries are kept, 0 keeps them until they are restored
+	Retention time.Duration
+
+	lock      sync.Mutex // Protects lastPurge and serializes the changes of the trash
+	lastPurge time.Time
+	now       func() time.Time
+}
+
+// NewTrashFS returns the file system keeping versions previous versions of the files and the entries for retention
+func NewTrashFS(fsys FS, versions int, retention time.Duration) *TrashFS {
+	return &TrashFS{FS: fsys, Versions: versions, Retention: retention, now: time.Now}
+}
+
+// inTrash reports whether the path is the trash or inside it
+func inTrash(name string) bool {
+	name = cleanName(name)
+	return name == TrashDir || strings.HasPrefix(name, TrashDir+"/")
+}
+
+func (t *TrashFS) denied(op, name string) error {
+	return &PermissionError{Op: op, Path: name, Reason: "the trash can only be changed by restoring or purging"}
+}
+
+// GetFS returns the fs.FS object of the wrapped file system, fs.FS is read only.
+// the trash is hidden from the listing of the root like in Dir
+func (t *TrashFS) GetFS() fs.FS {
+	return trashHiddenFS{getFS(t.FS)}
+}
+
+// Dir lists the directory, the trash is hidden from the listing of the root,
+// its entries are listed by Entries and it can still be read with its path
+func (t *TrashFS) Dir(folderName string) ([]string, []os.FileInfo, error) {
+	lines, infos, err := t.FS.Dir(folderName)
+	if err != nil || cleanName(folderName) != "/" {
+		return lines, infos, err
+	}
+	for i := 0; i < len(infos); i++ {
+		if infos[i].Name() == path.Base(TrashDir) {
+			lines, infos = slices.Delete(lines, i, i+1), slices.Delete(infos, i, i+1)
+			i--
+		}
+	}
+	return lines, infos, nil
+}
+
+// trashHiddenFS hides the trash from the listing of the root of a fs.FS
+type trashHiddenFS struct {
+	fs.FS
+}
+
+func (f trashHiddenFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := fs.ReadDir(f.FS, name)
+	if err != nil || path.Clean(name) != "." {
+		return entries, err
+	}
+	return slices.DeleteFunc(entries, func(entry fs.DirEntry) bool {
+		return entry.Name() == path.Base(TrashDir)
+	}), nil
+}
+
+// isFile reports whether the path is an existing file, links are not followed
+func (t *TrashFS) isFile(name string) (bool, error) {
+	_, info, err := t.FS.Lstat(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return !info.IsDir(), nil
+}
+
+// entryPath returns the path of a new trash entry of the file
+func (t *TrashFS) entryPath(name, kind string) string {
+	id := t.now().UTC().Format(trashTimeFormat) + "." + kind
+	return path.Join(TrashDir, cleanName(name), id)
+}
+
+// copyFile copies the content of a file to a new file
+func (t *TrashFS) copyFile(src, dst string) error {
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := t.FS.ReadFile(src, pw)
+		pw.CloseWithError(err)
+	}()
+	err := t.FS.WriteFile(dst, pr, "I", false)
+	pr.CloseWithError(errors.New("copy aborted"))
+	return err
+}
+
+// saveVersion copies the file to the trash before it is overwritten and drops the oldest versions but keep
+func (t *TrashFS) saveVersion(name, keep string) error {
+	if t.Versions <= 0 {
+		return nil
+	}
+	file, err := t.isFile(name)
+	if err != nil || !file {
+		return err
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	dst := t.entryPath(name, TrashVersion)
+	if err = t.FS.MakeDir(path.Dir(dst)); err != nil {
+		return fmt.Errorf("error creating the trash directory: %w", err)
+	}
+	if err = t.copyFile(name, dst); err != nil {
+		return fmt.Errorf("error saving the previous version: %w", err)
+	}
+
+	entries, err := t.entries(name)
+	if err != nil {
+		return err
+	}
+	var versions []TrashEntry
+	for _, entry := range entries {
+		if entry.Kind == TrashVersion && entry.ID != keep {
+			versions = append(versions, entry)
+		}
+	}
+	// the entries are sorted by time
+	for len(versions) > t.Versions {
+		_ = t.FS.Remove(path.Join(TrashDir, cleanName(name), versions[0].ID))
+		versions = versions[1:]
+	}
+	t.purgeLocked(false)
+	return nil
+}
+
+// entries returns the trash entries of a file sorted by time
+func (t *TrashFS) entries(name string) ([]TrashEntry, error) {
+	dir := path.Join(TrashDir, cleanName(name))
+	_, infos, err := t.FS.Dir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error listing the trash: %w", err)
+	}
+	var entries []TrashEntry
+	for _, info := range infos {
+		entry, ok := parseTrashEntry(info)
+		if !ok {
+			continue
+		}
+		entry.Path = cleanName(name)
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ID < entries[j].ID
+	})
+	return entries, nil
+}
+
+// parseTrashEntry returns the entry of a file in the trash, directories and other files aren't entries
+func parseTrashEntry(info fs.FileInfo) (TrashEntry, bool) {
+	if info.IsDir() {
+		return TrashEntry{}, false
+	}
+	stamp, kind, ok := strings.Cut(info.Name(), "Z.")
+	if !ok || (kind != TrashDeleted && kind != TrashVersion) {
+		return TrashEntry{}, false
+	}
+	deleted, err := time.Parse(trashTimeFormat, stamp+"Z")
+	if err != nil {
+		return TrashEntry{}, false
+	}
+	return TrashEntry{ID: info.Name(), Kind: kind, Time: deleted, Size: info.Size()}, true
+}
+
+// Entries returns the deleted and previous versions of a file sorted by time
+func (t *TrashFS) Entries(name string) ([]TrashEntry, error) {
+	if inTrash(name) {
+		return nil, nil
+	}
+	return t.entries(name)
+}
+
+// Restore puts a trash entry back to its original path, the current file is kept as a version first
+func (t *TrashFS) Restore(name, id string) error {
+	if inTrash(name) || id == "" || id == "." || id == ".." || strings.ContainsAny(id, "/\\") {
+		return &fs.PathError{Op: "restore", Path: name, Err: fs.ErrInvalid}
+	}
+	src := path.Join(TrashDir, cleanName(name), id)
+	if _, _, err := t.FS.Lstat(src); err != nil {
+		return fmt.Errorf("error restoring file: %w", err)
+	}
+	if err := t.saveVersion(name, id); err != nil {
+		return err
+	}
+	if err := t.FS.MakeDir(path.Dir(cleanName(name))); err != nil {
+		return fmt.Errorf("error restoring file: %w", err)
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if err := t.FS.Rename(src, name); err != nil {
+		return fmt.Errorf("error restoring file: %w", err)
+	}
+	return nil
+}
+
+// Purge removes the trash entries older than Retention and the empty trash directories
+func (t *TrashFS) Purge() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.purgeLocked(true)
+}
+
+// purgeLocked purges the trash, unless forced at most once per trashPurgeInterval
+func (t *TrashFS) purgeLocked(force bool) error {
+	now := t.now()
+	if t.Retention <= 0 || (!force && now.Sub(t.lastPurge) < trashPurgeInterval) {
+		return nil
+	}
+	t.lastPurge = now
+
+	var walk func(dir string) (empty bool, err error)
+	walk = func(dir string) (bool, error) {
+		_, infos, err := t.FS.Dir(dir)
+		if err != nil {
+			return false, err
+		}
+		left := len(infos)
+		for _, info := range infos {
+			name := path.Join(dir, info.Name())
+			if info.IsDir() {
+				empty, err := walk(name)
+				if err != nil {
+					return false, err
+				}
+				if empty && t.FS.Remove(name) == nil {
+					left--
+				}
+				continue
+			}
+			entry, ok := parseTrashEntry(info)
+			if ok && now.Sub(entry.Time) > t.Retention && t.FS.Remove(name) == nil {
+				left--
+			}
+		}
+		return left == 0, nil
+	}
+	if _, err := walk(TrashDir); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("error purging the trash: %w", err)
+	}
+	return nil
+}
+
+// Remove moves a file to the trash, directories are removed
+func (t *TrashFS) Remove(fileName string) error {
+	if inTrash(fileName) {
+		return t.denied("remove", fileName)
+	}
+	file, err := t.isFile(fileName)
+	if err != nil {
+		return err
+	}
+	if !file {
+		return t.FS.Remove(fileName)
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	dst := t.entryPath(fileName, TrashDeleted)
+	if err = t.FS.MakeDir(path.Dir(dst)); err != nil {
+		return fmt.Errorf("error creating the trash directory: %w", err)
+	}
+	if err = t.FS.Rename(fileName, dst); err != nil {
+		return fmt.Errorf("error moving the file to the trash: %w", err)
+	}
+	t.purgeLocked(false)
+	return nil
+}
+
+// WriteFile writes the file, an overwritten file is kept as a previous version
+func (t *TrashFS) WriteFile(fileName string, r io.Reader, transferType string, appendOnly bool) error {
+	if inTrash(fileName) {
+		return t.denied("write", fileName)
+	}
+	if err := t.saveVersion(fileName, ""); err != nil {
+		return err
+	}
+	return t.FS.WriteFile(fileName, r, transferType, appendOnly)
+}
+
+// Rename renames the file, a replaced file is kept as a previous version
+func (t *TrashFS) Rename(original string, target string) error {
+	if inTrash(original) || inTrash(target) {
+		return t.denied("rename", original)
+	}
+	if cleanName(original) != cleanName(target) {
+		if err := t.saveVersion(target, ""); err != nil {
+			return err
+		}
+	}
+	return t.FS.Rename(original, target)
+}
+
+// MakeDir creates the directory outside the trash
+func (t *TrashFS) MakeDir(folderName string) error {
+	if inTrash(folderName) {
+		return t.denied("mkdir", folderName)
+	}
+	return t.FS.MakeDir(folderName)
+}
+
+// ModifyTime changes the modification time outside the trash
+func (t *TrashFS) ModifyTime(filePath string, newTime string) error {
+	if inTrash(filePath) {
+		return t.denied("chtimes", filePath)
+	}
+	return t.FS.ModifyTime(filePath, newTime)
+}
+
+// SetStat changes the permissions outside the trash
+func (t *TrashFS) SetStat(fileName string, newPermissions os.FileMode) error {
+	if inTrash(fileName) {
+		return t.denied("chmod", fileName)
+	}
+	return t.FS.SetStat(fileName, newPermissions)
+}
+
+// Link creates a hard link outside the trash
+func (t *TrashFS) Link(fileName string, target string) error {
+	if inTrash(fileName) {
+		return t.denied("link", fileName)
+	}
+	return t.FS.Link(fileName, target)
+}
+
+// Symlink creates a symbolic link outside the trash
+func (t *TrashFS) Symlink(fileName string, target string) error {
+	if inTrash(fileName) {
+		return t.denied("symlink", fileName)
+	}
+	return t.FS.Symlink(fileName, target)
+}
+
+// FileWrite opens the file for writing, a truncated file is kept as a previous version
+func (t *TrashFS) FileWrite(fileName string, access int) (io.WriterAt, error) {
+	if inTrash(fileName) {
+		return nil, t.denied("write", fileName)
+	}
+	if access&os.O_TRUNC != 0 {
+		if err := t.saveVersion(fileName, ""); err != nil {
+			return nil, err
+		}
+	}
+	return fileWrite(t.FS, fileName, access)
+}
+
+// FileRead opens the file of the wrapped file system, the trash can't be opened for writing
+func (t *TrashFS) FileRead(fileName string, access int) (io.ReaderAt, error) {
+	if inTrash(fileName) && access&writeAccess != 0 {
+		return nil, t.denied("open", fileName)
+	}
+	return fileRead(t.FS, fileName, access)
+}
+
+// StatFS returns the file system status of the wrapped file system
+func (t *TrashFS) StatFS(path string) (*sftp.StatVFS, error) {
+	return statFS(t.FS, path)
+}
@@ -0,0 +1,124 @@
+package filesystem
+
+import (
+	"errors"
+	"io/fs"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTrashFS(t *testing.T) {
+	m := NewMemFS()
+	tr := NewTrashFS(m, 2, time.Hour)
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tr.now = func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}
+
+	for _, content := range []string{"v1", "v2", "v3", "v4"} {
+		if err := tr.WriteFile("/call.wav", strings.NewReader(content), "I", false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := tr.Entries("/call.wav")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Kind != TrashVersion || entries[0].Size != 2 {
+		t.Fatalf("expected the 2 newest versions, got %+v", entries)
+	}
+	if got := readMemFile(t, m, "/.trash/call.wav/"+entries[0].ID); got != "v2" {
+		t.Fatalf("expected the oldest kept version to be v2, got %q", got)
+	}
+
+	if err = tr.Remove("/call.wav"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = m.Stat("/call.wav"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected the file to be removed, got %v", err)
+	}
+	entries, _ = tr.Entries("/call.wav")
+	deleted := entries[len(entries)-1]
+	if deleted.Kind != TrashDeleted || deleted.Path != "/call.wav" {
+		t.Fatalf("expected the deleted file in the trash, got %+v", deleted)
+	}
+	if err = tr.Restore("/call.wav", deleted.ID); err != nil {
+		t.Fatal(err)
+	}
+	if got := readMemFile(t, m, "/call.wav"); got != "v4" {
+		t.Fatalf("expected the deleted file to be restored, got %q", got)
+	}
+
+	// restoring a version keeps the current file as a version
+	entries, _ = tr.Entries("/call.wav")
+	if err = tr.Restore("/call.wav", entries[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if got := readMemFile(t, m, "/call.wav"); got != "v2" {
+		t.Fatalf("expected v2 to be restored, got %q", got)
+	}
+	entries, _ = tr.Entries("/call.wav")
+	if got := readMemFile(t, m, "/.trash/call.wav/"+entries[len(entries)-1].ID); got != "v4" {
+		t.Fatalf("expected the replaced file to be kept, got %q", got)
+	}
+	if err = tr.Restore("/call.wav", "../../call.wav"); !errors.Is(err, fs.ErrInvalid) {
+		t.Fatalf("expected an invalid id to fail, got %v", err)
+	}
+
+	denied := map[string]error{
+		"WriteFile": tr.WriteFile("/.trash/x", strings.NewReader("x"), "I", false),
+		"Remove":    tr.Remove("/.trash/call.wav/" + entries[0].ID),
+		"Rename":    tr.Rename("/call.wav", "/.trash/call.wav"),
+		"MakeDir":   tr.MakeDir("/.trash/dir"),
+	}
+	for method, err := range denied {
+		if !errors.Is(err, fs.ErrPermission) {
+			t.Errorf("%s: expected a permission error, got %v", method, err)
+		}
+	}
+
+	now = now.Add(2 * time.Hour)
+	if err = tr.Purge(); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ = tr.Entries("/call.wav"); len(entries) != 0 {
+		t.Fatalf("expected the expired entries to be purged, got %+v", entries)
+	}
+	if _, _, err = m.Stat(TrashDir + "/call.wav"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected the empty trash directory to be removed, got %v", err)
+	}
+}
+
+func TestTrashFS_hidden(t *testing.T) {
+	m := NewMemFS()
+	m.MakeDir("/dir")
+	tr := NewTrashFS(m, 1, time.Hour)
+	tr.WriteFile("/a.txt", strings.NewReader("v1"), "I", false)
+	tr.WriteFile("/a.txt", strings.NewReader("v2"), "I", false)
+	tr.WriteFile("/dir/.trash", strings.NewReader("x"), "I", false)
+
+	_, infos, err := tr.Dir("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	if strings.Join(names, ",") != "a.txt,dir" {
+		t.Fatalf("expected the trash to be hidden from the root, got %v", names)
+	}
+	entries, err := fs.ReadDir(tr.GetFS(), ".")
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("expected the trash to be hidden from the fs.FS, got %v %v", entries, err)
+	}
+	// only the trash of the root is hidden, and it can still be read
+	if _, infos, err = tr.Dir("/dir"); err != nil || len(infos) != 1 {
+		t.Fatalf("expected the listing of /dir to be unchanged, got %v %v", infos, err)
+	}
+	if _, infos, err = tr.Dir(TrashDir + "/a.txt"); err != nil || len(infos) != 1 {
+		t.Fatalf("expected the trash to be readable, got %v %v", infos, err)
+	}
+}
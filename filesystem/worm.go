@@ -0,0 +1,222 @@
+package filesystem
+
+import (
+	"errors"
+	"github.com/pkg/sftp"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sync"
+)
+
+// Ensure that WORMFS implements the FtpFS interface
+var _ NewFSWithReadWriteAt = &WORMFS{}
+
+// WORMFS wraps a file system with write once read many semantics, e.g. for the legal hold of call recordings.
+// new files and directories can be created, but once a file exists it can't be overwritten, appended, renamed,
+// deleted or have its permissions and modification time changed, these operations fail with a *PermissionError.
+// empty directories can still be removed. uploads that write to a temporary file and rename it, like rsync, are denied.
+type WORMFS struct {
+	FS
+
+	lock     sync.Mutex          // Protects creating
+	creating map[string]struct{} // files being uploaded, a second upload of the same name is denied
+}
+
+// NewWORMFS returns a write once read many view of the file system
+func NewWORMFS(fsys FS) *WORMFS {
+	return &WORMFS{FS: fsys, creating: map[string]struct{}{}}
+}
+
+func (w *WORMFS) denied(op, path, reason string) error {
+	return &PermissionError{Op: op, Path: path, Reason: reason}
+}
+
+// GetFS returns the fs.FS object of the wrapped file system, fs.FS is read only
+func (w *WORMFS) GetFS() fs.FS {
+	return getFS(w.FS)
+}
+
+// create reserves a new file name, it fails if the file exists or is being created
+func (w *WORMFS) create(op, fileName string) (done func(), err error) {
+	name := path.Clean("/" + fileName)
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if _, ok := w.creating[name]; ok {
+		return nil, w.denied(op, fileName, "the write once file is being created")
+	}
+	_, _, err = w.FS.Lstat(fileName)
+	if err == nil {
+		return nil, w.denied(op, fileName, "write once files can't be overwritten")
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	w.creating[name] = struct{}{}
+	return func() {
+		w.lock.Lock()
+		delete(w.creating, name)
+		w.lock.Unlock()
+	}, nil
+}
+
+// isDir reports whether the path is a directory, links are not followed
+func (w *WORMFS) isDir(fileName string) (bool, error) {
+	_, info, err := w.FS.Lstat(fileName)
+	if err != nil {
+		return false, err
+	}
+	return info.IsDir(), nil
+}
+
+// WriteFile creates a new file, existing files can't be overwritten or appended.
+// the partial file of a failed upload is removed, it could never be replaced otherwise
+func (w *WORMFS) WriteFile(fileName string, r io.Reader, transferType string, _ bool) error {
+	done, err := w.create("write", fileName)
+	if err != nil {
+		return err
+	}
+	defer done()
+	if err = w.FS.WriteFile(fileName, r, transferType, false); err != nil {
+		w.removePartial(fileName)
+		return err
+	}
+	return nil
+}
+
+// removePartial removes the file of a failed upload while its name is reserved,
+// it is already missing if the wrapped file system discarded it, like an atomic upload
+func (w *WORMFS) removePartial(fileName string) {
+	_ = w.FS.Remove(fileName)
+}
+
+// Remove removes an empty directory, files can't be removed
+func (w *WORMFS) Remove(fileName string) error {
+	dir, err := w.isDir(fileName)
+	if err != nil {
+		return err
+	}
+	if !dir {
+		return w.denied("remove", fileName, "write once files can't be removed")
+	}
+	return w.FS.Remove(fileName)
+}
+
+// Rename is denied, renaming a directory would move its files
+func (w *WORMFS) Rename(original string, _ string) error {
+	return w.denied("rename", original, "write once files can't be renamed")
+}
+
+// ModifyTime changes the modification time of a directory, it is denied for files
+func (w *WORMFS) ModifyTime(filePath string, newTime string) error {
+	dir, err := w.isDir(filePath)
+	if err != nil {
+		return err
+	}
+	if !dir {
+		return w.denied("chtimes", filePath, "write once files can't be changed")
+	}
+	return w.FS.ModifyTime(filePath, newTime)
+}
+
+// SetStat changes the permissions of a directory, it is denied for files
+func (w *WORMFS) SetStat(fileName string, newPermissions os.FileMode) error {
+	dir, err := w.isDir(fileName)
+	if err != nil {
+		return err
+	}
+	if !dir {
+		return w.denied("chmod", fileName, "write once files can't be changed")
+	}
+	return w.FS.SetStat(fileName, newPermissions)
+}
+
+// Link creates a new hard link, an existing name can't be replaced
+func (w *WORMFS) Link(fileName string, target string) error {
+	done, err := w.create("link", fileName)
+	if err != nil {
+		return err
+	}
+	defer done()
+	return w.FS.Link(fileName, target)
+}
+
+// Symlink creates a new symbolic link, an existing name can't be replaced
+func (w *WORMFS) Symlink(fileName string, target string) error {
+	done, err := w.create("symlink", fileName)
+	if err != nil {
+		return err
+	}
+	defer done()
+	return w.FS.Symlink(fileName, target)
+}
+
+// FileWrite creates a new file exclusively, the name stays reserved until the writer is closed
+func (w *WORMFS) FileWrite(fileName string, access int) (io.WriterAt, error) {
+	done, err := w.create("write", fileName)
+	if err != nil {
+		return nil, err
+	}
+	access = access&^(os.O_TRUNC|os.O_APPEND) | os.O_CREATE | os.O_EXCL
+	file, err := fileWrite(w.FS, fileName, access)
+	if err != nil {
+		done()
+		if errors.Is(err, fs.ErrExist) {
+			return nil, w.denied("write", fileName, "write once files can't be overwritten")
+		}
+		return nil, err
+	}
+	return &wormWriter{WriterAt: file, done: done, fsys: w, name: fileName}, nil
+}
+
+// FileRead opens the file of the wrapped file system, opening it for writing is denied
+func (w *WORMFS) FileRead(fileName string, access int) (io.ReaderAt, error) {
+	if access&writeAccess != 0 {
+		return nil, w.denied("open", fileName, "write once files are opened for writing with FileWrite")
+	}
+	return fileRead(w.FS, fileName, access)
+}
+
+// StatFS returns the file system status of the wrapped file system
+func (w *WORMFS) StatFS(path string) (*sftp.StatVFS, error) {
+	return statFS(w.FS, path)
+}
+
+// wormWriter releases the reserved name of a new file when it is closed,
+// the file is removed if the transfer failed
+type wormWriter struct {
+	io.WriterAt
+	once sync.Once
+	done func()
+	fsys *WORMFS
+	name string
+
+	lock   sync.Mutex // Protects failed
+	failed bool
+}
+
+// TransferError forwards the failure of the transfer to the file, Close then removes it
+func (w *wormWriter) TransferError(err error) {
+	w.lock.Lock()
+	w.failed = true
+	w.lock.Unlock()
+	ForwardTransferError(w.WriterAt, err)
+}
+
+func (w *wormWriter) Close() error {
+	var err error
+	w.once.Do(func() {
+		defer w.done()
+		if closer, ok := w.WriterAt.(io.Closer); ok {
+			err = closer.Close()
+		}
+		w.lock.Lock()
+		failed := w.failed
+		w.lock.Unlock()
+		if failed || err != nil {
+			w.fsys.removePartial(w.name)
+		}
+	})
+	return err
+}
@@ -0,0 +1,93 @@
+package filesystem
+
+import (
+	"errors"
+	"github.com/pkg/sftp"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestWORMFS(t *testing.T) {
+	m := NewMemFS()
+	w := NewWORMFS(m)
+	if err := w.MakeDir("/recordings"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteFile("/recordings/call.wav", strings.NewReader("audio"), "I", false); err != nil {
+		t.Fatal(err)
+	}
+
+	denied := map[string]error{
+		"WriteFile":  w.WriteFile("/recordings/call.wav", strings.NewReader("x"), "I", false),
+		"Append":     w.WriteFile("/recordings/call.wav", strings.NewReader("x"), "I", true),
+		"Remove":     w.Remove("/recordings/call.wav"),
+		"Rename":     w.Rename("/recordings/call.wav", "/call.wav"),
+		"RenameDir":  w.Rename("/recordings", "/moved"),
+		"ModifyTime": w.ModifyTime("/recordings/call.wav", "20200102030405"),
+		"SetStat":    w.SetStat("/recordings/call.wav", 0600),
+		"Link":       w.Link("/recordings/call.wav", "/recordings"),
+	}
+	_, denied["FileWrite"] = w.FileWrite("/recordings/call.wav", os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+	_, denied["FileRead"] = w.FileRead("/recordings/call.wav", os.O_RDWR)
+	for method, err := range denied {
+		if !errors.Is(err, fs.ErrPermission) {
+			t.Errorf("%s: expected a permission error, got %v", method, err)
+		}
+	}
+	if got := readMemFile(t, m, "/recordings/call.wav"); got != "audio" {
+		t.Fatalf("the file was changed to %q", got)
+	}
+
+	// a new file is reserved until its writer is closed
+	writer, err := w.FileWrite("/recordings/new.wav", os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.FileWrite("/recordings/new.wav", os.O_RDWR|os.O_CREATE|os.O_TRUNC); !errors.Is(err, fs.ErrPermission) {
+		t.Fatalf("expected a permission error, got %v", err)
+	}
+	writer.WriteAt([]byte("new"), 0)
+	if err = writer.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readMemFile(t, m, "/recordings/new.wav"); got != "new" {
+		t.Fatalf("got %q", got)
+	}
+
+	if err = w.MakeDir("/empty"); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Remove("/empty"); err != nil {
+		t.Fatalf("expected an empty directory to be removable, got %v", err)
+	}
+}
+
+func TestWORMFS_failedUpload(t *testing.T) {
+	m := NewMemFS()
+	w := NewWORMFS(m)
+	if err := w.WriteFile("/call.wav", &failingReader{data: "partial"}, "I", false); err == nil {
+		t.Fatal("expected the failed upload to fail")
+	}
+	if _, _, err := m.Stat("/call.wav"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected the partial file to be removed, got %v", err)
+	}
+	if err := w.WriteFile("/call.wav", strings.NewReader("audio"), "I", false); err != nil {
+		t.Fatalf("expected the upload to be retried, got %v", err)
+	}
+
+	writer, err := w.FileWrite("/aborted.wav", os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.WriteAt([]byte("part"), 0)
+	writer.(sftp.TransferError).TransferError(io.ErrUnexpectedEOF)
+	if err = writer.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = m.Stat("/aborted.wav"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected the aborted file to be removed, got %v", err)
+	}
+}
@@ -3,12 +3,16 @@ package ftp
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"github.com/telebroad/fileserver/filesystem"
 	"github.com/telebroad/fileserver/tools"
+	"io"
 	"net"
 	"net/netip"
 	"os"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"runtime/debug"
 	"strconv"
@@ -38,7 +42,8 @@ func (s *Server) ftpHandler(conn net.Conn) {
 	logWriter := tools.NewBufLogReadWriter(conn, s.Logger())
 
 	sessionID := generateSessionID(conn)
-	ctx, cancel := context.WithCancelCause(context.Background())
+	// the session context ends with the server so the transfers are aborted on shutdown
+	ctx, cancel := context.WithCancelCause(s.ctx)
 	defer cancel(nil)
 
 	session := &Session{
@@ -160,10 +165,16 @@ func (s *Session) handlerSecureMap() handlerMap {
 // ParseCommand  parses the command from the client and returns the command and argument.
 func (s *Session) ParseCommand() (cmd, arg string, err error) {
 
-	line, err := s.readWriter.ReadString('\n')
-	if err != nil {
-		err = fmt.Errorf("error reading from connection: %w", err)
-		return
+	var line string
+	if len(s.pending) > 0 {
+		line, s.pending = s.pending[0], s.pending[1:]
+	} else {
+		line, err = s.readWriter.ReadString('\n')
+		line, s.partial = s.partial+line, ""
+		if err != nil {
+			err = fmt.Errorf("error reading from connection: %w", err)
+			return
+		}
 	}
 
 	command := strings.SplitN(strings.TrimSpace(line), " ", 2)
@@ -220,6 +231,16 @@ func (s *Session) PassCommand(cmd, arg string) (err error) {
 		fmt.Fprintf(s.readWriter, "530 Error: %s\r\n", err.Error())
 		return err
 	}
+	if s.ftpServer.UserFS != nil {
+		fsys, err := s.ftpServer.UserFS(s.username)
+		if err != nil {
+			s.ftpServer.Logger().Error("error opening the file system of the user", "user", s.username, "error", err)
+			fmt.Fprintf(s.readWriter, "530 Error: the file system of the user is not available\r\n")
+			return err
+		}
+		s.fs = fsys
+		s.root, s.workingDir = fsys.RootDir(), fsys.RootDir()
+	}
 
 	s.isAuthenticated = true
 	fmt.Fprintf(s.readWriter, "230 Login successful\r\n")
@@ -295,7 +316,7 @@ func (s *Session) ChangeDirectoryCommand(cmd, arg string) error {
 
 	requestedDir := Abs(s.root, s.workingDir, arg)
 
-	err := s.ftpServer.FsHandler.CheckDir(requestedDir)
+	err := s.fsHandler().CheckDir(requestedDir)
 	if err != nil {
 		fmt.Fprintf(s.readWriter, "550 Error: %s\r\n", err.Error())
 		return nil
@@ -313,7 +334,7 @@ func (s *Session) ChangeDirectoryToParentCommand(cmd, arg string) error {
 
 	requestedDir := Abs(s.root, s.workingDir, "..")
 
-	err := s.ftpServer.FsHandler.CheckDir(requestedDir)
+	err := s.fsHandler().CheckDir(requestedDir)
 	if err != nil {
 		fmt.Fprintf(s.readWriter, "550 Error: %s\r\n", err.Error())
 		return nil
@@ -325,7 +346,7 @@ func (s *Session) ChangeDirectoryToParentCommand(cmd, arg string) error {
 }
 func (s *Session) MakeDirectoryCommand(cmd, arg string) error {
 	requestedDir := Abs(s.root, s.workingDir, arg)
-	err := s.ftpServer.FsHandler.MakeDir(requestedDir)
+	err := s.fsHandler().MakeDir(requestedDir)
 	if err != nil {
 		fmt.Fprintf(s.readWriter, "550 Error: %s\r\n", err.Error())
 		return nil
@@ -548,7 +569,7 @@ func (s *Session) ExtendedActiveModeCommand(cmd, arg string) error {
 
 	ip := parts[2]
 	port := parts[3]
-	err := s.PortErptCommand(fmt.Sprintf("%s:%d", ip, port))
+	err := s.PortErptCommand(net.JoinHostPort(ip, port))
 	if err != nil {
 		return nil
 	}
@@ -634,14 +655,34 @@ func (s *Session) SaveCommand(cmd, arg string) error {
 	defer dataConn.Close()
 
 	filename := Abs(s.root, s.workingDir, arg)
-	appendOnly := false
+	flag := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
 	if cmd == "APPE" {
-		appendOnly = true
+		flag = os.O_WRONLY | os.O_CREATE | os.O_APPEND
 	}
 
-	err = s.ftpServer.FsHandler.WriteFile(filename, dataConn, string(s.ftpServer.Type), appendOnly)
+	err = s.transfer(dataConn, func(ctx context.Context) error {
+		file, err := s.fileSystem().Open(ctx, filename, flag, 0644)
+		if err != nil {
+			return err
+		}
+		var r io.Reader = dataConn
+		if s.ftpServer.Type == typeA {
+			text := textReader(dataConn)
+			defer text.Close()
+			r = text
+		}
+		if _, err = io.Copy(file, r); err != nil {
+			file.Close()
+			return err
+		}
+		return file.Close()
+	})
+	if errors.Is(err, errTransferAborted) {
+		fmt.Fprintf(s.readWriter, "426 Connection closed; transfer aborted.\r\n")
+		return nil
+	}
 	if err != nil {
-		fmt.Fprintf(s.readWriter, "550 Error writing to the file: %s\r\n", err.Error())
+		fmt.Fprintf(s.readWriter, "%d Error writing to the file: %s\r\n", replyCode(err, 550, 553), err.Error())
 		return nil
 
 	}
@@ -657,16 +698,16 @@ func (s *Session) ModifyTimeCommand(cmd, arg string) error {
 		fmt.Fprintf(s.readWriter, "501 No file name given\r\n")
 		return nil
 	} else if len(args) == 1 {
-		stat, _, err := s.ftpServer.FsHandler.Stat(args[0])
+		stat, _, err := s.fsHandler().Stat(args[0])
 		if err != nil {
 			fmt.Fprintf(s.readWriter, "501 Error getting file info: %s\r\n", err)
 			return nil
 		}
 		fmt.Fprintf(s.readWriter, "213 %s\r\n", stat)
 	} else if len(args) == 2 {
-		err := s.ftpServer.FsHandler.ModifyTime(args[1], args[0])
+		err := s.fsHandler().ModifyTime(args[1], args[0])
 		if err != nil {
-			fmt.Fprintf(s.readWriter, "501 Error setting file '%s' time '%s' modification time: %s\r\n", args[1], args[0], err.Error())
+			fmt.Fprintf(s.readWriter, "%d Error setting file '%s' time '%s' modification time: %s\r\n", replyCode(err, 501, 550), args[1], args[0], err.Error())
 			return nil
 		}
 		fmt.Fprintf(s.readWriter, "213 File modification time set to: %s\r\n", args[0])
@@ -689,14 +730,14 @@ func (s *Session) GetDirInfoCommand(cmd, arg string) error {
 	defer dataConn.Close()
 	// Send the directory listing
 	// Send the directory listing
-	entries, _, err := s.ftpServer.FsHandler.Dir(s.workingDir)
+	infos, err := s.fileSystem().ReadDir(s.CTX, s.workingDir)
 	if err != nil {
 		fmt.Fprintf(s.readWriter, "550 Error getting directory listing. error: %s\r\n", err.Error())
 		return nil
 	}
 
-	for _, entry := range entries {
-		fmt.Fprintf(dataConnRW, "%s\r\n", entry)
+	for _, info := range infos {
+		fmt.Fprintf(dataConnRW, "%s\r\n", info.MLSx())
 	}
 
 	fmt.Fprintf(s.readWriter, "226 Directory send OK.\r\n")
@@ -715,7 +756,7 @@ func (s *Session) StatusCommand(cmd, arg string) error {
 		fmt.Fprintf(s.readWriter, "213-Status of %s:\n", arg)
 		filename := Abs(s.root, s.workingDir, arg)
 
-		entries, _, err := s.ftpServer.FsHandler.Stat(filename)
+		entries, _, err := s.fsHandler().Stat(filename)
 		if err != nil {
 			fmt.Fprintf(s.readWriter, "550 Error getting file info: %s\n", err.Error())
 			return nil
@@ -731,13 +772,13 @@ func (s *Session) StatusCommand(cmd, arg string) error {
 func (s *Session) GetFileInfoCommand(cmd, arg string) error {
 	filename := Abs(s.root, s.workingDir, arg)
 
-	entries, _, err := s.ftpServer.FsHandler.Stat(filename)
+	info, err := s.fileSystem().Stat(s.CTX, filename)
 	if err != nil {
 		fmt.Fprintf(s.readWriter, "550 Error getting file info: %s\r\n", err.Error())
 		return nil
 	}
 	fmt.Fprintf(s.readWriter, "250-File details:\n")
-	fmt.Fprintf(s.readWriter, " %s\n", entries)
+	fmt.Fprintf(s.readWriter, " %s\n", info.MLSx())
 	fmt.Fprintf(s.readWriter, "250 End\r\n")
 	return nil
 }
@@ -746,7 +787,7 @@ func (s *Session) GetFileInfoCommand(cmd, arg string) error {
 func (s *Session) SizeCommand(cmd, arg string) error {
 	filename := Abs(s.root, s.workingDir, arg)
 
-	_, fileInfo, err := s.ftpServer.FsHandler.Stat(filename)
+	_, fileInfo, err := s.fsHandler().Stat(filename)
 	if err != nil {
 		fmt.Fprintf(s.readWriter, "550 Error getting file info: %s\r\n", err.Error())
 		return nil
@@ -773,7 +814,19 @@ func (s *Session) RetrieveCommand(cmd, arg string) error {
 	defer dataConn.Close()
 	filename := Abs(s.root, s.workingDir, arg)
 	s.ftpServer.Logger().Debug("RETR:", "filename", filename)
-	_, err = s.ftpServer.FsHandler.ReadFile(filename, dataConn)
+	err = s.transfer(dataConn, func(ctx context.Context) error {
+		file, err := s.fileSystem().Open(ctx, filename, os.O_RDONLY, 0)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(dataConn, file)
+		return err
+	})
+	if errors.Is(err, errTransferAborted) {
+		fmt.Fprintf(s.readWriter, "426 Connection closed; transfer aborted.\r\n")
+		return nil
+	}
 	if err != nil {
 		fmt.Fprintf(s.readWriter, "550 Error reading the file: %s\r\n", err.Error())
 		return nil
@@ -783,9 +836,78 @@ func (s *Session) RetrieveCommand(cmd, arg string) error {
 	return nil
 }
 
+// telnetCommands are the telnet IP and Synch sent before an ABOR
+const telnetCommands = "\xff\xf4\xf2"
+
+// errTransferAborted is the cause of a transfer aborted by the client or a shutdown
+var errTransferAborted = errors.New("transfer aborted")
+
+// transfer runs the transfer with a context that is canceled by an ABOR on the control connection,
+// by the client closing the control connection or by the server shutting down,
+// the data connection is closed on cancel. the commands received meanwhile are handled after the transfer
+func (s *Session) transfer(dataConn net.Conn, fn func(ctx context.Context) error) error {
+	ctx, cancel := context.WithCancelCause(s.CTX)
+	defer cancel(nil)
+	stop := context.AfterFunc(ctx, func() { dataConn.Close() })
+	defer stop()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		line, skipLF := []byte(s.partial), false
+		s.partial = ""
+		for {
+			c, err := s.readWriter.ReadByte()
+			if err != nil {
+				// the deadline set when the transfer ends keeps the partial command for ParseCommand
+				s.partial = string(line)
+				var netErr net.Error
+				if !errors.As(err, &netErr) || !netErr.Timeout() {
+					cancel(errTransferAborted)
+				}
+				return
+			}
+			if skipLF && c == '\n' {
+				skipLF = false
+				continue
+			}
+			skipLF = false
+			line = append(line, c)
+			if c != '\r' && c != '\n' {
+				continue
+			}
+			// clients send ABOR after a telnet interrupt as urgent data, the kernel drops the urgent LF
+			if strings.EqualFold(strings.TrimSpace(strings.TrimLeft(string(line), telnetCommands)), "ABOR") {
+				cancel(errTransferAborted)
+				s.pending = append(s.pending, "ABOR\r\n")
+				line, skipLF = line[:0], c == '\r'
+				continue
+			}
+			if c == '\n' {
+				s.pending = append(s.pending, string(line))
+				line = nil
+			}
+		}
+	}()
+
+	err := fn(ctx)
+	aborted := context.Cause(ctx)
+	s.conn.SetReadDeadline(time.Now())
+	<-done
+	s.conn.SetReadDeadline(time.Time{})
+	if aborted != nil && !errors.Is(aborted, errTransferAborted) {
+		// the session or the server ended
+		return fmt.Errorf("%w: %w", errTransferAborted, aborted)
+	}
+	if aborted != nil {
+		return aborted
+	}
+	return err
+}
+
 func (s *Session) RemoveCommand(cmd, arg string) error {
 	fileName := Abs(s.root, s.workingDir, arg)
-	err := s.ftpServer.FsHandler.Remove(fileName)
+	err := s.fsHandler().Remove(fileName)
 	if err != nil {
 		fmt.Fprintf(s.readWriter, "550 Error deleting file: %s\n", err.Error())
 		return nil
@@ -802,7 +924,7 @@ func (s *Session) RenameFromCommand(cmd, arg string) error {
 	}
 	renamingFile := Abs(s.root, s.workingDir, arg)
 
-	_, _, err := s.ftpServer.FsHandler.Stat(renamingFile)
+	_, _, err := s.fsHandler().Stat(renamingFile)
 	if err != nil {
 		fmt.Fprintf(s.readWriter, "550 Error getting file info: %s\r\n", err.Error())
 		return nil
@@ -823,7 +945,7 @@ func (s *Session) RenameToCommand(cmd, arg string) error {
 
 	newFileName := Abs(s.root, s.workingDir, arg)
 
-	err := s.ftpServer.FsHandler.Rename(s.renamingFile, newFileName)
+	err := s.fsHandler().Rename(s.renamingFile, newFileName)
 	if err != nil {
 		fmt.Fprintf(s.readWriter, "550 Error renaming file: %s\r\n", err.Error())
 		return nil
@@ -844,7 +966,20 @@ func (s *Session) SiteCommand(cmd, arg string) error {
 	if len(args) == 1 && strings.ToUpper(args[0]) == "HELP" {
 		fmt.Fprintf(s.readWriter, "214-The following commands are recognized.\n")
 		fmt.Fprintf(s.readWriter, " CHMOD\n")
+		fmt.Fprintf(s.readWriter, " QUOTA\n")
+		fmt.Fprintf(s.readWriter, " RESTORE\n")
+		fmt.Fprintf(s.readWriter, " FIND\n")
 		fmt.Fprintf(s.readWriter, "214 Help OK.\r\n")
+		return nil
+	}
+	if strings.ToUpper(args[0]) == "QUOTA" {
+		return s.QuotaCommand(cmd, arg)
+	}
+	if strings.ToUpper(args[0]) == "RESTORE" {
+		return s.RestoreCommand(cmd, arg)
+	}
+	if strings.ToUpper(args[0]) == "FIND" {
+		return s.FindCommand(cmd, arg)
 	}
 
 	if len(args) < 3 {
@@ -860,7 +995,7 @@ func (s *Session) SiteCommand(cmd, arg string) error {
 			fmt.Fprintf(s.readWriter, "501 Error parsing permissions: %s\r\n", err.Error())
 			return nil
 		}
-		err = s.ftpServer.FsHandler.SetStat(filepath.Join(s.workingDir, args[2]), os.FileMode(uint32(permInt)))
+		err = s.fsHandler().SetStat(filepath.Join(s.workingDir, args[2]), os.FileMode(uint32(permInt)))
 		if err != nil {
 			err = fmt.Errorf("550 Error changing permissions: %s", err.Error())
 			fmt.Fprintf(s.readWriter, "%s\r\n", err.Error())
@@ -876,6 +1011,165 @@ func (s *Session) SiteCommand(cmd, arg string) error {
 
 }
 
+// QuotaCommand handles the SITE QUOTA command from the client.
+// it reports the usage and the limits of the file system of the user, when it has a quota.
+func (s *Session) QuotaCommand(cmd, arg string) error {
+	quotaFS, ok := s.fsHandler().(interface{ Usage() filesystem.QuotaUsage })
+	if !ok {
+		fmt.Fprintf(s.readWriter, "202 No quota is set.\r\n")
+		return nil
+	}
+	usage := quotaFS.Usage()
+	limit := func(max int64) string {
+		if max <= 0 {
+			return "unlimited"
+		}
+		return strconv.FormatInt(max, 10)
+	}
+	fmt.Fprintf(s.readWriter, "200-Quota:\r\n")
+	fmt.Fprintf(s.readWriter, " Bytes used: %d of %s\r\n", usage.Bytes, limit(usage.MaxBytes))
+	fmt.Fprintf(s.readWriter, " Files used: %d of %s\r\n", usage.Files, limit(usage.MaxFiles))
+	fmt.Fprintf(s.readWriter, "200 End\r\n")
+	return nil
+}
+
+// RestoreCommand handles the SITE RESTORE command from the client.
+// "SITE RESTORE <path>" lists the deleted and previous versions of a file,
+// "SITE RESTORE <id> <path>" puts a version back to the file.
+func (s *Session) RestoreCommand(cmd, arg string) error {
+	trashFS, ok := s.fsHandler().(interface {
+		Entries(name string) ([]filesystem.TrashEntry, error)
+		Restore(name, id string) error
+	})
+	if !ok {
+		fmt.Fprintf(s.readWriter, "502 Versions are not kept.\r\n")
+		return nil
+	}
+	_, rest, _ := strings.Cut(arg, " ")
+	rest = strings.TrimSpace(rest)
+	if rest == "" {
+		fmt.Fprintf(s.readWriter, "501 Syntax: SITE RESTORE [<id>] <path>\r\n")
+		return nil
+	}
+
+	id, name, _ := strings.Cut(rest, " ")
+	entries, err := trashFS.Entries(Abs(s.root, s.workingDir, name))
+	if err != nil {
+		fmt.Fprintf(s.readWriter, "%d Error listing versions: %s\r\n", replyCode(err, 550, 550), err.Error())
+		return nil
+	}
+	restore := false
+	for _, entry := range entries {
+		restore = restore || entry.ID == id
+	}
+	if !restore {
+		// the argument is only a path, which can contain spaces
+		name = rest
+		if entries, err = trashFS.Entries(Abs(s.root, s.workingDir, name)); err != nil {
+			fmt.Fprintf(s.readWriter, "%d Error listing versions: %s\r\n", replyCode(err, 550, 550), err.Error())
+			return nil
+		}
+		fmt.Fprintf(s.readWriter, "200-Versions of %s:\r\n", name)
+		for _, entry := range entries {
+			fmt.Fprintf(s.readWriter, " %s %s %d %s\r\n", entry.ID, entry.Kind, entry.Size, entry.Time.Format(time.RFC3339))
+		}
+		fmt.Fprintf(s.readWriter, "200 End\r\n")
+		return nil
+	}
+
+	if err = trashFS.Restore(Abs(s.root, s.workingDir, name), id); err != nil {
+		fmt.Fprintf(s.readWriter, "%d Error restoring file: %s\r\n", replyCode(err, 550, 550), err.Error())
+		return nil
+	}
+	fmt.Fprintf(s.readWriter, "200 File %s restored.\r\n", name)
+	return nil
+}
+
+// findLimit is the number of results of SITE FIND without a limit, maxFindLimit is the maximum
+const (
+	findLimit    = 100
+	maxFindLimit = 1000
+)
+
+// findTimeout stops a SITE FIND that takes too long, the tests shorten it
+var findTimeout = 30 * time.Second
+
+// FindCommand handles the SITE FIND command from the client.
+// "SITE FIND [name=<glob>] [regex=<re>] [min_size=<n>] [max_size=<n>] [after=<time>] [before=<time>] [limit=<n>] [dirs] [<glob>]"
+// finds the files of the working directory and its subdirectories, the times are RFC 3339 or YYYYMMDDHHMMSS,
+// the results are the relative paths with their size and modification time
+func (s *Session) FindCommand(cmd, arg string) error {
+	_, rest, _ := strings.Cut(arg, " ")
+	query := filesystem.SearchQuery{Limit: findLimit}
+	for _, option := range strings.Fields(rest) {
+		key, value, ok := strings.Cut(option, "=")
+		var err error
+		switch strings.ToLower(key) {
+		case "name":
+			query.Glob = value
+		case "regex":
+			query.Regexp, err = regexp.Compile(value)
+		case "min_size":
+			query.MinSize, err = strconv.ParseInt(value, 10, 64)
+		case "max_size":
+			query.MaxSize, err = strconv.ParseInt(value, 10, 64)
+		case "after":
+			query.ModifiedAfter, err = parseFindTime(value)
+		case "before":
+			query.ModifiedBefore, err = parseFindTime(value)
+		case "limit":
+			if query.Limit, err = strconv.Atoi(value); err == nil && query.Limit <= 0 {
+				err = errors.New("the limit must be positive")
+			}
+			query.Limit = min(query.Limit, maxFindLimit)
+		case "dirs":
+			query.Dirs = true
+		default:
+			if ok {
+				err = errors.New("unknown option")
+			}
+			query.Glob = option
+		}
+		if err != nil {
+			fmt.Fprintf(s.readWriter, "501 Invalid option %s: %s\r\n", key, err.Error())
+			return nil
+		}
+	}
+	if query.Glob != "" {
+		if _, err := filepath.Match(query.Glob, ""); err != nil {
+			fmt.Fprintf(s.readWriter, "501 Invalid name pattern: %s\r\n", err.Error())
+			return nil
+		}
+	}
+
+	// the search stops when the session is closed
+	ctx, cancel := context.WithTimeoutCause(s.CTX, findTimeout, errors.New("search timed out"))
+	defer cancel()
+	results, truncated, err := filesystem.Search(ctx, s.fsHandler(), s.workingDir, query)
+	if err != nil {
+		fmt.Fprintf(s.readWriter, "%d Error searching: %s\r\n", replyCode(err, 550, 550), err.Error())
+		return nil
+	}
+	fmt.Fprintf(s.readWriter, "200-Found %d matches in %s:\r\n", len(results), s.workingDir)
+	for _, result := range results {
+		fmt.Fprintf(s.readWriter, " %s %d %s\r\n", result.Info.ModTime().UTC().Format("20060102150405"), result.Info.Size(), result.Path)
+	}
+	if truncated {
+		fmt.Fprintf(s.readWriter, "200 End, more files match, narrow the search or raise the limit\r\n")
+		return nil
+	}
+	fmt.Fprintf(s.readWriter, "200 End\r\n")
+	return nil
+}
+
+// parseFindTime parses a time of SITE FIND, RFC 3339 or the YYYYMMDDHHMMSS of MDTM in UTC
+func parseFindTime(value string) (time.Time, error) {
+	if t, err := time.Parse("20060102150405", value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
 func (s *Session) CloseCommand(cmd, arg string) error {
 	fmt.Fprintf(s.readWriter, "221 Goodbye.\r\n")
 	return nil
@@ -1,9 +1,14 @@
 package ftp
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"net/http"
+	"syscall"
 )
 
 // PublicIpUrl is the url to get the public ip of the server
@@ -22,3 +27,54 @@ func GetServerPublicIP() (string, error) {
 	}
 	return string(ftpServerIPv4), nil
 }
+
+// replyCode returns the reply code of a failed file system operation,
+// operations denied by the file system, like a write to a read only file system, get deniedCode
+// and operations exceeding the storage, like a quota, get 552
+func replyCode(err error, code, deniedCode int) int {
+	switch {
+	case errors.Is(err, syscall.ENOSPC):
+		return 552
+	case errors.Is(err, fs.ErrPermission):
+		return deniedCode
+	}
+	return code
+}
+
+// textReader converts the CRLF line endings of a type A (text) upload to the line endings of the server,
+// the lines have no length limit and the last line gets a line ending if it has none
+func textReader(r io.Reader) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		br := bufio.NewReader(r)
+		var err error
+		for err == nil {
+			var line []byte
+			line, err = br.ReadSlice('\n')
+			switch {
+			case errors.Is(err, bufio.ErrBufferFull):
+				// a long line is written in parts, a CR ending a part may be the start of the line ending
+				err = nil
+				if line[len(line)-1] == '\r' {
+					line = line[:len(line)-1]
+					_ = br.UnreadByte()
+				}
+			case err == nil:
+				line = append(bytes.TrimSuffix(line[:len(line)-1], []byte("\r")), '\n')
+			case errors.Is(err, io.EOF) && len(line) > 0:
+				line = append(bytes.TrimSuffix(line, []byte("\r")), '\n')
+			}
+			if len(line) == 0 {
+				continue
+			}
+			if _, writeErr := pw.Write(line); writeErr != nil && err == nil {
+				err = writeErr
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			err = nil
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
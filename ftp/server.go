@@ -31,6 +31,12 @@ type Server struct {
 	Addr string
 	// supportsTLS is a flag to indicate if the server supports TLS
 	FsHandler filesystem.FS
+	// FileSystem is the context aware file system of the transfers, when it is nil FsHandler is adapted,
+	// it must serve the same files as FsHandler
+	FileSystem filesystem.FileSystem
+	// UserFS, if set, returns the file system of a user when it logs in, the sessions of the user are served from it
+	// instead of FsHandler and FileSystem, e.g. the FS of a UserQuotas for a quota per user
+	UserFS func(user string) (filesystem.FS, error)
 	// Root is the server root directory
 	Root string
 	//  sessionManager is the server session manager
@@ -58,6 +64,14 @@ type Server struct {
 	logger *slog.Logger
 }
 
+// fileSystem returns the file system of the transfers, FileSystem or else the current FsHandler adapted
+func (s *Server) fileSystem() filesystem.FileSystem {
+	if s.FileSystem != nil {
+		return s.FileSystem
+	}
+	return filesystem.AdaptFS(s.FsHandler)
+}
+
 // NewServer creates a new FTP server
 func NewServer(addr string, fsHandler filesystem.FS, users Users) (*Server, error) {
 	s := &Server{
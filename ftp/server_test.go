@@ -0,0 +1,438 @@
+package ftp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/telebroad/fileserver/filesystem"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testUsers struct{}
+
+func (testUsers) FindUser(_ context.Context, username, password, _ string) (any, error) {
+	if (username == "user" || username == "other") && password == "pass" {
+		return username, nil
+	}
+	return nil, errors.New("invalid credentials")
+}
+
+// startTestServer starts a server of the file system on a free local port and returns its address
+func startTestServer(t *testing.T, fsys filesystem.FS, configure func(s *Server)) string {
+	t.Helper()
+	s, err := NewServer("127.0.0.1:0", fsys, testUsers{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetLogger(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	// the passive data connections listen on a free port
+	s.PasvMinPort, s.PasvMaxPort = 0, 0
+	if configure != nil {
+		configure(s)
+	}
+	if err = s.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve()
+	t.Cleanup(func() {
+		s.Close(nil)
+		s.Wait()
+	})
+	return s.listener.Addr().String()
+}
+
+// testClient is a client of the control connection of a test server
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// dialTestServer connects and logs in as the user
+func dialTestServer(t *testing.T, addr, user string) *testClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	c := &testClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+	c.expect(220)
+	c.cmd(331, "USER %s", user)
+	c.cmd(230, "PASS pass")
+	return c
+}
+
+// send sends a command without reading the reply
+func (c *testClient) send(format string, args ...any) {
+	c.t.Helper()
+	if _, err := fmt.Fprintf(c.conn, format+"\r\n", args...); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// reply reads a reply, the lines of a multi-line reply are joined with a line feed
+func (c *testClient) reply() (int, string) {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var lines []string
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			c.t.Fatalf("reading the reply: %v, got %q", err, lines)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		lines = append(lines, line)
+		if len(lines) == 1 && (len(line) < 4 || line[3] != '-') {
+			break
+		}
+		if len(lines) > 1 && len(line) >= 4 && line[:3] == lines[0][:3] && line[3] == ' ' {
+			break
+		}
+	}
+	code, err := strconv.Atoi(lines[0][:3])
+	if err != nil {
+		c.t.Fatalf("invalid reply %q", lines)
+	}
+	return code, strings.Join(lines, "\n")
+}
+
+// expect reads a reply and fails unless it has the code
+func (c *testClient) expect(code int) string {
+	c.t.Helper()
+	got, text := c.reply()
+	if got != code {
+		c.t.Fatalf("expected a %d reply, got %q", code, text)
+	}
+	return text
+}
+
+// cmd sends a command and reads its reply, it fails unless the reply has the code
+func (c *testClient) cmd(code int, format string, args ...any) string {
+	c.t.Helper()
+	c.send(format, args...)
+	return c.expect(code)
+}
+
+// passive enters the extended passive mode and connects the data connection
+func (c *testClient) passive() net.Conn {
+	c.t.Helper()
+	text := c.cmd(229, "EPSV")
+	port := strings.TrimSuffix(text[strings.Index(text, "(|||")+4:], "|)")
+	data, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", port))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.t.Cleanup(func() { data.Close() })
+	return data
+}
+
+// readFile returns the content of the file of the memory file system
+func readFile(t *testing.T, m *filesystem.MemFS, name string) string {
+	t.Helper()
+	var b strings.Builder
+	if _, err := m.ReadFile(name, &b); err != nil {
+		t.Fatalf("read %s: %v", name, err)
+	}
+	return b.String()
+}
+
+func TestServer_userQuota(t *testing.T) {
+	homes := map[string]*filesystem.MemFS{"user": filesystem.NewMemFS(), "other": filesystem.NewMemFS()}
+	quotas := filesystem.NewUserQuotas(func(user string) (filesystem.FS, error) {
+		if home, ok := homes[user]; ok {
+			return home, nil
+		}
+		return nil, fs.ErrNotExist
+	}, 10, 0)
+	addr := startTestServer(t, filesystem.NewMemFS(), func(s *Server) {
+		s.UserFS = func(user string) (filesystem.FS, error) {
+			return quotas.FS(user)
+		}
+	})
+
+	user := dialTestServer(t, addr, "user")
+	data := user.passive()
+	user.cmd(150, "STOR a.txt")
+	data.Write([]byte("12345678"))
+	data.Close()
+	user.expect(226)
+	if got := readFile(t, homes["user"], "/a.txt"); got != "12345678" {
+		t.Fatalf("expected the upload in the file system of the user, got %q", got)
+	}
+
+	// the quota is per user, the files of the other users don't count
+	other := dialTestServer(t, addr, "other")
+	if text := other.cmd(200, "SITE QUOTA"); !strings.Contains(text, "Bytes used: 0 of 10") {
+		t.Fatalf("unexpected quota of other %q", text)
+	}
+	if text := user.cmd(200, "SITE QUOTA"); !strings.Contains(text, "Bytes used: 8 of 10") || !strings.Contains(text, "Files used: 1 of unlimited") {
+		t.Fatalf("unexpected quota of user %q", text)
+	}
+	data = user.passive()
+	user.cmd(150, "STOR b.txt")
+	data.Write([]byte("12345678"))
+	data.Close()
+	user.expect(552)
+}
+
+func TestServer_quotaCommand(t *testing.T) {
+	// a file system without a quota
+	addr := startTestServer(t, filesystem.NewMemFS(), nil)
+	dialTestServer(t, addr, "user").cmd(202, "SITE QUOTA")
+
+	quota, err := filesystem.NewQuotaFS(filesystem.NewMemFS(), 0, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr = startTestServer(t, quota, nil)
+	text := dialTestServer(t, addr, "user").cmd(200, "SITE QUOTA")
+	if !strings.Contains(text, "Bytes used: 0 of unlimited") || !strings.Contains(text, "Files used: 0 of 5") {
+		t.Fatalf("unexpected quota %q", text)
+	}
+}
+
+func TestServer_userFSError(t *testing.T) {
+	addr := startTestServer(t, filesystem.NewMemFS(), func(s *Server) {
+		s.UserFS = func(user string) (filesystem.FS, error) {
+			return nil, fs.ErrNotExist
+		}
+	})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := &testClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+	c.expect(220)
+	c.cmd(331, "USER user")
+	c.cmd(530, "PASS pass")
+}
+
+func TestServer_restoreCommand(t *testing.T) {
+	m := filesystem.NewMemFS()
+	trash := filesystem.NewTrashFS(m, 5, time.Hour)
+	m.MakeDir("/my dir")
+	for _, name := range []string{"/a.txt", "/my dir/b c.txt"} {
+		trash.WriteFile(name, strings.NewReader("v1"), "I", false)
+		trash.WriteFile(name, strings.NewReader("v2"), "I", false)
+	}
+	c := dialTestServer(t, startTestServer(t, trash, nil), "user")
+
+	text := c.cmd(200, "SITE RESTORE a.txt")
+	entries, _ := trash.Entries("/a.txt")
+	if len(entries) != 1 || !strings.Contains(text, entries[0].ID+" version 2 ") {
+		t.Fatalf("unexpected versions %q of %+v", text, entries)
+	}
+	c.cmd(200, "SITE RESTORE %s a.txt", entries[0].ID)
+	if got := readFile(t, m, "/a.txt"); got != "v1" {
+		t.Fatalf("expected the version to be restored, got %q", got)
+	}
+
+	// the whole argument is the path when it doesn't start with an id
+	entries, _ = trash.Entries("/my dir/b c.txt")
+	if text = c.cmd(200, "SITE RESTORE my dir/b c.txt"); len(entries) != 1 || !strings.Contains(text, "Versions of my dir/b c.txt") || !strings.Contains(text, entries[0].ID) {
+		t.Fatalf("unexpected versions %q of %+v", text, entries)
+	}
+	c.cmd(250, "CWD my dir")
+	c.cmd(200, "SITE RESTORE %s b c.txt", entries[0].ID)
+	if got := readFile(t, m, "/my dir/b c.txt"); got != "v1" {
+		t.Fatalf("expected the version of the path with spaces to be restored, got %q", got)
+	}
+	if text = c.cmd(200, "SITE RESTORE unknown b c.txt"); !strings.Contains(text, "Versions of unknown b c.txt") {
+		t.Fatalf("expected an unknown id to list the versions of the whole argument, got %q", text)
+	}
+	c.cmd(501, "SITE RESTORE")
+
+	// the trash isn't listed
+	data := c.passive()
+	c.cmd(250, "CWD /")
+	c.cmd(150, "MLSD")
+	listing, _ := io.ReadAll(data)
+	c.expect(226)
+	if strings.Contains(string(listing), ".trash") || !strings.Contains(string(listing), "a.txt") {
+		t.Fatalf("unexpected listing %q", listing)
+	}
+
+	dialTestServer(t, startTestServer(t, m, nil), "user").cmd(502, "SITE RESTORE a.txt")
+}
+
+func TestServer_abort(t *testing.T) {
+	m := filesystem.NewMemFS()
+	m.WriteFile("/big.bin", bytes.NewReader(make([]byte, 32<<20)), "I", false)
+	c := dialTestServer(t, startTestServer(t, m, nil), "user")
+
+	// an ABOR during a download closes the data connection
+	data := c.passive()
+	c.cmd(150, "RETR big.bin")
+	if _, err := io.ReadFull(data, make([]byte, 1024)); err != nil {
+		t.Fatal(err)
+	}
+	c.send("\xff\xf4\xf2ABOR")
+	c.expect(426)
+	c.expect(226)
+	c.cmd(200, "NOOP")
+
+	// and during an upload
+	data = c.passive()
+	c.cmd(150, "STOR up.bin")
+	if _, err := data.Write(make([]byte, 1024)); err != nil {
+		t.Fatal(err)
+	}
+	c.send("ABOR")
+	c.expect(426)
+	c.expect(226)
+	c.cmd(200, "NOOP")
+
+	// the session can transfer again
+	data = c.passive()
+	c.cmd(150, "STOR up.bin")
+	data.Write([]byte("hello"))
+	data.Close()
+	c.expect(226)
+	if got := readFile(t, m, "/up.bin"); got != "hello" {
+		t.Fatalf("expected the upload after the aborts, got %q", got)
+	}
+}
+
+func TestServer_pipelined(t *testing.T) {
+	m := filesystem.NewMemFS()
+	c := dialTestServer(t, startTestServer(t, m, nil), "user")
+
+	// the commands received during a transfer are answered after it, a partial command is completed later
+	data := c.passive()
+	c.cmd(150, "STOR a.txt")
+	data.Write([]byte("hello"))
+	c.conn.Write([]byte("PWD\r\nNO"))
+	time.Sleep(50 * time.Millisecond)
+	data.Close()
+	c.expect(226)
+	c.expect(257)
+	c.send("OP")
+	c.expect(200)
+	if got := readFile(t, m, "/a.txt"); got != "hello" {
+		t.Fatalf("unexpected upload %q", got)
+	}
+}
+
+func TestServer_textUpload(t *testing.T) {
+	m := filesystem.NewMemFS()
+	c := dialTestServer(t, startTestServer(t, m, nil), "user")
+
+	// the lines longer than the buffers are kept, the CR of a line ending can end a buffer
+	long := strings.Repeat("x", 4095)
+	huge := strings.Repeat("y", 100_000)
+	c.cmd(200, "TYPE A")
+	data := c.passive()
+	c.cmd(150, "STOR a.txt")
+	data.Write([]byte("a\r\nb\n" + long + "\r\n" + huge + "\r\nlast"))
+	data.Close()
+	c.expect(226)
+	if got, want := readFile(t, m, "/a.txt"), "a\nb\n"+long+"\n"+huge+"\nlast\n"; got != want {
+		t.Fatalf("unexpected text upload of %d bytes, want %d", len(got), len(want))
+	}
+
+	c.cmd(200, "TYPE I")
+	data = c.passive()
+	c.cmd(150, "STOR b.txt")
+	data.Write([]byte("a\r\nb"))
+	data.Close()
+	c.expect(226)
+	if got := readFile(t, m, "/b.txt"); got != "a\r\nb" {
+		t.Fatalf("expected the binary upload unchanged, got %q", got)
+	}
+}
+
+// findPaths returns the paths of the results of a SITE FIND reply
+func findPaths(text string) string {
+	var paths []string
+	for _, line := range strings.Split(text, "\n") {
+		if fields := strings.Fields(line); strings.HasPrefix(line, " ") && len(fields) == 3 {
+			paths = append(paths, fields[2])
+		}
+	}
+	return strings.Join(paths, ",")
+}
+
+func TestServer_findCommand(t *testing.T) {
+	m := filesystem.NewMemFS()
+	m.MakeDir("/calls")
+	m.MakeDir("/calls/2024")
+	m.MakeDir("/calls/2025")
+	m.WriteFile("/calls/2024/a.wav", strings.NewReader("aaaa"), "I", false)
+	m.WriteFile("/calls/2025/b.wav", strings.NewReader("bbbbbbbb"), "I", false)
+	m.WriteFile("/calls/2025/b.txt", strings.NewReader("b"), "I", false)
+	m.ModifyTime("/calls/2024/a.wav", "20240101120000")
+	c := dialTestServer(t, startTestServer(t, m, nil), "user")
+
+	for options, want := range map[string]string{
+		"*.wav":                                 "calls/2024/a.wav,calls/2025/b.wav",
+		"name=*.wav min_size=5":                 "calls/2025/b.wav",
+		"name=*.wav max_size=4":                 "calls/2024/a.wav",
+		`regex=\.txt$`:                          "calls/2025/b.txt",
+		"before=20240601000000":                 "calls/2024/a.wav",
+		"after=2024-06-01T00:00:00Z name=*.wav": "calls/2025/b.wav",
+		"dirs name=2025":                        "calls/2025",
+		"name=2025":                             "",
+		"LIMIT=1 *.wav":                         "calls/2024/a.wav",
+		"limit=5000 name=*.txt":                 "calls/2025/b.txt",
+		"min_size=100":                          "",
+	} {
+		if got := findPaths(c.cmd(200, "SITE FIND %s", options)); got != want {
+			t.Errorf("SITE FIND %s: expected %q, got %q", options, want, got)
+		}
+	}
+	if text := c.cmd(200, "SITE FIND limit=1 *.wav"); !strings.Contains(text, "200 End, more files match") {
+		t.Fatalf("expected the truncated search to be reported, got %q", text)
+	}
+	for _, options := range []string{"limit=0", "limit=-1", "limit=x", "min_size=x", "max_size=1k", "regex=(", "after=yesterday", "before=2024", "color=red", "name=["} {
+		c.cmd(501, "SITE FIND %s", options)
+	}
+
+	// the search is in the working directory
+	c.cmd(250, "CWD calls/2025")
+	if got := findPaths(c.cmd(200, "SITE FIND *.wav")); got != "b.wav" {
+		t.Fatalf("expected the paths relative to the working directory, got %q", got)
+	}
+}
+
+func TestServer_findLimit(t *testing.T) {
+	m := filesystem.NewMemFS()
+	for i := 0; i < maxFindLimit+5; i++ {
+		m.WriteFile(fmt.Sprintf("/f%04d.txt", i), strings.NewReader("x"), "I", false)
+	}
+	c := dialTestServer(t, startTestServer(t, m, nil), "user")
+
+	text := c.cmd(200, "SITE FIND *.txt")
+	if !strings.HasPrefix(text, fmt.Sprintf("200-Found %d matches", findLimit)) || !strings.Contains(text, "more files match") {
+		t.Fatalf("expected the default limit, got %.100q", text)
+	}
+	// a larger limit is capped
+	text = c.cmd(200, "SITE FIND limit=5000 *.txt")
+	if !strings.HasPrefix(text, fmt.Sprintf("200-Found %d matches", maxFindLimit)) || !strings.Contains(text, "more files match") {
+		t.Fatalf("expected the limit to be capped, got %.100q", text)
+	}
+}
+
+func TestServer_findTimeout(t *testing.T) {
+	timeout := findTimeout
+	t.Cleanup(func() { findTimeout = timeout })
+	findTimeout = 0
+	m := filesystem.NewMemFS()
+	m.WriteFile("/a.txt", strings.NewReader("a"), "I", false)
+	c := dialTestServer(t, startTestServer(t, m, nil), "user")
+
+	if text := c.cmd(550, "SITE FIND *.txt"); !strings.Contains(text, "search timed out") {
+		t.Fatalf("expected the search to time out, got %q", text)
+	}
+	c.cmd(200, "NOOP")
+}
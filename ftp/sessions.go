@@ -2,6 +2,7 @@ package ftp
 
 import (
 	"context"
+	"github.com/telebroad/fileserver/filesystem"
 	"github.com/telebroad/fileserver/tools"
 	"net"
 	"sync"
@@ -24,9 +25,28 @@ type Session struct {
 	dataListenerPortRangeEnd   int                     // data transfer connection port range
 	renamingFile               string                  // File to be renamed
 	HelpCommands               string
+	pending                    []string      // Commands received during a transfer
+	partial                    string        // Part of a command received when a transfer ended
+	fs                         filesystem.FS // File system of the user given by Server.UserFS, nil is the FsHandler of the server
 	CTX                        context.Context
 }
 
+// fsHandler returns the file system of the session
+func (s *Session) fsHandler() filesystem.FS {
+	if s.fs != nil {
+		return s.fs
+	}
+	return s.ftpServer.FsHandler
+}
+
+// fileSystem returns the file system of the transfers of the session
+func (s *Session) fileSystem() filesystem.FileSystem {
+	if s.fs != nil {
+		return filesystem.AdaptFS(s.fs)
+	}
+	return s.ftpServer.fileSystem()
+}
+
 // SessionManager manages all active sessions.
 type SessionManager struct {
 	sessions map[string]*Session // Map of active sessions
@@ -0,0 +1,181 @@
+// streamed archives of the directories of the http file server
+
+package httphandler
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// archiveWriter writes the files of a directory to an archive
+type archiveWriter interface {
+	// add adds the file, content writes the data of a regular file
+	add(name string, info fs.FileInfo, content func(io.Writer) error) error
+	Close() error
+}
+
+// zipArchive is a deflated zip archive
+type zipArchive struct {
+	*zip.Writer
+}
+
+func (a *zipArchive) add(name string, info fs.FileInfo, content func(io.Writer) error) error {
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	if info.IsDir() {
+		header.Name += "/"
+	} else {
+		header.Method = zip.Deflate
+	}
+	w, err := a.CreateHeader(header)
+	if err != nil || content == nil {
+		return err
+	}
+	return content(w)
+}
+
+// tarArchive is a gzipped tar archive
+type tarArchive struct {
+	*tar.Writer
+	gz *gzip.Writer
+}
+
+func (a *tarArchive) add(name string, info fs.FileInfo, content func(io.Writer) error) error {
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	if info.IsDir() {
+		header.Name += "/"
+	}
+	if err = a.WriteHeader(header); err != nil || content == nil {
+		return err
+	}
+	return content(a.Writer)
+}
+
+func (a *tarArchive) Close() error {
+	if err := a.Writer.Close(); err != nil {
+		return err
+	}
+	return a.gz.Close()
+}
+
+// Archive streams the directory, or the selected files of the directory, as a zip or tar.gz archive,
+// `GET /dir/?archive=zip|tar.gz` or `POST /dir/?archive=zip|tar.gz` with `files` form values
+func (s *FileServer) Archive(w http.ResponseWriter, r *http.Request) {
+	dir := s.fsPath(r.URL.Path)
+	_, info, err := s.localDirFS.Stat(dir)
+	if err != nil {
+		http.Error(w, "Directory not found", errorStatus(err))
+		return
+	}
+	if !info.IsDir() {
+		http.Error(w, "Only directories can be archived", http.StatusBadRequest)
+		return
+	}
+
+	// the selected files are relative to the directory and can't leave it,
+	// they are checked before streaming so a missing file is reported
+	var selected []string
+	infos := map[string]fs.FileInfo{}
+	if r.Method == http.MethodPost {
+		if err = r.ParseForm(); err != nil {
+			http.Error(w, "Invalid form", http.StatusBadRequest)
+			return
+		}
+		for _, file := range r.PostForm["files"] {
+			file = strings.TrimPrefix(path.Clean("/"+file), "/")
+			if _, ok := infos[file]; ok || file == "" {
+				continue
+			}
+			if _, infos[file], err = s.localDirFS.Lstat(path.Join(dir, file)); err != nil {
+				http.Error(w, "File "+file+" not found", errorStatus(err))
+				return
+			}
+			selected = append(selected, file)
+		}
+		if len(selected) == 0 {
+			http.Error(w, "No files selected", http.StatusBadRequest)
+			return
+		}
+	}
+
+	archiveName := path.Base(dir)
+	if archiveName == "/" || archiveName == "." {
+		archiveName = "files"
+	}
+	var archive archiveWriter
+	switch r.URL.Query().Get("archive") {
+	case "zip":
+		w.Header().Set("Content-Type", "application/zip")
+		archive = &zipArchive{Writer: zip.NewWriter(w)}
+	case "tar.gz":
+		w.Header().Set("Content-Type", "application/gzip")
+		gz := gzip.NewWriter(w)
+		archive = &tarArchive{Writer: tar.NewWriter(gz), gz: gz}
+	default:
+		http.Error(w, "Unsupported archive format, zip or tar.gz", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", archiveName+"."+r.URL.Query().Get("archive")))
+
+	// once streaming the status is sent, a failure leaves an incomplete archive
+	if selected == nil {
+		err = s.addToArchive(archive, dir, "", info)
+	}
+	for _, file := range selected {
+		if err = s.addToArchive(archive, path.Join(dir, file), file, infos[file]); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = archive.Close()
+	}
+	if err != nil {
+		s.Logger().Error("Error streaming archive", "dir", dir, "error", err)
+	}
+}
+
+// addToArchive adds the file, or the directory with its content, symlinks and special files are skipped
+func (s *FileServer) addToArchive(archive archiveWriter, name, archiveName string, info fs.FileInfo) error {
+	switch {
+	case info.IsDir():
+		if archiveName != "" {
+			if err := archive.add(archiveName, info, nil); err != nil {
+				return err
+			}
+		}
+		_, infos, err := s.localDirFS.Dir(name)
+		if err != nil {
+			return err
+		}
+		for _, child := range infos {
+			// the listing of some file systems follows the links
+			childName := path.Join(name, child.Name())
+			if _, child, err = s.localDirFS.Lstat(childName); err != nil {
+				return err
+			}
+			if err = s.addToArchive(archive, childName, path.Join(archiveName, child.Name()), child); err != nil {
+				return err
+			}
+		}
+	case info.Mode().IsRegular():
+		return archive.add(archiveName, info, func(w io.Writer) error {
+			_, err := s.localDirFS.ReadFile(name, w)
+			return err
+		})
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package httphandler
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// zipFiles returns the names and the contents of the files of the zip archive
+func zipFiles(t *testing.T, data []byte) map[string]string {
+	t.Helper()
+	z, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{}
+	for _, f := range z.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[f.Name] = string(content)
+	}
+	return files
+}
+
+// tarFiles returns the names and the contents of the files of the tar.gz archive
+func tarFiles(t *testing.T, data []byte) map[string]string {
+	t.Helper()
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{}
+	r := tar.NewReader(gz)
+	for {
+		header, err := r.Next()
+		if err == io.EOF {
+			return files
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[header.Name] = string(content)
+	}
+}
+
+// archiveNames returns the sorted names of the archive
+func archiveNames(files map[string]string) string {
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+func TestFileServer_archive(t *testing.T) {
+	s, m := newTestServer(t)
+	m.WriteFile("/secret.txt", strings.NewReader("secret"), "I", false)
+	m.MakeDir("/dir")
+	m.MakeDir("/dir/sub")
+	m.WriteFile("/dir/a.txt", strings.NewReader("a"), "I", false)
+	m.WriteFile("/dir/sub/b.txt", strings.NewReader("b"), "I", false)
+	m.Symlink("/dir/link.txt", "/secret.txt")
+
+	w := serve(s, httptest.NewRequest(http.MethodGet, "/files/dir/?archive=zip", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Disposition") != `attachment; filename="dir.zip"` {
+		t.Fatalf("zip: %d %q", w.Code, w.Header().Get("Content-Disposition"))
+	}
+	files := zipFiles(t, w.Body.Bytes())
+	if archiveNames(files) != "a.txt,sub/,sub/b.txt" || files["sub/b.txt"] != "b" {
+		t.Fatalf("unexpected zip %v", files)
+	}
+
+	w = serve(s, httptest.NewRequest(http.MethodGet, "/files/?archive=tar.gz", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Disposition") != `attachment; filename="files.tar.gz"` {
+		t.Fatalf("tar.gz: %d %q", w.Code, w.Header().Get("Content-Disposition"))
+	}
+	if files = tarFiles(t, w.Body.Bytes()); archiveNames(files) != "dir/,dir/a.txt,dir/sub/,dir/sub/b.txt,secret.txt" {
+		t.Fatalf("unexpected tar.gz %v", files)
+	}
+
+	// the selected files can't leave the directory, the links are skipped
+	form := url.Values{"files": {"a.txt", "../dir/sub/b.txt", "a.txt"}}
+	r := httptest.NewRequest(http.MethodPost, "/files/dir/?archive=zip", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if w = serve(s, r); w.Code != http.StatusNotFound {
+		t.Fatalf("selected file outside the directory: expected 404, got %d", w.Code)
+	}
+	form = url.Values{"files": {"a.txt", "/sub/../sub/b.txt", "a.txt", "link.txt"}}
+	r = httptest.NewRequest(http.MethodPost, "/files/dir/?archive=zip", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if w = serve(s, r); w.Code != http.StatusOK {
+		t.Fatalf("selected files: %d %s", w.Code, w.Body)
+	}
+	if files = zipFiles(t, w.Body.Bytes()); archiveNames(files) != "a.txt,sub/b.txt" {
+		t.Fatalf("unexpected selected files %v", files)
+	}
+
+	for _, test := range []struct {
+		method, target, form string
+		want                 int
+	}{
+		{http.MethodGet, "/files/dir/?archive=rar", "", http.StatusBadRequest},
+		{http.MethodGet, "/files/dir/a.txt?archive=zip", "", http.StatusBadRequest},
+		{http.MethodGet, "/files/missing/?archive=zip", "", http.StatusNotFound},
+		{http.MethodPost, "/files/dir/?archive=zip", "", http.StatusBadRequest},
+		{http.MethodPost, "/files/dir/?archive=zip", "files=..%2F", http.StatusBadRequest},
+	} {
+		r = httptest.NewRequest(test.method, test.target, strings.NewReader(test.form))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if w = serve(s, r); w.Code != test.want {
+			t.Errorf("%s %s %q: expected %d, got %d", test.method, test.target, test.form, test.want, w.Code)
+		}
+	}
+}
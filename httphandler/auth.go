@@ -0,0 +1,81 @@
+// authentication and permissions of the http handlers
+
+package httphandler
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// the permissions of the requests, like users.ScopeRead
+const (
+	scopeRead   = "read"
+	scopeWrite  = "write"
+	scopeDelete = "delete"
+)
+
+// scoped is a user with permissions, like *users.Principal, a user without scopes is allowed everything
+type scoped interface {
+	HasScope(scope string) bool
+}
+
+// requiredScopes returns the permissions of the request, reads, writes and deletes,
+// a move deletes its source so it needs both write and delete
+func requiredScopes(r *http.Request) []string {
+	query := r.URL.Query()
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, "PROPFIND":
+		return []string{scopeRead}
+	case http.MethodDelete:
+		return []string{scopeDelete}
+	case "MOVE":
+		return []string{scopeWrite, scopeDelete}
+	case http.MethodPost:
+		switch {
+		case query.Has("archive"):
+			return []string{scopeRead}
+		case query.Has("move"):
+			return []string{scopeWrite, scopeDelete}
+		case query.Has("share") && !strings.EqualFold(r.PostFormValue("method"), http.MethodPut):
+			return []string{scopeRead}
+		}
+	}
+	return []string{scopeWrite}
+}
+
+// authorize verifies the user of the request and its permissions,
+// it responds 401 to an unknown user, 403 to a user without the permission, and reports false
+func authorize(users Users, w http.ResponseWriter, r *http.Request) bool {
+	if users == nil {
+		return true
+	}
+	user, err := users.VerifyUser(r)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Basic realm="Restricted"`)
+		w.Header().Add("WWW-Authenticate", `Bearer realm="Restricted"`)
+		http.Error(w, "Unauthorized! "+err.Error(), http.StatusUnauthorized)
+		return false
+	}
+	if user, ok := user.(scoped); ok {
+		for _, scope := range requiredScopes(r) {
+			if !user.HasScope(scope) {
+				http.Error(w, "Forbidden, the "+scope+" permission is required", http.StatusForbidden)
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// redactedURL returns the url of the request for the logs, without the signature of a signed link
+func redactedURL(u *url.URL) string {
+	if !u.Query().Has(signatureParam) {
+		return u.String()
+	}
+	redacted := *u
+	query := u.Query()
+	query.Set(signatureParam, "REDACTED")
+	redacted.RawQuery = query.Encode()
+	return redacted.String()
+}
@@ -0,0 +1,140 @@
+package httphandler
+
+import (
+	"github.com/telebroad/fileserver/filesystem"
+	"github.com/telebroad/fileserver/users"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestRequiredScopes(t *testing.T) {
+	read, write, del, move := []string{scopeRead}, []string{scopeWrite}, []string{scopeDelete}, []string{scopeWrite, scopeDelete}
+	for _, test := range []struct {
+		method, target, form string
+		want                 []string
+	}{
+		{http.MethodGet, "/files/a.txt", "", read},
+		{http.MethodHead, "/files/a.txt", "", read},
+		{http.MethodOptions, "/files/a.txt", "", read},
+		{http.MethodGet, "/files/a.txt?versions", "", read},
+		{http.MethodGet, "/files/?archive=zip", "", read},
+		{http.MethodGet, "/files/?search=x", "", read},
+		{http.MethodGet, "/files/a.txt?stat", "", read},
+		{"PROPFIND", "/dav/", "", read},
+		{http.MethodPut, "/files/a.txt", "", write},
+		{http.MethodPatch, "/files/a.txt", "", write},
+		{http.MethodPost, "/files/", "", write},
+		{http.MethodPost, "/files/?upload", "", write},
+		{http.MethodPost, "/files/?mkdir", "name=x", write},
+		{http.MethodPost, "/files/a.txt?restore=1", "", write},
+		{http.MethodPost, "/tus/", "", write},
+		{"MKCOL", "/dav/dir", "", write},
+		{"COPY", "/dav/a.txt", "", write},
+		{"PROPPATCH", "/dav/a.txt", "", write},
+		{"LOCK", "/dav/a.txt", "", write},
+		{"UNLOCK", "/dav/a.txt", "", write},
+		{http.MethodDelete, "/files/a.txt", "", del},
+		{"MOVE", "/dav/a.txt", "", move},
+		{http.MethodPost, "/files/a.txt?move", "to=b.txt", move},
+		{http.MethodPost, "/files/?archive=zip", "files=a.txt", read},
+		{http.MethodPost, "/files/a.txt?share", "", read},
+		{http.MethodPost, "/files/a.txt?share", "method=get", read},
+		{http.MethodPost, "/files/a.txt?share", "method=put", write},
+		{http.MethodPost, "/files/a.txt?share", "method=PUT", write},
+		{http.MethodPost, "/files/a.txt?share&archive=zip&move", "", read},
+		{"UNKNOWN", "/files/a.txt", "", write},
+	} {
+		r := httptest.NewRequest(test.method, test.target, strings.NewReader(test.form))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if got := requiredScopes(r); !slices.Equal(got, test.want) {
+			t.Errorf("%s %s %q: expected %v, got %v", test.method, test.target, test.form, test.want, got)
+		}
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	keys := users.NewAPIKeys()
+	keys.Add("reader", "reader-key-0123456789", users.ScopeRead)
+	keys.Add("writer", "writer-key-0123456789", users.ScopeRead, users.ScopeWrite)
+	keys.Add("deleter", "deleter-key-0123456789", users.ScopeRead, users.ScopeDelete)
+	keys.Add("admin", "admin-key-0123456789", users.AllScopes...)
+	authenticator := &users.Authenticator{APIKeys: keys}
+
+	m := filesystem.NewMemFS()
+	handlers := map[string]http.Handler{
+		"/files/": NewFileServerHandler("/files/", m, authenticator),
+		"/dav/":   NewWebDAVHandler("/dav/", m, authenticator),
+		"/tus/":   NewTusHandler("/tus/", m, filesystem.NewMemFS(), authenticator),
+	}
+
+	for _, test := range []struct {
+		method, target string
+		allowed        []string
+	}{
+		{http.MethodGet, "/files/a.txt", []string{"reader", "writer", "deleter", "admin"}},
+		{http.MethodPut, "/files/a.txt", []string{"writer", "admin"}},
+		{http.MethodDelete, "/files/a.txt", []string{"deleter", "admin"}},
+		{http.MethodPost, "/files/a.txt?move", []string{"admin"}},
+		{"PROPFIND", "/dav/a.txt", []string{"reader", "writer", "deleter", "admin"}},
+		{"MOVE", "/dav/a.txt", []string{"admin"}},
+		{"COPY", "/dav/a.txt", []string{"writer", "admin"}},
+		{http.MethodDelete, "/dav/a.txt", []string{"deleter", "admin"}},
+		{http.MethodPost, "/tus/", []string{"writer", "admin"}},
+		{http.MethodHead, "/tus/0123", []string{"reader", "writer", "deleter", "admin"}},
+	} {
+		prefix := "/" + strings.SplitN(test.target, "/", 3)[1] + "/"
+		for _, user := range []string{"", "unknown", "reader", "writer", "deleter", "admin"} {
+			m.WriteFile("/a.txt", strings.NewReader("a"), "I", false)
+			r := formRequest(test.target, url.Values{"to": {"b.txt"}}, testCSRFToken)
+			r.Method = test.method
+			r.Header.Set(csrfHeader, testCSRFToken)
+			if user != "" {
+				r.Header.Set("X-API-Key", user+"-key-0123456789")
+			}
+			// the permission is checked before the request is served, the status of the handler doesn't matter
+			w := serve(handlers[prefix], r)
+			denied := w.Code == http.StatusForbidden && strings.Contains(w.Body.String(), "permission is required")
+			switch {
+			case user == "" || user == "unknown":
+				if w.Code != http.StatusUnauthorized || len(w.Header().Values("WWW-Authenticate")) != 2 {
+					t.Errorf("%s %s by %q: expected 401 with the challenges, got %d", test.method, test.target, user, w.Code)
+				}
+				if strings.Contains(w.Body.String(), "key-0123456789") {
+					t.Errorf("%s %s by %q: the key is in the response", test.method, test.target, user)
+				}
+			case slices.Contains(test.allowed, user):
+				if w.Code == http.StatusUnauthorized || denied {
+					t.Errorf("%s %s by %s: expected to be allowed, got %d", test.method, test.target, user, w.Code)
+				}
+			default:
+				if !denied {
+					t.Errorf("%s %s by %s: expected 403, got %d", test.method, test.target, user, w.Code)
+				}
+			}
+		}
+	}
+}
+
+func TestAuthorize_scopeless(t *testing.T) {
+	// a user without HasScope, like the ftp users, is allowed everything
+	local := users.NewLocalUsers(nil)
+	local.Add("bob", "password").AddIP("*")
+	s, m := newTestServer(t)
+	s.users = local
+	m.WriteFile("/a.txt", strings.NewReader("a"), "I", false)
+
+	r := httptest.NewRequest(http.MethodDelete, "/files/a.txt", nil)
+	r.SetBasicAuth("bob", "password")
+	if w := serve(s, r); w.Code != http.StatusOK {
+		t.Fatalf("DELETE by a user without scopes: %d %s", w.Code, w.Body)
+	}
+	r = httptest.NewRequest(http.MethodGet, "/files/?"+url.Values{"format": {"json"}}.Encode(), nil)
+	r.SetBasicAuth("bob", "wrong")
+	if w := serve(s, r); w.Code != http.StatusUnauthorized {
+		t.Fatalf("a wrong password: expected 401, got %d", w.Code)
+	}
+}
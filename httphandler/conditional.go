@@ -0,0 +1,117 @@
+// conditional requests of the http file server, optimistic concurrency of editors and sync clients
+
+package httphandler
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// etagListed reports if the If-Match or If-None-Match header value lists the entity tag,
+// the weak comparison ignores the W/ prefix, the strong comparison never matches a weak tag
+func etagListed(header, tag string, weak bool) bool {
+	for _, listed := range strings.Split(header, ",") {
+		listed = strings.TrimSpace(listed)
+		if listed == "*" {
+			return true
+		}
+		if weak {
+			listed, tag = strings.TrimPrefix(listed, "W/"), strings.TrimPrefix(tag, "W/")
+		} else if strings.HasPrefix(listed, "W/") || strings.HasPrefix(tag, "W/") {
+			continue
+		}
+		if listed == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPreconditions evaluates If-Match, If-None-Match and If-Unmodified-Since of a write against the file,
+// info is nil if the file doesn't exist, so `If-None-Match: *` only creates and `If-Match: *` only replaces.
+// it responds 412 with the current entity tag and reports false if a precondition fails
+func checkPreconditions(w http.ResponseWriter, r *http.Request, info fs.FileInfo) bool {
+	current := ""
+	if info != nil {
+		current = etag(info)
+	}
+	failed := false
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+		failed = info == nil || !etagListed(ifMatch, current, false)
+	} else if since, err := http.ParseTime(r.Header.Get("If-Unmodified-Since")); err == nil && info != nil {
+		failed = info.ModTime().Truncate(time.Second).After(since)
+	}
+	if ifNoneMatch := r.Header.Get("If-None-Match"); !failed && ifNoneMatch != "" {
+		failed = info != nil && etagListed(ifNoneMatch, current, true)
+	}
+	if !failed {
+		return true
+	}
+	if current != "" {
+		w.Header().Set("ETag", current)
+	}
+	http.Error(w, "Precondition failed", http.StatusPreconditionFailed)
+	return false
+}
+
+// notModified responds 304 if If-None-Match of a read lists the entity tag
+func notModified(w http.ResponseWriter, r *http.Request, tag string) bool {
+	w.Header().Set("ETag", tag)
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch == "" || !etagListed(ifNoneMatch, tag, true) {
+		return false
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// listingETag returns the weak entity tag of a directory listing, it changes with any entry
+func listingETag(listing directoryListing) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s\n%d\n%d\n%d\n", listing.Path, listing.Total, listing.Offset, listing.Limit)
+	for _, entry := range listing.Entries {
+		fmt.Fprintf(hash, "%s\n%s\n%s\n", entry.Name, entry.Mode, entry.ETag)
+	}
+	return fmt.Sprintf(`W/"%x"`, hash.Sum(nil)[:16])
+}
+
+// pathLocks serializes the writes of a path, the preconditions are checked and the file written
+// without another write of the server in between
+type pathLocks struct {
+	lock  sync.Mutex // Protects paths
+	paths map[string]*pathLock
+}
+
+type pathLock struct {
+	sync.Mutex
+	refs int
+}
+
+// acquire locks the path, release unlocks it
+func (l *pathLocks) acquire(name string) (release func()) {
+	l.lock.Lock()
+	if l.paths == nil {
+		l.paths = map[string]*pathLock{}
+	}
+	lock, ok := l.paths[name]
+	if !ok {
+		lock = &pathLock{}
+		l.paths[name] = lock
+	}
+	lock.refs++
+	l.lock.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		l.lock.Lock()
+		if lock.refs--; lock.refs == 0 {
+			delete(l.paths, name)
+		}
+		l.lock.Unlock()
+	}
+}
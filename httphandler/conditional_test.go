@@ -0,0 +1,160 @@
+package httphandler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestEtagListed(t *testing.T) {
+	for _, test := range []struct {
+		header, tag string
+		weak, want  bool
+	}{
+		{`"a"`, `"a"`, false, true},
+		{`"b", "a"`, `"a"`, false, true},
+		{`*`, `"a"`, false, true},
+		{`"b"`, `"a"`, false, false},
+		{`W/"a"`, `"a"`, false, false},
+		{`"a"`, `W/"a"`, false, false},
+		{`W/"a"`, `"a"`, true, true},
+		{`"a"`, `W/"a"`, true, true},
+		{`W/"b"`, `W/"a"`, true, false},
+	} {
+		if got := etagListed(test.header, test.tag, test.weak); got != test.want {
+			t.Errorf("etagListed(%s, %s, %v) = %v", test.header, test.tag, test.weak, got)
+		}
+	}
+}
+
+func TestFileServer_preconditions(t *testing.T) {
+	s, m := newTestServer(t)
+	m.WriteFile("/a.txt", strings.NewReader("hello"), "I", false)
+	current := serve(s, httptest.NewRequest(http.MethodGet, "/files/a.txt?stat", nil)).Header().Get("ETag")
+	past := time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)
+	future := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+
+	for _, test := range []struct {
+		method, target, header, value string
+	}{
+		{http.MethodPut, "/files/a.txt", "If-None-Match", "*"},
+		{http.MethodPut, "/files/a.txt", "If-None-Match", current},
+		{http.MethodPut, "/files/a.txt", "If-Match", `"stale"`},
+		{http.MethodPut, "/files/a.txt", "If-Match", "W/" + current},
+		{http.MethodPut, "/files/a.txt", "If-Unmodified-Since", past},
+		{http.MethodPut, "/files/new.txt", "If-Match", "*"},
+		{http.MethodPatch, "/files/a.txt", "If-Match", `"stale"`},
+		{http.MethodDelete, "/files/a.txt", "If-Match", `"stale"`},
+		{http.MethodDelete, "/files/a.txt", "If-Unmodified-Since", past},
+	} {
+		r := httptest.NewRequest(test.method, test.target, strings.NewReader("changed"))
+		r.Header.Set(test.header, test.value)
+		w := serve(s, r)
+		if w.Code != http.StatusPreconditionFailed {
+			t.Errorf("%s %s %s: %s: expected 412, got %d", test.method, test.target, test.header, test.value, w.Code)
+		}
+		if test.target == "/files/a.txt" && w.Header().Get("ETag") != current {
+			t.Errorf("%s %s: expected the current entity tag, got %q", test.method, test.header, w.Header().Get("ETag"))
+		}
+	}
+	if readFile(t, m, "/a.txt") != "hello" {
+		t.Fatal("a failed precondition changed the file")
+	}
+	if _, _, err := m.Stat("/new.txt"); err == nil {
+		t.Fatal("If-Match: * created the file")
+	}
+
+	for _, test := range []struct {
+		method, target, header, value string
+		want                          int
+	}{
+		{http.MethodPut, "/files/new.txt", "If-None-Match", "*", http.StatusCreated},
+		{http.MethodPut, "/files/a.txt", "If-Unmodified-Since", future, http.StatusOK},
+		{http.MethodPatch, "/files/a.txt", "If-Match", "*", http.StatusOK},
+	} {
+		r := httptest.NewRequest(test.method, test.target, strings.NewReader("changed"))
+		r.Header.Set(test.header, test.value)
+		if w := serve(s, r); w.Code != test.want {
+			t.Errorf("%s %s %s: %s: expected %d, got %d", test.method, test.target, test.header, test.value, test.want, w.Code)
+		}
+	}
+
+	// the entity tag of a write is the tag of the next condition
+	r := httptest.NewRequest(http.MethodPut, "/files/a.txt", strings.NewReader("v2"))
+	w := serve(s, r)
+	tag := w.Header().Get("ETag")
+	r = httptest.NewRequest(http.MethodDelete, "/files/a.txt", nil)
+	r.Header.Set("If-Match", tag)
+	if w = serve(s, r); w.Code != http.StatusOK {
+		t.Fatalf("DELETE with the entity tag of the write: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestFileServer_concurrentWrites(t *testing.T) {
+	s, m := newTestServer(t)
+	m.WriteFile("/a.txt", strings.NewReader("v"), "I", false)
+	tag := serve(s, httptest.NewRequest(http.MethodGet, "/files/a.txt?stat", nil)).Header().Get("ETag")
+
+	// the writes of the same version replace it once, the sizes differ so every write changes the tag
+	var wg sync.WaitGroup
+	codes := make([]int, 10)
+	for i := range codes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := httptest.NewRequest(http.MethodPut, "/files/a.txt", strings.NewReader(strings.Repeat("x", i+2)))
+			r.Header.Set("If-Match", tag)
+			codes[i] = serve(s, r).Code
+		}()
+	}
+	wg.Wait()
+	succeeded := 0
+	for _, code := range codes {
+		switch code {
+		case http.StatusOK:
+			succeeded++
+		case http.StatusPreconditionFailed:
+		default:
+			t.Fatalf("unexpected status %d", code)
+		}
+	}
+	if succeeded != 1 {
+		t.Fatalf("expected a single write to succeed, got %d", succeeded)
+	}
+}
+
+func TestFileServer_notModified(t *testing.T) {
+	s, m := newTestServer(t)
+	m.MakeDir("/dir")
+	m.WriteFile("/dir/a.txt", strings.NewReader("hello"), "I", false)
+
+	for _, target := range []string{"/files/dir/a.txt", "/files/dir/a.txt?stat", "/files/dir/?format=json"} {
+		w := serve(s, httptest.NewRequest(http.MethodGet, target, nil))
+		tag := w.Header().Get("ETag")
+		if w.Code != http.StatusOK || tag == "" {
+			t.Fatalf("GET %s: %d %q", target, w.Code, tag)
+		}
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		r.Header.Set("If-None-Match", `"other", `+tag)
+		if w = serve(s, r); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+			t.Errorf("GET %s with the entity tag: expected 304, got %d", target, w.Code)
+		}
+		r = httptest.NewRequest(http.MethodGet, target, nil)
+		r.Header.Set("If-None-Match", `"other"`)
+		if w = serve(s, r); w.Code != http.StatusOK {
+			t.Errorf("GET %s with another entity tag: expected 200, got %d", target, w.Code)
+		}
+	}
+
+	// a change of the directory changes the tag of its listing
+	tag := serve(s, httptest.NewRequest(http.MethodGet, "/files/dir/?format=json", nil)).Header().Get("ETag")
+	m.WriteFile("/dir/a.txt", strings.NewReader("changed"), "I", false)
+	r := httptest.NewRequest(http.MethodGet, "/files/dir/?format=json", nil)
+	r.Header.Set("If-None-Match", tag)
+	if w := serve(s, r); w.Code != http.StatusOK {
+		t.Fatalf("listing of a changed directory: expected 200, got %d", w.Code)
+	}
+}
@@ -4,25 +4,30 @@ package httphandler
 
 import (
 	_ "embed"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/telebroad/fileserver/filesystem"
 	"github.com/telebroad/fileserver/tools"
 	"html/template"
-	"io"
 	"io/fs"
 	"log/slog"
 	"mime"
 	"net/http"
 	"os"
 	"path"
-	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 )
 
-// Users is the interface to find a user by username and password and return it
+// Users is the interface to verify the user of a request and return it
 type Users interface {
-	// VerifyUser returns a user by JWT, if the user is not found it returns an error
+	// VerifyUser returns the user of the request, by basic auth, a JWT or an API key like users.Authenticator,
+	// a user with a HasScope(scope string) bool method is limited to its read, write and delete scopes.
+	// if the user is not found it returns an error, the error must not contain the credentials
 	VerifyUser(request *http.Request) (any, error)
 }
 
@@ -35,6 +40,13 @@ type FileServer struct {
 	mux        *http.ServeMux
 	logger     *slog.Logger
 	users      Users
+	signer     *Signer
+	locks      pathLocks
+}
+
+// SetSigner enables the signed links of the signer, they are served without verifying the user
+func (s *FileServer) SetSigner(signer *Signer) {
+	s.signer = signer
 }
 
 func (s *FileServer) SetLogger(l *slog.Logger) {
@@ -49,7 +61,7 @@ func (s *FileServer) Logger() *slog.Logger {
 
 // ServeHTTP serves the httphandler request implementing the httphandler.Handler interface
 func (s *FileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("ServeHTTP>", r.Method, r.URL.String())
+	fmt.Println("ServeHTTP>", r.Method, redactedURL(r.URL))
 	var protocol string
 	if r.TLS == nil {
 		protocol = "http://"
@@ -57,33 +69,58 @@ func (s *FileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		protocol = "https://"
 	}
 
-	if s.users != nil {
-		_, err := s.users.VerifyUser(r)
-		if err != nil {
-			w.Header().Set("WWW-Authenticate", `Basic realm="Restricted"`)
-			http.Error(w, "Unauthorized! "+err.Error(), http.StatusUnauthorized)
+	// a signed link grants its method on its path only, instead of the user
+	if isSigned(r) {
+		if !s.verifyLink(w, r) {
 			return
 		}
+	} else if !authorize(s.users, w, r) {
+		return
 	}
-	s.Logger().Debug("ServeHTTP", "method", r.Method, "url", protocol+r.Host+r.URL.String(), "remote", r.RemoteAddr, "user-agent", r.UserAgent())
+	s.Logger().Debug("ServeHTTP", "method", r.Method, "url", protocol+r.Host+redactedURL(r.URL), "remote", r.RemoteAddr, "user-agent", r.UserAgent())
 
 	lw := tools.NewHttpResponseWriter(w, s.Logger())
 
 	switch r.Method {
-	case http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
 		s.mux.ServeHTTP(lw, r)
 	case http.MethodOptions:
-		w.Header().Set("Allow", "GET, POST, PUT, PATCH, DELETE")
+		w.Header().Set("Allow", "GET, HEAD, POST, PUT, PATCH, DELETE")
 		w.WriteHeader(http.StatusOK)
 	default:
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
 }
 
-// Get the local path of the file
-func (s *FileServer) localPath(urlPath string) string {
-	// Trim the virtual directory and prepend the localDir directory
-	relativePath := strings.TrimPrefix(urlPath, s.virtualDir)
+// errorStatus returns the status code of a failed file system operation,
+// operations denied by the file system, like a write to a read only file system, are forbidden
+// and operations exceeding the storage, like a quota, get insufficient storage,
+// bodies exceeding the limit of the request, like a signed upload link, are too large
+func errorStatus(err error) int {
+	var maxBytes *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxBytes):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, syscall.ENOSPC):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, fs.ErrPermission):
+		return http.StatusForbidden
+	case errors.Is(err, fs.ErrNotExist):
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
+// etag returns the entity tag of the file from its modification time and size
+func etag(info fs.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size())
+}
+
+// fsPath returns the file system path of the url path, the url path is cleaned
+// as an absolute path before it is joined to the root, so it can't leave the root directory
+func (s *FileServer) fsPath(urlPath string) string {
+	// Trim the virtual directory and prepend the root directory of the file system
+	relativePath := path.Clean("/" + strings.TrimPrefix(urlPath, s.virtualDir))
 	return path.Join(s.localDirFS.RootDir(), relativePath)
 }
 
@@ -92,7 +129,7 @@ var (
 	directoryTemplate string
 )
 
-func (s *FileServer) generateCustomDirectoryHTML(w http.ResponseWriter, FS fs.FS, dirPath, displayDir string) {
+func (s *FileServer) generateCustomDirectoryHTML(w http.ResponseWriter, r *http.Request, FS fs.FS, dirPath, displayDir string) {
 	type FileInfo struct {
 		Name  string
 		URL   string
@@ -100,8 +137,9 @@ func (s *FileServer) generateCustomDirectoryHTML(w http.ResponseWriter, FS fs.FS
 	}
 
 	type DirectoryData struct {
-		Path  string
-		Files []FileInfo
+		Path      string
+		CSRFToken string
+		Files     []FileInfo
 	}
 
 	files, err := fs.ReadDir(FS, dirPath)
@@ -134,8 +172,9 @@ func (s *FileServer) generateCustomDirectoryHTML(w http.ResponseWriter, FS fs.FS
 	}
 
 	data := DirectoryData{
-		Path:  displayDir,
-		Files: fileInfos,
+		Path:      displayDir,
+		CSRFToken: s.csrfToken(w, r),
+		Files:     fileInfos,
 	}
 
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
@@ -144,7 +183,11 @@ func (s *FileServer) generateCustomDirectoryHTML(w http.ResponseWriter, FS fs.FS
 
 // Get the file from the localDir directory
 func (s *FileServer) Get(w http.ResponseWriter, r *http.Request) {
-	p := s.localPath(r.URL.Path)
+	if r.URL.Query().Has("versions") {
+		s.Versions(w, r)
+		return
+	}
+	p := s.fsPath(r.URL.Path)
 	p = strings.TrimPrefix(p, "/")
 	if p == "" {
 		p = "."
@@ -155,21 +198,198 @@ func (s *FileServer) Get(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "path `"+p+"` File not found", http.StatusNotFound)
 			return
 		}
-		http.Error(w, "path `"+p+"` error: "+err.Error(), http.StatusInternalServerError)
+		http.Error(w, "path `"+p+"` error: "+err.Error(), errorStatus(err))
 		return
 
 	}
+	if r.URL.Query().Has("archive") {
+		s.Archive(w, r)
+		return
+	}
+	if r.URL.Query().Has("search") {
+		if !stat.IsDir() {
+			http.Error(w, "Only directories can be searched", http.StatusBadRequest)
+			return
+		}
+		s.Search(w, r)
+		return
+	}
+	if r.URL.Query().Has("stat") {
+		if !notModified(w, r, etag(stat)) {
+			writeJSON(w, newFileEntry(stat))
+		}
+		return
+	}
 	if stat != nil && stat.IsDir() {
-		s.generateCustomDirectoryHTML(w, s.localDirFS.GetFS(), p, r.URL.Path)
+		if wantsJSON(r) {
+			s.List(w, r)
+			return
+		}
+		s.generateCustomDirectoryHTML(w, r, s.localDirFS.GetFS(), p, r.URL.Path)
 		return
 	}
 
+	w.Header().Set("ETag", etag(stat))
 	http.FileServerFS(s.localDirFS.GetFS()).ServeHTTP(w, r)
 
 }
 
+// fileEntry is a file of the json listing and of `?stat`
+type fileEntry struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	Mode    string    `json:"mode"`
+	ModTime time.Time `json:"modTime"`
+	MIME    string    `json:"mime,omitempty"`
+	ETag    string    `json:"etag,omitempty"`
+	IsDir   bool      `json:"isDir"`
+}
+
+func newFileEntry(info fs.FileInfo) fileEntry {
+	entry := fileEntry{
+		Name:    info.Name(),
+		Size:    info.Size(),
+		Mode:    info.Mode().String(),
+		ModTime: info.ModTime().UTC(),
+		IsDir:   info.IsDir(),
+	}
+	if !info.IsDir() {
+		entry.MIME = mime.TypeByExtension(path.Ext(info.Name()))
+		if entry.MIME == "" {
+			entry.MIME = "application/octet-stream"
+		}
+		entry.ETag = etag(info)
+	}
+	return entry
+}
+
+// directoryListing is the json listing of a directory, Total counts the entries matching the glob
+type directoryListing struct {
+	Path    string      `json:"path"`
+	Total   int         `json:"total"`
+	Offset  int         `json:"offset"`
+	Limit   int         `json:"limit"`
+	Entries []fileEntry `json:"entries"`
+}
+
+// maxListLimit is the default and maximal number of entries of a json listing
+const maxListLimit = 1000
+
+// wantsJSON reports whether the client asks for json, with `?format=json` or the Accept header
+func wantsJSON(r *http.Request) bool {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return format == "json"
+	}
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(accept)
+		if err == nil && mediaType == "application/json" {
+			return true
+		}
+	}
+	return false
+}
+
+// writeJSON writes the value as json
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// List lists the directory as json, `?glob=*.csv&sort=name|size|modTime&order=asc|desc&offset=0&limit=100`
+func (s *FileServer) List(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	glob := query.Get("glob")
+	if _, err := path.Match(glob, ""); err != nil {
+		http.Error(w, "Invalid glob", http.StatusBadRequest)
+		return
+	}
+	offset, err := strconv.Atoi(query.Get("offset"))
+	if err != nil && query.Has("offset") || offset < 0 {
+		http.Error(w, "Invalid offset", http.StatusBadRequest)
+		return
+	}
+	limit, err := strconv.Atoi(query.Get("limit"))
+	if err != nil && query.Has("limit") || limit < 0 {
+		http.Error(w, "Invalid limit", http.StatusBadRequest)
+		return
+	}
+	if limit == 0 || limit > maxListLimit {
+		limit = maxListLimit
+	}
+	var less func(a, b fileEntry) bool
+	switch query.Get("sort") {
+	case "", "name":
+		less = func(a, b fileEntry) bool { return a.Name < b.Name }
+	case "size":
+		less = func(a, b fileEntry) bool { return a.Size < b.Size }
+	case "modTime":
+		less = func(a, b fileEntry) bool { return a.ModTime.Before(b.ModTime) }
+	default:
+		http.Error(w, "Invalid sort", http.StatusBadRequest)
+		return
+	}
+	if order := query.Get("order"); order == "desc" {
+		ascending := less
+		less = func(a, b fileEntry) bool { return ascending(b, a) }
+	} else if order != "" && order != "asc" {
+		http.Error(w, "Invalid order", http.StatusBadRequest)
+		return
+	}
+
+	_, infos, err := s.localDirFS.Dir(s.fsPath(r.URL.Path))
+	if err != nil {
+		http.Error(w, "Unable to read directory", errorStatus(err))
+		return
+	}
+	entries := make([]fileEntry, 0, len(infos))
+	for _, info := range infos {
+		if matched, _ := path.Match(glob, info.Name()); glob == "" || matched {
+			entries = append(entries, newFileEntry(info))
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return less(entries[i], entries[j]) })
+
+	listing := directoryListing{Path: path.Clean("/" + r.URL.Path), Total: len(entries), Offset: offset, Limit: limit}
+	if offset < len(entries) {
+		listing.Entries = entries[offset:min(offset+limit, len(entries))]
+	} else {
+		listing.Entries = []fileEntry{}
+	}
+	if notModified(w, r, listingETag(listing)) {
+		return
+	}
+	writeJSON(w, listing)
+}
+
 // Post the file to the localDir directory
 func (s *FileServer) Post(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var handle http.HandlerFunc
+	switch {
+	case query.Has("archive"):
+		s.Archive(w, r)
+		return
+	case query.Has("share"):
+		s.Share(w, r)
+		return
+	case query.Has("upload"):
+		handle = s.Upload
+	case query.Has("mkdir"):
+		handle = s.MakeDir
+	case query.Has("move"):
+		handle = s.Move
+	case query.Has("restore"):
+		handle = s.Restore
+	}
+	if handle != nil {
+		// the actions of the directory UI and the restore are form posts changing the files, a cross site form could send them
+		if !validCSRF(r) {
+			http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+			return
+		}
+		handle(w, r)
+		return
+	}
 
 	randFileName := fmt.Sprintf("%s", time.Now().Format("2006-01-02_15-06-07.00000000_MST"))
 	filePathExt, err := mime.ExtensionsByType(r.Header.Get("Content-Type"))
@@ -179,74 +399,157 @@ func (s *FileServer) Post(w http.ResponseWriter, r *http.Request) {
 	}
 	randFileName = randFileName + filePathExt[0]
 
-	filename := s.localPath(filepath.Join(r.URL.Path, randFileName))
+	filename := s.fsPath(path.Join(r.URL.Path, randFileName))
 
-	newFile, err := os.Create(filename)
-	if err != nil {
-		http.Error(w, "Error creating file", http.StatusInternalServerError)
-		return
-	}
-	defer newFile.Close()
-	_, err = io.Copy(newFile, r.Body)
+	err = s.localDirFS.WriteFile(filename, r.Body, "I", false)
 	if err != nil {
-		http.Error(w, "Error writing file", http.StatusInternalServerError)
+		http.Error(w, "Error writing file", errorStatus(err))
 		return
 	}
 	w.WriteHeader(http.StatusCreated)
 	fmt.Fprintf(w, "File %s created\nto upload a file with a file name use PUT method", filename)
 }
 
-// Put the file to the localDir directory
+// Put the file to the localDir directory,
+// If-Match, If-None-Match: * and If-Unmodified-Since make the write conditional
 func (s *FileServer) Put(w http.ResponseWriter, r *http.Request) {
-	filename := s.localPath(r.URL.Path)
-	newFile, err := os.Create(filename)
-	if err != nil {
-		http.Error(w, "Error creating file", http.StatusInternalServerError)
+	filename := s.fsPath(r.URL.Path)
+	defer s.locks.acquire(filename)()
+	info, ok := s.statForWrite(w, filename)
+	if !ok || !checkPreconditions(w, r, info) {
 		return
 	}
-	defer newFile.Close()
-	_, err = io.Copy(newFile, r.Body)
+	if info != nil && info.IsDir() {
+		http.Error(w, "Error writing file: is a directory", http.StatusConflict)
+		return
+	}
+	err := s.localDirFS.WriteFile(filename, r.Body, "I", false)
 	if err != nil {
-		http.Error(w, "Error writing file", http.StatusInternalServerError)
+		http.Error(w, "Error writing file", errorStatus(err))
 		return
 	}
-	w.WriteHeader(http.StatusCreated)
+	s.setETag(w, filename)
+	if info == nil {
+		w.WriteHeader(http.StatusCreated)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
 	fmt.Fprintf(w, "File %s updated", filename)
 }
 
-// Patch the file to the localDir directory
+// Patch the file to the localDir directory, conditional like Put
 func (s *FileServer) Patch(w http.ResponseWriter, r *http.Request) {
-	filename := s.localPath(r.URL.Path)
+	filename := s.fsPath(r.URL.Path)
+	defer s.locks.acquire(filename)()
 
-	f, err := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, 0644)
-	if err != nil {
-		http.Error(w, "Error opening file", http.StatusInternalServerError)
+	// the file is appended to, it isn't created
+	info, ok := s.statForWrite(w, filename)
+	if !ok || !checkPreconditions(w, r, info) {
+		return
+	}
+	if info == nil {
+		http.Error(w, "Error opening file", http.StatusNotFound)
+		return
+	}
+	if info.IsDir() {
+		http.Error(w, "Error opening file: is a directory", http.StatusConflict)
 		return
 	}
-	defer f.Close()
-	_, err = io.Copy(f, r.Body)
+	err := s.localDirFS.WriteFile(filename, r.Body, "I", true)
 	if err != nil {
-		http.Error(w, "Error appending to file", http.StatusInternalServerError)
+		http.Error(w, "Error appending to file", errorStatus(err))
 		return
 	}
+	s.setETag(w, filename)
 	w.WriteHeader(http.StatusOK)
 	fmt.Fprintf(w, "File %s updated", filename)
 }
 
-// Delete the file from the localDir directory
+// statForWrite returns the file a write replaces, nil if it doesn't exist,
+// it responds with the error and reports false if the file can't be checked
+func (s *FileServer) statForWrite(w http.ResponseWriter, filename string) (fs.FileInfo, bool) {
+	_, info, err := s.localDirFS.Stat(filename)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return nil, true
+	case err != nil:
+		http.Error(w, "Error opening file", errorStatus(err))
+		return nil, false
+	}
+	return info, true
+}
+
+// setETag sets the entity tag of the written file
+func (s *FileServer) setETag(w http.ResponseWriter, filename string) {
+	if _, info, err := s.localDirFS.Stat(filename); err == nil {
+		w.Header().Set("ETag", etag(info))
+	}
+}
+
+// Delete the file from the localDir directory, conditional like Put
 func (s *FileServer) Delete(w http.ResponseWriter, r *http.Request) {
-	filename := s.localPath(r.URL.Path)
-	err := os.Remove(filename)
+	filename := s.fsPath(r.URL.Path)
+	defer s.locks.acquire(filename)()
+	info, ok := s.statForWrite(w, filename)
+	if !ok || !checkPreconditions(w, r, info) {
+		return
+	}
+	err := s.localDirFS.Remove(filename)
 	if err != nil {
-		http.Error(w, "Error deleting file", http.StatusInternalServerError)
+		http.Error(w, "Error deleting file", errorStatus(err))
 		return
 	}
 	w.WriteHeader(http.StatusOK)
 	fmt.Fprintf(w, "File %s deleted", filename)
 }
 
+// trashFS is a file system keeping the deleted files and the previous versions, like filesystem.TrashFS
+type trashFS interface {
+	Entries(name string) ([]filesystem.TrashEntry, error)
+	Restore(name, id string) error
+}
+
+// Versions lists the deleted and previous versions of the file as json, `GET /path?versions`
+func (s *FileServer) Versions(w http.ResponseWriter, r *http.Request) {
+	trash, ok := s.localDirFS.(trashFS)
+	if !ok {
+		http.Error(w, "Versions are not kept", http.StatusNotImplemented)
+		return
+	}
+	entries, err := trash.Entries(s.fsPath(r.URL.Path))
+	if err != nil {
+		http.Error(w, "Error listing versions", errorStatus(err))
+		return
+	}
+	if entries == nil {
+		entries = []filesystem.TrashEntry{}
+	}
+	writeJSON(w, entries)
+}
+
+// Restore puts a deleted or previous version back to the file, `POST /path?restore=<id>` with the CSRF token
+func (s *FileServer) Restore(w http.ResponseWriter, r *http.Request) {
+	trash, ok := s.localDirFS.(trashFS)
+	if !ok {
+		http.Error(w, "Versions are not kept", http.StatusNotImplemented)
+		return
+	}
+	filename := s.fsPath(r.URL.Path)
+	err := trash.Restore(filename, r.URL.Query().Get("restore"))
+	if errors.Is(err, fs.ErrInvalid) {
+		http.Error(w, "Invalid version", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error restoring file", errorStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "File %s restored", filename)
+}
+
 func (s *FileServer) Option(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Allow", "GET, POST, PUT, PATCH, DELETE")
+	w.Header().Set("Allow", "GET, HEAD, POST, PUT, PATCH, DELETE")
 	w.WriteHeader(http.StatusOK)
 }
 
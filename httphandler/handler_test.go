@@ -0,0 +1,224 @@
+package httphandler
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/telebroad/fileserver/filesystem"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestServer returns a file server of a memory file system served at /files/, without users
+func newTestServer(t *testing.T) (*FileServer, *filesystem.MemFS) {
+	t.Helper()
+	m := filesystem.NewMemFS()
+	s := NewFileServerHandler("/files/", m, nil).(*FileServer)
+	s.SetLogger(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	return s, m
+}
+
+// serve serves the request and returns the response
+func serve(h http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// readFile returns the content of the file of the memory file system
+func readFile(t *testing.T, m *filesystem.MemFS, name string) string {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	if _, err := m.ReadFile(name, buf); err != nil {
+		t.Fatalf("read %s: %v", name, err)
+	}
+	return buf.String()
+}
+
+func TestFileServer_writes(t *testing.T) {
+	s, m := newTestServer(t)
+
+	w := serve(s, httptest.NewRequest(http.MethodPut, "/files/a.txt", strings.NewReader("hello")))
+	if w.Code != http.StatusCreated || readFile(t, m, "/a.txt") != "hello" {
+		t.Fatalf("PUT of a new file: %d %s", w.Code, w.Body)
+	}
+	w = serve(s, httptest.NewRequest(http.MethodPut, "/files/a.txt", strings.NewReader("hi")))
+	if w.Code != http.StatusOK || readFile(t, m, "/a.txt") != "hi" {
+		t.Fatalf("PUT of an existing file: %d %s", w.Code, w.Body)
+	}
+	w = serve(s, httptest.NewRequest(http.MethodPatch, "/files/a.txt", strings.NewReader(" there")))
+	if w.Code != http.StatusOK || readFile(t, m, "/a.txt") != "hi there" {
+		t.Fatalf("PATCH: %d %s", w.Code, w.Body)
+	}
+	if w = serve(s, httptest.NewRequest(http.MethodPatch, "/files/missing.txt", strings.NewReader("x"))); w.Code != http.StatusNotFound {
+		t.Fatalf("PATCH of a missing file: expected 404, got %d", w.Code)
+	}
+
+	m.MakeDir("/dir")
+	if w = serve(s, httptest.NewRequest(http.MethodPut, "/files/dir", strings.NewReader("x"))); w.Code != http.StatusConflict {
+		t.Fatalf("PUT of a directory: expected 409, got %d", w.Code)
+	}
+	if w = serve(s, httptest.NewRequest(http.MethodPatch, "/files/dir", strings.NewReader("x"))); w.Code != http.StatusConflict {
+		t.Fatalf("PATCH of a directory: expected 409, got %d", w.Code)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/files/dir/", strings.NewReader("posted"))
+	r.Header.Set("Content-Type", "text/plain")
+	if w = serve(s, r); w.Code != http.StatusCreated {
+		t.Fatalf("POST: %d %s", w.Code, w.Body)
+	}
+	if _, infos, err := m.Dir("/dir"); err != nil || len(infos) != 1 || readFile(t, m, "/dir/"+infos[0].Name()) != "posted" {
+		t.Fatalf("expected the posted file in the directory, got %v %v", infos, err)
+	}
+
+	if w = serve(s, httptest.NewRequest(http.MethodDelete, "/files/a.txt", nil)); w.Code != http.StatusOK {
+		t.Fatalf("DELETE: %d %s", w.Code, w.Body)
+	}
+	if _, _, err := m.Stat("/a.txt"); err == nil {
+		t.Fatal("expected the file to be deleted")
+	}
+	if w = serve(s, httptest.NewRequest(http.MethodDelete, "/files/a.txt", nil)); w.Code != http.StatusNotFound {
+		t.Fatalf("DELETE of a missing file: expected 404, got %d", w.Code)
+	}
+}
+
+func TestFileServer_readOnly(t *testing.T) {
+	m := filesystem.NewMemFS()
+	m.WriteFile("/a.txt", strings.NewReader("hello"), "I", false)
+	s := NewFileServerHandler("/files/", filesystem.NewReadOnlyFS(m), nil)
+
+	for _, method := range []string{http.MethodPut, http.MethodPatch, http.MethodDelete} {
+		if w := serve(s, httptest.NewRequest(method, "/files/a.txt", strings.NewReader("x"))); w.Code != http.StatusForbidden {
+			t.Errorf("%s on a read only file system: expected 403, got %d", method, w.Code)
+		}
+	}
+	if readFile(t, m, "/a.txt") != "hello" {
+		t.Fatal("the read only file changed")
+	}
+}
+
+func TestFileServer_fsPath(t *testing.T) {
+	s := NewFileServerHandler("/files", filesystem.NewMemFS(), nil).(*FileServer)
+	for urlPath, want := range map[string]string{
+		"/files/a.txt":            "/a.txt",
+		"a.txt":                   "/a.txt",
+		"../../etc/passwd":        "/etc/passwd",
+		"/files/../../etc/passwd": "/etc/passwd",
+		"dir/../../../etc/passwd": "/etc/passwd",
+		"/files/dir/./b/../c.txt": "/dir/c.txt",
+		"":                        "/",
+	} {
+		if got := s.fsPath(urlPath); got != want {
+			t.Errorf("fsPath(%q) = %q, want %q", urlPath, got, want)
+		}
+	}
+}
+
+func TestFileServer_confined(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	if err := os.Mkdir(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	s := NewFileServerHandler("/files/", filesystem.NewLocalFS(root), nil)
+
+	// the encoded slashes reach the handler unchanged by the clean path redirect of the mux
+	for _, target := range []string{"/files/..%2f..%2fescape.txt", "/files/sub%2f..%2f..%2f..%2fescape.txt"} {
+		for _, method := range []string{http.MethodPut, http.MethodPatch, http.MethodDelete} {
+			if w := serve(s, httptest.NewRequest(method, target, strings.NewReader("x"))); w.Code != http.StatusOK && w.Code != http.StatusCreated {
+				t.Fatalf("%s %s: %d %s", method, target, w.Code, w.Body)
+			}
+			if _, err := os.Stat(filepath.Join(dir, "escape.txt")); err == nil {
+				t.Fatalf("%s %s wrote outside the root", method, target)
+			}
+			if data, err := os.ReadFile(filepath.Join(root, "escape.txt")); method == http.MethodPatch && (err != nil || string(data) != "xx") {
+				t.Fatalf("expected the file in the root, got %q %v", data, err)
+			}
+		}
+	}
+}
+
+func TestFileServer_list(t *testing.T) {
+	s, m := newTestServer(t)
+	m.MakeDir("/dir")
+	m.MakeDir("/dir/sub")
+	for name, content := range map[string]string{"b.csv": "bb", "a.csv": "aaa", "c.txt": "c"} {
+		m.WriteFile("/dir/"+name, strings.NewReader(content), "I", false)
+	}
+	list := func(query string, header ...string) (directoryListing, *httptest.ResponseRecorder) {
+		t.Helper()
+		r := davRequest(http.MethodGet, "/files/dir/?"+query, "", header...)
+		w := serve(s, r)
+		var listing directoryListing
+		if w.Header().Get("Content-Type") == "application/json" {
+			if err := json.Unmarshal(w.Body.Bytes(), &listing); err != nil {
+				t.Fatalf("?%s: %v %s", query, err, w.Body)
+			}
+		}
+		return listing, w
+	}
+	names := func(listing directoryListing) string {
+		var names []string
+		for _, entry := range listing.Entries {
+			names = append(names, entry.Name)
+		}
+		return strings.Join(names, ",")
+	}
+
+	for query, want := range map[string]string{
+		"format=json":                        "a.csv,b.csv,c.txt,sub",
+		"format=json&glob=*.csv":             "a.csv,b.csv",
+		"format=json&sort=size&order=desc":   "a.csv,b.csv,c.txt,sub",
+		"format=json&order=desc":             "sub,c.txt,b.csv,a.csv",
+		"format=json&offset=1&limit=2":       "b.csv,c.txt",
+		"format=json&offset=10":              "",
+		"format=json&limit=5000&glob=[ab].*": "a.csv,b.csv",
+	} {
+		listing, w := list(query)
+		if w.Code != http.StatusOK || names(listing) != want {
+			t.Errorf("?%s: expected %q, got %d %q", query, want, w.Code, names(listing))
+		}
+	}
+	if listing, _ := list("", "Accept", "text/html;q=0.9, application/json"); listing.Total != 4 || listing.Limit != maxListLimit || listing.Path != "/dir" {
+		t.Fatalf("Accept json: unexpected listing %+v", listing)
+	}
+	if listing, _ := list("format=json&glob=*.csv&limit=1"); listing.Total != 2 || len(listing.Entries) != 1 {
+		t.Fatalf("expected the total of the glob, got %+v", listing)
+	}
+	if listing, _ := list("format=json&glob=a.csv"); listing.Entries[0].Size != 3 || listing.Entries[0].MIME != "text/csv; charset=utf-8" || listing.Entries[0].ETag == "" {
+		t.Fatalf("unexpected entry %+v", listing.Entries[0])
+	}
+	for _, query := range []string{"glob=[", "offset=-1", "offset=x", "limit=-1", "limit=x", "sort=owner", "order=up"} {
+		if _, w := list("format=json&" + query); w.Code != http.StatusBadRequest {
+			t.Errorf("?%s: expected 400, got %d", query, w.Code)
+		}
+	}
+	if _, w := list(""); w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") {
+		t.Fatalf("expected the html listing by default, got %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	if w := serve(s, httptest.NewRequest(http.MethodGet, "/files/missing/?format=json", nil)); w.Code != http.StatusNotFound {
+		t.Fatalf("listing of a missing directory: expected 404, got %d", w.Code)
+	}
+}
+
+func TestFileServer_stat(t *testing.T) {
+	s, m := newTestServer(t)
+	m.WriteFile("/a.txt", strings.NewReader("hello"), "I", false)
+
+	w := serve(s, httptest.NewRequest(http.MethodGet, "/files/a.txt?stat", nil))
+	var entry fileEntry
+	if err := json.Unmarshal(w.Body.Bytes(), &entry); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("stat: %d %v %s", w.Code, err, w.Body)
+	}
+	if entry.Name != "a.txt" || entry.Size != 5 || entry.IsDir || entry.ETag == "" || entry.ETag != w.Header().Get("ETag") {
+		t.Fatalf("unexpected entry %+v", entry)
+	}
+	if w = serve(s, httptest.NewRequest(http.MethodGet, "/files/missing.txt?stat", nil)); w.Code != http.StatusNotFound {
+		t.Fatalf("stat of a missing file: expected 404, got %d", w.Code)
+	}
+}
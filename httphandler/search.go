@@ -0,0 +1,110 @@
+// search of the files of the http file server
+
+package httphandler
+
+import (
+	"context"
+	"errors"
+	"github.com/telebroad/fileserver/filesystem"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+const (
+	// defaultSearchLimit is the number of results of a search without a limit, maxListLimit is the maximum
+	defaultSearchLimit = 100
+	// searchTimeout stops a search walking too many directories
+	searchTimeout = 30 * time.Second
+)
+
+// searchResult is a found file, the path is relative to the searched directory
+type searchResult struct {
+	Path string `json:"path"`
+	fileEntry
+}
+
+// searchResults is the json response of a search
+type searchResults struct {
+	Path      string         `json:"path"`
+	Truncated bool           `json:"truncated"`
+	Results   []searchResult `json:"results"`
+}
+
+// parseSearchQuery parses the search parameters: name (a glob), regex, min_size, max_size,
+// after and before (RFC 3339 times), dirs, hidden and limit
+func parseSearchQuery(r *http.Request) (filesystem.SearchQuery, error) {
+	values := r.URL.Query()
+	query := filesystem.SearchQuery{Glob: values.Get("name"), Limit: defaultSearchLimit}
+	if query.Glob != "" {
+		if _, err := path.Match(query.Glob, ""); err != nil {
+			return query, errors.New("invalid name glob")
+		}
+	}
+	if expr := values.Get("regex"); expr != "" {
+		var err error
+		if query.Regexp, err = regexp.Compile(expr); err != nil {
+			return query, errors.New("invalid regex: " + err.Error())
+		}
+	}
+	for param, size := range map[string]*int64{"min_size": &query.MinSize, "max_size": &query.MaxSize} {
+		if value := values.Get(param); value != "" {
+			var err error
+			if *size, err = strconv.ParseInt(value, 10, 64); err != nil || *size < 0 {
+				return query, errors.New("invalid " + param)
+			}
+		}
+	}
+	for param, t := range map[string]*time.Time{"after": &query.ModifiedAfter, "before": &query.ModifiedBefore} {
+		if value := values.Get(param); value != "" {
+			var err error
+			if *t, err = time.Parse(time.RFC3339, value); err != nil {
+				return query, errors.New("invalid " + param + ", expected an RFC 3339 time")
+			}
+		}
+	}
+	if value := values.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 {
+			return query, errors.New("invalid limit")
+		}
+		query.Limit = min(limit, maxListLimit)
+	}
+	query.Dirs, _ = strconv.ParseBool(values.Get("dirs"))
+	query.Hidden, _ = strconv.ParseBool(values.Get("hidden"))
+	return query, nil
+}
+
+// Search finds the files of the directory and its subdirectories as json, `GET /dir/?search&name=*.wav`,
+// the search stops when the client disconnects
+func (s *FileServer) Search(w http.ResponseWriter, r *http.Request) {
+	query, err := parseSearchQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeoutCause(r.Context(), searchTimeout, errors.New("search timed out"))
+	defer cancel()
+
+	dir := s.fsPath(r.URL.Path)
+	found, truncated, err := filesystem.Search(ctx, s.localDirFS, dir, query)
+	switch {
+	case err != nil && r.Context().Err() != nil:
+		s.Logger().Debug("search canceled", "dir", dir, "error", err)
+		return
+	case err != nil && ctx.Err() != nil:
+		http.Error(w, "Search timed out, narrow the search", http.StatusServiceUnavailable)
+		return
+	case err != nil:
+		http.Error(w, "Error searching", errorStatus(err))
+		return
+	}
+
+	results := searchResults{Path: path.Clean("/" + r.URL.Path), Truncated: truncated, Results: make([]searchResult, 0, len(found))}
+	for _, result := range found {
+		results.Results = append(results.Results, searchResult{Path: result.Path, fileEntry: newFileEntry(result.Info)})
+	}
+	writeJSON(w, results)
+}
@@ -0,0 +1,121 @@
+package httphandler
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/telebroad/fileserver/filesystem"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// search returns the results of the search request
+func search(t *testing.T, h http.Handler, target string) (searchResults, *httptest.ResponseRecorder) {
+	t.Helper()
+	w := serve(h, httptest.NewRequest(http.MethodGet, target, nil))
+	var results searchResults
+	if w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+			t.Fatalf("%s: %v %s", target, err, w.Body)
+		}
+	}
+	return results, w
+}
+
+// resultPaths returns the paths of the results
+func resultPaths(results searchResults) []string {
+	var paths []string
+	for _, result := range results.Results {
+		paths = append(paths, result.Path)
+	}
+	return paths
+}
+
+func TestFileServer_search(t *testing.T) {
+	s, m := newTestServer(t)
+	m.MakeDir("/calls")
+	m.MakeDir("/calls/2024")
+	m.MakeDir("/calls/.cache")
+	m.WriteFile("/calls/a.wav", strings.NewReader("aaaa"), "I", false)
+	m.WriteFile("/calls/2024/b.wav", strings.NewReader("bb"), "I", false)
+	m.WriteFile("/calls/2024/notes.txt", strings.NewReader("n"), "I", false)
+	m.WriteFile("/calls/.cache/c.wav", strings.NewReader("c"), "I", false)
+	m.WriteFile("/secret.wav", strings.NewReader("s"), "I", false)
+
+	for query, want := range map[string][]string{
+		"name=*.wav":                    {"2024/b.wav", "a.wav"},
+		"name=*.wav&hidden=true":        {".cache/c.wav", "2024/b.wav", "a.wav"},
+		"name=*.wav&min_size=3":         {"a.wav"},
+		"name=*.wav&max_size=2":         {"2024/b.wav"},
+		"regex=^2024/":                  {"2024/b.wav", "2024/notes.txt"},
+		"dirs=true&name=2024":           {"2024"},
+		"after=2000-01-01T00:00:00Z":    {"2024/b.wav", "2024/notes.txt", "a.wav"},
+		"before=2000-01-01T00:00:00Z":   nil,
+		"name=*.wav&limit=1":            {"2024/b.wav"},
+		"name=secret.wav&regex=secret.": nil,
+	} {
+		results, w := search(t, s, "/files/calls/?search&"+query)
+		if w.Code != http.StatusOK || !slices.Equal(resultPaths(results), want) {
+			t.Errorf("?%s: expected %v, got %d %v", query, want, w.Code, resultPaths(results))
+		}
+		if results.Path != "/calls" {
+			t.Errorf("?%s: unexpected path %q", query, results.Path)
+		}
+	}
+	if results, _ := search(t, s, "/files/calls/?search&name=a.wav"); results.Results[0].Size != 4 || results.Results[0].ETag == "" {
+		t.Fatalf("unexpected result %+v", results.Results[0])
+	}
+
+	// the search can't leave the root, a url path above it is the root
+	if results, w := search(t, s, "/files/..%2f..%2f?search&name=secret.wav"); w.Code != http.StatusOK || !slices.Equal(resultPaths(results), []string{"secret.wav"}) {
+		t.Fatalf("search above the root: %d %v", w.Code, resultPaths(results))
+	}
+
+	for _, query := range []string{
+		"limit=0", "limit=-1", "limit=x", "name=[", "regex=(", "min_size=-1", "max_size=x", "after=yesterday", "before=2024-01-01",
+	} {
+		if _, w := search(t, s, "/files/calls/?search&"+query); w.Code != http.StatusBadRequest {
+			t.Errorf("?%s: expected 400, got %d", query, w.Code)
+		}
+	}
+	if _, w := search(t, s, "/files/calls/a.wav?search"); w.Code != http.StatusBadRequest {
+		t.Fatalf("search of a file: expected 400, got %d", w.Code)
+	}
+	if _, w := search(t, s, "/files/missing/?search"); w.Code != http.StatusNotFound {
+		t.Fatalf("search of a missing directory: expected 404, got %d", w.Code)
+	}
+}
+
+func TestFileServer_searchLimit(t *testing.T) {
+	m := filesystem.NewMemFS()
+	for i := range maxListLimit + 50 {
+		m.WriteFile(fmt.Sprintf("/%04d.wav", i), strings.NewReader("x"), "I", false)
+	}
+	indexed, err := filesystem.NewIndexedFS(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, fsys := range map[string]filesystem.NewFS{"walk": m, "index": indexed} {
+		s := NewFileServerHandler("/files/", fsys, nil)
+		for query, want := range map[string]int{
+			"":               defaultSearchLimit,
+			"&limit=10":      10,
+			"&limit=500":     500,
+			"&limit=1000000": maxListLimit,
+		} {
+			results, w := search(t, s, "/files/?search"+query)
+			if w.Code != http.StatusOK || len(results.Results) != want || !results.Truncated {
+				t.Errorf("%s ?search%s: expected %d truncated results, got %d %d %v", name, query, want, w.Code, len(results.Results), results.Truncated)
+			}
+			if len(results.Results) > 0 && results.Results[0].Path != "0000.wav" {
+				t.Errorf("%s ?search%s: expected the results in order, got %s first", name, query, results.Results[0].Path)
+			}
+		}
+		if results, _ := search(t, s, "/files/?search&name=000*"); len(results.Results) != 10 || results.Truncated {
+			t.Errorf("%s: expected all the results of a narrow search, got %d %v", name, len(results.Results), results.Truncated)
+		}
+	}
+}
@@ -0,0 +1,323 @@
+// pre-signed share links of the http file server, downloads and uploads without an account
+
+package httphandler
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the query parameters of a signed link
+const (
+	signKeyParam     = "X-Key"
+	signMethodParam  = "X-Method"
+	signExpiresParam = "X-Expires"
+	signMaxSizeParam = "X-Max-Size"
+	signIPParam      = "X-IP"
+	signatureParam   = "X-Signature"
+)
+
+var (
+	ErrLinkExpired   = errors.New("link expired")
+	ErrLinkSignature = errors.New("invalid link signature")
+	ErrLinkDenied    = errors.New("link not valid for the request")
+	ErrLinkTooLarge  = errors.New("upload larger than the link allows")
+)
+
+// SigningKey is a secret signing links, the id is sent with the link to find the key verifying it
+type SigningKey struct {
+	ID     string
+	Secret []byte
+}
+
+// ParseSigningKeys parses keys in the format `id:secret,id:secret`, the first key signs the new links
+func ParseSigningKeys(s string) ([]SigningKey, error) {
+	var keys []SigningKey
+	for i, key := range strings.Split(s, ",") {
+		key = strings.TrimSpace(key)
+		if key == "" {
+			continue
+		}
+		// the entry may be a misplaced secret, it isn't in the error
+		id, secret, ok := strings.Cut(key, ":")
+		if !ok || id == "" || secret == "" {
+			return nil, fmt.Errorf("invalid signing key %d, expected id:secret", i+1)
+		}
+		keys = append(keys, SigningKey{ID: id, Secret: []byte(secret)})
+	}
+	return keys, nil
+}
+
+// SignedLink is the access a link grants, a method on a single path until it expires
+type SignedLink struct {
+	// Path is the url path of the file, including the prefix of the handler
+	Path string
+	// Method is GET, allowing HEAD too, or PUT
+	Method  string
+	Expires time.Time
+	// MaxSize is the maximum size of an upload, 0 is unlimited
+	MaxSize int64
+	// IP restricts the link to an address or a network, empty allows any client
+	IP string
+}
+
+// canonical returns the signed content of the link
+func (l SignedLink) canonical(keyID string) string {
+	return strings.Join([]string{
+		keyID,
+		l.Method,
+		l.Path,
+		strconv.FormatInt(l.Expires.Unix(), 10),
+		strconv.FormatInt(l.MaxSize, 10),
+		l.IP,
+	}, "\n")
+}
+
+// Signer signs and verifies links, keys are rotated by adding a new first key
+// and keeping the old keys until the links signed by them expire
+type Signer struct {
+	keys []SigningKey
+}
+
+// NewSigner returns a signer of the keys, the first key signs
+func NewSigner(keys ...SigningKey) (*Signer, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no signing keys")
+	}
+	ids := map[string]bool{}
+	for _, key := range keys {
+		if len(key.Secret) < 16 {
+			return nil, fmt.Errorf("signing key %s is shorter than 16 bytes", key.ID)
+		}
+		if ids[key.ID] {
+			return nil, fmt.Errorf("duplicate signing key %s", key.ID)
+		}
+		ids[key.ID] = true
+	}
+	return &Signer{keys: keys}, nil
+}
+
+func (s *Signer) signature(key SigningKey, link SignedLink) string {
+	mac := hmac.New(sha256.New, key.Secret)
+	mac.Write([]byte(link.canonical(key.ID)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Sign returns the query of the signed link
+func (s *Signer) Sign(link SignedLink) (url.Values, error) {
+	link.Path = path.Clean("/" + link.Path)
+	switch link.Method {
+	case http.MethodGet, http.MethodPut:
+	default:
+		return nil, fmt.Errorf("links can't be signed for the method %q, only GET or PUT", link.Method)
+	}
+	if link.IP != "" {
+		if _, err := parseIPPrefix(link.IP); err != nil {
+			return nil, err
+		}
+	}
+	if link.MaxSize < 0 {
+		return nil, errors.New("negative max size")
+	}
+	key := s.keys[0]
+	query := url.Values{}
+	query.Set(signKeyParam, key.ID)
+	query.Set(signMethodParam, link.Method)
+	query.Set(signExpiresParam, strconv.FormatInt(link.Expires.Unix(), 10))
+	if link.MaxSize > 0 {
+		query.Set(signMaxSizeParam, strconv.FormatInt(link.MaxSize, 10))
+	}
+	if link.IP != "" {
+		query.Set(signIPParam, link.IP)
+	}
+	query.Set(signatureParam, s.signature(key, link))
+	return query, nil
+}
+
+// SignURL returns the signed link on the base url, like `https://example.com`
+func (s *Signer) SignURL(base string, link SignedLink) (string, error) {
+	query, err := s.Sign(link)
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(base)
+	if err != nil {
+		return "", fmt.Errorf("invalid base url: %w", err)
+	}
+	u.Path = path.Clean("/" + link.Path)
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// isSigned reports if the request carries a link signature
+func isSigned(r *http.Request) bool {
+	return r.URL.Query().Has(signatureParam)
+}
+
+// Verify checks the signed link of the request, it returns the link it grants
+func (s *Signer) Verify(r *http.Request) (SignedLink, error) {
+	query := r.URL.Query()
+	// any other parameter would select another action of the handler, like an archive or a move
+	for param := range query {
+		switch param {
+		case signKeyParam, signMethodParam, signExpiresParam, signMaxSizeParam, signIPParam, signatureParam:
+		default:
+			return SignedLink{}, fmt.Errorf("%w: unexpected parameter %s", ErrLinkDenied, param)
+		}
+	}
+	link := SignedLink{
+		Path:   r.URL.Path,
+		Method: query.Get(signMethodParam),
+		IP:     query.Get(signIPParam),
+	}
+	expires, err := strconv.ParseInt(query.Get(signExpiresParam), 10, 64)
+	if err != nil {
+		return SignedLink{}, ErrLinkSignature
+	}
+	link.Expires = time.Unix(expires, 0)
+	if query.Has(signMaxSizeParam) {
+		if link.MaxSize, err = strconv.ParseInt(query.Get(signMaxSizeParam), 10, 64); err != nil || link.MaxSize <= 0 {
+			return SignedLink{}, ErrLinkSignature
+		}
+	}
+	keyID := query.Get(signKeyParam)
+	valid := false
+	for _, key := range s.keys {
+		if key.ID == keyID {
+			valid = hmac.Equal([]byte(s.signature(key, link)), []byte(query.Get(signatureParam)))
+			break
+		}
+	}
+	if !valid {
+		return SignedLink{}, ErrLinkSignature
+	}
+
+	if time.Now().After(link.Expires) {
+		return SignedLink{}, ErrLinkExpired
+	}
+	if r.Method != link.Method && !(link.Method == http.MethodGet && r.Method == http.MethodHead) {
+		return SignedLink{}, fmt.Errorf("%w: method %s", ErrLinkDenied, r.Method)
+	}
+	if link.IP != "" {
+		prefix, err := parseIPPrefix(link.IP)
+		if err != nil {
+			return SignedLink{}, ErrLinkSignature
+		}
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		addr, err := netip.ParseAddr(host)
+		if err != nil || !prefix.Contains(addr.Unmap()) {
+			return SignedLink{}, fmt.Errorf("%w: address %s", ErrLinkDenied, host)
+		}
+	}
+	if link.MaxSize > 0 && r.ContentLength > link.MaxSize {
+		return SignedLink{}, fmt.Errorf("%w: %d bytes", ErrLinkTooLarge, link.MaxSize)
+	}
+	return link, nil
+}
+
+// parseIPPrefix parses an address or a network
+func parseIPPrefix(ip string) (netip.Prefix, error) {
+	if strings.Contains(ip, "/") {
+		prefix, err := netip.ParsePrefix(ip)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid network %q: %w", ip, err)
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid address %q: %w", ip, err)
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// verifyLink serves the request of a signed link, it reports false if the link is denied
+func (s *FileServer) verifyLink(w http.ResponseWriter, r *http.Request) bool {
+	if s.signer == nil {
+		http.Error(w, "Signed links are not enabled", http.StatusForbidden)
+		return false
+	}
+	link, err := s.signer.Verify(r)
+	switch {
+	case errors.Is(err, ErrLinkExpired):
+		http.Error(w, "The link expired", http.StatusGone)
+		return false
+	case errors.Is(err, ErrLinkTooLarge):
+		http.Error(w, "The upload is too large", http.StatusRequestEntityTooLarge)
+		return false
+	case err != nil:
+		s.Logger().Debug("signed link denied", "path", r.URL.Path, "error", err, "remote", r.RemoteAddr)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return false
+	}
+	if link.MaxSize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, link.MaxSize)
+	}
+	return true
+}
+
+// Share mints a signed link of the file for the authenticated user, `POST /path?share`
+// with the form values method (GET or PUT), expires (a duration, 24h by default), max_size and ip
+func (s *FileServer) Share(w http.ResponseWriter, r *http.Request) {
+	if s.signer == nil {
+		http.Error(w, "Signed links are not enabled", http.StatusNotImplemented)
+		return
+	}
+	// the handler strips its prefix, the link is of the full path
+	link := SignedLink{
+		Path:   path.Join(s.virtualDir, r.URL.Path),
+		Method: strings.ToUpper(r.PostFormValue("method")),
+		IP:     r.PostFormValue("ip"),
+	}
+	if link.Method == "" {
+		link.Method = http.MethodGet
+	}
+	expires := 24 * time.Hour
+	if value := r.PostFormValue("expires"); value != "" {
+		var err error
+		if expires, err = time.ParseDuration(value); err != nil || expires <= 0 {
+			http.Error(w, "Invalid expires duration", http.StatusBadRequest)
+			return
+		}
+	}
+	link.Expires = time.Now().Add(expires)
+	if value := r.PostFormValue("max_size"); value != "" {
+		var err error
+		if link.MaxSize, err = strconv.ParseInt(value, 10, 64); err != nil {
+			http.Error(w, "Invalid max_size", http.StatusBadRequest)
+			return
+		}
+	}
+	if link.Method == http.MethodGet {
+		if _, info, err := s.localDirFS.Stat(s.fsPath(r.URL.Path)); err != nil || info.IsDir() {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	signed, err := s.signer.SignURL(scheme+"://"+r.Host, link)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, map[string]any{"url": signed, "method": link.Method, "expires": link.Expires.UTC()})
+}
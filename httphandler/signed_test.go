@@ -0,0 +1,223 @@
+package httphandler
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/telebroad/fileserver/filesystem"
+	"github.com/telebroad/fileserver/users"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testReadKey  = "read-key-0123456789"
+	testWriteKey = "write-key-0123456789"
+)
+
+// newSignedServer returns a file server of /files/a.txt with the API keys of testReadKey and testWriteKey
+func newSignedServer(t *testing.T, signer *Signer) (*FileServer, *filesystem.MemFS) {
+	t.Helper()
+	keys := users.NewAPIKeys()
+	keys.Add("reader", testReadKey, users.ScopeRead)
+	keys.Add("writer", testWriteKey, users.ScopeRead, users.ScopeWrite)
+	m := filesystem.NewMemFS()
+	m.WriteFile("/a.txt", strings.NewReader("hello"), "I", false)
+	s := NewFileServerHandler("/files/", m, &users.Authenticator{APIKeys: keys}).(*FileServer)
+	s.SetLogger(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	s.SetSigner(signer)
+	return s, m
+}
+
+// newTestSigner returns a signer of the keys, by id
+func newTestSigner(t *testing.T, ids ...string) *Signer {
+	t.Helper()
+	var keys []SigningKey
+	for _, id := range ids {
+		keys = append(keys, SigningKey{ID: id, Secret: []byte("secret-of-the-key-" + id)})
+	}
+	signer, err := NewSigner(keys...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// signedTarget returns the path and the query of the signed link
+func signedTarget(t *testing.T, signer *Signer, link SignedLink) string {
+	t.Helper()
+	query, err := signer.Sign(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return link.Path + "?" + query.Encode()
+}
+
+// withParam returns the target with the query parameter replaced
+func withParam(target, param, value string) string {
+	u, _ := url.Parse(target)
+	query := u.Query()
+	query.Set(param, value)
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+func TestSigner(t *testing.T) {
+	if keys, err := ParseSigningKeys(" 2025:secret-of-2025-key , 2024:secret:with:colons,"); err != nil || len(keys) != 2 || string(keys[1].Secret) != "secret:with:colons" {
+		t.Fatalf("unexpected keys %v %v", keys, err)
+	}
+	for _, keys := range []string{"k:0123456789abcdef,hunter2hunter2", ":hunter2hunter2", "hunter2hunter2:"} {
+		if _, err := ParseSigningKeys(keys); err == nil || strings.Contains(err.Error(), "hunter2") {
+			t.Errorf("%q: expected an error without the secret, got %v", keys, err)
+		}
+	}
+	if _, err := NewSigner(); err == nil {
+		t.Error("expected an error without keys")
+	}
+	if _, err := NewSigner(SigningKey{ID: "short", Secret: []byte("0123456789")}); err == nil {
+		t.Error("expected an error for a short key")
+	}
+	key := SigningKey{ID: "k", Secret: []byte("0123456789abcdef")}
+	if _, err := NewSigner(key, key); err == nil {
+		t.Error("expected an error for a duplicate key")
+	}
+
+	signer := newTestSigner(t, "k")
+	expires := time.Now().Add(time.Hour)
+	for _, link := range []SignedLink{
+		{Path: "/files/a.txt", Method: http.MethodDelete, Expires: expires},
+		{Path: "/files/a.txt", Method: http.MethodPost, Expires: expires},
+		{Path: "/files/a.txt", Method: http.MethodGet, Expires: expires, IP: "not an ip"},
+		{Path: "/files/a.txt", Method: http.MethodPut, Expires: expires, MaxSize: -1},
+	} {
+		if _, err := signer.Sign(link); err == nil {
+			t.Errorf("expected %+v not to be signed", link)
+		}
+	}
+}
+
+func TestFileServer_signedLinks(t *testing.T) {
+	signer := newTestSigner(t, "2025", "2024")
+	s, m := newSignedServer(t, signer)
+	expires := time.Now().Add(time.Hour)
+	get := signedTarget(t, signer, SignedLink{Path: "/files/a.txt", Method: http.MethodGet, Expires: expires})
+	put := signedTarget(t, signer, SignedLink{Path: "/files/b.txt", Method: http.MethodPut, Expires: expires, MaxSize: 5})
+	old := signedTarget(t, newTestSigner(t, "2024"), SignedLink{Path: "/files/a.txt", Method: http.MethodGet, Expires: expires})
+	removed := signedTarget(t, newTestSigner(t, "2023"), SignedLink{Path: "/files/a.txt", Method: http.MethodGet, Expires: expires})
+	expired := signedTarget(t, signer, SignedLink{Path: "/files/a.txt", Method: http.MethodGet, Expires: time.Now().Add(-time.Second)})
+	network := signedTarget(t, signer, SignedLink{Path: "/files/a.txt", Method: http.MethodGet, Expires: expires, IP: "192.0.2.0/24"})
+	otherIP := signedTarget(t, signer, SignedLink{Path: "/files/a.txt", Method: http.MethodGet, Expires: expires, IP: "198.51.100.7"})
+
+	for _, test := range []struct {
+		name           string
+		method, target string
+		body           string
+		want           int
+	}{
+		{"a download", http.MethodGet, get, "", http.StatusOK},
+		{"a HEAD of a download", http.MethodHead, get, "", http.StatusOK},
+		{"an unsigned request", http.MethodGet, "/files/a.txt", "", http.StatusUnauthorized},
+		{"another path", http.MethodGet, strings.Replace(get, "a.txt", "b.txt", 1), "", http.StatusForbidden},
+		{"another method", http.MethodGet, withParam(get, signMethodParam, http.MethodPut), "", http.StatusForbidden},
+		{"another expiry", http.MethodGet, withParam(get, signExpiresParam, "9999999999"), "", http.StatusForbidden},
+		{"another signature", http.MethodGet, withParam(get, signatureParam, "AAAA"), "", http.StatusForbidden},
+		{"an unknown key", http.MethodGet, withParam(get, signKeyParam, "2023"), "", http.StatusForbidden},
+		{"a removed key", http.MethodGet, removed, "", http.StatusForbidden},
+		{"a rotated key", http.MethodGet, old, "", http.StatusOK},
+		{"an added max size", http.MethodGet, withParam(get, signMaxSizeParam, "1"), "", http.StatusForbidden},
+		{"an added action", http.MethodGet, withParam(get, "archive", "zip"), "", http.StatusForbidden},
+		{"an added move", http.MethodPost, withParam(get, "move", ""), "", http.StatusForbidden},
+		{"an expired link", http.MethodGet, expired, "", http.StatusGone},
+		{"a download link used to upload", http.MethodPut, strings.Replace(get, signMethodParam+"=GET", signMethodParam+"=PUT", 1), "x", http.StatusForbidden},
+		{"a download link used to delete", http.MethodDelete, get, "", http.StatusForbidden},
+		{"an upload link used to download", http.MethodGet, put, "", http.StatusForbidden},
+		{"a client of the network", http.MethodGet, network, "", http.StatusOK},
+		{"a client of another address", http.MethodGet, otherIP, "", http.StatusForbidden},
+		{"a client of a removed address", http.MethodGet, withParam(otherIP, signIPParam, "192.0.2.1"), "", http.StatusForbidden},
+		{"an upload over the max size", http.MethodPut, put, "too large", http.StatusRequestEntityTooLarge},
+		{"an upload", http.MethodPut, put, "small", http.StatusCreated},
+	} {
+		r := httptest.NewRequest(test.method, test.target, strings.NewReader(test.body))
+		if w := serve(s, r); w.Code != test.want {
+			t.Errorf("%s: expected %d, got %d %s", test.name, test.want, w.Code, w.Body)
+		}
+	}
+	if readFile(t, m, "/b.txt") != "small" {
+		t.Fatal("expected the uploaded file")
+	}
+
+	// a body without a length is cut at the max size
+	r := httptest.NewRequest(http.MethodPut, put, io.MultiReader(strings.NewReader("too large")))
+	r.ContentLength = -1
+	if w := serve(s, r); w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("a streamed upload over the max size: expected 413, got %d", w.Code)
+	}
+
+	// an IPv4 mapped address is in the IPv4 network, an IPv6 address is not
+	r = httptest.NewRequest(http.MethodGet, network, nil)
+	r.RemoteAddr = "[::ffff:192.0.2.9]:1234"
+	if _, err := signer.Verify(r); err != nil {
+		t.Fatalf("IPv4 mapped address: %v", err)
+	}
+	r.RemoteAddr = "[2001:db8::1]:1234"
+	if _, err := signer.Verify(r); !errors.Is(err, ErrLinkDenied) {
+		t.Fatalf("IPv6 address: expected a denied link, got %v", err)
+	}
+}
+
+func TestFileServer_share(t *testing.T) {
+	signer := newTestSigner(t, "k")
+	s, _ := newSignedServer(t, signer)
+
+	share := func(target, key string, form url.Values) *httptest.ResponseRecorder {
+		r := formRequest(target, form, "")
+		r.Header.Set("X-API-Key", key)
+		return serve(s, r)
+	}
+	w := share("/files/a.txt?share", testReadKey, url.Values{"expires": {"1h"}})
+	var shared struct {
+		URL    string `json:"url"`
+		Method string `json:"method"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &shared); err != nil || w.Code != http.StatusCreated || shared.Method != http.MethodGet {
+		t.Fatalf("share: %d %v %s", w.Code, err, w.Body)
+	}
+	if w = serve(s, httptest.NewRequest(http.MethodGet, shared.URL, nil)); w.Code != http.StatusOK || w.Body.String() != "hello" {
+		t.Fatalf("shared link: %d %s", w.Code, w.Body)
+	}
+
+	for _, test := range []struct {
+		name, key string
+		form      url.Values
+		want      int
+	}{
+		{"an upload link of a reader", testReadKey, url.Values{"method": {"put"}}, http.StatusForbidden},
+		{"an upload link of a writer", testWriteKey, url.Values{"method": {"put"}, "max_size": {"10"}}, http.StatusCreated},
+		{"a link without a user", "", nil, http.StatusUnauthorized},
+		{"a delete link", testWriteKey, url.Values{"method": {"delete"}}, http.StatusBadRequest},
+		{"an invalid expiry", testReadKey, url.Values{"expires": {"-1h"}}, http.StatusBadRequest},
+		{"an invalid max size", testWriteKey, url.Values{"method": {"put"}, "max_size": {"x"}}, http.StatusBadRequest},
+		{"an invalid address", testReadKey, url.Values{"ip": {"x"}}, http.StatusBadRequest},
+	} {
+		if w = share("/files/a.txt?share", test.key, test.form); w.Code != test.want {
+			t.Errorf("%s: expected %d, got %d %s", test.name, test.want, w.Code, w.Body)
+		}
+	}
+	if w = share("/files/missing.txt?share", testReadKey, nil); w.Code != http.StatusNotFound {
+		t.Fatalf("share of a missing file: expected 404, got %d", w.Code)
+	}
+
+	// without a signer the links are disabled
+	s.SetSigner(nil)
+	if w = share("/files/a.txt?share", testReadKey, nil); w.Code != http.StatusNotImplemented {
+		t.Fatalf("share without a signer: expected 501, got %d", w.Code)
+	}
+	if w = serve(s, httptest.NewRequest(http.MethodGet, shared.URL, nil)); w.Code != http.StatusForbidden {
+		t.Fatalf("signed link without a signer: expected 403, got %d", w.Code)
+	}
+}
@@ -0,0 +1,452 @@
+// tus handler for resumable uploads, tus 1.0 with the creation, termination, checksum and expiration extensions
+
+package httphandler
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/telebroad/fileserver/filesystem"
+	"hash"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// tusVersion is the supported version of the tus protocol
+	tusVersion = "1.0.0"
+	// tusExpiration is how long an upload is kept after its last chunk
+	tusExpiration = 24 * time.Hour
+	// tusPurgeInterval is the minimal interval between the removals of the expired uploads
+	tusPurgeInterval = time.Minute
+	// statusChecksumMismatch is the status of a chunk that doesn't match its Upload-Checksum
+	statusChecksumMismatch = 460
+)
+
+// tusChecksums are the supported algorithms of the Upload-Checksum header
+var tusChecksums = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"md5":    md5.New,
+}
+
+// tusUpload is the state of an upload, persisted next to its data so uploads survive restarts
+type tusUpload struct {
+	ID       string    `json:"id"`
+	Path     string    `json:"path"`     // the path of the finished file in the served file system
+	Length   int64     `json:"length"`   // Upload-Length
+	Offset   int64     `json:"offset"`   // the bytes received
+	Metadata string    `json:"metadata"` // Upload-Metadata
+	Expires  time.Time `json:"expires"`
+	Done     bool      `json:"done"` // the file was moved to its path
+}
+
+// Tus is a httphandler handler for resumable uploads with the tus protocol,
+// the chunks are written at their offsets in the staging file system and the finished file is copied
+// to the path of the `filename` metadata in the served file system
+type Tus struct {
+	prefix string // The virtual directory of the uploads
+	fsys   filesystem.FS
+	// staging keeps the data and the state of the unfinished uploads, it must be outside the served files
+	// so the users of the other handlers can't read or change them
+	staging   filesystem.FSWithReadWriteAt
+	users     Users
+	lock      sync.Mutex      // Protects busy and lastPurge
+	busy      map[string]bool // the uploads receiving a chunk
+	lastPurge time.Time
+	logger    *slog.Logger
+}
+
+func (t *Tus) SetLogger(l *slog.Logger) {
+	t.logger = l
+}
+func (t *Tus) Logger() *slog.Logger {
+	if t.logger == nil {
+		t.logger = slog.Default()
+	}
+	return t.logger.With("module", "tus-handler")
+}
+
+// NewTusHandler creates a new tus handler of the files of fsys, the unfinished uploads are kept in staging,
+// uploads are created with a POST to the pattern and continued with PATCH requests to the returned Location
+func NewTusHandler(pattern string, fsys filesystem.FS, staging filesystem.FSWithReadWriteAt, users Users) http.Handler {
+	return &Tus{
+		prefix:  strings.TrimSuffix(path.Clean(pattern), "/") + "/",
+		fsys:    fsys,
+		staging: staging,
+		users:   users,
+		busy:    map[string]bool{},
+	}
+}
+
+// ServeHTTP serves the tus request implementing the httphandler.Handler interface
+func (t *Tus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !authorize(t.users, w, r) {
+		return
+	}
+	t.Logger().Debug("ServeHTTP", "method", r.Method, "url", r.URL.String(), "remote", r.RemoteAddr)
+	t.purge()
+
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", "creation,termination,checksum,expiration")
+		w.Header().Set("Tus-Checksum-Algorithm", "sha1,sha256,md5")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "Unsupported tus version", http.StatusPreconditionFailed)
+		return
+	}
+
+	id, ok := strings.CutPrefix(r.URL.Path, t.prefix)
+	if r.URL.Path+"/" == t.prefix {
+		id, ok = "", true
+	}
+	switch {
+	case !ok:
+		http.NotFound(w, r)
+	case id == "" && r.Method == http.MethodPost:
+		t.create(w, r)
+	case id == "" || strings.Contains(id, "/"):
+		http.NotFound(w, r)
+	case r.Method == http.MethodHead:
+		t.head(w, id)
+	case r.Method == http.MethodPatch:
+		t.patch(w, r, id)
+	case r.Method == http.MethodDelete:
+		t.terminate(w, id)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// create creates an upload of Upload-Length bytes to the path of the filename metadata
+func (t *Tus) create(w http.ResponseWriter, r *http.Request) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "Invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+	metadata := r.Header.Get("Upload-Metadata")
+	filename, err := tusMetadata(metadata, "filename")
+	if err != nil || filename == "" {
+		http.Error(w, "Missing filename metadata", http.StatusBadRequest)
+		return
+	}
+	name := path.Join(t.fsys.RootDir(), path.Clean("/"+filename))
+	if !t.validPath(name) {
+		http.Error(w, "Invalid filename", http.StatusBadRequest)
+		return
+	}
+
+	id, err := tusID()
+	if err != nil {
+		http.Error(w, "Error creating upload", http.StatusInternalServerError)
+		return
+	}
+	upload := &tusUpload{ID: id, Path: name, Length: length, Metadata: metadata, Expires: time.Now().Add(tusExpiration)}
+	err = t.staging.WriteFile(t.dataPath(id), strings.NewReader(""), "I", false)
+	if err == nil {
+		err = t.save(upload)
+	}
+	if err == nil && length == 0 {
+		err = t.finish(upload)
+	}
+	if err != nil {
+		t.remove(id)
+		http.Error(w, "Error creating upload", errorStatus(err))
+		return
+	}
+	w.Header().Set("Location", t.prefix+id)
+	w.Header().Set("Upload-Expires", upload.Expires.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// head returns the offset of the upload
+func (t *Tus) head(w http.ResponseWriter, id string) {
+	upload, err := t.load(id)
+	if err != nil {
+		http.Error(w, "Upload not found", errorStatus(err))
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	if upload.Metadata != "" {
+		w.Header().Set("Upload-Metadata", upload.Metadata)
+	}
+	w.Header().Set("Upload-Expires", upload.Expires.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusOK)
+}
+
+// patch writes the chunk at Upload-Offset, a chunk failing its Upload-Checksum is discarded,
+// the file is moved to its path once all the bytes are received
+func (t *Tus) patch(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Invalid Content-Type", http.StatusUnsupportedMediaType)
+		return
+	}
+	var checksum hash.Hash
+	var expected []byte
+	if header := r.Header.Get("Upload-Checksum"); header != "" {
+		algorithm, sum, _ := strings.Cut(header, " ")
+		newHash, ok := tusChecksums[algorithm]
+		decoded, err := base64.StdEncoding.DecodeString(sum)
+		if !ok || err != nil {
+			http.Error(w, "Unsupported Upload-Checksum", http.StatusBadRequest)
+			return
+		}
+		checksum, expected = newHash(), decoded
+	}
+
+	if !t.acquire(id) {
+		http.Error(w, "Upload is receiving an other chunk", http.StatusLocked)
+		return
+	}
+	defer t.release(id)
+	upload, err := t.load(id)
+	if err != nil {
+		http.Error(w, "Upload not found", errorStatus(err))
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset != upload.Offset || upload.Done {
+		http.Error(w, "Upload-Offset doesn't match", http.StatusConflict)
+		return
+	}
+	if r.ContentLength > upload.Length-upload.Offset {
+		http.Error(w, "Chunk exceeds Upload-Length", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	n, err := t.write(upload, r.Body, checksum)
+	switch {
+	case checksum != nil && err == nil && !bytes.Equal(checksum.Sum(nil), expected):
+		http.Error(w, "Checksum mismatch", statusChecksumMismatch)
+		return
+	case checksum != nil && err != nil:
+		// a chunk with a checksum is only kept whole
+		http.Error(w, "Error writing chunk", errorStatus(err))
+		return
+	}
+	// the bytes received before a failure are kept, the client resumes after them
+	upload.Offset += n
+	upload.Expires = time.Now().Add(tusExpiration)
+	if saveErr := t.save(upload); err == nil {
+		err = saveErr
+	}
+	if err == nil && upload.Offset == upload.Length {
+		err = t.finish(upload)
+	}
+	if err != nil {
+		http.Error(w, "Error writing chunk", errorStatus(err))
+		return
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Expires", upload.Expires.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// write writes the body at the offset of the upload, up to its length
+func (t *Tus) write(upload *tusUpload, body io.Reader, checksum hash.Hash) (int64, error) {
+	writer, err := t.staging.FileWrite(t.dataPath(upload.ID), os.O_WRONLY|os.O_CREATE)
+	if err != nil {
+		return 0, err
+	}
+	r := io.LimitReader(body, upload.Length-upload.Offset)
+	if checksum != nil {
+		r = io.TeeReader(r, checksum)
+	}
+	n, err := io.Copy(io.NewOffsetWriter(writer, upload.Offset), r)
+	if closer, ok := writer.(io.Closer); ok {
+		if closeErr := closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return n, err
+}
+
+// finish copies the received file to its path and removes its data,
+// the state is kept until it expires so HEAD reports the upload complete
+func (t *Tus) finish(upload *tusUpload) error {
+	if !t.validPath(upload.Path) {
+		return &fs.PathError{Op: "finish", Path: upload.Path, Err: fs.ErrPermission}
+	}
+	if err := t.fsys.MakeDir(path.Dir(upload.Path)); err != nil {
+		return err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := t.staging.ReadFile(t.dataPath(upload.ID), pw)
+		pw.CloseWithError(err)
+	}()
+	err := t.fsys.WriteFile(upload.Path, pr, "I", false)
+	pr.CloseWithError(errors.New("copy aborted"))
+	if err != nil {
+		return err
+	}
+	if err = t.staging.Remove(t.dataPath(upload.ID)); err != nil {
+		t.Logger().Error("Error removing the finished upload", "id", upload.ID, "error", err)
+	}
+	upload.Done = true
+	return t.save(upload)
+}
+
+// validPath reports whether the path of a finished file is a file under the root of the served file system
+func (t *Tus) validPath(name string) bool {
+	return name == path.Clean(name) && isWithin(name, t.fsys.RootDir())
+}
+
+// terminate removes the upload
+func (t *Tus) terminate(w http.ResponseWriter, id string) {
+	if !t.acquire(id) {
+		http.Error(w, "Upload is receiving an other chunk", http.StatusLocked)
+		return
+	}
+	defer t.release(id)
+	if _, err := t.load(id); err != nil {
+		http.Error(w, "Upload not found", errorStatus(err))
+		return
+	}
+	t.remove(id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// acquire marks the upload busy, false if it already is
+func (t *Tus) acquire(id string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.busy[id] {
+		return false
+	}
+	t.busy[id] = true
+	return true
+}
+
+func (t *Tus) release(id string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.busy, id)
+}
+
+// dataPath returns the path of the received data of the upload in the staging file system
+func (t *Tus) dataPath(id string) string {
+	return path.Join(t.staging.RootDir(), id)
+}
+
+// infoPath returns the path of the state of the upload
+func (t *Tus) infoPath(id string) string {
+	return t.dataPath(id) + ".info"
+}
+
+// load reads the state of the upload, an expired upload doesn't exist
+func (t *Tus) load(id string) (*tusUpload, error) {
+	if !isTusID(id) {
+		return nil, fs.ErrNotExist
+	}
+	var b bytes.Buffer
+	if _, err := t.staging.ReadFile(t.infoPath(id), &b); err != nil {
+		return nil, err
+	}
+	upload := &tusUpload{}
+	if err := json.Unmarshal(b.Bytes(), upload); err != nil {
+		return nil, fmt.Errorf("error reading upload %s: %w", id, err)
+	}
+	if time.Now().After(upload.Expires) {
+		return nil, fs.ErrNotExist
+	}
+	return upload, nil
+}
+
+// save writes the state of the upload
+func (t *Tus) save(upload *tusUpload) error {
+	data, err := json.Marshal(upload)
+	if err != nil {
+		return err
+	}
+	return t.staging.WriteFile(t.infoPath(upload.ID), bytes.NewReader(data), "I", false)
+}
+
+// remove removes the data and the state of the upload
+func (t *Tus) remove(id string) {
+	for _, name := range []string{t.dataPath(id), t.infoPath(id)} {
+		if err := t.staging.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			t.Logger().Error("Error removing upload", "id", id, "error", err)
+		}
+	}
+}
+
+// purge removes the expired uploads, at most once per tusPurgeInterval
+func (t *Tus) purge() {
+	t.lock.Lock()
+	if time.Since(t.lastPurge) < tusPurgeInterval {
+		t.lock.Unlock()
+		return
+	}
+	t.lastPurge = time.Now()
+	t.lock.Unlock()
+
+	_, infos, err := t.staging.Dir(t.staging.RootDir())
+	if err != nil {
+		return
+	}
+	for _, info := range infos {
+		id, ok := strings.CutSuffix(info.Name(), ".info")
+		if !ok || !t.acquire(id) {
+			continue
+		}
+		if _, err = t.load(id); errors.Is(err, fs.ErrNotExist) {
+			t.remove(id)
+		}
+		t.release(id)
+	}
+}
+
+// tusID returns the id of a new upload
+func tusID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", fmt.Errorf("error creating upload id: %w", err)
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// isTusID reports whether the id can be an upload id, so it can't name an other file
+func isTusID(id string) bool {
+	_, err := hex.DecodeString(id)
+	return err == nil && len(id) == 32
+}
+
+// tusMetadata returns the value of the key of the Upload-Metadata header, `key base64,key base64`
+func tusMetadata(header, key string) (string, error) {
+	for _, pair := range strings.Split(header, ",") {
+		k, value, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if k != key {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return "", fmt.Errorf("error decoding metadata %s: %w", key, err)
+		}
+		return string(decoded), nil
+	}
+	return "", nil
+}
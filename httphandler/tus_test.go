@@ -0,0 +1,143 @@
+package httphandler
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/telebroad/fileserver/filesystem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// tusRequest returns a tus request with the headers, as name and value pairs
+func tusRequest(method, target, body string, header ...string) *http.Request {
+	r := davRequest(method, target, body, header...)
+	r.Header.Set("Tus-Resumable", tusVersion)
+	return r
+}
+
+// tusCreate creates an upload of the file and returns its location
+func tusCreate(t *testing.T, h http.Handler, filename string, length string) string {
+	t.Helper()
+	metadata := "filename " + base64.StdEncoding.EncodeToString([]byte(filename))
+	w := serve(h, tusRequest(http.MethodPost, "/tus/", "", "Upload-Length", length, "Upload-Metadata", metadata))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create %s: %d %s", filename, w.Code, w.Body)
+	}
+	return w.Header().Get("Location")
+}
+
+// tusPatch sends the chunk at the offset
+func tusPatch(h http.Handler, location, offset, chunk string, header ...string) *httptest.ResponseRecorder {
+	header = append(header, "Content-Type", "application/offset+octet-stream", "Upload-Offset", offset)
+	return serve(h, tusRequest(http.MethodPatch, location, chunk, header...))
+}
+
+func TestTus_upload(t *testing.T) {
+	m, staging := filesystem.NewMemFS(), filesystem.NewMemFS()
+	h := NewTusHandler("/tus/", m, staging, nil)
+
+	location := tusCreate(t, h, "../../dir/a.txt", "11")
+	if w := tusPatch(h, location, "0", "hello"); w.Code != http.StatusNoContent || w.Header().Get("Upload-Offset") != "5" {
+		t.Fatalf("PATCH: %d %s", w.Code, w.Body)
+	}
+
+	sum := func(chunk string) string {
+		s := sha1.Sum([]byte(chunk))
+		return "sha1 " + base64.StdEncoding.EncodeToString(s[:])
+	}
+	for _, test := range []struct {
+		name         string
+		offset, body string
+		header       []string
+		want         int
+	}{
+		{"a stale offset", "0", " world", nil, http.StatusConflict},
+		{"an offset after the received bytes", "6", "world", nil, http.StatusConflict},
+		{"an invalid offset", "x", " world", nil, http.StatusConflict},
+		{"a chunk exceeding the length", "5", " world and more", nil, http.StatusRequestEntityTooLarge},
+		{"a checksum mismatch", "5", " world", []string{"Upload-Checksum", sum(" other")}, statusChecksumMismatch},
+		{"an unknown checksum", "5", " world", []string{"Upload-Checksum", "crc32 AAAA"}, http.StatusBadRequest},
+		{"another content type", "5", " world", []string{"Content-Type", "text/plain"}, http.StatusUnsupportedMediaType},
+	} {
+		r := tusRequest(http.MethodPatch, location, test.body, "Content-Type", "application/offset+octet-stream", "Upload-Offset", test.offset)
+		for i := 0; i+1 < len(test.header); i += 2 {
+			r.Header.Set(test.header[i], test.header[i+1])
+		}
+		if w := serve(h, r); w.Code != test.want {
+			t.Errorf("%s: expected %d, got %d %s", test.name, test.want, w.Code, w.Body)
+		}
+	}
+	if w := serve(h, tusRequest(http.MethodHead, location, "")); w.Code != http.StatusOK || w.Header().Get("Upload-Offset") != "5" {
+		t.Fatalf("expected the rejected chunks to be discarded, got %d %s", w.Code, w.Header().Get("Upload-Offset"))
+	}
+
+	if w := tusPatch(h, location, "5", " world", "Upload-Checksum", sum(" world")); w.Code != http.StatusNoContent || w.Header().Get("Upload-Offset") != "11" {
+		t.Fatalf("last PATCH: %d %s", w.Code, w.Body)
+	}
+	if got := readFile(t, m, "/dir/a.txt"); got != "hello world" {
+		t.Fatalf("expected the finished file in the root, got %q", got)
+	}
+	if w := tusPatch(h, location, "11", ""); w.Code != http.StatusConflict {
+		t.Fatalf("PATCH of a finished upload: expected 409, got %d", w.Code)
+	}
+
+	// the unfinished uploads are staged outside the served files
+	if _, infos, err := m.Dir("/"); err != nil || len(infos) != 1 || infos[0].Name() != "dir" {
+		t.Fatalf("expected only the finished file in the served files, got %v %v", infos, err)
+	}
+	if w := serve(h, tusRequest(http.MethodDelete, location, "")); w.Code != http.StatusNoContent {
+		t.Fatalf("DELETE: %d", w.Code)
+	}
+	if _, infos, _ := staging.Dir("/"); len(infos) != 0 {
+		t.Fatalf("expected the upload to be removed from the staging, got %v", infos)
+	}
+}
+
+func TestTus_invalid(t *testing.T) {
+	m, staging := filesystem.NewMemFS(), filesystem.NewMemFS()
+	h := NewTusHandler("/tus/", m, staging, nil)
+
+	if w := serve(h, httptest.NewRequest(http.MethodPost, "/tus/", nil)); w.Code != http.StatusPreconditionFailed {
+		t.Fatalf("without Tus-Resumable: expected 412, got %d", w.Code)
+	}
+	metadata := "filename " + base64.StdEncoding.EncodeToString([]byte("a.txt"))
+	for _, header := range [][]string{
+		{"Upload-Length", "-1", "Upload-Metadata", metadata},
+		{"Upload-Length", "x", "Upload-Metadata", metadata},
+		{"Upload-Length", "1"},
+		{"Upload-Length", "1", "Upload-Metadata", "filename !!!"},
+		{"Upload-Length", "1", "Upload-Metadata", "filename " + base64.StdEncoding.EncodeToString([]byte("/.."))},
+	} {
+		if w := serve(h, tusRequest(http.MethodPost, "/tus/", "", header...)); w.Code != http.StatusBadRequest {
+			t.Errorf("create with %q: expected 400, got %d", header, w.Code)
+		}
+	}
+	for _, target := range []string{"/tus/0123", "/tus/" + strings.Repeat("0", 32), "/tus/a/b", "/tus/..%2f..%2fa.txt"} {
+		if w := serve(h, tusRequest(http.MethodHead, target, "")); w.Code != http.StatusNotFound {
+			t.Errorf("HEAD %s: expected 404, got %d", target, w.Code)
+		}
+	}
+
+	// a changed state can't finish the upload outside the root
+	location := tusCreate(t, h, "a.txt", "1")
+	id := strings.TrimPrefix(location, "/tus/")
+	var b bytes.Buffer
+	if _, err := staging.ReadFile("/"+id+".info", &b); err != nil {
+		t.Fatal(err)
+	}
+	upload := tusUpload{}
+	json.Unmarshal(b.Bytes(), &upload)
+	upload.Path = "/../escape.txt"
+	data, _ := json.Marshal(upload)
+	staging.WriteFile("/"+id+".info", bytes.NewReader(data), "I", false)
+	if w := tusPatch(h, location, "0", "x"); w.Code != http.StatusForbidden {
+		t.Fatalf("finish of a changed path: expected 403, got %d", w.Code)
+	}
+	if _, infos, _ := m.Dir("/"); len(infos) != 0 {
+		t.Fatalf("expected no finished file, got %v", infos)
+	}
+}
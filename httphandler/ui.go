@@ -0,0 +1,183 @@
+// endpoints of the html directory UI, uploads, folders, renames and moves
+
+package httphandler
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+const (
+	// csrfCookie is the cookie of the CSRF token of the directory UI
+	csrfCookie = "csrf_token"
+	// csrfHeader is the header the directory UI sends the CSRF token in
+	csrfHeader = "X-CSRF-Token"
+)
+
+// csrfToken returns the CSRF token of the client, a new token is set as a cookie
+func (s *FileServer) csrfToken(w http.ResponseWriter, r *http.Request) string {
+	if cookie, err := r.Cookie(csrfCookie); err == nil && len(cookie.Value) == 43 {
+		return cookie.Value
+	}
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		s.Logger().Error("Error creating CSRF token", "error", err)
+		return ""
+	}
+	cookie := &http.Cookie{
+		Name:     csrfCookie,
+		Value:    base64.RawURLEncoding.EncodeToString(token),
+		Path:     s.virtualDir,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	}
+	http.SetCookie(w, cookie)
+	return cookie.Value
+}
+
+// validCSRF checks the CSRF token of the request against its cookie, a double submitted cookie.
+// the token is sent in the X-CSRF-Token header, or the csrf_token field of an url encoded form
+func validCSRF(r *http.Request) bool {
+	cookie, err := r.Cookie(csrfCookie)
+	if err != nil || cookie.Value == "" {
+		return false
+	}
+	token := r.Header.Get(csrfHeader)
+	if token == "" {
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/x-www-form-urlencoded" {
+			token = r.PostFormValue(csrfCookie)
+		}
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(cookie.Value)) == 1
+}
+
+// relativeName returns the cleaned name of a form value, empty if it names the directory itself
+func relativeName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// Upload saves the files of a multipart form to the directory, `POST /dir/?upload`
+func (s *FileServer) Upload(w http.ResponseWriter, r *http.Request) {
+	dir := s.fsPath(r.URL.Path)
+	if _, info, err := s.localDirFS.Stat(dir); err != nil || !info.IsDir() {
+		http.Error(w, "Directory not found", http.StatusNotFound)
+		return
+	}
+	reader, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "Invalid multipart form", http.StatusBadRequest)
+		return
+	}
+	// the parts are streamed to the file system, a large upload isn't buffered
+	var uploaded []string
+	for {
+		part, err := reader.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			http.Error(w, "Invalid multipart form", http.StatusBadRequest)
+			return
+		}
+		name := path.Base(relativeName(part.FileName()))
+		if part.FileName() == "" || name == "." {
+			part.Close()
+			continue
+		}
+		err = s.localDirFS.WriteFile(path.Join(dir, name), part, "I", false)
+		part.Close()
+		if err != nil {
+			http.Error(w, "Error writing file "+name, errorStatus(err))
+			return
+		}
+		uploaded = append(uploaded, name)
+	}
+	if len(uploaded) == 0 {
+		http.Error(w, "No files uploaded", http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, uploaded)
+}
+
+// MakeDir creates the folder of the name form value in the directory, `POST /dir/?mkdir`
+func (s *FileServer) MakeDir(w http.ResponseWriter, r *http.Request) {
+	name := relativeName(r.PostFormValue("name"))
+	if name == "" {
+		http.Error(w, "Missing folder name", http.StatusBadRequest)
+		return
+	}
+	dir := path.Join(s.fsPath(r.URL.Path), name)
+	if _, _, err := s.localDirFS.Stat(dir); err == nil {
+		http.Error(w, "Folder "+name+" exists", http.StatusConflict)
+		return
+	}
+	if err := s.localDirFS.MakeDir(dir); err != nil {
+		http.Error(w, "Error creating folder", errorStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, newFileEntryOf(s, dir))
+}
+
+// Move renames or moves the file to the to form value, `POST /path?move`.
+// a relative destination is in the directory of the file, so a name renames it,
+// and an existing folder as the destination moves the file into it
+func (s *FileServer) Move(w http.ResponseWriter, r *http.Request) {
+	source := path.Clean("/" + r.URL.Path)
+	from := s.fsPath(source)
+	if from == path.Clean(s.localDirFS.RootDir()) {
+		http.Error(w, "The root can't be moved", http.StatusForbidden)
+		return
+	}
+	to := r.PostFormValue("to")
+	if to == "" {
+		http.Error(w, "Missing destination", http.StatusBadRequest)
+		return
+	}
+	if !strings.HasPrefix(to, "/") {
+		to = path.Join(path.Dir(source), to)
+	}
+	target := s.fsPath(to)
+	if _, _, err := s.localDirFS.Stat(from); err != nil {
+		http.Error(w, "File not found", errorStatus(err))
+		return
+	}
+	if _, info, err := s.localDirFS.Stat(target); err == nil && info.IsDir() {
+		target = path.Join(target, path.Base(from))
+	}
+	if target == from || strings.HasPrefix(target, from+"/") {
+		http.Error(w, "Destination is inside the file", http.StatusBadRequest)
+		return
+	}
+	if _, _, err := s.localDirFS.Stat(target); err == nil {
+		http.Error(w, "Destination exists", http.StatusConflict)
+		return
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		http.Error(w, "Error checking destination", errorStatus(err))
+		return
+	}
+	if err := s.localDirFS.Rename(from, target); err != nil {
+		http.Error(w, "Error moving file", errorStatus(err))
+		return
+	}
+	writeJSON(w, newFileEntryOf(s, target))
+}
+
+// newFileEntryOf returns the entry of the file, only the name when it can't be read
+func newFileEntryOf(s *FileServer, name string) fileEntry {
+	_, info, err := s.localDirFS.Stat(name)
+	if err != nil {
+		return fileEntry{Name: path.Base(name)}
+	}
+	return newFileEntry(info)
+}
@@ -0,0 +1,178 @@
+package httphandler
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/telebroad/fileserver/filesystem"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testCSRFToken = "0123456789012345678901234567890123456789012"
+
+// formRequest returns a url encoded form post with the csrf_token cookie, cookie may be empty
+func formRequest(target string, form url.Values, cookie string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, target, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if cookie != "" {
+		r.AddCookie(&http.Cookie{Name: csrfCookie, Value: cookie})
+	}
+	return r
+}
+
+// uploadRequest returns a multipart upload of the files, by name and content
+func uploadRequest(target string, files map[string]string, cookie, token string) *http.Request {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for name, content := range files {
+		part, _ := mw.CreateFormFile("files", name)
+		part.Write([]byte(content))
+	}
+	mw.Close()
+	r := httptest.NewRequest(http.MethodPost, target, &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	r.Header.Set(csrfHeader, token)
+	r.AddCookie(&http.Cookie{Name: csrfCookie, Value: cookie})
+	return r
+}
+
+func TestFileServer_csrfToken(t *testing.T) {
+	s, _ := newTestServer(t)
+
+	w := serve(s, httptest.NewRequest(http.MethodGet, "/files/", nil))
+	cookies := w.Result().Cookies()
+	if w.Code != http.StatusOK || len(cookies) != 1 || cookies[0].Name != csrfCookie {
+		t.Fatalf("expected the CSRF cookie, got %d %v", w.Code, cookies)
+	}
+	cookie := cookies[0]
+	if !cookie.HttpOnly || cookie.SameSite != http.SameSiteStrictMode || cookie.Path != "/files/" || len(cookie.Value) != 43 {
+		t.Fatalf("unexpected cookie %+v", cookie)
+	}
+	if !strings.Contains(w.Body.String(), cookie.Value) {
+		t.Fatal("expected the token in the page")
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/files/", nil)
+	r.AddCookie(cookie)
+	if w = serve(s, r); len(w.Result().Cookies()) != 0 || !strings.Contains(w.Body.String(), cookie.Value) {
+		t.Fatal("expected the token of the cookie to be kept")
+	}
+}
+
+func TestFileServer_csrf(t *testing.T) {
+	s, m := newTestServer(t)
+	m.MakeDir("/dir")
+	m.WriteFile("/dir/a.txt", strings.NewReader("a"), "I", false)
+
+	rejected := map[string]*http.Request{
+		"mkdir without cookie":      formRequest("/files/dir/?mkdir", url.Values{"name": {"new"}, csrfCookie: {testCSRFToken}}, ""),
+		"mkdir without token":       formRequest("/files/dir/?mkdir", url.Values{"name": {"new"}}, testCSRFToken),
+		"mkdir with another token":  formRequest("/files/dir/?mkdir", url.Values{"name": {"new"}, csrfCookie: {"x" + testCSRFToken[1:]}}, testCSRFToken),
+		"mkdir with empty cookie":   formRequest("/files/dir/?mkdir", url.Values{"name": {"new"}, csrfCookie: {""}}, ""),
+		"move without token":        formRequest("/files/dir/a.txt?move", url.Values{"to": {"b.txt"}}, testCSRFToken),
+		"upload without token":      uploadRequest("/files/dir/?upload", map[string]string{"b.txt": "b"}, testCSRFToken, ""),
+		"upload with another token": uploadRequest("/files/dir/?upload", map[string]string{"b.txt": "b"}, testCSRFToken, "x"+testCSRFToken[1:]),
+	}
+	for name, r := range rejected {
+		if w := serve(s, r); w.Code != http.StatusForbidden {
+			t.Errorf("%s: expected 403, got %d", name, w.Code)
+		}
+	}
+	if _, infos, _ := m.Dir("/dir"); len(infos) != 1 {
+		t.Fatalf("a rejected request changed the files: %v", infos)
+	}
+
+	r := formRequest("/files/dir/?mkdir", url.Values{"name": {"../../new"}, csrfCookie: {testCSRFToken}}, testCSRFToken)
+	if w := serve(s, r); w.Code != http.StatusCreated {
+		t.Fatalf("mkdir with the form token: %d %s", w.Code, w.Body)
+	}
+	r = formRequest("/files/dir/a.txt?move", url.Values{"to": {"new"}}, testCSRFToken)
+	r.Header.Set(csrfHeader, testCSRFToken)
+	if w := serve(s, r); w.Code != http.StatusOK {
+		t.Fatalf("move with the header token: %d %s", w.Code, w.Body)
+	}
+	r = uploadRequest("/files/dir/?upload", map[string]string{"../../b.txt": "b"}, testCSRFToken, testCSRFToken)
+	if w := serve(s, r); w.Code != http.StatusCreated {
+		t.Fatalf("upload with the header token: %d %s", w.Code, w.Body)
+	}
+	if readFile(t, m, "/dir/new/a.txt") != "a" || readFile(t, m, "/dir/b.txt") != "b" {
+		t.Fatal("expected the folder, the move and the upload in the directory")
+	}
+
+	// a post with several actions runs the first of a fixed order, mkdir before move and restore
+	for _, name := range []string{"x1", "x2", "x3", "x4", "x5"} {
+		r = formRequest("/files/dir/?restore&move&mkdir", url.Values{"name": {name}, csrfCookie: {testCSRFToken}}, testCSRFToken)
+		if w := serve(s, r); w.Code != http.StatusCreated || m.CheckDir("/dir/"+name) != nil {
+			t.Fatalf("expected the mkdir of %s, got %d %s", name, w.Code, w.Body)
+		}
+	}
+}
+
+func TestFileServer_move(t *testing.T) {
+	s, m := newTestServer(t)
+	m.MakeDir("/dir")
+	m.MakeDir("/dir/sub")
+	m.WriteFile("/dir/a.txt", strings.NewReader("a"), "I", false)
+	m.WriteFile("/dir/b.txt", strings.NewReader("b"), "I", false)
+
+	move := func(target, to string) int {
+		r := formRequest(target, url.Values{"to": {to}, csrfCookie: {testCSRFToken}}, testCSRFToken)
+		return serve(s, r).Code
+	}
+	for _, test := range []struct {
+		target, to string
+		want       int
+	}{
+		{"/files/?move", "x", http.StatusForbidden},
+		{"/files/dir/a.txt?move", "", http.StatusBadRequest},
+		{"/files/dir/missing.txt?move", "c.txt", http.StatusNotFound},
+		{"/files/dir/a.txt?move", "b.txt", http.StatusConflict},
+		{"/files/dir?move", "/dir/sub/dir", http.StatusBadRequest},
+		{"/files/dir/a.txt?move", "c.txt", http.StatusOK},
+		{"/files/dir/c.txt?move", "sub", http.StatusOK},
+		{"/files/dir/sub/c.txt?move", "../../../../d.txt", http.StatusOK},
+	} {
+		if got := move(test.target, test.to); got != test.want {
+			t.Errorf("move %s to %q: expected %d, got %d", test.target, test.to, test.want, got)
+		}
+	}
+	if readFile(t, m, "/d.txt") != "a" {
+		t.Fatal("expected the file moved to the root")
+	}
+}
+
+func TestFileServer_restore(t *testing.T) {
+	m := filesystem.NewMemFS()
+	trash := filesystem.NewTrashFS(m, 5, time.Hour)
+	trash.WriteFile("/a.txt", strings.NewReader("v1"), "I", false)
+	trash.WriteFile("/a.txt", strings.NewReader("v2"), "I", false)
+	s := NewFileServerHandler("/files/", trash, nil)
+
+	w := serve(s, httptest.NewRequest(http.MethodGet, "/files/a.txt?versions", nil))
+	var entries []filesystem.TrashEntry
+	if err := json.Unmarshal(w.Body.Bytes(), &entries); err != nil || len(entries) != 1 {
+		t.Fatalf("versions: %d %v %s", w.Code, err, w.Body)
+	}
+	restore := "/files/a.txt?restore=" + url.QueryEscape(entries[0].ID)
+
+	if w = serve(s, formRequest(restore, nil, testCSRFToken)); w.Code != http.StatusForbidden {
+		t.Fatalf("restore without token: expected 403, got %d", w.Code)
+	}
+	if readFile(t, m, "/a.txt") != "v2" {
+		t.Fatal("a rejected restore changed the file")
+	}
+	if w = serve(s, formRequest("/files/a.txt?restore=..", url.Values{csrfCookie: {testCSRFToken}}, testCSRFToken)); w.Code != http.StatusBadRequest {
+		t.Fatalf("restore of an invalid version: expected 400, got %d", w.Code)
+	}
+	if w = serve(s, formRequest(restore, url.Values{csrfCookie: {testCSRFToken}}, testCSRFToken)); w.Code != http.StatusOK {
+		t.Fatalf("restore: %d %s", w.Code, w.Body)
+	}
+	if readFile(t, m, "/a.txt") != "v1" {
+		t.Fatal("expected the restored version")
+	}
+}
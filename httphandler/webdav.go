@@ -0,0 +1,1087 @@
+// WebDAV handler to mount the file system as a network drive, class 1 and 2 of RFC 4918
+
+package httphandler
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/telebroad/fileserver/filesystem"
+	"io"
+	"io/fs"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultLockTimeout is the timeout of a lock when the client doesn't ask for one
+	defaultLockTimeout = time.Hour
+	// maxLockTimeout is the longest timeout of a lock, an infinite timeout gets it
+	maxLockTimeout = 24 * time.Hour
+)
+
+// errLocked is returned when a lock conflicts with an other lock
+var errLocked = errors.New("locked")
+
+// WebDAV is a httphandler handler to serve filesystem files over WebDAV, so they can be mounted as a network drive
+type WebDAV struct {
+	prefix string // The virtual directory to serve
+	fsys   filesystem.NewFSWithReadWriteAt
+	users  Users
+	locks  *lockStore
+	props  *propStore
+	logger *slog.Logger
+}
+
+func (d *WebDAV) SetLogger(l *slog.Logger) {
+	d.logger = l
+}
+func (d *WebDAV) Logger() *slog.Logger {
+	if d.logger == nil {
+		d.logger = slog.Default()
+	}
+	return d.logger.With("module", "webdav-handler")
+}
+
+// NewWebDAVHandler creates a new WebDAV handler to serve filesystem files, class 1 and 2 with the locks kept in memory
+// The pattern is the virtual directory to serve it will be stripped from the URL in the handler
+func NewWebDAVHandler(pattern string, fsys filesystem.NewFSWithReadWriteAt, users Users) http.Handler {
+	return &WebDAV{
+		prefix: strings.TrimSuffix(path.Clean(pattern), "/") + "/",
+		fsys:   fsys,
+		users:  users,
+		locks:  &lockStore{locks: map[string]*davLock{}},
+		props:  &propStore{props: map[string]map[xml.Name]string{}},
+	}
+}
+
+// ServeHTTP serves the WebDAV request implementing the httphandler.Handler interface
+func (d *WebDAV) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !authorize(d.users, w, r) {
+		return
+	}
+	d.Logger().Debug("ServeHTTP", "method", r.Method, "url", r.URL.String(), "remote", r.RemoteAddr, "user-agent", r.UserAgent())
+
+	name, ok := d.name(r.URL.Path)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodOptions:
+		w.Header().Set("DAV", "1, 2")
+		w.Header().Set("MS-Author-Via", "DAV")
+		w.Header().Set("Allow", "OPTIONS, GET, HEAD, PUT, DELETE, MKCOL, COPY, MOVE, PROPFIND, PROPPATCH, LOCK, UNLOCK")
+		w.WriteHeader(http.StatusOK)
+	case http.MethodGet, http.MethodHead:
+		d.get(w, r, name)
+	case http.MethodPut:
+		d.put(w, r, name)
+	case http.MethodDelete:
+		d.delete(w, r, name)
+	case "MKCOL":
+		d.mkcol(w, r, name)
+	case "COPY", "MOVE":
+		d.copyMove(w, r, name)
+	case "PROPFIND":
+		d.propfind(w, r, name)
+	case "PROPPATCH":
+		d.proppatch(w, r, name)
+	case "LOCK":
+		d.lock(w, r, name)
+	case "UNLOCK":
+		d.unlock(w, r, name)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// name returns the file system path of the url path, false if the url is outside the virtual directory,
+// the url path is cleaned as an absolute path so it can't leave the root directory
+func (d *WebDAV) name(urlPath string) (string, bool) {
+	if !strings.HasPrefix(urlPath+"/", d.prefix) {
+		return "", false
+	}
+	relativePath := path.Clean("/" + strings.TrimPrefix(urlPath, strings.TrimSuffix(d.prefix, "/")))
+	return path.Join(d.fsys.RootDir(), relativePath), true
+}
+
+// href returns the escaped url path of the file system path, the collections end with a slash
+func (d *WebDAV) href(name string, isDir bool) string {
+	relativePath := strings.TrimPrefix(name, strings.TrimSuffix(d.fsys.RootDir(), "/"))
+	urlPath := path.Join(d.prefix, relativePath)
+	if isDir && !strings.HasSuffix(urlPath, "/") {
+		urlPath += "/"
+	}
+	return (&url.URL{Path: urlPath}).EscapedPath()
+}
+
+// parentDir checks that the parent of the file is a directory, RFC 4918 requires a conflict otherwise
+func (d *WebDAV) parentDir(w http.ResponseWriter, name string) bool {
+	_, info, err := d.fsys.Stat(path.Dir(name))
+	if err != nil || !info.IsDir() {
+		http.Error(w, "Parent collection not found", http.StatusConflict)
+		return false
+	}
+	return true
+}
+
+// unlocked checks that the files aren't locked by a lock the client didn't submit in the If header,
+// recursive checks the locks inside the directories too
+func (d *WebDAV) unlocked(w http.ResponseWriter, r *http.Request, recursive bool, names ...string) bool {
+	tokens := submittedTokens(r)
+	for _, name := range names {
+		if l := d.locks.conflict(name, recursive, tokens); l != nil {
+			http.Error(w, "Locked", http.StatusLocked)
+			return false
+		}
+	}
+	return true
+}
+
+// get serves the file with range and conditional requests
+func (d *WebDAV) get(w http.ResponseWriter, r *http.Request, name string) {
+	_, info, err := d.fsys.Stat(name)
+	if err != nil {
+		http.Error(w, "File not found", errorStatus(err))
+		return
+	}
+	if info.IsDir() {
+		w.Header().Set("Allow", "OPTIONS, PUT, DELETE, MKCOL, COPY, MOVE, PROPFIND, PROPPATCH, LOCK, UNLOCK")
+		http.Error(w, "Method not allowed on a collection", http.StatusMethodNotAllowed)
+		return
+	}
+	reader, err := d.fsys.FileRead(name, os.O_RDONLY)
+	if err != nil {
+		http.Error(w, "Error reading file", errorStatus(err))
+		return
+	}
+	if closer, ok := reader.(io.Closer); ok {
+		defer closer.Close()
+	}
+	w.Header().Set("ETag", etag(info))
+	http.ServeContent(w, r, info.Name(), info.ModTime(), io.NewSectionReader(reader, 0, info.Size()))
+}
+
+// put writes the file, 201 when it is created and 204 when it is replaced
+func (d *WebDAV) put(w http.ResponseWriter, r *http.Request, name string) {
+	_, info, err := d.fsys.Stat(name)
+	exists := err == nil
+	if exists && info.IsDir() {
+		http.Error(w, "Method not allowed on a collection", http.StatusMethodNotAllowed)
+		return
+	}
+	if !d.parentDir(w, name) || !d.unlocked(w, r, false, name) {
+		return
+	}
+	if err = d.fsys.WriteFile(name, r.Body, "I", false); err != nil {
+		http.Error(w, "Error writing file", errorStatus(err))
+		return
+	}
+	if !exists {
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// delete removes the file or the collection with its content, the locks and the properties
+func (d *WebDAV) delete(w http.ResponseWriter, r *http.Request, name string) {
+	if _, _, err := d.fsys.Lstat(name); err != nil {
+		http.Error(w, "File not found", errorStatus(err))
+		return
+	}
+	if name == d.fsys.RootDir() {
+		http.Error(w, "The root can't be deleted", http.StatusForbidden)
+		return
+	}
+	if !d.unlocked(w, r, true, name) {
+		return
+	}
+	if err := d.removeAll(name); err != nil {
+		http.Error(w, "Error deleting file", errorStatus(err))
+		return
+	}
+	d.locks.removeAll(name)
+	d.props.removeAll(name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// removeAll removes the file or the directory with its content
+func (d *WebDAV) removeAll(name string) error {
+	_, info, err := d.fsys.Lstat(name)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		_, infos, err := d.fsys.Dir(name)
+		if err != nil {
+			return err
+		}
+		for _, child := range infos {
+			if err = d.removeAll(path.Join(name, child.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return d.fsys.Remove(name)
+}
+
+// mkcol creates the collection, the parent must exist
+func (d *WebDAV) mkcol(w http.ResponseWriter, r *http.Request, name string) {
+	if r.ContentLength > 0 {
+		http.Error(w, "Unsupported MKCOL body", http.StatusUnsupportedMediaType)
+		return
+	}
+	if _, _, err := d.fsys.Lstat(name); err == nil {
+		http.Error(w, "File exists", http.StatusMethodNotAllowed)
+		return
+	}
+	if !d.parentDir(w, name) || !d.unlocked(w, r, false, name) {
+		return
+	}
+	if err := d.fsys.MakeDir(name); err != nil {
+		http.Error(w, "Error creating collection", errorStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// copyMove copies or moves the file to the Destination, 201 when it is created and 204 when it is replaced
+func (d *WebDAV) copyMove(w http.ResponseWriter, r *http.Request, name string) {
+	destination, err := url.Parse(r.Header.Get("Destination"))
+	if err != nil || destination.Path == "" {
+		http.Error(w, "Invalid Destination", http.StatusBadRequest)
+		return
+	}
+	// a Destination on another server isn't copied there, RFC 4918 answers 502
+	if destination.Host != "" && !strings.EqualFold(destination.Host, r.Host) ||
+		destination.Scheme != "" && destination.Scheme != "http" && destination.Scheme != "https" {
+		http.Error(w, "Destination is not on this server", http.StatusBadGateway)
+		return
+	}
+	target, ok := d.name(destination.Path)
+	if !ok {
+		http.Error(w, "Destination is not on this server", http.StatusBadGateway)
+		return
+	}
+	_, info, err := d.fsys.Lstat(name)
+	if err != nil {
+		http.Error(w, "File not found", errorStatus(err))
+		return
+	}
+	if target == name || isWithin(target, name) {
+		http.Error(w, "Destination is inside the source", http.StatusForbidden)
+		return
+	}
+	// replacing a destination that contains the source would delete the source first
+	if target == d.fsys.RootDir() || isWithin(name, target) {
+		http.Error(w, "Destination contains the source", http.StatusForbidden)
+		return
+	}
+	depth := r.Header.Get("Depth")
+	switch {
+	case depth == "" || strings.EqualFold(depth, "infinity"):
+	case depth == "0" && r.Method == "COPY":
+	default:
+		http.Error(w, "Invalid Depth", http.StatusBadRequest)
+		return
+	}
+	if !d.parentDir(w, target) {
+		return
+	}
+	locked := []string{target}
+	if r.Method == "MOVE" {
+		locked = append(locked, name)
+	}
+	if !d.unlocked(w, r, true, locked...) {
+		return
+	}
+
+	_, _, err = d.fsys.Lstat(target)
+	exists := err == nil
+	if exists {
+		if r.Header.Get("Overwrite") == "F" {
+			http.Error(w, "Destination exists", http.StatusPreconditionFailed)
+			return
+		}
+		if err = d.removeAll(target); err != nil {
+			http.Error(w, "Error replacing destination", errorStatus(err))
+			return
+		}
+		d.locks.removeAll(target)
+		d.props.removeAll(target)
+	}
+
+	if r.Method == "MOVE" {
+		err = d.fsys.Rename(name, target)
+		if err == nil {
+			d.locks.removeAll(name)
+			d.props.move(name, target)
+		}
+	} else {
+		err = d.copyAll(name, target, info.IsDir() && depth != "0")
+		if err == nil {
+			d.props.copy(name, target)
+		}
+	}
+	if err != nil {
+		http.Error(w, "Error copying file", errorStatus(err))
+		return
+	}
+	if exists {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// copyAll copies the file, or the directory with its content when recursive
+func (d *WebDAV) copyAll(name, target string, recursive bool) error {
+	_, info, err := d.fsys.Stat(name)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		if err = d.fsys.MakeDir(target); err != nil || !recursive {
+			return err
+		}
+		_, infos, err := d.fsys.Dir(name)
+		if err != nil {
+			return err
+		}
+		for _, child := range infos {
+			if err = d.copyAll(path.Join(name, child.Name()), path.Join(target, child.Name()), true); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := d.fsys.ReadFile(name, pw)
+		pw.CloseWithError(err)
+	}()
+	err = d.fsys.WriteFile(target, pr, "I", false)
+	pr.Close()
+	return err
+}
+
+// propfind lists the properties of the file and, with Depth 1, of the files of the directory
+func (d *WebDAV) propfind(w http.ResponseWriter, r *http.Request, name string) {
+	_, info, err := d.fsys.Stat(name)
+	if err != nil {
+		http.Error(w, "File not found", errorStatus(err))
+		return
+	}
+	depth := r.Header.Get("Depth")
+	if depth != "0" && depth != "1" {
+		// listing a whole tree is expensive, RFC 4918 allows to refuse it
+		writeXML(w, http.StatusForbidden, `<D:error xmlns:D="DAV:"><D:propfind-finite-depth/></D:error>`)
+		return
+	}
+	var req propfindRequest
+	if err = decodeXML(r.Body, &req); err != nil {
+		http.Error(w, "Invalid PROPFIND body", http.StatusBadRequest)
+		return
+	}
+
+	var b bytes.Buffer
+	d.propfindResponse(&b, &req, name, info)
+	if depth == "1" && info.IsDir() {
+		_, infos, err := d.fsys.Dir(name)
+		if err != nil {
+			http.Error(w, "Error reading directory", errorStatus(err))
+			return
+		}
+		for _, child := range infos {
+			d.propfindResponse(&b, &req, path.Join(name, child.Name()), child)
+		}
+	}
+	writeMultistatus(w, b.String())
+}
+
+// propfindResponse writes the response of a file to the multistatus of a PROPFIND
+func (d *WebDAV) propfindResponse(b *bytes.Buffer, req *propfindRequest, name string, info fs.FileInfo) {
+	deadProps := d.props.get(name)
+	found, missing := map[xml.Name]string{}, []xml.Name{}
+	switch {
+	case req.PropName != nil:
+		for _, prop := range liveProps {
+			if _, ok := d.liveProp(name, info, prop); ok {
+				found[prop] = ""
+			}
+		}
+		for prop := range deadProps {
+			found[prop] = ""
+		}
+	case req.Prop != nil:
+		for _, prop := range req.Prop.Props {
+			if value, ok := d.liveProp(name, info, prop.Name); ok {
+				found[prop.Name] = value
+			} else if value, ok = deadProps[prop.Name]; ok {
+				found[prop.Name] = value
+			} else {
+				missing = append(missing, prop.Name)
+			}
+		}
+	default:
+		for _, prop := range liveProps {
+			if value, ok := d.liveProp(name, info, prop); ok {
+				found[prop] = value
+			}
+		}
+		for prop, value := range deadProps {
+			found[prop] = value
+		}
+		if req.Include != nil {
+			for _, prop := range req.Include.Props {
+				if value, ok := d.liveProp(name, info, prop.Name); ok {
+					found[prop.Name] = value
+				}
+			}
+		}
+	}
+
+	fmt.Fprintf(b, "<D:response><D:href>%s</D:href>", escapeXML(d.href(name, info.IsDir())))
+	writePropstat(b, found, http.StatusOK)
+	notFound := map[xml.Name]string{}
+	for _, prop := range missing {
+		notFound[prop] = ""
+	}
+	writePropstat(b, notFound, http.StatusNotFound)
+	b.WriteString("</D:response>")
+}
+
+// liveProps are the live properties of allprop, RFC 4331 excludes the quota properties
+var liveProps = []xml.Name{
+	{Space: "DAV:", Local: "resourcetype"},
+	{Space: "DAV:", Local: "displayname"},
+	{Space: "DAV:", Local: "getcontentlength"},
+	{Space: "DAV:", Local: "getlastmodified"},
+	{Space: "DAV:", Local: "getcontenttype"},
+	{Space: "DAV:", Local: "getetag"},
+	{Space: "DAV:", Local: "supportedlock"},
+	{Space: "DAV:", Local: "lockdiscovery"},
+}
+
+// isLiveProp reports whether the property is maintained by the server, they can't be changed with PROPPATCH
+func isLiveProp(prop xml.Name) bool {
+	if prop.Space != "DAV:" {
+		return false
+	}
+	switch prop.Local {
+	case "quota-available-bytes", "quota-used-bytes", "creationdate", "getcontentlanguage":
+		return true
+	}
+	for _, live := range liveProps {
+		if live == prop {
+			return true
+		}
+	}
+	return false
+}
+
+// liveProp returns the xml value of a live property, false if the file doesn't have it
+func (d *WebDAV) liveProp(name string, info fs.FileInfo, prop xml.Name) (string, bool) {
+	if prop.Space != "DAV:" {
+		return "", false
+	}
+	switch prop.Local {
+	case "resourcetype":
+		if info.IsDir() {
+			return "<D:collection/>", true
+		}
+		return "", true
+	case "displayname":
+		return escapeXML(path.Base(name)), name != "/"
+	case "getcontentlength":
+		return strconv.FormatInt(info.Size(), 10), !info.IsDir()
+	case "getlastmodified":
+		return info.ModTime().UTC().Format(http.TimeFormat), true
+	case "getcontenttype":
+		contentType := mime.TypeByExtension(path.Ext(name))
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		return escapeXML(contentType), !info.IsDir()
+	case "getetag":
+		return escapeXML(etag(info)), !info.IsDir()
+	case "supportedlock":
+		return "<D:lockentry><D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype></D:lockentry>" +
+			"<D:lockentry><D:lockscope><D:shared/></D:lockscope><D:locktype><D:write/></D:locktype></D:lockentry>", true
+	case "lockdiscovery":
+		var b strings.Builder
+		for _, l := range d.locks.covering(name) {
+			b.WriteString(activeLock(l))
+		}
+		return b.String(), true
+	case "quota-available-bytes", "quota-used-bytes":
+		stat, err := d.fsys.StatFS(name)
+		if err != nil || stat == nil {
+			return "", false
+		}
+		if prop.Local == "quota-available-bytes" {
+			return strconv.FormatUint(stat.Bavail*stat.Frsize, 10), true
+		}
+		return strconv.FormatUint((stat.Blocks-stat.Bfree)*stat.Frsize, 10), true
+	}
+	return "", false
+}
+
+// proppatch sets and removes the dead properties, all or none of the changes are made
+func (d *WebDAV) proppatch(w http.ResponseWriter, r *http.Request, name string) {
+	_, info, err := d.fsys.Stat(name)
+	if err != nil {
+		http.Error(w, "File not found", errorStatus(err))
+		return
+	}
+	if !d.unlocked(w, r, false, name) {
+		return
+	}
+	var req proppatchRequest
+	if err = decodeXML(r.Body, &req); err != nil || req.XMLName.Local == "" {
+		http.Error(w, "Invalid PROPPATCH body", http.StatusBadRequest)
+		return
+	}
+
+	changed, forbidden := map[xml.Name]string{}, map[xml.Name]string{}
+	for _, update := range req.Updates {
+		for _, prop := range update.Prop.Props {
+			if isLiveProp(prop.Name) {
+				forbidden[prop.Name] = ""
+			}
+			changed[prop.Name] = ""
+		}
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "<D:response><D:href>%s</D:href>", escapeXML(d.href(name, info.IsDir())))
+	if len(forbidden) > 0 {
+		for prop := range forbidden {
+			delete(changed, prop)
+		}
+		writePropstat(&b, forbidden, http.StatusForbidden)
+		writePropstat(&b, changed, http.StatusFailedDependency)
+	} else {
+		d.props.update(name, req.Updates)
+		writePropstat(&b, changed, http.StatusOK)
+	}
+	b.WriteString("</D:response>")
+	writeMultistatus(w, b.String())
+}
+
+// lock creates a lock, or refreshes the lock of the If header when there is no body,
+// locking a missing file creates an empty file
+func (d *WebDAV) lock(w http.ResponseWriter, r *http.Request, name string) {
+	timeout := lockTimeout(r.Header.Get("Timeout"))
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, "Error reading body", http.StatusBadRequest)
+		return
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		tokens := submittedTokens(r)
+		if len(tokens) != 1 {
+			http.Error(w, "Missing lock token", http.StatusBadRequest)
+			return
+		}
+		l, ok := d.locks.refresh(tokens[0], name, timeout)
+		if !ok {
+			http.Error(w, "Lock token doesn't match", http.StatusPreconditionFailed)
+			return
+		}
+		writeXML(w, http.StatusOK, `<D:prop xmlns:D="DAV:"><D:lockdiscovery>`+activeLock(l)+`</D:lockdiscovery></D:prop>`)
+		return
+	}
+
+	var info lockInfo
+	if err = decodeXML(bytes.NewReader(body), &info); err != nil || info.Scope.Exclusive == nil && info.Scope.Shared == nil {
+		http.Error(w, "Invalid LOCK body", http.StatusBadRequest)
+		return
+	}
+	depth := r.Header.Get("Depth")
+	if depth != "" && depth != "0" && !strings.EqualFold(depth, "infinity") {
+		http.Error(w, "Invalid Depth", http.StatusBadRequest)
+		return
+	}
+	_, stat, err := d.fsys.Stat(name)
+	exists := err == nil
+	if !exists && !d.parentDir(w, name) {
+		return
+	}
+
+	token, err := lockToken()
+	if err != nil {
+		http.Error(w, "Error creating lock", http.StatusInternalServerError)
+		return
+	}
+	l := &davLock{
+		token:     token,
+		root:      name,
+		href:      d.href(name, exists && stat.IsDir()),
+		infinite:  depth != "0",
+		exclusive: info.Scope.Exclusive != nil,
+		owner:     string(info.Owner),
+		timeout:   timeout,
+	}
+	if err = d.locks.create(l); err != nil {
+		http.Error(w, "Locked", http.StatusLocked)
+		return
+	}
+	status := http.StatusOK
+	if !exists {
+		if err = d.fsys.WriteFile(name, strings.NewReader(""), "I", false); err != nil {
+			d.locks.unlock(token, name)
+			http.Error(w, "Error creating file", errorStatus(err))
+			return
+		}
+		status = http.StatusCreated
+	}
+	w.Header().Set("Lock-Token", "<"+token+">")
+	writeXML(w, status, `<D:prop xmlns:D="DAV:"><D:lockdiscovery>`+activeLock(l)+`</D:lockdiscovery></D:prop>`)
+}
+
+// unlock removes the lock of the Lock-Token header
+func (d *WebDAV) unlock(w http.ResponseWriter, r *http.Request, name string) {
+	token := strings.Trim(r.Header.Get("Lock-Token"), "<>")
+	if token == "" {
+		http.Error(w, "Missing Lock-Token", http.StatusBadRequest)
+		return
+	}
+	if !d.locks.unlock(token, name) {
+		writeXML(w, http.StatusConflict, `<D:error xmlns:D="DAV:"><D:lock-token-matches-request-uri/></D:error>`)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// isWithin reports whether the path is inside the directory
+func isWithin(name, dir string) bool {
+	if dir == "/" {
+		return name != "/"
+	}
+	return strings.HasPrefix(name, dir+"/")
+}
+
+// submittedTokens returns the lock tokens of the If header, the conditions aren't evaluated
+func submittedTokens(r *http.Request) []string {
+	var tokens []string
+	header := r.Header.Get("If")
+	for {
+		start := strings.IndexByte(header, '<')
+		if start < 0 {
+			return tokens
+		}
+		end := strings.IndexByte(header[start:], '>')
+		if end < 0 {
+			return tokens
+		}
+		if token := header[start+1 : start+end]; strings.HasPrefix(token, "opaquelocktoken:") {
+			tokens = append(tokens, token)
+		}
+		header = header[start+end+1:]
+	}
+}
+
+// lockTimeout returns the first supported timeout of the Timeout header, `Second-n` or `Infinite`
+func lockTimeout(header string) time.Duration {
+	for _, value := range strings.Split(header, ",") {
+		value = strings.TrimSpace(value)
+		if strings.EqualFold(value, "Infinite") {
+			return maxLockTimeout
+		}
+		if seconds, ok := strings.CutPrefix(value, "Second-"); ok {
+			if n, err := strconv.ParseInt(seconds, 10, 64); err == nil && n > 0 {
+				return min(time.Duration(n)*time.Second, maxLockTimeout)
+			}
+		}
+	}
+	return defaultLockTimeout
+}
+
+// lockToken returns a new opaque lock token, an uuid of RFC 4122
+func lockToken() (string, error) {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return "", fmt.Errorf("error creating lock token: %w", err)
+	}
+	id[6] = id[6]&0x0f | 0x40
+	id[8] = id[8]&0x3f | 0x80
+	return fmt.Sprintf("opaquelocktoken:%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:]), nil
+}
+
+// activeLock returns the activelock xml of the lockdiscovery property
+func activeLock(l *davLock) string {
+	scope, depth := "<D:shared/>", "0"
+	if l.exclusive {
+		scope = "<D:exclusive/>"
+	}
+	if l.infinite {
+		depth = "infinity"
+	}
+	remaining := max(time.Until(l.expires).Round(time.Second), 0)
+	return fmt.Sprintf("<D:activelock><D:locktype><D:write/></D:locktype><D:lockscope>%s</D:lockscope><D:depth>%s</D:depth>"+
+		"<D:owner>%s</D:owner><D:timeout>Second-%d</D:timeout><D:locktoken><D:href>%s</D:href></D:locktoken>"+
+		"<D:lockroot><D:href>%s</D:href></D:lockroot></D:activelock>",
+		scope, depth, l.owner, int64(remaining/time.Second), escapeXML(l.token), escapeXML(l.href))
+}
+
+// escapeXML escapes the text of an element or an attribute
+func escapeXML(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// writePropstat writes the propstat of the properties with the status, nothing when there are no properties
+func writePropstat(b *bytes.Buffer, props map[xml.Name]string, status int) {
+	if len(props) == 0 {
+		return
+	}
+	names := make([]xml.Name, 0, len(props))
+	for prop := range props {
+		names = append(names, prop)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if names[i].Space != names[j].Space {
+			return names[i].Space < names[j].Space
+		}
+		return names[i].Local < names[j].Local
+	})
+	b.WriteString("<D:propstat><D:prop>")
+	for _, prop := range names {
+		if prop.Space == "DAV:" {
+			fmt.Fprintf(b, "<D:%s>%s</D:%s>", prop.Local, props[prop], prop.Local)
+			continue
+		}
+		fmt.Fprintf(b, `<x:%s xmlns:x="%s">%s</x:%s>`, prop.Local, escapeXML(prop.Space), props[prop], prop.Local)
+	}
+	fmt.Fprintf(b, "</D:prop><D:status>HTTP/1.1 %d %s</D:status></D:propstat>", status, http.StatusText(status))
+}
+
+// writeMultistatus writes the 207 response of the responses
+func writeMultistatus(w http.ResponseWriter, responses string) {
+	writeXML(w, http.StatusMultiStatus, `<D:multistatus xmlns:D="DAV:">`+responses+`</D:multistatus>`)
+}
+
+// writeXML writes the xml document with the status
+func writeXML(w http.ResponseWriter, status int, document string) {
+	w.Header().Set("Content-Type", `application/xml; charset="utf-8"`)
+	w.WriteHeader(status)
+	io.WriteString(w, xml.Header+document)
+}
+
+// decodeXML decodes the xml body, an empty body leaves v unchanged
+func decodeXML(r io.Reader, v any) error {
+	err := xml.NewDecoder(io.LimitReader(r, 1<<20)).Decode(v)
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+	return err
+}
+
+// xmlContent is the content of an element of a request, re-encoded so it declares the namespaces it uses
+type xmlContent string
+
+func (c *xmlContent) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	var b strings.Builder
+	e := xml.NewEncoder(&b)
+	for depth := 0; ; {
+		token, err := d.Token()
+		if err != nil {
+			return err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			depth++
+			// the encoder declares the namespaces of the names itself
+			var attrs []xml.Attr
+			for _, attr := range t.Attr {
+				if attr.Name.Space != "xmlns" && attr.Name.Local != "xmlns" {
+					attrs = append(attrs, attr)
+				}
+			}
+			t.Attr = attrs
+			err = e.EncodeToken(t)
+		case xml.EndElement:
+			if depth == 0 {
+				if err = e.Flush(); err != nil {
+					return err
+				}
+				*c = xmlContent(b.String())
+				return nil
+			}
+			depth--
+			err = e.EncodeToken(t)
+		case xml.CharData:
+			err = e.EncodeToken(t)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// davProperty is a property of a request with its value
+type davProperty struct {
+	Name  xml.Name
+	Value xmlContent
+}
+
+func (p *davProperty) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	p.Name = start.Name
+	return p.Value.UnmarshalXML(d, start)
+}
+
+// davProps are the properties of a prop element
+type davProps struct {
+	Props []davProperty `xml:",any"`
+}
+
+// propfindRequest is the body of a PROPFIND, no body is an allprop
+type propfindRequest struct {
+	XMLName  xml.Name  `xml:"DAV: propfind"`
+	AllProp  *struct{} `xml:"DAV: allprop"`
+	PropName *struct{} `xml:"DAV: propname"`
+	Prop     *davProps `xml:"DAV: prop"`
+	Include  *davProps `xml:"DAV: include"`
+}
+
+// proppatchRequest is the body of a PROPPATCH, the set and remove updates in order
+type proppatchRequest struct {
+	XMLName xml.Name    `xml:"DAV: propertyupdate"`
+	Updates []davUpdate `xml:",any"`
+}
+
+// davUpdate is a set or a remove of a PROPPATCH
+type davUpdate struct {
+	XMLName xml.Name
+	Prop    davProps `xml:"DAV: prop"`
+}
+
+// lockInfo is the body of a LOCK creating a lock
+type lockInfo struct {
+	XMLName xml.Name `xml:"DAV: lockinfo"`
+	Scope   struct {
+		Exclusive *struct{} `xml:"DAV: exclusive"`
+		Shared    *struct{} `xml:"DAV: shared"`
+	} `xml:"DAV: lockscope"`
+	Owner xmlContent `xml:"DAV: owner"`
+}
+
+// davLock is a write lock of a file, or of a directory with its content when infinite
+type davLock struct {
+	token     string
+	root      string // the locked file system path
+	href      string // the locked url
+	infinite  bool
+	exclusive bool
+	owner     string // the owner xml sent by the client
+	timeout   time.Duration
+	expires   time.Time
+}
+
+// covers reports whether the lock applies to the file
+func (l *davLock) covers(name string) bool {
+	return l.root == name || l.infinite && isWithin(name, l.root)
+}
+
+// lockStore keeps the locks in memory
+type lockStore struct {
+	lock  sync.Mutex
+	locks map[string]*davLock // by token
+}
+
+// expire removes the expired locks, the store is locked
+func (s *lockStore) expire() {
+	now := time.Now()
+	for token, l := range s.locks {
+		if now.After(l.expires) {
+			delete(s.locks, token)
+		}
+	}
+}
+
+// conflict returns a lock of the file, or inside the directory when recursive, whose token isn't submitted
+func (s *lockStore) conflict(name string, recursive bool, tokens []string) *davLock {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.expire()
+	for token, l := range s.locks {
+		if !l.covers(name) && !(recursive && isWithin(l.root, name)) {
+			continue
+		}
+		submitted := false
+		for _, t := range tokens {
+			submitted = submitted || t == token
+		}
+		if !submitted {
+			return l
+		}
+	}
+	return nil
+}
+
+// create adds the lock, an exclusive lock can't overlap an other lock
+func (s *lockStore) create(l *davLock) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.expire()
+	for _, other := range s.locks {
+		overlaps := other.covers(l.root) || l.covers(other.root)
+		if overlaps && (other.exclusive || l.exclusive) {
+			return errLocked
+		}
+	}
+	l.expires = time.Now().Add(l.timeout)
+	s.locks[l.token] = l
+	return nil
+}
+
+// refresh restarts the timeout of the lock of the file
+func (s *lockStore) refresh(token, name string, timeout time.Duration) (*davLock, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.expire()
+	l, ok := s.locks[token]
+	if !ok || !l.covers(name) {
+		return nil, false
+	}
+	l.timeout, l.expires = timeout, time.Now().Add(timeout)
+	return l, true
+}
+
+// unlock removes the lock of the file
+func (s *lockStore) unlock(token, name string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.expire()
+	l, ok := s.locks[token]
+	if !ok || !l.covers(name) {
+		return false
+	}
+	delete(s.locks, token)
+	return true
+}
+
+// covering returns the locks applying to the file
+func (s *lockStore) covering(name string) []*davLock {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.expire()
+	var locks []*davLock
+	for _, l := range s.locks {
+		if l.covers(name) {
+			locks = append(locks, l)
+		}
+	}
+	return locks
+}
+
+// removeAll removes the locks of the file and of the files inside it, once it is deleted or moved
+func (s *lockStore) removeAll(name string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for token, l := range s.locks {
+		if l.root == name || isWithin(l.root, name) {
+			delete(s.locks, token)
+		}
+	}
+}
+
+// propStore keeps the dead properties of the files in memory
+type propStore struct {
+	lock  sync.Mutex
+	props map[string]map[xml.Name]string // the xml values by file system path
+}
+
+// get returns a copy of the properties of the file
+func (s *propStore) get(name string) map[xml.Name]string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	props := map[xml.Name]string{}
+	for prop, value := range s.props[name] {
+		props[prop] = value
+	}
+	return props
+}
+
+// update sets and removes the properties of the file
+func (s *propStore) update(name string, updates []davUpdate) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	props := s.props[name]
+	if props == nil {
+		props = map[xml.Name]string{}
+		s.props[name] = props
+	}
+	for _, update := range updates {
+		for _, prop := range update.Prop.Props {
+			if update.XMLName.Local == "remove" {
+				delete(props, prop.Name)
+				continue
+			}
+			props[prop.Name] = string(prop.Value)
+		}
+	}
+	if len(props) == 0 {
+		delete(s.props, name)
+	}
+}
+
+// move moves the properties of the file and of the files inside it
+func (s *propStore) move(name, target string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	moved := map[string]map[xml.Name]string{}
+	for file, props := range s.props {
+		if file == name || isWithin(file, name) {
+			delete(s.props, file)
+			moved[target+strings.TrimPrefix(file, name)] = props
+		}
+	}
+	for file, props := range moved {
+		s.props[file] = props
+	}
+}
+
+// copy copies the properties of the file and of the files inside it
+func (s *propStore) copy(name, target string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	copied := map[string]map[xml.Name]string{}
+	for file, props := range s.props {
+		if file == name || isWithin(file, name) {
+			values := map[xml.Name]string{}
+			for prop, value := range props {
+				values[prop] = value
+			}
+			copied[target+strings.TrimPrefix(file, name)] = values
+		}
+	}
+	for file, props := range copied {
+		s.props[file] = props
+	}
+}
+
+// removeAll removes the properties of the file and of the files inside it
+func (s *propStore) removeAll(name string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for file := range s.props {
+		if file == name || isWithin(file, name) {
+			delete(s.props, file)
+		}
+	}
+}
@@ -0,0 +1,312 @@
+package httphandler
+
+import (
+	"github.com/telebroad/fileserver/filesystem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const exclusiveLock = `<?xml version="1.0" encoding="utf-8"?>
+<D:lockinfo xmlns:D="DAV:"><D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype></D:lockinfo>`
+
+// davRequest returns a request of the WebDAV handler with the headers, as name and value pairs
+func davRequest(method, target, body string, header ...string) *http.Request {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	return r
+}
+
+func TestWebDAV_destination(t *testing.T) {
+	m := filesystem.NewMemFS()
+	m.WriteFile("/a.txt", strings.NewReader("a"), "I", false)
+	m.MakeDir("/dir")
+	m.WriteFile("/dir/b.txt", strings.NewReader("b"), "I", false)
+	d := NewWebDAVHandler("/dav/", m, nil)
+
+	for _, test := range []struct {
+		method, target, destination string
+		want                        int
+	}{
+		{"COPY", "/dav/a.txt", "http://example.com/dav/c.txt", http.StatusCreated},
+		{"COPY", "/dav/a.txt", "/dav/dir/c.txt", http.StatusCreated},
+		{"COPY", "/dav/a.txt", "http://other.example/dav/d.txt", http.StatusBadGateway},
+		{"MOVE", "/dav/a.txt", "https://other.example/dav/d.txt", http.StatusBadGateway},
+		{"MOVE", "/dav/a.txt", "ftp://example.com/dav/d.txt", http.StatusBadGateway},
+		{"MOVE", "/dav/a.txt", "/other/d.txt", http.StatusBadGateway},
+		{"MOVE", "/dav/a.txt", "/davx/d.txt", http.StatusBadGateway},
+		{"MOVE", "/dav/a.txt", "%zz", http.StatusBadRequest},
+		{"MOVE", "/dav/a.txt", "", http.StatusBadRequest},
+		{"COPY", "/dav/dir", "/dav/dir/sub", http.StatusForbidden},
+		{"MOVE", "/dav/dir", "/dav/dir", http.StatusForbidden},
+		{"MOVE", "/dav/dir/b.txt", "/dav/dir", http.StatusForbidden},
+		{"COPY", "/dav/a.txt", "/dav/", http.StatusForbidden},
+		{"MOVE", "/dav/a.txt", "/dav/missing/d.txt", http.StatusConflict},
+		{"COPY", "/dav/a.txt", "/dav/c.txt", http.StatusNoContent},
+		{"MOVE", "/dav/a.txt", "/dav/c.txt", http.StatusNoContent},
+	} {
+		w := serve(d, davRequest(test.method, test.target, "", "Destination", test.destination))
+		if w.Code != test.want {
+			t.Errorf("%s %s to %q: expected %d, got %d %s", test.method, test.target, test.destination, test.want, w.Code, w.Body)
+		}
+	}
+	for name, content := range map[string]string{"/c.txt": "a", "/dir/c.txt": "a", "/dir/b.txt": "b"} {
+		if got := readFile(t, m, name); got != content {
+			t.Errorf("%s: expected %q, got %q", name, content, got)
+		}
+	}
+	for _, name := range []string{"/a.txt", "/d.txt", "/dir/sub"} {
+		if _, _, err := m.Stat(name); err == nil {
+			t.Errorf("expected %s not to exist", name)
+		}
+	}
+
+	m.WriteFile("/e.txt", strings.NewReader("e"), "I", false)
+	if w := serve(d, davRequest("MOVE", "/dav/e.txt", "", "Destination", "/dav/c.txt", "Overwrite", "F")); w.Code != http.StatusPreconditionFailed {
+		t.Fatalf("MOVE without overwrite: expected 412, got %d", w.Code)
+	}
+	if readFile(t, m, "/c.txt") != "a" {
+		t.Fatal("the destination was overwritten")
+	}
+}
+
+func TestWebDAV_destinationConfined(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	if err := os.Mkdir(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "a.txt"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	d := NewWebDAVHandler("/dav/", filesystem.NewLocalFS(root), nil)
+
+	for _, destination := range []string{"/dav/../../escape.txt", "/dav/..%2f..%2fescape.txt", "http://example.com/dav/sub/../../../escape.txt"} {
+		w := serve(d, davRequest("COPY", "/dav/a.txt", "", "Destination", destination))
+		if w.Code != http.StatusCreated && w.Code != http.StatusNoContent {
+			t.Fatalf("COPY to %q: %d %s", destination, w.Code, w.Body)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "escape.txt")); err == nil {
+			t.Fatalf("COPY to %q wrote outside the root", destination)
+		}
+	}
+	if data, err := os.ReadFile(filepath.Join(root, "escape.txt")); err != nil || string(data) != "a" {
+		t.Fatalf("expected the copy in the root, got %q %v", data, err)
+	}
+}
+
+func TestWebDAV_locks(t *testing.T) {
+	m := filesystem.NewMemFS()
+	m.MakeDir("/dir")
+	m.WriteFile("/dir/a.txt", strings.NewReader("a"), "I", false)
+	m.WriteFile("/b.txt", strings.NewReader("b"), "I", false)
+	d := NewWebDAVHandler("/dav/", m, nil)
+
+	w := serve(d, davRequest("LOCK", "/dav/dir/a.txt", exclusiveLock))
+	token := strings.Trim(w.Header().Get("Lock-Token"), "<>")
+	if w.Code != http.StatusOK || !strings.HasPrefix(token, "opaquelocktoken:") {
+		t.Fatalf("LOCK: %d %q %s", w.Code, token, w.Body)
+	}
+	if w = serve(d, davRequest("LOCK", "/dav/dir/a.txt", exclusiveLock)); w.Code != http.StatusLocked {
+		t.Fatalf("second exclusive LOCK: expected 423, got %d", w.Code)
+	}
+
+	// the writes of the locked file, or of a directory containing it, need the token
+	denied := []*http.Request{
+		davRequest(http.MethodPut, "/dav/dir/a.txt", "x"),
+		davRequest(http.MethodDelete, "/dav/dir/a.txt", ""),
+		davRequest(http.MethodDelete, "/dav/dir", ""),
+		davRequest("MOVE", "/dav/dir/a.txt", "", "Destination", "/dav/c.txt"),
+		davRequest("MOVE", "/dav/dir", "", "Destination", "/dav/moved"),
+		davRequest("COPY", "/dav/b.txt", "", "Destination", "/dav/dir/a.txt"),
+		davRequest("MOVE", "/dav/b.txt", "", "Destination", "/dav/dir/a.txt"),
+		davRequest(http.MethodPut, "/dav/dir/a.txt", "x", "If", "(<opaquelocktoken:wrong>)"),
+	}
+	for _, r := range denied {
+		if w = serve(d, r); w.Code != http.StatusLocked {
+			t.Errorf("%s %s: expected 423, got %d", r.Method, r.URL.Path, w.Code)
+		}
+	}
+	if readFile(t, m, "/dir/a.txt") != "a" || readFile(t, m, "/b.txt") != "b" {
+		t.Fatal("a locked file changed")
+	}
+
+	// reads and the copies from the locked file don't need it
+	if w = serve(d, davRequest(http.MethodGet, "/dav/dir/a.txt", "")); w.Code != http.StatusOK {
+		t.Fatalf("GET of a locked file: %d", w.Code)
+	}
+	if w = serve(d, davRequest("COPY", "/dav/dir/a.txt", "", "Destination", "/dav/copy.txt")); w.Code != http.StatusCreated {
+		t.Fatalf("COPY of a locked file: %d", w.Code)
+	}
+
+	if w = serve(d, davRequest(http.MethodPut, "/dav/dir/a.txt", "x", "If", "(<"+token+">)")); w.Code != http.StatusNoContent {
+		t.Fatalf("PUT with the token: %d %s", w.Code, w.Body)
+	}
+	if w = serve(d, davRequest("UNLOCK", "/dav/b.txt", "", "Lock-Token", "<"+token+">")); w.Code != http.StatusConflict {
+		t.Fatalf("UNLOCK of another file: expected 409, got %d", w.Code)
+	}
+	if w = serve(d, davRequest("UNLOCK", "/dav/dir/a.txt", "", "Lock-Token", "<"+token+">")); w.Code != http.StatusNoContent {
+		t.Fatalf("UNLOCK: %d %s", w.Code, w.Body)
+	}
+	if w = serve(d, davRequest(http.MethodDelete, "/dav/dir", "")); w.Code != http.StatusNoContent {
+		t.Fatalf("DELETE after UNLOCK: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestWebDAV_propfind(t *testing.T) {
+	m := filesystem.NewMemFS()
+	m.MakeDir("/dir")
+	m.MakeDir("/dir/sub")
+	m.WriteFile("/dir/a.txt", strings.NewReader("a"), "I", false)
+	m.WriteFile("/dir/sub/deep.txt", strings.NewReader("deep"), "I", false)
+	d := NewWebDAVHandler("/dav/", m, nil)
+
+	for depth, want := range map[string][]string{
+		"0": {"/dav/dir/"},
+		"1": {"/dav/dir/", "/dav/dir/a.txt", "/dav/dir/sub/"},
+	} {
+		w := serve(d, davRequest("PROPFIND", "/dav/dir", "", "Depth", depth))
+		if w.Code != http.StatusMultiStatus || strings.Count(w.Body.String(), "<D:href>") != len(want) {
+			t.Fatalf("Depth %s: expected %d responses, got %d %s", depth, len(want), w.Code, w.Body)
+		}
+		for _, href := range want {
+			if !strings.Contains(w.Body.String(), "<D:href>"+href+"</D:href>") {
+				t.Errorf("Depth %s: expected %s, got %s", depth, href, w.Body)
+			}
+		}
+	}
+	// the whole tree isn't listed
+	for _, depth := range []string{"infinity", ""} {
+		w := serve(d, davRequest("PROPFIND", "/dav/dir", "", "Depth", depth))
+		if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "propfind-finite-depth") {
+			t.Errorf("Depth %q: expected 403, got %d %s", depth, w.Code, w.Body)
+		}
+	}
+	if w := serve(d, davRequest("PROPFIND", "/dav/missing", "", "Depth", "0")); w.Code != http.StatusNotFound {
+		t.Fatalf("PROPFIND of a missing file: expected 404, got %d", w.Code)
+	}
+	w := serve(d, davRequest("PROPFIND", "/dav/dir/a.txt", `<D:propfind xmlns:D="DAV:"><D:prop><D:getcontentlength/><D:missing/></D:prop></D:propfind>`, "Depth", "0"))
+	if body := w.Body.String(); !strings.Contains(body, "<D:getcontentlength>1</D:getcontentlength>") || !strings.Contains(body, "404 Not Found") {
+		t.Fatalf("expected the found and the missing properties, got %s", body)
+	}
+}
+
+func TestWebDAV_proppatch(t *testing.T) {
+	m := filesystem.NewMemFS()
+	m.WriteFile("/a.txt", strings.NewReader("a"), "I", false)
+	d := NewWebDAVHandler("/dav/", m, nil)
+	patch := func(updates string) string {
+		t.Helper()
+		w := serve(d, davRequest("PROPPATCH", "/dav/a.txt", `<D:propertyupdate xmlns:D="DAV:" xmlns:Z="urn:test">`+updates+`</D:propertyupdate>`))
+		if w.Code != http.StatusMultiStatus {
+			t.Fatalf("PROPPATCH: %d %s", w.Code, w.Body)
+		}
+		return w.Body.String()
+	}
+	color := func() string {
+		t.Helper()
+		w := serve(d, davRequest("PROPFIND", "/dav/a.txt", `<D:propfind xmlns:D="DAV:"><D:prop><Z:color xmlns:Z="urn:test"/></D:prop></D:propfind>`, "Depth", "0"))
+		return w.Body.String()
+	}
+
+	if body := patch(`<D:set><D:prop><Z:color>red</Z:color></D:prop></D:set>`); !strings.Contains(body, "200 OK") {
+		t.Fatalf("expected the property to be set, got %s", body)
+	}
+	if body := color(); !strings.Contains(body, ">red</x:color>") {
+		t.Fatalf("expected the property, got %s", body)
+	}
+
+	// a live property fails the whole update, the other changes aren't made
+	body := patch(`<D:set><D:prop><Z:color>blue</Z:color><D:getcontentlength>5</D:getcontentlength></D:prop></D:set><D:remove><D:prop><Z:size/></D:prop></D:remove>`)
+	if !strings.Contains(body, "<D:getcontentlength></D:getcontentlength></D:prop><D:status>HTTP/1.1 403 Forbidden") ||
+		!strings.Contains(body, "</x:size></D:prop><D:status>HTTP/1.1 424 Failed Dependency") || !strings.Contains(body, "<x:color") {
+		t.Fatalf("expected 403 for the live property and 424 for the others, got %s", body)
+	}
+	if body = color(); !strings.Contains(body, ">red</x:color>") {
+		t.Fatalf("expected the property to be unchanged, got %s", body)
+	}
+
+	if body = patch(`<D:remove><D:prop><Z:color/></D:prop></D:remove>`); !strings.Contains(body, "200 OK") {
+		t.Fatalf("expected the property to be removed, got %s", body)
+	}
+	if body = color(); !strings.Contains(body, "404 Not Found") {
+		t.Fatalf("expected the property to be missing, got %s", body)
+	}
+}
+
+func TestWebDAV_mkcol(t *testing.T) {
+	m := filesystem.NewMemFS()
+	m.WriteFile("/a.txt", strings.NewReader("a"), "I", false)
+	d := NewWebDAVHandler("/dav/", m, nil)
+
+	for _, test := range []struct {
+		target, body string
+		want         int
+	}{
+		{"/dav/dir", "", http.StatusCreated},
+		{"/dav/dir", "", http.StatusMethodNotAllowed},
+		{"/dav/a.txt", "", http.StatusMethodNotAllowed},
+		{"/dav/missing/sub", "", http.StatusConflict},
+		{"/dav/a.txt/sub", "", http.StatusConflict},
+		{"/dav/body", "<x/>", http.StatusUnsupportedMediaType},
+		{"/dav/dir/sub", "", http.StatusCreated},
+	} {
+		if w := serve(d, davRequest("MKCOL", test.target, test.body)); w.Code != test.want {
+			t.Errorf("MKCOL %s: expected %d, got %d %s", test.target, test.want, w.Code, w.Body)
+		}
+	}
+	if err := m.CheckDir("/dir/sub"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := m.Stat("/body"); err == nil {
+		t.Fatal("expected the MKCOL with a body not to create the collection")
+	}
+}
+
+func TestWebDAV_lockRefresh(t *testing.T) {
+	m := filesystem.NewMemFS()
+	d := NewWebDAVHandler("/dav/", m, nil)
+
+	// locking a missing file creates it
+	w := serve(d, davRequest("LOCK", "/dav/a.txt", exclusiveLock, "Timeout", "Second-60"))
+	token := strings.Trim(w.Header().Get("Lock-Token"), "<>")
+	if w.Code != http.StatusCreated || !strings.Contains(w.Body.String(), "Second-60") {
+		t.Fatalf("LOCK of a missing file: %d %s", w.Code, w.Body)
+	}
+	if _, _, err := m.Stat("/a.txt"); err != nil {
+		t.Fatalf("expected the locked file to be created, got %v", err)
+	}
+
+	w = serve(d, davRequest("LOCK", "/dav/a.txt", "", "If", "(<"+token+">)", "Timeout", "Second-600"))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Second-600") || !strings.Contains(w.Body.String(), token) {
+		t.Fatalf("LOCK refresh: %d %s", w.Code, w.Body)
+	}
+	if w = serve(d, davRequest("LOCK", "/dav/a.txt", "", "If", "(<opaquelocktoken:wrong>)")); w.Code != http.StatusPreconditionFailed {
+		t.Fatalf("LOCK refresh of an unknown token: expected 412, got %d", w.Code)
+	}
+	if w = serve(d, davRequest("LOCK", "/dav/a.txt", "")); w.Code != http.StatusBadRequest {
+		t.Fatalf("LOCK refresh without a token: expected 400, got %d", w.Code)
+	}
+
+	if w = serve(d, davRequest("UNLOCK", "/dav/a.txt", "")); w.Code != http.StatusBadRequest {
+		t.Fatalf("UNLOCK without a token: expected 400, got %d", w.Code)
+	}
+	if w = serve(d, davRequest("UNLOCK", "/dav/a.txt", "", "Lock-Token", "<"+token+">")); w.Code != http.StatusNoContent {
+		t.Fatalf("UNLOCK: %d %s", w.Code, w.Body)
+	}
+	// the token is gone, it can't refresh or unlock again
+	if w = serve(d, davRequest("LOCK", "/dav/a.txt", "", "If", "(<"+token+">)")); w.Code != http.StatusPreconditionFailed {
+		t.Fatalf("LOCK refresh after UNLOCK: expected 412, got %d", w.Code)
+	}
+	if w = serve(d, davRequest("UNLOCK", "/dav/a.txt", "", "Lock-Token", "<"+token+">")); w.Code != http.StatusConflict {
+		t.Fatalf("second UNLOCK: expected 409, got %d", w.Code)
+	}
+	if w = serve(d, davRequest(http.MethodPut, "/dav/a.txt", "x")); w.Code != http.StatusNoContent {
+		t.Fatalf("PUT after UNLOCK: %d %s", w.Code, w.Body)
+	}
+}
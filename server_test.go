@@ -244,9 +244,9 @@ func GetEnv(logger *slog.Logger) (env *Environment, err error) {
 
 	// load the crt and key files
 	env.CrtFile = os.Getenv("CRT_FILE")
-	logger.Debug("CRT_FILE is ", env.CrtFile)
+	logger.Debug("CRT_FILE is", "file", env.CrtFile)
 	env.KeyFile = os.Getenv("KEY_FILE")
-	logger.Debug("KEY_FILE is ", env.KeyFile)
+	logger.Debug("KEY_FILE is", "file", env.KeyFile)
 
 	return
 }
@@ -0,0 +1,117 @@
+package sftp
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// CryptoPolicy restricts the algorithms negotiated with the clients, empty lists keep the golang.org/x/crypto/ssh defaults
+type CryptoPolicy struct {
+	// Ciphers are the allowed ciphers in preference order
+	Ciphers []string
+	// KeyExchanges are the allowed key exchange algorithms in preference order
+	KeyExchanges []string
+	// MACs are the allowed message authentication codes in preference order
+	MACs []string
+	// HostKeyAlgorithms are the signature algorithms the host keys may use, keys without an allowed algorithm are not offered
+	HostKeyAlgorithms []string
+	// RekeyThreshold is the number of bytes sent or received after which a new key is negotiated, 0 uses the default of 1GB
+	RekeyThreshold uint64
+}
+
+// ModernCryptoPolicy returns a policy that only allows AEAD or SHA-2 algorithms,
+// SHA-1 key exchanges, MACs and ssh-rsa signatures and all CBC ciphers are disabled.
+func ModernCryptoPolicy() CryptoPolicy {
+	return CryptoPolicy{
+		Ciphers: []string{
+			"chacha20-poly1305@openssh.com",
+			"aes256-gcm@openssh.com", "aes128-gcm@openssh.com",
+			"aes256-ctr", "aes192-ctr", "aes128-ctr",
+		},
+		KeyExchanges: []string{
+			"curve25519-sha256", "curve25519-sha256@libssh.org",
+			"ecdh-sha2-nistp521", "ecdh-sha2-nistp384", "ecdh-sha2-nistp256",
+			"diffie-hellman-group16-sha512", "diffie-hellman-group14-sha256",
+		},
+		MACs: []string{
+			"hmac-sha2-512-etm@openssh.com", "hmac-sha2-256-etm@openssh.com",
+			"hmac-sha2-512", "hmac-sha2-256",
+		},
+		HostKeyAlgorithms: []string{
+			ssh.KeyAlgoED25519,
+			ssh.KeyAlgoECDSA521, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA256,
+			ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256,
+		},
+	}
+}
+
+// hostKeySigner restricts the signature algorithms of a host key to the policy,
+// it returns false if the key can't sign with any of the allowed algorithms.
+func (p CryptoPolicy) hostKeySigner(signer ssh.Signer) (ssh.Signer, bool) {
+	if len(p.HostKeyAlgorithms) == 0 {
+		return signer, true
+	}
+	keyType := signer.PublicKey().Type()
+	if keyType != ssh.KeyAlgoRSA {
+		return signer, slices.Contains(p.HostKeyAlgorithms, keyType)
+	}
+	// rsa keys can sign with sha-1, sha-256 and sha-512
+	algorithmSigner, ok := signer.(ssh.AlgorithmSigner)
+	if !ok {
+		return signer, slices.Contains(p.HostKeyAlgorithms, ssh.KeyAlgoRSA)
+	}
+	var algorithms []string
+	for _, algorithm := range []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA} {
+		if slices.Contains(p.HostKeyAlgorithms, algorithm) {
+			algorithms = append(algorithms, algorithm)
+		}
+	}
+	if len(algorithms) == 0 {
+		return signer, false
+	}
+	restricted, err := ssh.NewSignerWithAlgorithms(algorithmSigner, algorithms)
+	if err != nil {
+		return signer, false
+	}
+	return restricted, true
+}
+
+// validateOptions checks the server options before listening
+func (s *Server) validateOptions() error {
+	if s.ServerVersion != "" && !strings.HasPrefix(s.ServerVersion, "SSH-2.0-") {
+		return fmt.Errorf("invalid server version %q: it must start with SSH-2.0-", s.ServerVersion)
+	}
+	if s.MaxAuthTries < -1 {
+		return fmt.Errorf("invalid MaxAuthTries %d", s.MaxAuthTries)
+	}
+	return nil
+}
+
+// sshConfig returns the ssh server configuration for a new connection
+func (s *Server) sshConfig(session *Sessions) *ssh.ServerConfig {
+	sshCfg := &ssh.ServerConfig{
+		Config: ssh.Config{
+			Ciphers:        s.CryptoPolicy.Ciphers,
+			KeyExchanges:   s.CryptoPolicy.KeyExchanges,
+			MACs:           s.CryptoPolicy.MACs,
+			RekeyThreshold: s.CryptoPolicy.RekeyThreshold,
+		},
+		PasswordCallback: s.AuthHandler(session),
+		MaxAuthTries:     s.MaxAuthTries,
+		ServerVersion:    s.ServerVersion,
+	}
+	if s.Banner != "" {
+		banner := s.Banner
+		if !strings.HasSuffix(banner, "\n") {
+			banner += "\n"
+		}
+		sshCfg.BannerCallback = func(ssh.ConnMetadata) string { return banner }
+	}
+	for _, key := range s.privateKeySigner {
+		sshCfg.AddHostKey(key)
+	}
+	return sshCfg
+}
@@ -12,15 +12,25 @@ import (
 	"io"
 	"io/fs"
 	"log/slog"
+	"net"
 	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 type Sessions struct {
-	fs       filesystem.FSWithReadWriteAt
-	logger   *slog.Logger
-	ctx      context.Context
-	cancel   context.CancelCauseFunc
-	UserInfo ssh.ConnMetadata
+	id        string
+	conn      net.Conn
+	connected time.Time
+	fs        filesystem.FSWithReadWriteAt
+	logger    *slog.Logger
+	ctx       context.Context
+	cancel    context.CancelCauseFunc
+	transfers atomic.Int64
+	lock      sync.Mutex // Protects UserInfo and the changes of fs and the logger by the authentication
+	UserInfo  ssh.ConnMetadata
 }
 
 func NewFileSys(Sessions *Sessions) sftp.Handlers {
@@ -58,13 +68,18 @@ func (s *Sessions) Fileread(request *sftp.Request) (io.ReaderAt, error) {
 		"request.Flags:", request.Flags,
 		"request.Target:", request.Target,
 	)
+	done, err := s.startTransfer()
+	if err != nil {
+		return nil, err
+	}
 	file, err := s.fs.FileRead(request.Filepath, os.O_RDONLY)
 
 	if err != nil {
+		done()
 		s.logger.Error("error opening file", "error", err)
-		return nil, fmt.Errorf("error opening file: %w", err)
+		return nil, statusError(fmt.Errorf("error opening file: %w", err))
 	}
-	return file, nil
+	return &trackedReaderAt{ReaderAt: file, done: done}, nil
 }
 
 func (s *Sessions) Filewrite(request *sftp.Request) (io.WriterAt, error) {
@@ -77,17 +92,26 @@ func (s *Sessions) Filewrite(request *sftp.Request) (io.WriterAt, error) {
 		"request.Target:", request.Target,
 	)
 
+	done, err := s.startTransfer()
+	if err != nil {
+		return nil, err
+	}
 	file, err := s.fs.FileWrite(request.Filepath, os.O_RDWR|os.O_CREATE|os.O_TRUNC)
 
 	if err != nil {
+		done()
 		s.logger.Error("error opening file", "error", err)
-		return nil, fmt.Errorf("error opening file: %w", err)
+		return nil, statusError(fmt.Errorf("error opening file: %w", err))
 	}
 
-	return file, nil
+	return &trackedWriterAt{WriterAt: file, done: done}, nil
 }
 
 func (s *Sessions) Filecmd(request *sftp.Request) error {
+	return statusError(s.filecmd(request))
+}
+
+func (s *Sessions) filecmd(request *sftp.Request) error {
 	s.logger.Debug("Filecmd",
 		"request.Method:", request.Method,
 		"request.Filepath:", request.Filepath,
@@ -165,6 +189,42 @@ func (s *Sessions) StatVFS(request *sftp.Request) (*sftp.StatVFS, error) {
 	return s.fs.StatFS(request.Filepath)
 }
 
+// errSSHFxNoSpace is SSH_FX_NO_SPACE_ON_FILESYSTEM, pkg/sftp only exports the codes of the version 3 protocol
+var errSSHFxNoSpace = fxCode(sftp.ErrSSHFxFailure, 14)
+
+// fxCode returns a status code with the unexported error type of pkg/sftp
+func fxCode[T ~uint32](_ T, code uint32) T {
+	return T(code)
+}
+
+// statusCodeError sends the code to the client with the message of the error
+type statusCodeError struct {
+	code error
+	err  error
+}
+
+func (e *statusCodeError) Error() string {
+	return e.err.Error()
+}
+
+func (e *statusCodeError) Unwrap() []error {
+	return []error{e.code, e.err}
+}
+
+// statusError makes the request server reply to an operation denied by the file system with SSH_FX_PERMISSION_DENIED
+// and to an operation exceeding the storage with SSH_FX_NO_SPACE_ON_FILESYSTEM, it only translates unwrapped os errors
+func statusError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, syscall.ENOSPC):
+		return &statusCodeError{code: errSSHFxNoSpace, err: err}
+	case errors.Is(err, fs.ErrPermission):
+		return &statusCodeError{code: sftp.ErrSSHFxPermissionDenied, err: err}
+	}
+	return err
+}
+
 type ListerAt []os.FileInfo
 
 // ListAt Modeled after strings.Reader's ReadAt() implementation
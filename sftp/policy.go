@@ -0,0 +1,115 @@
+package sftp
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/telebroad/fileserver/tools"
+	"golang.org/x/crypto/ssh"
+)
+
+// the server only provides file transfers, these features are always denied with the given reason
+var (
+	deniedGlobalRequests = map[string]string{
+		"tcpip-forward":                          "port forwarding is disabled",
+		"cancel-tcpip-forward":                   "port forwarding is disabled",
+		"streamlocal-forward@openssh.com":        "unix socket forwarding is disabled",
+		"cancel-streamlocal-forward@openssh.com": "unix socket forwarding is disabled",
+	}
+	deniedChannelTypes = map[string]string{
+		"direct-tcpip":                   "port forwarding is disabled",
+		"forwarded-tcpip":                "port forwarding is disabled",
+		"direct-streamlocal@openssh.com": "unix socket forwarding is disabled",
+		"x11":                            "x11 forwarding is disabled",
+		"auth-agent@openssh.com":         "agent forwarding is disabled",
+	}
+	deniedSessionRequests = map[string]string{
+		"pty-req":                    "terminals are disabled, only sftp, scp and rsync are allowed",
+		"shell":                      "shell access is disabled, only sftp, scp and rsync are allowed",
+		"x11-req":                    "x11 forwarding is disabled",
+		"auth-agent-req@openssh.com": "agent forwarding is disabled",
+	}
+)
+
+// PolicyViolation describes a denied attempt to use an ssh feature other than file transfers
+type PolicyViolation struct {
+	// SessionID is the id of the session, see Server.ActiveSessions
+	SessionID string
+	// User is the authenticated ssh user
+	User string
+	// IP is the client ip address
+	IP string
+	// Kind is the rejected global request, channel type or session request, e.g. "tcpip-forward" or "shell"
+	Kind string
+	// Detail is the rejected command or subsystem if any
+	Detail string
+	// Reason is the reason given for the rejection
+	Reason string
+	// Time is the time of the attempt
+	Time time.Time
+}
+
+// BanHandler feeds the policy violations into ban logic
+type BanHandler interface {
+	// Banned reports whether connections from the ip address are refused
+	Banned(ip string) bool
+	// Violation is called for every denied request, returning true closes the connection
+	Violation(v PolicyViolation) bool
+}
+
+// remoteIP returns the ip address of a connection without the port
+func remoteIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// violation logs a denied request and reports it to the ban handler, which may close the connection
+func (s *Server) violation(session *Sessions, kind, detail, reason string) {
+	info := session.Info()
+	v := PolicyViolation{
+		SessionID: info.ID,
+		User:      info.User,
+		IP:        remoteIP(session.conn.RemoteAddr()),
+		Kind:      kind,
+		Detail:    tools.IsPrintable(detail),
+		Reason:    reason,
+		Time:      time.Now(),
+	}
+	session.logger.Warn("ssh request denied by policy", "kind", v.Kind, "detail", v.Detail, "reason", v.Reason)
+
+	if s.BanHandler != nil && s.BanHandler.Violation(v) {
+		session.logger.Warn("connection closed by the ban handler")
+		session.close(errors.New("closed by the ban handler"))
+	}
+}
+
+// globalRequests rejects the global requests, forwarding requests are reported as violations
+func (s *Server) globalRequests(session *Sessions, in <-chan *ssh.Request) {
+	for req := range in {
+		if reason, denied := deniedGlobalRequests[req.Type]; denied {
+			s.violation(session, req.Type, "", reason)
+		} else {
+			session.logger.Debug("Global request ignored", "type", req.Type)
+		}
+		if req.WantReply {
+			req.Reply(false, nil)
+		}
+	}
+}
+
+// rejectChannel rejects a channel that isn't a session with an explicit reason
+func (s *Server) rejectChannel(session *Sessions, newChannel ssh.NewChannel) {
+	channelType := newChannel.ChannelType()
+	reason, denied := deniedChannelTypes[channelType]
+	if !denied {
+		newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+		session.logger.Debug("Unknown channel type rejected", "channelType", channelType)
+		return
+	}
+	newChannel.Reject(ssh.Prohibited, reason)
+	s.violation(session, channelType, "", reason)
+}
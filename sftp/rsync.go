@@ -0,0 +1,1028 @@
+package sftp
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/telebroad/fileserver/filesystem"
+	"golang.org/x/crypto/md4"
+	"hash"
+	"io"
+	"io/fs"
+	"log/slog"
+	"math"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// the rsync protocol versions the server can speak, the highest common version is used
+const (
+	rsyncMinProtocol = 27
+	rsyncMaxProtocol = 31
+)
+
+// item flags sent with the file indexes since protocol 29
+const (
+	rsyncItemBasisTypeFollows = 1 << 11
+	rsyncItemXNameFollows     = 1 << 12
+	rsyncItemIsNew            = 1 << 13
+	rsyncItemTransfer         = 1 << 15
+)
+
+const (
+	// rsyncBlockSize is the default delta block size for files up to rsyncBlockSize^2 bytes
+	rsyncBlockSize = 700
+	// rsyncMaxBlockSize is the largest block size accepted by clients speaking protocol 30 and later
+	rsyncMaxBlockSize = 1 << 17
+	// rsyncChunkSize is the largest literal data chunk sent in a delta
+	rsyncChunkSize = 32 * 1024
+	// rsyncSumLength is the length of the md4 and md5 checksums
+	rsyncSumLength = 16
+)
+
+// rsyncCommand is a parsed `rsync --server` command line
+type rsyncCommand struct {
+	sender bool
+	rsyncFlistOptions
+	recursive     bool
+	preserveTimes bool
+	preservePerms bool
+	ignoreTimes   bool
+	wholeFile     bool
+	paths         []string
+}
+
+// parseRsyncCommand parses the command that an rsync client runs on the server side, the server options are a small
+// subset of rsync, options that need features the filesystem.FS doesn't have (hard links, acls, xattrs, deletion,
+// compression) are rejected so the client fails early with a clear message.
+func parseRsyncCommand(command string) (*rsyncCommand, error) {
+	args, err := splitShellWords(command)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) < 2 || path.Base(args[0]) != "rsync" || args[1] != "--server" {
+		return nil, fmt.Errorf("command not allowed: %q", command)
+	}
+
+	cmd := &rsyncCommand{}
+	i := 2
+	for ; i < len(args); i++ {
+		arg := args[i]
+		if arg == "." {
+			i++
+			break
+		}
+		switch {
+		case arg == "--sender":
+			cmd.sender = true
+		case arg == "--numeric-ids":
+			cmd.numericIDs = true
+		case arg == "--ignore-times":
+			cmd.ignoreTimes = true
+		case arg == "--whole-file":
+			cmd.wholeFile = true
+		case strings.HasPrefix(arg, "--log-format="), strings.HasPrefix(arg, "--out-format="):
+		case strings.HasPrefix(arg, "--"):
+			return nil, fmt.Errorf("rsync option not allowed: %s", arg)
+		case strings.HasPrefix(arg, "-"):
+			if err = cmd.parseShortOptions(arg[1:]); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unexpected rsync argument: %q", arg)
+		}
+	}
+
+	if i >= len(args) {
+		return nil, errors.New("rsync requires a path")
+	}
+	if !cmd.sender && len(args)-i != 1 {
+		return nil, errors.New("rsync requires exactly one destination")
+	}
+	for _, p := range args[i:] {
+		clean := path.Join("/", p)
+		// the trailing slash means the content of the directory and not the directory itself
+		if strings.HasSuffix(p, "/") && clean != "/" {
+			clean += "/"
+		}
+		cmd.paths = append(cmd.paths, clean)
+	}
+	return cmd, nil
+}
+
+func (cmd *rsyncCommand) parseShortOptions(opts string) error {
+	for _, opt := range opts {
+		switch opt {
+		case 'v', 'q', 'i', 'x', 'L':
+		case 'l':
+			cmd.preserveLinks = true
+		case 'o':
+			cmd.preserveUID = true
+		case 'g':
+			cmd.preserveGID = true
+		case 'D':
+			cmd.preserveDevices = true
+			cmd.preserveSpecials = true
+		case 't':
+			cmd.preserveTimes = true
+		case 'p':
+			cmd.preservePerms = true
+		case 'r':
+			cmd.recursive = true
+		case 'I':
+			cmd.ignoreTimes = true
+		case 'W':
+			cmd.wholeFile = true
+		case 'e':
+			// the rest of the option is the client capabilities, none of them is enabled by this server
+			return nil
+		default:
+			return fmt.Errorf("rsync option not allowed: -%c", opt)
+		}
+	}
+	return nil
+}
+
+// rsyncSession runs the server side of the rsync protocol against the session file system
+type rsyncSession struct {
+	fs     filesystem.FSWithReadWriteAt
+	logger *slog.Logger
+	cmd    *rsyncCommand
+	conn   *rsyncConn
+	seed   int32
+}
+
+func newRsyncSession(fs filesystem.FSWithReadWriteAt, logger *slog.Logger, cmd *rsyncCommand, rw io.ReadWriter) *rsyncSession {
+	return &rsyncSession{
+		fs:     fs,
+		logger: logger.With("rsync-paths", cmd.paths),
+		cmd:    cmd,
+		conn:   newRsyncConn(rw, logger),
+	}
+}
+
+// Run negotiates the protocol and runs the sender or the receiver
+func (s *rsyncSession) Run() error {
+	err := s.setup()
+	if err != nil {
+		return err
+	}
+	if s.cmd.sender {
+		err = s.send()
+	} else {
+		err = s.receive()
+	}
+	if err != nil {
+		// the client prints error messages, it's only possible once the output is multiplexed
+		_ = s.conn.sendMessage(rsyncMsgError, "rsync server error: "+err.Error()+"\n")
+		return err
+	}
+	return s.conn.Flush()
+}
+
+// setup exchanges the protocol version, the compatibility flags and the checksum seed
+func (s *rsyncSession) setup() error {
+	if err := s.conn.writeInt(rsyncMaxProtocol); err != nil {
+		return err
+	}
+	if err := s.conn.Flush(); err != nil {
+		return err
+	}
+	remote, err := s.conn.readInt()
+	if err != nil {
+		return err
+	}
+	if remote < rsyncMinProtocol {
+		return fmt.Errorf("rsync protocol version %d is not supported, the minimum is %d", remote, rsyncMinProtocol)
+	}
+	s.conn.protocol = int(min(remote, rsyncMaxProtocol))
+	s.logger = s.logger.With("rsync-protocol", s.conn.protocol)
+
+	if s.conn.protocol >= 30 {
+		// no compatibility flags: no incremental recursion and no checksum negotiation, md5 is used
+		if err = s.conn.writeVarInt(0); err != nil {
+			return err
+		}
+	}
+	s.seed = int32(time.Now().Unix()) ^ int32(os.Getpid()<<6)
+	if err = s.conn.writeInt(s.seed); err != nil {
+		return err
+	}
+	if err = s.conn.Flush(); err != nil {
+		return err
+	}
+
+	s.conn.multiplexOut()
+	if s.conn.protocol >= 30 {
+		s.conn.multiplexIn()
+	}
+	return nil
+}
+
+// newFileSum returns the whole file checksum of the negotiated protocol
+func (s *rsyncSession) newFileSum() hash.Hash {
+	if s.conn.protocol >= 30 {
+		return md5.New()
+	}
+	h := md4.New()
+	var seed [4]byte
+	binary.LittleEndian.PutUint32(seed[:], uint32(s.seed))
+	h.Write(seed[:])
+	return h
+}
+
+// blockSum returns the strong checksum of a block
+func (s *rsyncSession) blockSum(block []byte) []byte {
+	var h hash.Hash
+	if s.conn.protocol >= 30 {
+		h = md5.New()
+	} else {
+		h = md4.New()
+	}
+	h.Write(block)
+	if s.seed != 0 {
+		var seed [4]byte
+		binary.LittleEndian.PutUint32(seed[:], uint32(s.seed))
+		h.Write(seed[:])
+	}
+	return h.Sum(nil)
+}
+
+// rsyncRollingSum is the weak rolling checksum, bytes are signed like in the C implementation
+func rsyncRollingSum(block []byte) (s1, s2 uint32) {
+	for _, b := range block {
+		s1 += uint32(int32(int8(b)))
+		s2 += s1
+	}
+	return s1, s2
+}
+
+func rsyncWeakSum(s1, s2 uint32) uint32 {
+	return s1&0xFFFF | s2<<16
+}
+
+// rsyncSumHead describes the block checksums of a basis file
+type rsyncSumHead struct {
+	count     int32
+	blockLen  int32
+	sum2Len   int32
+	remainder int32
+}
+
+func (s *rsyncSession) readSumHead() (rsyncSumHead, error) {
+	var head rsyncSumHead
+	var err error
+	if head.count, err = s.conn.readInt(); err != nil {
+		return head, err
+	}
+	if head.blockLen, err = s.conn.readInt(); err != nil {
+		return head, err
+	}
+	if head.sum2Len, err = s.conn.readInt(); err != nil {
+		return head, err
+	}
+	if head.remainder, err = s.conn.readInt(); err != nil {
+		return head, err
+	}
+	if head.count < 0 || head.blockLen < 0 || head.blockLen > 1<<29 || head.sum2Len < 0 || head.sum2Len > rsyncSumLength ||
+		head.remainder < 0 || head.remainder > head.blockLen {
+		return head, errors.New("rsync protocol error: invalid checksum header")
+	}
+	return head, nil
+}
+
+func (s *rsyncSession) writeSumHead(head rsyncSumHead) error {
+	for _, n := range []int32{head.count, head.blockLen, head.sum2Len, head.remainder} {
+		if err := s.conn.writeInt(n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeNdxAndAttrs writes a file index with its item flags
+func (s *rsyncSession) writeNdxAndAttrs(ndx int32, iflags int) error {
+	if err := s.conn.writeNdx(ndx); err != nil {
+		return err
+	}
+	if s.conn.protocol >= 29 {
+		return s.conn.writeShortInt(iflags)
+	}
+	return nil
+}
+
+// readNdxAndAttrs reads a file index with its item flags, the basis type and the alternative name are ignored
+func (s *rsyncSession) readNdxAndAttrs() (int32, int, error) {
+	ndx, err := s.conn.readNdx()
+	if err != nil || ndx == rsyncNdxDone {
+		return ndx, 0, err
+	}
+	if ndx < 0 {
+		return 0, 0, fmt.Errorf("rsync protocol error: unexpected index %d", ndx)
+	}
+	if s.conn.protocol < 29 {
+		return ndx, rsyncItemTransfer, nil
+	}
+	iflags, err := s.conn.readShortInt()
+	if err != nil {
+		return 0, 0, err
+	}
+	if iflags&rsyncItemBasisTypeFollows != 0 {
+		if _, err = s.conn.readByte(); err != nil {
+			return 0, 0, err
+		}
+	}
+	if iflags&rsyncItemXNameFollows != 0 {
+		if _, err = s.conn.readVString(); err != nil {
+			return 0, 0, err
+		}
+	}
+	return ndx, iflags, nil
+}
+
+// finish reads the final goodbye of the client, since protocol 31 the sender answers it
+func (s *rsyncSession) finish() error {
+	if err := s.conn.Flush(); err != nil {
+		return err
+	}
+	ndx, _, err := s.readNdxAndAttrs()
+	if err != nil {
+		return err
+	}
+	if ndx != rsyncNdxDone {
+		return fmt.Errorf("rsync protocol error: expected goodbye, got index %d", ndx)
+	}
+	if s.conn.protocol >= 31 && s.cmd.sender {
+		if err = s.conn.writeNdx(rsyncNdxDone); err != nil {
+			return err
+		}
+	}
+	return s.conn.Flush()
+}
+
+// send implements `rsync --server --sender`, the client downloads from the server
+func (s *rsyncSession) send() error {
+	// the client always sends its filter rules to a sender, they are not applied
+	for {
+		n, err := s.conn.readInt()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			break
+		}
+		if n < 0 || n > 4096 {
+			return errors.New("rsync protocol error: invalid filter rule")
+		}
+		rule := make([]byte, n)
+		if err = s.conn.readFull(rule); err != nil {
+			return err
+		}
+		s.logger.Debug("rsync filter rule ignored", "rule", string(rule))
+	}
+
+	files, err := s.buildFileList()
+	if err != nil {
+		return err
+	}
+	sortRsyncFiles(files, s.conn.protocol)
+	if err = s.conn.sendFileList(files, s.cmd.rsyncFlistOptions); err != nil {
+		return err
+	}
+	if err = s.conn.Flush(); err != nil {
+		return err
+	}
+
+	var totalWritten, totalSize int64
+	for _, f := range files {
+		totalSize += f.size
+	}
+
+	maxPhase := 1
+	if s.conn.protocol >= 29 {
+		maxPhase = 2
+	}
+	phase := 0
+	for {
+		ndx, iflags, err := s.readNdxAndAttrs()
+		if err != nil {
+			return err
+		}
+		if ndx == rsyncNdxDone {
+			phase++
+			if phase > maxPhase {
+				break
+			}
+			if err = s.conn.writeNdx(rsyncNdxDone); err != nil {
+				return err
+			}
+			if err = s.conn.Flush(); err != nil {
+				return err
+			}
+			continue
+		}
+		if int(ndx) >= len(files) {
+			return fmt.Errorf("rsync protocol error: invalid file index %d", ndx)
+		}
+		if iflags&rsyncItemTransfer == 0 {
+			continue
+		}
+
+		head, err := s.readSumHead()
+		if err != nil {
+			return err
+		}
+		sums, err := s.readBlockSums(head)
+		if err != nil {
+			return err
+		}
+		n, err := s.sendFile(ndx, iflags, files[ndx], head, sums)
+		if err != nil {
+			return err
+		}
+		totalWritten += n
+		if err = s.conn.Flush(); err != nil {
+			return err
+		}
+	}
+	if err = s.conn.writeNdx(rsyncNdxDone); err != nil {
+		return err
+	}
+
+	// the transfer statistics, the client reads them as seen from its side
+	for _, n := range []int64{0, totalWritten, totalSize} {
+		if err = s.conn.writeVarLong30(n, 3); err != nil {
+			return err
+		}
+	}
+	if s.conn.protocol >= 29 {
+		// the file list build and transfer times
+		if err = s.conn.writeVarLong30(0, 3); err != nil {
+			return err
+		}
+		if err = s.conn.writeVarLong30(0, 3); err != nil {
+			return err
+		}
+	}
+	return s.finish()
+}
+
+// buildFileList walks the requested paths, a path with a trailing slash sends the content of the directory
+func (s *rsyncSession) buildFileList() ([]*rsyncFile, error) {
+	var files []*rsyncFile
+	for _, p := range s.cmd.paths {
+		contentOnly := strings.HasSuffix(p, "/")
+		p = path.Clean(p)
+		_, info, err := s.fs.Stat(p)
+		if err != nil {
+			return nil, fmt.Errorf("%s: no such file or directory", p)
+		}
+		if info.IsDir() && !s.cmd.recursive {
+			s.logger.Debug("rsync skipping directory without -r", "path", p)
+			continue
+		}
+
+		name := path.Base(p)
+		if contentOnly || p == "/" {
+			name = "."
+		}
+		root := newRsyncFile(p, name, info)
+		root.topDir = true
+		files = append(files, root)
+		if info.IsDir() {
+			if files, err = s.walk(files, p, name); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return files, nil
+}
+
+func (s *rsyncSession) walk(files []*rsyncFile, dir, name string) ([]*rsyncFile, error) {
+	_, entries, err := s.fs.Dir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		childPath := path.Join(dir, entry.Name())
+		childName := path.Join(name, entry.Name())
+		// the filesystem.FS can't read link targets, Dir follows the links and they are sent as the files they point to
+		f := newRsyncFile(childPath, childName, entry)
+		if f.isDevice() || f.isSpecial() || f.isSymlink() {
+			continue
+		}
+		files = append(files, f)
+		if f.isDir() {
+			if files, err = s.walk(files, childPath, childName); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return files, nil
+}
+
+func newRsyncFile(p, name string, info fs.FileInfo) *rsyncFile {
+	f := &rsyncFile{
+		name:    name,
+		path:    p,
+		size:    info.Size(),
+		modTime: info.ModTime().Unix(),
+		mode:    rsyncWireMode(info.Mode()),
+	}
+	if !f.isRegular() {
+		f.size = 0
+	}
+	return f
+}
+
+func (s *rsyncSession) readBlockSums(head rsyncSumHead) ([]rsyncBlockSum, error) {
+	sums := make([]rsyncBlockSum, head.count)
+	for i := range sums {
+		weak, err := s.conn.readInt()
+		if err != nil {
+			return nil, err
+		}
+		strong := make([]byte, head.sum2Len)
+		if err = s.conn.readFull(strong); err != nil {
+			return nil, err
+		}
+		sums[i] = rsyncBlockSum{weak: uint32(weak), strong: strong}
+	}
+	return sums, nil
+}
+
+type rsyncBlockSum struct {
+	weak   uint32
+	strong []byte
+}
+
+// sendFile sends the delta of a file against the block checksums of the client basis file
+func (s *rsyncSession) sendFile(ndx int32, iflags int, f *rsyncFile, head rsyncSumHead, sums []rsyncBlockSum) (int64, error) {
+	var data bytes.Buffer
+	_, err := s.fs.ReadFile(f.path, &data)
+	if err != nil {
+		// the client is told with an error message and gets an empty file that fails the checksum
+		s.logger.Error("rsync error reading file", "path", f.path, "error", err)
+		_ = s.conn.sendMessage(rsyncMsgErrXfer, fmt.Sprintf("rsync: read error on %q: %s\n", f.name, err))
+		data.Reset()
+	}
+
+	if err = s.writeNdxAndAttrs(ndx, iflags); err != nil {
+		return 0, err
+	}
+	if err = s.writeSumHead(head); err != nil {
+		return 0, err
+	}
+	fileSum := s.newFileSum()
+	fileSum.Write(data.Bytes())
+
+	written, err := s.writeDelta(data.Bytes(), head, sums)
+	if err != nil {
+		return written, err
+	}
+	_, err = s.conn.Write(fileSum.Sum(nil))
+	s.logger.Debug("rsync file sent", "file", f.name, "size", data.Len(), "literal", written)
+	return written, err
+}
+
+// writeDelta writes the tokens that rebuild data from the basis blocks: literal data and block references
+func (s *rsyncSession) writeDelta(data []byte, head rsyncSumHead, sums []rsyncBlockSum) (int64, error) {
+	var literal int64
+	flush := func(p []byte) error {
+		for len(p) > 0 {
+			chunk := p[:min(len(p), rsyncChunkSize)]
+			if err := s.conn.writeInt(int32(len(chunk))); err != nil {
+				return err
+			}
+			if _, err := s.conn.Write(chunk); err != nil {
+				return err
+			}
+			literal += int64(len(chunk))
+			p = p[len(chunk):]
+		}
+		return nil
+	}
+
+	blockLen := int(head.blockLen)
+	if len(sums) == 0 || blockLen == 0 {
+		if err := flush(data); err != nil {
+			return literal, err
+		}
+		return literal, s.conn.writeInt(0)
+	}
+
+	lookup := make(map[uint32][]int, len(sums))
+	for i, sum := range sums {
+		lookup[sum.weak] = append(lookup[sum.weak], i)
+	}
+	blockSize := func(i int) int {
+		if i == len(sums)-1 && head.remainder != 0 {
+			return int(head.remainder)
+		}
+		return blockLen
+	}
+	match := func(pos int, weak uint32, size int) int {
+		for _, i := range lookup[weak] {
+			if blockSize(i) != size {
+				continue
+			}
+			strong := s.blockSum(data[pos : pos+size])
+			if bytes.Equal(strong[:len(sums[i].strong)], sums[i].strong) {
+				return i
+			}
+		}
+		return -1
+	}
+
+	start, pos := 0, 0
+	var s1, s2 uint32
+	window := 0
+	for pos < len(data) {
+		size := min(blockLen, len(data)-pos)
+		if window != size {
+			s1, s2 = rsyncRollingSum(data[pos : pos+size])
+			window = size
+		}
+		if i := match(pos, rsyncWeakSum(s1, s2), size); i >= 0 {
+			if err := flush(data[start:pos]); err != nil {
+				return literal, err
+			}
+			if err := s.conn.writeInt(int32(-(i + 1))); err != nil {
+				return literal, err
+			}
+			pos += size
+			start = pos
+			window = 0
+			continue
+		}
+		if pos+size >= len(data) {
+			// the window reached the end of the file, it shrinks from now on
+			pos++
+			window = 0
+			continue
+		}
+		// roll the window one byte forward
+		out := uint32(int32(int8(data[pos])))
+		in := uint32(int32(int8(data[pos+size])))
+		s1 = s1 - out + in
+		s2 = s2 - uint32(size)*out + s1
+		pos++
+	}
+	if err := flush(data[start:]); err != nil {
+		return literal, err
+	}
+	return literal, s.conn.writeInt(0)
+}
+
+// receive implements `rsync --server`, the client uploads to the server
+func (s *rsyncSession) receive() error {
+	files, err := s.conn.recvFileList(s.cmd.rsyncFlistOptions)
+	if err != nil {
+		return err
+	}
+	sortRsyncFiles(files, s.conn.protocol)
+
+	dest := path.Clean(s.cmd.paths[0])
+	destIsDir := s.fs.CheckDir(dest) == nil
+	// a single file is written to the destination path unless it is an existing directory
+	if !destIsDir && !(len(files) == 1 && !files[0].isDir()) {
+		if err = s.fs.MakeDir(dest); err != nil {
+			return fmt.Errorf("%s: %w", dest, err)
+		}
+		destIsDir = true
+	}
+	target := func(f *rsyncFile) string {
+		if !destIsDir {
+			return dest
+		}
+		return path.Join(dest, f.name)
+	}
+
+	// the generator runs concurrently with the receiver, like the generator process of rsync
+	phaseDone := make(chan []int32)
+	genErr := make(chan error, 1)
+	go func() {
+		genErr <- s.generate(files, target, phaseDone)
+	}()
+	defer close(phaseDone)
+
+	maxPhase := 1
+	if s.conn.protocol >= 29 {
+		maxPhase = 2
+	}
+	phase := 0
+	var redo []int32
+	for {
+		ndx, iflags, err := s.readNdxAndAttrs()
+		if err != nil {
+			return err
+		}
+		if ndx == rsyncNdxDone {
+			phase++
+			if phase > maxPhase {
+				break
+			}
+			select {
+			case phaseDone <- redo:
+			case err = <-genErr:
+				if err == nil {
+					err = errors.New("rsync generator exited early")
+				}
+				return err
+			}
+			redo = nil
+			continue
+		}
+		if int(ndx) >= len(files) {
+			return fmt.Errorf("rsync protocol error: invalid file index %d", ndx)
+		}
+		if iflags&rsyncItemTransfer == 0 {
+			continue
+		}
+		f := files[ndx]
+		ok, err := s.receiveFile(f, target(f))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			if phase == 0 {
+				redo = append(redo, ndx)
+			} else {
+				s.logger.Error("rsync checksum failed twice", "file", f.name)
+				_ = s.conn.sendMessage(rsyncMsgErrXfer, fmt.Sprintf("rsync: checksum failed for %q\n", f.name))
+			}
+		}
+	}
+	if err = <-genErr; err != nil {
+		return err
+	}
+
+	// directory times are set last, writing the files changed them
+	for _, f := range files {
+		if f.isDir() {
+			s.setAttributes(target(f), f)
+		}
+	}
+
+	// the final goodbye
+	if err = s.conn.writeNdx(rsyncNdxDone); err != nil {
+		return err
+	}
+	if err = s.conn.Flush(); err != nil {
+		return err
+	}
+	if s.conn.protocol >= 31 {
+		// the client sender answers the goodbye
+		if _, err = s.conn.readNdx(); err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+	}
+	return nil
+}
+
+// generate sends the block checksums of the files that must be transferred, it writes to the client while the
+// receiver reads from it. after each phase it waits for the receiver to report the files to transfer again.
+func (s *rsyncSession) generate(files []*rsyncFile, target func(*rsyncFile) string, phaseDone <-chan []int32) error {
+	for i, f := range files {
+		name := target(f)
+		switch {
+		case f.isDir():
+			if s.fs.CheckDir(name) != nil {
+				if err := s.fs.MakeDir(name); err != nil {
+					s.logger.Error("rsync error creating directory", "path", name, "error", err)
+				}
+			}
+		case f.isSymlink():
+			s.createSymlink(name, f)
+		case f.isRegular():
+			_, info, err := s.fs.Stat(name)
+			if err == nil && !s.cmd.ignoreTimes && info.Size() == f.size && info.ModTime().Unix() == f.modTime {
+				s.setAttributes(name, f)
+				continue
+			}
+			iflags := rsyncItemTransfer
+			var head rsyncSumHead
+			var sums []rsyncBlockSum
+			if err != nil {
+				iflags |= rsyncItemIsNew
+			} else if !s.cmd.wholeFile {
+				head, sums = s.blockSums(name, info.Size())
+			}
+			if err = s.writeNdxAndAttrs(int32(i), iflags); err != nil {
+				return err
+			}
+			if err = s.writeSumHead(head); err != nil {
+				return err
+			}
+			for _, sum := range sums {
+				if err = s.conn.writeInt(int32(sum.weak)); err != nil {
+					return err
+				}
+				if _, err = s.conn.Write(sum.strong); err != nil {
+					return err
+				}
+			}
+			if err = s.conn.Flush(); err != nil {
+				return err
+			}
+		default:
+			s.logger.Debug("rsync skipping special file", "file", f.name)
+		}
+	}
+
+	phases := 2
+	if s.conn.protocol < 29 {
+		phases = 1
+	}
+	for phase := 0; phase < phases+1; phase++ {
+		if err := s.conn.writeNdx(rsyncNdxDone); err != nil {
+			return err
+		}
+		if err := s.conn.Flush(); err != nil {
+			return err
+		}
+		if phase == phases {
+			return nil
+		}
+		redo, ok := <-phaseDone
+		if !ok {
+			return nil
+		}
+		// files that failed the checksum are sent again in full
+		for _, ndx := range redo {
+			if err := s.writeNdxAndAttrs(ndx, rsyncItemTransfer); err != nil {
+				return err
+			}
+			if err := s.writeSumHead(rsyncSumHead{sum2Len: rsyncSumLength}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// blockSums computes the block checksums of the basis file, on error the file is sent in full
+func (s *rsyncSession) blockSums(name string, size int64) (rsyncSumHead, []rsyncBlockSum) {
+	blockLen := int64(rsyncBlockSize)
+	if size > rsyncBlockSize*rsyncBlockSize {
+		blockLen = min(int64(math.Sqrt(float64(size)))&^7, rsyncMaxBlockSize)
+	}
+	head := rsyncSumHead{
+		count:     int32((size + blockLen - 1) / blockLen),
+		blockLen:  int32(blockLen),
+		sum2Len:   rsyncSumLength,
+		remainder: int32(size % blockLen),
+	}
+
+	r, err := s.fs.FileRead(name, os.O_RDONLY)
+	if err != nil {
+		s.logger.Debug("rsync error opening basis file", "path", name, "error", err)
+		return rsyncSumHead{sum2Len: rsyncSumLength}, nil
+	}
+	if c, ok := r.(io.Closer); ok {
+		defer c.Close()
+	}
+
+	sums := make([]rsyncBlockSum, 0, head.count)
+	block := make([]byte, blockLen)
+	for offset := int64(0); offset < size; offset += blockLen {
+		n, err := r.ReadAt(block[:min(blockLen, size-offset)], offset)
+		if err != nil && !(errors.Is(err, io.EOF) && int64(n) == min(blockLen, size-offset)) {
+			s.logger.Debug("rsync error reading basis file", "path", name, "error", err)
+			return rsyncSumHead{sum2Len: rsyncSumLength}, nil
+		}
+		s1, s2 := rsyncRollingSum(block[:n])
+		sums = append(sums, rsyncBlockSum{weak: rsyncWeakSum(s1, s2), strong: s.blockSum(block[:n])})
+	}
+	return head, sums
+}
+
+// receiveFile rebuilds a file from the delta sent by the client into a temporary file and renames it over the
+// target when the checksum matches. it returns false when the checksum doesn't match.
+func (s *rsyncSession) receiveFile(f *rsyncFile, name string) (bool, error) {
+	head, err := s.readSumHead()
+	if err != nil {
+		return false, err
+	}
+
+	var basis io.ReaderAt
+	if head.count > 0 {
+		basis, err = s.fs.FileRead(name, os.O_RDONLY)
+		if err != nil {
+			return false, fmt.Errorf("%s: error opening basis file: %w", name, err)
+		}
+		if c, ok := basis.(io.Closer); ok {
+			defer c.Close()
+		}
+	}
+
+	tmpName := path.Join(path.Dir(name), fmt.Sprintf(".%s.rsync-%d", path.Base(name), time.Now().UnixNano()))
+	out, err := s.fs.FileWrite(tmpName, os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+	var writeErr error
+	if err != nil {
+		writeErr = err
+	}
+
+	fileSum := s.newFileSum()
+	var offset int64
+	write := func(p []byte) {
+		fileSum.Write(p)
+		if writeErr == nil {
+			_, writeErr = out.WriteAt(p, offset)
+		}
+		offset += int64(len(p))
+	}
+
+	buf := make([]byte, rsyncChunkSize)
+	for {
+		token, err := s.conn.readInt()
+		if err != nil {
+			return false, err
+		}
+		if token == 0 {
+			break
+		}
+		if token > 0 {
+			if token > rsyncChunkSize {
+				return false, errors.New("rsync protocol error: literal data too large")
+			}
+			if err = s.conn.readFull(buf[:token]); err != nil {
+				return false, err
+			}
+			write(buf[:token])
+			continue
+		}
+		block := int64(-(token + 1))
+		if block >= int64(head.count) {
+			return false, fmt.Errorf("rsync protocol error: invalid block %d", block)
+		}
+		size := int64(head.blockLen)
+		if block == int64(head.count)-1 && head.remainder != 0 {
+			size = int64(head.remainder)
+		}
+		data := make([]byte, size)
+		if _, err = basis.ReadAt(data, block*int64(head.blockLen)); err != nil && !errors.Is(err, io.EOF) {
+			writeErr = err
+		}
+		write(data)
+	}
+
+	remoteSum := make([]byte, rsyncSumLength)
+	if err = s.conn.readFull(remoteSum); err != nil {
+		return false, err
+	}
+
+	if c, ok := out.(io.Closer); ok {
+		if err = c.Close(); err != nil && writeErr == nil {
+			writeErr = err
+		}
+	}
+	if writeErr == nil && !bytes.Equal(fileSum.Sum(nil), remoteSum) {
+		_ = s.fs.Remove(tmpName)
+		return false, nil
+	}
+	if writeErr == nil {
+		writeErr = s.fs.Rename(tmpName, name)
+	}
+	if writeErr != nil {
+		_ = s.fs.Remove(tmpName)
+		s.logger.Error("rsync error writing file", "path", name, "error", writeErr)
+		_ = s.conn.sendMessage(rsyncMsgErrXfer, fmt.Sprintf("rsync: write error on %q: %s\n", f.name, writeErr))
+		return true, nil
+	}
+	s.setAttributes(name, f)
+	s.logger.Debug("rsync file received", "file", name, "size", offset)
+	return true, nil
+}
+
+// createSymlink creates a link that stays inside the root, other links are skipped
+func (s *rsyncSession) createSymlink(name string, f *rsyncFile) {
+	if path.IsAbs(f.link) {
+		s.logger.Warn("rsync skipping absolute symlink", "path", name, "target", f.link)
+		return
+	}
+	target := path.Join(path.Dir(name), f.link)
+	_ = s.fs.Remove(name)
+	if err := s.fs.Symlink(name, target); err != nil {
+		s.logger.Warn("rsync error creating symlink", "path", name, "error", err)
+	}
+}
+
+// setAttributes applies the mode and the modification time when the client asked to preserve them
+func (s *rsyncSession) setAttributes(name string, f *rsyncFile) {
+	if s.cmd.preservePerms {
+		if err := s.fs.SetStat(name, rsyncPermissions(f.mode)); err != nil {
+			s.logger.Debug("rsync could not set mode", "path", name, "error", err)
+		}
+	}
+	if s.cmd.preserveTimes {
+		err := s.fs.ModifyTime(name, time.Unix(f.modTime, 0).UTC().Format("20060102150405"))
+		if err != nil {
+			s.logger.Debug("rsync could not set modification time", "path", name, "error", err)
+		}
+	}
+}
@@ -0,0 +1,494 @@
+package sftp
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strings"
+)
+
+// rsync file list entry flags
+const (
+	rsyncXmitTopDir        = 1 << 0
+	rsyncXmitSameMode      = 1 << 1
+	rsyncXmitExtendedFlags = 1 << 2
+	rsyncXmitSameRdevPre28 = 1 << 2
+	rsyncXmitSameUID       = 1 << 3
+	rsyncXmitSameGID       = 1 << 4
+	rsyncXmitSameName      = 1 << 5
+	rsyncXmitLongName      = 1 << 6
+	rsyncXmitSameTime      = 1 << 7
+	rsyncXmitSameRdevMajor = 1 << 8
+	rsyncXmitHLinked       = 1 << 9
+	rsyncXmitUserName      = 1 << 10
+	rsyncXmitRdevMinor8    = 1 << 11
+	rsyncXmitGroupName     = 1 << 11
+	rsyncXmitModNsec       = 1 << 13
+)
+
+// unix file type bits as they are sent on the wire
+const (
+	rsyncModeTypeMask = 0o170000
+	rsyncModeSocket   = 0o140000
+	rsyncModeSymlink  = 0o120000
+	rsyncModeRegular  = 0o100000
+	rsyncModeBlock    = 0o060000
+	rsyncModeDir      = 0o040000
+	rsyncModeChar     = 0o020000
+	rsyncModeFifo     = 0o010000
+)
+
+// rsyncFile is an entry of the file list
+type rsyncFile struct {
+	// name is the path relative to the transfer root, the root itself is "."
+	name    string
+	size    int64
+	modTime int64
+	mode    uint32
+	uid     int32
+	gid     int32
+	link    string
+	topDir  bool
+	// path is the path in the filesystem.FS, only set on the sending side
+	path string
+}
+
+func (f *rsyncFile) isDir() bool {
+	return f.mode&rsyncModeTypeMask == rsyncModeDir
+}
+
+func (f *rsyncFile) isRegular() bool {
+	return f.mode&rsyncModeTypeMask == rsyncModeRegular
+}
+
+func (f *rsyncFile) isSymlink() bool {
+	return f.mode&rsyncModeTypeMask == rsyncModeSymlink
+}
+
+func (f *rsyncFile) isDevice() bool {
+	t := f.mode & rsyncModeTypeMask
+	return t == rsyncModeBlock || t == rsyncModeChar
+}
+
+func (f *rsyncFile) isSpecial() bool {
+	t := f.mode & rsyncModeTypeMask
+	return t == rsyncModeFifo || t == rsyncModeSocket
+}
+
+// rsyncWireMode converts a go file mode to the unix mode used on the wire
+func rsyncWireMode(mode fs.FileMode) uint32 {
+	m := uint32(mode.Perm())
+	if mode&fs.ModeSetuid != 0 {
+		m |= 0o4000
+	}
+	if mode&fs.ModeSetgid != 0 {
+		m |= 0o2000
+	}
+	if mode&fs.ModeSticky != 0 {
+		m |= 0o1000
+	}
+	switch {
+	case mode.IsDir():
+		m |= rsyncModeDir
+	case mode&fs.ModeSymlink != 0:
+		m |= rsyncModeSymlink
+	case mode&fs.ModeNamedPipe != 0:
+		m |= rsyncModeFifo
+	case mode&fs.ModeSocket != 0:
+		m |= rsyncModeSocket
+	case mode&fs.ModeCharDevice != 0:
+		m |= rsyncModeChar
+	case mode&fs.ModeDevice != 0:
+		m |= rsyncModeBlock
+	default:
+		m |= rsyncModeRegular
+	}
+	return m
+}
+
+// rsyncPermissions returns the permission bits of a wire mode as a go file mode
+func rsyncPermissions(mode uint32) fs.FileMode {
+	return fs.FileMode(mode & 0o777)
+}
+
+// sortRsyncFiles sorts the file list the way rsync does, indexes sent on the wire refer to the sorted list.
+// since protocol 29 the files of a directory sort before its subdirectories, and "." sorts first.
+func sortRsyncFiles(files []*rsyncFile, protocol int) {
+	if protocol < 29 {
+		sort.SliceStable(files, func(i, j int) bool { return files[i].name < files[j].name })
+		return
+	}
+	sort.SliceStable(files, func(i, j int) bool { return rsyncNameLess(files[i], files[j]) })
+}
+
+func rsyncNameLess(a, b *rsyncFile) bool {
+	if a.name == "." || b.name == "." {
+		return a.name == "." && b.name != "."
+	}
+	ap := strings.Split(a.name, "/")
+	bp := strings.Split(b.name, "/")
+	for i := 0; i < len(ap) && i < len(bp); i++ {
+		// a component followed by more components is a directory
+		aDir := i < len(ap)-1 || a.isDir()
+		bDir := i < len(bp)-1 || b.isDir()
+		if aDir != bDir {
+			return bDir
+		}
+		if ap[i] != bp[i] {
+			return ap[i] < bp[i]
+		}
+	}
+	return len(ap) < len(bp)
+}
+
+// rsyncFlistOptions are the options that change the file list format
+type rsyncFlistOptions struct {
+	preserveUID      bool
+	preserveGID      bool
+	preserveLinks    bool
+	preserveDevices  bool
+	preserveSpecials bool
+	numericIDs       bool
+}
+
+// sendFileList writes the file list, the terminator and the id lists.
+func (c *rsyncConn) sendFileList(files []*rsyncFile, opts rsyncFlistOptions) error {
+	lastName := ""
+	for _, f := range files {
+		xflags := 0
+		if f.topDir && f.isDir() {
+			xflags |= rsyncXmitTopDir
+		}
+
+		// only the name prefix is compressed, every other field is always sent in full
+		prefix := 0
+		for prefix < len(lastName) && prefix < len(f.name) && prefix < 255 && lastName[prefix] == f.name[prefix] {
+			prefix++
+		}
+		if prefix > 0 {
+			xflags |= rsyncXmitSameName
+		}
+		suffix := f.name[prefix:]
+		if len(suffix) > 255 {
+			xflags |= rsyncXmitLongName
+		}
+
+		if c.protocol >= 28 {
+			if xflags == 0 && !f.isDir() {
+				xflags |= rsyncXmitTopDir
+			}
+			if xflags&0xFF00 != 0 || xflags == 0 {
+				xflags |= rsyncXmitExtendedFlags
+				if err := c.writeShortInt(xflags); err != nil {
+					return err
+				}
+			} else if err := c.writeByte(byte(xflags)); err != nil {
+				return err
+			}
+		} else {
+			if xflags&0xFF == 0 {
+				if f.isDir() {
+					xflags |= rsyncXmitLongName
+				} else {
+					xflags |= rsyncXmitTopDir
+				}
+			}
+			if err := c.writeByte(byte(xflags)); err != nil {
+				return err
+			}
+		}
+
+		if xflags&rsyncXmitSameName != 0 {
+			if err := c.writeByte(byte(prefix)); err != nil {
+				return err
+			}
+		}
+		var err error
+		if xflags&rsyncXmitLongName != 0 {
+			err = c.writeVarInt30(int32(len(suffix)))
+		} else {
+			err = c.writeByte(byte(len(suffix)))
+		}
+		if err != nil {
+			return err
+		}
+		if _, err = c.Write([]byte(suffix)); err != nil {
+			return err
+		}
+
+		if err = c.writeVarLong30(f.size, 3); err != nil {
+			return err
+		}
+		if c.protocol >= 30 {
+			err = c.writeVarLong(f.modTime, 4)
+		} else {
+			err = c.writeInt(int32(f.modTime))
+		}
+		if err != nil {
+			return err
+		}
+		if err = c.writeInt(int32(f.mode)); err != nil {
+			return err
+		}
+		if opts.preserveUID {
+			if err = c.writeVarInt30(f.uid); err != nil {
+				return err
+			}
+		}
+		if opts.preserveGID {
+			if err = c.writeVarInt30(f.gid); err != nil {
+				return err
+			}
+		}
+		if opts.preserveLinks && f.isSymlink() {
+			if err = c.writeVarInt30(int32(len(f.link))); err != nil {
+				return err
+			}
+			if _, err = c.Write([]byte(f.link)); err != nil {
+				return err
+			}
+		}
+		lastName = f.name
+	}
+
+	// end of the list
+	if err := c.writeByte(0); err != nil {
+		return err
+	}
+
+	// the user and group names lists, no names are sent so the ids are used as they are
+	if opts.preserveUID && !opts.numericIDs {
+		if err := c.writeVarInt30(0); err != nil {
+			return err
+		}
+	}
+	if opts.preserveGID && !opts.numericIDs {
+		if err := c.writeVarInt30(0); err != nil {
+			return err
+		}
+	}
+	// the io error flag
+	if c.protocol < 30 {
+		return c.writeInt(0)
+	}
+	return nil
+}
+
+// recvFileList reads the file list, the id lists and the io error flag sent by the client
+func (c *rsyncConn) recvFileList(opts rsyncFlistOptions) ([]*rsyncFile, error) {
+	var files []*rsyncFile
+	var last rsyncFile
+
+	for {
+		b, err := c.readByte()
+		if err != nil {
+			return nil, err
+		}
+		if b == 0 {
+			break
+		}
+		xflags := int(b)
+		if c.protocol >= 28 && xflags&rsyncXmitExtendedFlags != 0 {
+			b, err = c.readByte()
+			if err != nil {
+				return nil, err
+			}
+			xflags |= int(b) << 8
+		}
+		if xflags&rsyncXmitHLinked != 0 && c.protocol >= 28 {
+			return nil, errors.New("rsync hard links are not supported")
+		}
+
+		f := &rsyncFile{}
+		prefix := 0
+		if xflags&rsyncXmitSameName != 0 {
+			b, err = c.readByte()
+			if err != nil {
+				return nil, err
+			}
+			prefix = int(b)
+		}
+		var suffix int
+		if xflags&rsyncXmitLongName != 0 {
+			n, err := c.readVarInt30()
+			if err != nil {
+				return nil, err
+			}
+			suffix = int(n)
+		} else {
+			b, err = c.readByte()
+			if err != nil {
+				return nil, err
+			}
+			suffix = int(b)
+		}
+		if prefix > len(last.name) || suffix < 0 || prefix+suffix > 4096 {
+			return nil, errors.New("rsync protocol error: invalid file name length")
+		}
+		name := make([]byte, prefix+suffix)
+		copy(name, last.name[:prefix])
+		if err = c.readFull(name[prefix:]); err != nil {
+			return nil, err
+		}
+		f.name = string(name)
+
+		if f.size, err = c.readVarLong30(3); err != nil {
+			return nil, err
+		}
+		if xflags&rsyncXmitSameTime != 0 {
+			f.modTime = last.modTime
+		} else if c.protocol >= 30 {
+			if f.modTime, err = c.readVarLong(4); err != nil {
+				return nil, err
+			}
+		} else {
+			t, err := c.readInt()
+			if err != nil {
+				return nil, err
+			}
+			f.modTime = int64(t)
+		}
+		if c.protocol >= 31 && xflags&rsyncXmitModNsec != 0 {
+			if _, err = c.readVarInt(); err != nil {
+				return nil, err
+			}
+		}
+		if xflags&rsyncXmitSameMode != 0 {
+			f.mode = last.mode
+		} else {
+			m, err := c.readInt()
+			if err != nil {
+				return nil, err
+			}
+			f.mode = uint32(m)
+		}
+		// the top dir flag is only meaningful for directories, it fills empty flags of other files
+		f.topDir = xflags&rsyncXmitTopDir != 0 && f.isDir()
+		f.uid, f.gid = last.uid, last.gid
+		if opts.preserveUID && xflags&rsyncXmitSameUID == 0 {
+			if f.uid, err = c.readVarInt30(); err != nil {
+				return nil, err
+			}
+			if c.protocol >= 30 && xflags&rsyncXmitUserName != 0 {
+				if _, err = c.readVString(); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if opts.preserveGID && xflags&rsyncXmitSameGID == 0 {
+			if f.gid, err = c.readVarInt30(); err != nil {
+				return nil, err
+			}
+			if c.protocol >= 30 && xflags&rsyncXmitGroupName != 0 {
+				if _, err = c.readVString(); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if (opts.preserveDevices && f.isDevice()) || (opts.preserveSpecials && f.isSpecial() && c.protocol < 31) {
+			// devices are never created, the numbers are read to keep the stream in sync
+			if c.protocol < 28 {
+				if xflags&rsyncXmitSameRdevPre28 == 0 {
+					if _, err = c.readInt(); err != nil {
+						return nil, err
+					}
+				}
+			} else {
+				if xflags&rsyncXmitSameRdevMajor == 0 {
+					if _, err = c.readVarInt30(); err != nil {
+						return nil, err
+					}
+				}
+				switch {
+				case c.protocol >= 30:
+					_, err = c.readVarInt()
+				case xflags&rsyncXmitRdevMinor8 != 0:
+					_, err = c.readByte()
+				default:
+					_, err = c.readInt()
+				}
+				if err != nil {
+					return nil, err
+				}
+			}
+			if f.isSpecial() {
+				f.size = 0
+			}
+		}
+		if opts.preserveLinks && f.isSymlink() {
+			n, err := c.readVarInt30()
+			if err != nil {
+				return nil, err
+			}
+			if n < 0 || n > 4096 {
+				return nil, errors.New("rsync protocol error: invalid symlink length")
+			}
+			link := make([]byte, n)
+			if err = c.readFull(link); err != nil {
+				return nil, err
+			}
+			f.link = string(link)
+		}
+
+		if err = validRsyncName(f.name); err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+		last = *f
+	}
+
+	if opts.preserveUID && !opts.numericIDs {
+		if err := c.skipIDList(); err != nil {
+			return nil, err
+		}
+	}
+	if opts.preserveGID && !opts.numericIDs {
+		if err := c.skipIDList(); err != nil {
+			return nil, err
+		}
+	}
+	if c.protocol < 30 {
+		ioError, err := c.readInt()
+		if err != nil {
+			return nil, err
+		}
+		if ioError != 0 {
+			c.logger.Warn("rsync client reported io errors while building the file list", "io_error", ioError)
+		}
+	}
+	return files, nil
+}
+
+// skipIDList reads a user or group id to name list, names are not mapped since the files don't have owners
+func (c *rsyncConn) skipIDList() error {
+	for {
+		id, err := c.readVarInt30()
+		if err != nil {
+			return err
+		}
+		if id == 0 {
+			return nil
+		}
+		l, err := c.readByte()
+		if err != nil {
+			return err
+		}
+		if err = c.readFull(make([]byte, l)); err != nil {
+			return err
+		}
+	}
+}
+
+// validRsyncName rejects names that would escape the transfer root
+func validRsyncName(name string) error {
+	if name == "" || strings.HasPrefix(name, "/") {
+		return fmt.Errorf("rsync protocol error: invalid file name %q", name)
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return fmt.Errorf("rsync protocol error: invalid file name %q", name)
+		}
+	}
+	return nil
+}
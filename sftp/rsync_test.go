@@ -0,0 +1,223 @@
+package sftp
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/telebroad/fileserver/filesystem"
+)
+
+type rsyncTestConn struct {
+	io.Reader
+	out *bytes.Buffer
+}
+
+func (c rsyncTestConn) Write(p []byte) (int, error) {
+	return c.out.Write(p)
+}
+
+// newRsyncTestPair returns a writer and a reader connected through a buffer
+func newRsyncTestPair(protocol int) (w *rsyncConn, r func() *rsyncConn) {
+	buf := &bytes.Buffer{}
+	w = newRsyncConn(rsyncTestConn{Reader: &bytes.Buffer{}, out: buf}, slog.Default())
+	w.protocol = protocol
+	return w, func() *rsyncConn {
+		w.Flush()
+		c := newRsyncConn(rsyncTestConn{Reader: buf, out: &bytes.Buffer{}}, slog.Default())
+		c.protocol = protocol
+		return c
+	}
+}
+
+func Test_rsyncVarInt(t *testing.T) {
+	known := map[int32][]byte{
+		0:   {0x00},
+		127: {0x7F},
+		128: {0x80, 0x80},
+		-1:  {0xF0, 0xFF, 0xFF, 0xFF, 0xFF},
+	}
+	for n, want := range known {
+		w, r := newRsyncTestPair(30)
+		w.writeVarInt(n)
+		w.Flush()
+		got, err := r().readVarInt()
+		if err != nil || got != n {
+			t.Fatalf("varint %d round trip: got %d, %v", n, got, err)
+		}
+		w2, _ := newRsyncTestPair(30)
+		buf := &bytes.Buffer{}
+		w2 = newRsyncConn(rsyncTestConn{Reader: buf, out: buf}, slog.Default())
+		w2.writeVarInt(n)
+		w2.Flush()
+		if !bytes.Equal(buf.Bytes(), want) {
+			t.Fatalf("varint %d encoded as %x, want %x", n, buf.Bytes(), want)
+		}
+	}
+
+	values := []int64{0, 1, 255, 256, 1 << 20, 1<<31 - 1, 1 << 32, 1<<40 + 7, 1<<62 + 3}
+	for _, protocol := range []int{29, 30} {
+		w, r := newRsyncTestPair(protocol)
+		for _, v := range values {
+			w.writeVarLong30(v, 3)
+			w.writeVarInt30(int32(v))
+		}
+		rc := r()
+		for _, v := range values {
+			got, err := rc.readVarLong30(3)
+			if err != nil || got != v {
+				t.Fatalf("protocol %d varlong %d: got %d, %v", protocol, v, got, err)
+			}
+			got32, err := rc.readVarInt30()
+			if err != nil || got32 != int32(v) {
+				t.Fatalf("protocol %d varint %d: got %d, %v", protocol, int32(v), got32, err)
+			}
+		}
+	}
+}
+
+func Test_rsyncNdx(t *testing.T) {
+	ndxs := []int32{0, 1, 2, 5, 300, 299, 70000, 3, rsyncNdxDone, -101, 4, rsyncNdxDone}
+	for _, protocol := range []int{29, 30, 31} {
+		w, r := newRsyncTestPair(protocol)
+		for _, n := range ndxs {
+			w.writeNdx(n)
+		}
+		rc := r()
+		for _, n := range ndxs {
+			got, err := rc.readNdx()
+			if err != nil || got != n {
+				t.Fatalf("protocol %d ndx %d: got %d, %v", protocol, n, got, err)
+			}
+		}
+	}
+}
+
+func Test_rsyncFileList(t *testing.T) {
+	files := []*rsyncFile{
+		{name: ".", mode: rsyncModeDir | 0o755, modTime: 1700000000, topDir: true},
+		{name: "a.wav", mode: rsyncModeRegular | 0o644, size: 1 << 33, modTime: 1700000001},
+		{name: "sub", mode: rsyncModeDir | 0o700, modTime: 1700000002},
+		{name: "sub/b.wav", mode: rsyncModeRegular | 0o600, size: 12, modTime: 1700000003, uid: 1000, gid: 1000},
+	}
+	opts := rsyncFlistOptions{preserveUID: true, preserveGID: true, preserveLinks: true}
+	for protocol := rsyncMinProtocol; protocol <= rsyncMaxProtocol; protocol++ {
+		w, r := newRsyncTestPair(protocol)
+		if err := w.sendFileList(files, opts); err != nil {
+			t.Fatal(err)
+		}
+		got, err := r().recvFileList(opts)
+		if err != nil {
+			t.Fatalf("protocol %d: %v", protocol, err)
+		}
+		if len(got) != len(files) {
+			t.Fatalf("protocol %d: got %d files, want %d", protocol, len(got), len(files))
+		}
+		for i := range files {
+			want := *files[i]
+			if protocol < 30 {
+				// protocol 29 sends the size as a longint, the time as an int
+				want.modTime = int64(int32(want.modTime))
+			}
+			if *got[i] != want {
+				t.Fatalf("protocol %d: file %d got %+v, want %+v", protocol, i, *got[i], want)
+			}
+		}
+	}
+}
+
+func Test_sortRsyncFiles(t *testing.T) {
+	files := []*rsyncFile{
+		{name: "sub", mode: rsyncModeDir},
+		{name: "sub/z", mode: rsyncModeRegular},
+		{name: "b", mode: rsyncModeRegular},
+		{name: ".", mode: rsyncModeDir},
+		{name: "sub/a", mode: rsyncModeDir},
+		{name: "sub/y", mode: rsyncModeRegular},
+		{name: "a", mode: rsyncModeDir},
+	}
+	sortRsyncFiles(files, 30)
+	var names []string
+	for _, f := range files {
+		names = append(names, f.name)
+	}
+	want := []string{".", "b", "a", "sub", "sub/y", "sub/z", "sub/a"}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Fatalf("got %v, want %v", names, want)
+		}
+	}
+}
+
+func Test_rsyncDelta(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	basis := make([]byte, 100_000)
+	rnd.Read(basis)
+	// the new version has an insertion, a deletion and a changed tail
+	data := append([]byte{}, basis[:30_000]...)
+	data = append(data, []byte("inserted data")...)
+	data = append(data, basis[31_000:90_000]...)
+	data = append(data, []byte("new tail")...)
+
+	for _, protocol := range []int{29, 30} {
+		dir := t.TempDir()
+		fs := filesystem.NewLocalFS(dir)
+		if err := os.WriteFile(filepath.Join(dir, "f.wav"), basis, 0644); err != nil {
+			t.Fatal(err)
+		}
+		cmd := &rsyncCommand{}
+
+		w, r := newRsyncTestPair(protocol)
+		generator := &rsyncSession{fs: fs, logger: slog.Default(), cmd: cmd, conn: w, seed: 1234}
+		head, sums := generator.blockSums("/f.wav", int64(len(basis)))
+		if head.count == 0 {
+			t.Fatal("expected block checksums")
+		}
+		generator.writeSumHead(head)
+		literal, err := generator.writeDelta(data, head, sums)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if literal > 3*rsyncBlockSize {
+			t.Fatalf("protocol %d: delta sent %d literal bytes", protocol, literal)
+		}
+		sum := generator.newFileSum()
+		sum.Write(data)
+		w.Write(sum.Sum(nil))
+
+		receiver := &rsyncSession{fs: fs, logger: slog.Default(), cmd: cmd, conn: r(), seed: 1234}
+		ok, err := receiver.receiveFile(&rsyncFile{name: "f.wav"}, "/f.wav")
+		if err != nil || !ok {
+			t.Fatalf("protocol %d: receive failed: %v %v", protocol, ok, err)
+		}
+		got, _ := os.ReadFile(filepath.Join(dir, "f.wav"))
+		if !bytes.Equal(got, data) {
+			t.Fatalf("protocol %d: the rebuilt file doesn't match", protocol)
+		}
+	}
+}
+
+func Test_parseRsyncCommand(t *testing.T) {
+	cmd, err := parseRsyncCommand("rsync --server --sender -vlogDtpre.iLsfxCIvu . /recordings/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cmd.sender || !cmd.recursive || !cmd.preserveTimes || len(cmd.paths) != 1 || cmd.paths[0] != "/recordings/" {
+		t.Fatalf("unexpected command %+v", cmd)
+	}
+	for _, bad := range []string{
+		"rsync --server -vlogDtpre.iLsfxCIvu --delete . /dst",
+		"rsync --server -vlHogDtpr . /dst",
+		"rsync --server -vz . /dst",
+		"rsync --server -r . /a /b",
+		"rsync -r . /dst",
+	} {
+		if _, err = parseRsyncCommand(bad); err == nil {
+			t.Fatalf("expected %q to be rejected", bad)
+		}
+	}
+}
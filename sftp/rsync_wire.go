@@ -0,0 +1,447 @@
+package sftp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+)
+
+// rsync multiplexed message tags, the tag is added to rsyncMplexBase in the high byte of the frame header
+const (
+	rsyncMplexBase = 7
+
+	rsyncMsgData    = 0
+	rsyncMsgErrXfer = 1
+	rsyncMsgInfo    = 2
+	rsyncMsgError   = 3
+	rsyncMsgWarning = 4
+)
+
+// rsync file list indexes with a special meaning
+const (
+	rsyncNdxDone = -1
+)
+
+// rsyncIntByteExtra is the number of extra bytes following the first byte of a varint, indexed by the first byte / 4
+var rsyncIntByteExtra = [64]int{
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+	2, 2, 2, 2, 2, 2, 2, 2, 3, 3, 3, 3, 4, 4, 5, 6,
+}
+
+// rsyncConn reads and writes the rsync wire format, all the integers are little endian.
+// the output is multiplexed once multiplexOut is called, and the input once multiplexIn is called.
+type rsyncConn struct {
+	protocol int
+	logger   *slog.Logger
+
+	r        *bufio.Reader
+	inMplex  bool
+	inRemain int
+
+	wmu      sync.Mutex
+	w        *bufio.Writer
+	outMplex bool
+
+	// the read and write indexes state, the protocol 30 index encoding is relative to the previous index
+	readPrevPositive, readPrevNegative   int32
+	writePrevPositive, writePrevNegative int32
+}
+
+func newRsyncConn(rw io.ReadWriter, logger *slog.Logger) *rsyncConn {
+	return &rsyncConn{
+		logger:            logger,
+		r:                 bufio.NewReaderSize(rw, 32*1024),
+		w:                 bufio.NewWriterSize(rw, 32*1024),
+		readPrevPositive:  -1,
+		readPrevNegative:  1,
+		writePrevPositive: -1,
+		writePrevNegative: 1,
+	}
+}
+
+// multiplexOut frames all the following writes as MSG_DATA messages
+func (c *rsyncConn) multiplexOut() {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.outMplex = true
+}
+
+// multiplexIn expects all the following reads to be framed
+func (c *rsyncConn) multiplexIn() {
+	c.inMplex = true
+}
+
+// Read reads the data stream, messages that aren't MSG_DATA are logged and skipped
+func (c *rsyncConn) Read(p []byte) (int, error) {
+	if !c.inMplex {
+		return c.r.Read(p)
+	}
+	for c.inRemain == 0 {
+		var header [4]byte
+		if _, err := io.ReadFull(c.r, header[:]); err != nil {
+			return 0, err
+		}
+		tag := int(header[3]) - rsyncMplexBase
+		size := int(binary.LittleEndian.Uint32(header[:]) & 0xFFFFFF)
+		if tag == rsyncMsgData {
+			c.inRemain = size
+			continue
+		}
+		msg := make([]byte, size)
+		if _, err := io.ReadFull(c.r, msg); err != nil {
+			return 0, err
+		}
+		switch tag {
+		case rsyncMsgInfo:
+			c.logger.Debug("rsync client info", "message", string(msg))
+		case rsyncMsgErrXfer, rsyncMsgError, rsyncMsgWarning:
+			c.logger.Warn("rsync client message", "tag", tag, "message", string(msg))
+		default:
+			c.logger.Debug("rsync client message ignored", "tag", tag, "size", size)
+		}
+	}
+	if len(p) > c.inRemain {
+		p = p[:c.inRemain]
+	}
+	n, err := c.r.Read(p)
+	c.inRemain -= n
+	return n, err
+}
+
+// Write writes to the data stream
+func (c *rsyncConn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if !c.outMplex {
+		return c.w.Write(p)
+	}
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > 0xFFFFFF {
+			chunk = chunk[:0xFFFFFF]
+		}
+		if err := c.writeFrame(rsyncMsgData, chunk); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+func (c *rsyncConn) writeFrame(tag int, p []byte) error {
+	var header [4]byte
+	binary.LittleEndian.PutUint32(header[:], uint32(rsyncMplexBase+tag)<<24|uint32(len(p)))
+	if _, err := c.w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := c.w.Write(p)
+	return err
+}
+
+// sendMessage sends an out of band message to the client, it's only possible when the output is multiplexed
+func (c *rsyncConn) sendMessage(tag int, msg string) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if !c.outMplex {
+		return errors.New("rsync output is not multiplexed")
+	}
+	if err := c.writeFrame(tag, []byte(msg)); err != nil {
+		return err
+	}
+	return c.w.Flush()
+}
+
+// Flush flushes the buffered output
+func (c *rsyncConn) Flush() error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.w.Flush()
+}
+
+func (c *rsyncConn) readFull(p []byte) error {
+	_, err := io.ReadFull(c, p)
+	if err != nil {
+		return fmt.Errorf("rsync read error: %w", err)
+	}
+	return nil
+}
+
+func (c *rsyncConn) readByte() (byte, error) {
+	var b [1]byte
+	err := c.readFull(b[:])
+	return b[0], err
+}
+
+func (c *rsyncConn) readShortInt() (int, error) {
+	var b [2]byte
+	err := c.readFull(b[:])
+	return int(binary.LittleEndian.Uint16(b[:])), err
+}
+
+func (c *rsyncConn) readInt() (int32, error) {
+	var b [4]byte
+	err := c.readFull(b[:])
+	return int32(binary.LittleEndian.Uint32(b[:])), err
+}
+
+// readLongInt reads a 64bit integer in the pre protocol 30 format
+func (c *rsyncConn) readLongInt() (int64, error) {
+	n, err := c.readInt()
+	if err != nil || n != -1 {
+		return int64(n), err
+	}
+	var b [8]byte
+	err = c.readFull(b[:])
+	return int64(binary.LittleEndian.Uint64(b[:])), err
+}
+
+func (c *rsyncConn) readVarInt() (int32, error) {
+	ch, err := c.readByte()
+	if err != nil {
+		return 0, err
+	}
+	var b [5]byte
+	extra := rsyncIntByteExtra[ch/4]
+	if extra == 0 {
+		b[0] = ch
+	} else {
+		if extra >= 5 {
+			return 0, errors.New("rsync protocol error: overflow in varint")
+		}
+		bit := byte(1) << (8 - extra)
+		if err = c.readFull(b[:extra]); err != nil {
+			return 0, err
+		}
+		b[extra] = ch & (bit - 1)
+	}
+	return int32(binary.LittleEndian.Uint32(b[:4])), nil
+}
+
+func (c *rsyncConn) readVarLong(minBytes int) (int64, error) {
+	var b2 [8]byte
+	if err := c.readFull(b2[:minBytes]); err != nil {
+		return 0, err
+	}
+	var b [9]byte
+	copy(b[:], b2[1:minBytes])
+	ch := b2[0]
+	extra := rsyncIntByteExtra[ch/4]
+	if extra == 0 {
+		b[minBytes-1] = ch
+	} else {
+		if minBytes+extra > 9 {
+			return 0, errors.New("rsync protocol error: overflow in varlong")
+		}
+		bit := byte(1) << (8 - extra)
+		if err := c.readFull(b[minBytes-1 : minBytes-1+extra]); err != nil {
+			return 0, err
+		}
+		b[minBytes+extra-1] = ch & (bit - 1)
+	}
+	return int64(binary.LittleEndian.Uint64(b[:8])), nil
+}
+
+// readVarInt30 reads an int in the format of the negotiated protocol
+func (c *rsyncConn) readVarInt30() (int32, error) {
+	if c.protocol < 30 {
+		return c.readInt()
+	}
+	return c.readVarInt()
+}
+
+// readVarLong30 reads a long in the format of the negotiated protocol
+func (c *rsyncConn) readVarLong30(minBytes int) (int64, error) {
+	if c.protocol < 30 {
+		return c.readLongInt()
+	}
+	return c.readVarLong(minBytes)
+}
+
+// readNdx reads a file list index
+func (c *rsyncConn) readNdx() (int32, error) {
+	if c.protocol < 30 {
+		return c.readInt()
+	}
+	var b [4]byte
+	if err := c.readFull(b[:1]); err != nil {
+		return 0, err
+	}
+	prev := &c.readPrevPositive
+	if b[0] == 0xFF {
+		if err := c.readFull(b[:1]); err != nil {
+			return 0, err
+		}
+		prev = &c.readPrevNegative
+	} else if b[0] == 0 {
+		return rsyncNdxDone, nil
+	}
+
+	var num int32
+	if b[0] == 0xFE {
+		if err := c.readFull(b[:2]); err != nil {
+			return 0, err
+		}
+		if b[0]&0x80 != 0 {
+			b[3] = b[0] &^ 0x80
+			b[0] = b[1]
+			if err := c.readFull(b[1:3]); err != nil {
+				return 0, err
+			}
+			num = int32(binary.LittleEndian.Uint32(b[:]))
+		} else {
+			num = int32(b[0])<<8 + int32(b[1]) + *prev
+		}
+	} else {
+		num = int32(b[0]) + *prev
+	}
+	*prev = num
+	if prev == &c.readPrevNegative {
+		num = -num
+	}
+	return num, nil
+}
+
+// readVString reads a string prefixed with its length in one or two bytes
+func (c *rsyncConn) readVString() (string, error) {
+	l, err := c.readByte()
+	if err != nil {
+		return "", err
+	}
+	size := int(l)
+	if l&0x80 != 0 {
+		l2, err := c.readByte()
+		if err != nil {
+			return "", err
+		}
+		size = int(l&0x7F)<<8 + int(l2)
+	}
+	buf := make([]byte, size)
+	err = c.readFull(buf)
+	return string(buf), err
+}
+
+func (c *rsyncConn) writeByte(b byte) error {
+	_, err := c.Write([]byte{b})
+	return err
+}
+
+func (c *rsyncConn) writeShortInt(n int) error {
+	var b [2]byte
+	binary.LittleEndian.PutUint16(b[:], uint16(n))
+	_, err := c.Write(b[:])
+	return err
+}
+
+func (c *rsyncConn) writeInt(n int32) error {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], uint32(n))
+	_, err := c.Write(b[:])
+	return err
+}
+
+// writeLongInt writes a 64bit integer in the pre protocol 30 format
+func (c *rsyncConn) writeLongInt(n int64) error {
+	if n >= 0 && n <= 0x7FFFFFFF {
+		return c.writeInt(int32(n))
+	}
+	var b [12]byte
+	binary.LittleEndian.PutUint32(b[:4], 0xFFFFFFFF)
+	binary.LittleEndian.PutUint64(b[4:], uint64(n))
+	_, err := c.Write(b[:])
+	return err
+}
+
+func (c *rsyncConn) writeVarInt(n int32) error {
+	var b [5]byte
+	binary.LittleEndian.PutUint32(b[1:], uint32(n))
+	cnt := 4
+	for cnt > 1 && b[cnt] == 0 {
+		cnt--
+	}
+	bit := byte(1) << (7 - cnt + 1)
+	if b[cnt] >= bit {
+		cnt++
+		b[0] = ^(bit - 1)
+	} else if cnt > 1 {
+		b[0] = b[cnt] | ^(bit*2 - 1)
+	} else {
+		b[0] = b[cnt]
+	}
+	_, err := c.Write(b[:cnt])
+	return err
+}
+
+func (c *rsyncConn) writeVarLong(n int64, minBytes int) error {
+	var b [9]byte
+	binary.LittleEndian.PutUint64(b[1:], uint64(n))
+	cnt := 8
+	for cnt > minBytes && b[cnt] == 0 {
+		cnt--
+	}
+	bit := byte(1) << (7 - cnt + minBytes)
+	if b[cnt] >= bit {
+		cnt++
+		b[0] = ^(bit - 1)
+	} else if cnt > minBytes {
+		b[0] = b[cnt] | ^(bit*2 - 1)
+	} else {
+		b[0] = b[cnt]
+	}
+	_, err := c.Write(b[:cnt])
+	return err
+}
+
+// writeVarInt30 writes an int in the format of the negotiated protocol
+func (c *rsyncConn) writeVarInt30(n int32) error {
+	if c.protocol < 30 {
+		return c.writeInt(n)
+	}
+	return c.writeVarInt(n)
+}
+
+// writeVarLong30 writes a long in the format of the negotiated protocol
+func (c *rsyncConn) writeVarLong30(n int64, minBytes int) error {
+	if c.protocol < 30 {
+		return c.writeLongInt(n)
+	}
+	return c.writeVarLong(n, minBytes)
+}
+
+// writeNdx writes a file list index
+func (c *rsyncConn) writeNdx(ndx int32) error {
+	if c.protocol < 30 {
+		return c.writeInt(ndx)
+	}
+	var b []byte
+	var diff int32
+	if ndx >= 0 {
+		diff = ndx - c.writePrevPositive
+		c.writePrevPositive = ndx
+	} else if ndx == rsyncNdxDone {
+		return c.writeByte(0)
+	} else {
+		b = append(b, 0xFF)
+		ndx = -ndx
+		diff = ndx - c.writePrevNegative
+		c.writePrevNegative = ndx
+	}
+
+	switch {
+	case diff > 0 && diff < 0xFE:
+		b = append(b, byte(diff))
+	case diff < 0 || diff > 0x7FFF:
+		b = append(b, 0xFE, byte(ndx>>24)|0x80, byte(ndx), byte(ndx>>8), byte(ndx>>16))
+	default:
+		b = append(b, 0xFE, byte(diff>>8), byte(diff))
+	}
+	_, err := c.Write(b)
+	return err
+}
@@ -0,0 +1,499 @@
+package sftp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/telebroad/fileserver/filesystem"
+	"io"
+	"io/fs"
+	"log/slog"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// scpCommand is a parsed legacy scp command line, only the flags that the remote side of scp receives are supported
+// -t sink mode (the client uploads), -f source mode (the client downloads)
+// -r recursive, -p preserve modification time and mode, -d the target must be a directory, -v verbose (ignored)
+type scpCommand struct {
+	sink      bool
+	source    bool
+	recursive bool
+	preserve  bool
+	targetDir bool
+	path      string
+}
+
+// parseSCPCommand parses the command sent with an exec request, it returns an error for every command that isn't scp
+func parseSCPCommand(command string) (*scpCommand, error) {
+	args, err := splitShellWords(command)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 || path.Base(args[0]) != "scp" {
+		return nil, fmt.Errorf("command not allowed: %q", command)
+	}
+
+	cmd := &scpCommand{}
+	i := 1
+	for ; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			i++
+			break
+		}
+		if len(arg) < 2 || arg[0] != '-' {
+			break
+		}
+		for _, flag := range arg[1:] {
+			switch flag {
+			case 't':
+				cmd.sink = true
+			case 'f':
+				cmd.source = true
+			case 'r':
+				cmd.recursive = true
+			case 'p':
+				cmd.preserve = true
+			case 'd':
+				cmd.targetDir = true
+			case 'v':
+			default:
+				return nil, fmt.Errorf("scp option not allowed: -%c", flag)
+			}
+		}
+	}
+
+	if cmd.sink == cmd.source {
+		return nil, errors.New("scp requires exactly one of -t or -f")
+	}
+	if len(args)-i != 1 {
+		return nil, errors.New("scp requires exactly one path")
+	}
+	cmd.path = path.Join("/", args[i])
+	return cmd, nil
+}
+
+// splitShellWords splits a command line into words, it understands single quotes, double quotes and backslash escapes
+// but no other shell syntax, nothing is ever passed to a shell
+func splitShellWords(line string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+	escaped := false
+
+	for _, r := range line {
+		switch {
+		case escaped:
+			word.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+			inWord = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inWord = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		case strings.ContainsRune("|&;<>()$`*?[]{}~", r):
+			return nil, fmt.Errorf("unsupported shell character %q in command", r)
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if escaped || quote != 0 {
+		return nil, errors.New("unterminated quote or escape in command")
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// scpSession runs the scp protocol over an ssh channel against the session file system
+type scpSession struct {
+	fs     filesystem.FSWithReadWriteAt
+	logger *slog.Logger
+	cmd    *scpCommand
+	r      *bufio.Reader
+	w      io.Writer
+}
+
+func newSCPSession(fs filesystem.FSWithReadWriteAt, logger *slog.Logger, cmd *scpCommand, rw io.ReadWriter) *scpSession {
+	return &scpSession{
+		fs:     fs,
+		logger: logger.With("scp-path", cmd.path),
+		cmd:    cmd,
+		r:      bufio.NewReader(rw),
+		w:      rw,
+	}
+}
+
+// Run runs the sink or the source side of the protocol
+func (s *scpSession) Run() error {
+	if s.cmd.sink {
+		return s.receive()
+	}
+	return s.send()
+}
+
+// ack sends a success response to the client
+func (s *scpSession) ack() error {
+	_, err := s.w.Write([]byte{0})
+	return err
+}
+
+// warn sends a non-fatal error to the client, the transfer of the other files continues
+func (s *scpSession) warn(err error) error {
+	s.logger.Warn("scp warning", "error", err)
+	_, werr := fmt.Fprintf(s.w, "\x01scp: %s\n", err.Error())
+	return werr
+}
+
+// fatal sends a fatal error to the client and returns the error
+func (s *scpSession) fatal(err error) error {
+	s.logger.Error("scp error", "error", err)
+	fmt.Fprintf(s.w, "\x02scp: %s\n", err.Error())
+	return err
+}
+
+// readAck reads the client response to a control line or a file
+func (s *scpSession) readAck() error {
+	b, err := s.r.ReadByte()
+	if err != nil {
+		return fmt.Errorf("error reading scp response: %w", err)
+	}
+	if b == 0 {
+		return nil
+	}
+	msg, _ := s.r.ReadString('\n')
+	return fmt.Errorf("scp client error: %s", strings.TrimSpace(msg))
+}
+
+// receive implements `scp -t`, the client sends files and directories to the server
+func (s *scpSession) receive() error {
+	targetIsDir := s.fs.CheckDir(s.cmd.path) == nil
+	if s.cmd.targetDir && !targetIsDir {
+		return s.fatal(fmt.Errorf("%s: not a directory", s.cmd.path))
+	}
+	if err := s.ack(); err != nil {
+		return err
+	}
+
+	// dirs is the stack of the directories opened with D and not closed with E yet
+	var dirs []string
+	destination := func(name string) string {
+		if len(dirs) > 0 {
+			return path.Join(dirs[len(dirs)-1], name)
+		}
+		if targetIsDir {
+			return path.Join(s.cmd.path, name)
+		}
+		return s.cmd.path
+	}
+
+	var modTime time.Time
+	for {
+		line, err := s.r.ReadString('\n')
+		if err == io.EOF && line == "" {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error reading scp control line: %w", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return s.fatal(errors.New("protocol error: empty control line"))
+		}
+
+		switch line[0] {
+		case 0x01, 0x02:
+			s.logger.Warn("scp client reported an error", "message", line[1:])
+			if line[0] == 0x02 {
+				return fmt.Errorf("scp client error: %s", line[1:])
+			}
+		case 'T':
+			var mtime, mtimeUsec, atime, atimeUsec int64
+			_, err = fmt.Sscanf(line, "T%d %d %d %d", &mtime, &mtimeUsec, &atime, &atimeUsec)
+			if err != nil {
+				return s.fatal(fmt.Errorf("protocol error: invalid time line %q", line))
+			}
+			modTime = time.Unix(mtime, 0)
+			if err = s.ack(); err != nil {
+				return err
+			}
+		case 'C', 'D':
+			mode, size, name, err := parseSCPControlLine(line)
+			if err != nil {
+				return s.fatal(err)
+			}
+			target := destination(name)
+
+			if line[0] == 'D' {
+				if !s.cmd.recursive {
+					return s.fatal(errors.New("received directory without -r"))
+				}
+				if s.fs.CheckDir(target) != nil {
+					if err = s.fs.MakeDir(target); err != nil {
+						return s.fatal(fmt.Errorf("%s: %w", target, err))
+					}
+				}
+				dirs = append(dirs, target)
+				s.setAttributes(target, mode, modTime)
+				modTime = time.Time{}
+				if err = s.ack(); err != nil {
+					return err
+				}
+				continue
+			}
+
+			if err = s.ack(); err != nil {
+				return err
+			}
+			writeErr := s.receiveFile(target, size)
+			// the client terminates the file data with a null byte
+			if err = s.readAck(); err != nil {
+				return err
+			}
+			if writeErr != nil {
+				if err = s.warn(fmt.Errorf("%s: %w", target, writeErr)); err != nil {
+					return err
+				}
+				modTime = time.Time{}
+				continue
+			}
+			s.setAttributes(target, mode, modTime)
+			modTime = time.Time{}
+			if err = s.ack(); err != nil {
+				return err
+			}
+		case 'E':
+			if len(dirs) == 0 {
+				return s.fatal(errors.New("protocol error: unexpected end of directory"))
+			}
+			dirs = dirs[:len(dirs)-1]
+			if err = s.ack(); err != nil {
+				return err
+			}
+		default:
+			return s.fatal(fmt.Errorf("protocol error: unknown control line %q", line))
+		}
+	}
+}
+
+// receiveFile writes exactly size bytes from the client to the file, on error the remaining bytes are discarded
+// so the protocol stays in sync
+func (s *scpSession) receiveFile(target string, size int64) error {
+	data := &io.LimitedReader{R: s.r, N: size}
+	err := s.fs.WriteFile(target, data, "I", false)
+	if data.N > 0 {
+		n, copyErr := io.Copy(io.Discard, data)
+		if copyErr != nil || n < data.N {
+			return fmt.Errorf("unexpected end of file data: %w", io.ErrUnexpectedEOF)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	s.logger.Debug("scp file received", "file", target, "size", size)
+	return nil
+}
+
+// setAttributes applies the mode and the modification time when the client asked to preserve them
+func (s *scpSession) setAttributes(target string, mode fs.FileMode, modTime time.Time) {
+	if !s.cmd.preserve {
+		return
+	}
+	err := s.fs.SetStat(target, mode)
+	if err != nil {
+		s.logger.Debug("scp could not set mode", "file", target, "error", err)
+	}
+	if modTime.IsZero() {
+		return
+	}
+	err = s.fs.ModifyTime(target, modTime.UTC().Format("20060102150405"))
+	if err != nil {
+		s.logger.Debug("scp could not set modification time", "file", target, "error", err)
+	}
+}
+
+// parseSCPControlLine parses a `C0644 size name` or `D0755 0 name` line
+func parseSCPControlLine(line string) (fs.FileMode, int64, string, error) {
+	parts := strings.SplitN(line[1:], " ", 3)
+	if len(parts) != 3 {
+		return 0, 0, "", fmt.Errorf("protocol error: invalid control line %q", line)
+	}
+	mode, err := strconv.ParseUint(parts[0], 8, 32)
+	if err != nil {
+		return 0, 0, "", fmt.Errorf("protocol error: invalid mode %q", parts[0])
+	}
+	size, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || size < 0 {
+		return 0, 0, "", fmt.Errorf("protocol error: invalid size %q", parts[1])
+	}
+	name := parts[2]
+	if name == "" || name == "." || name == ".." || strings.ContainsRune(name, '/') {
+		return 0, 0, "", fmt.Errorf("protocol error: invalid file name %q", name)
+	}
+	return fs.FileMode(mode).Perm(), size, name, nil
+}
+
+// send implements `scp -f`, the server sends the file or the directory to the client
+func (s *scpSession) send() error {
+	// the client starts the transfer with a null byte
+	if err := s.readAck(); err != nil {
+		return err
+	}
+
+	_, info, err := s.fs.Stat(s.cmd.path)
+	if err != nil {
+		return s.fatal(fmt.Errorf("%s: no such file or directory", s.cmd.path))
+	}
+	if info.IsDir() {
+		if !s.cmd.recursive {
+			return s.fatal(fmt.Errorf("%s: not a regular file", s.cmd.path))
+		}
+		return s.sendDir(s.cmd.path, info)
+	}
+	return s.sendFile(s.cmd.path, info)
+}
+
+// sendTime sends the modification time line when the client asked to preserve it
+func (s *scpSession) sendTime(info fs.FileInfo) error {
+	if !s.cmd.preserve {
+		return nil
+	}
+	mtime := info.ModTime().Unix()
+	_, err := fmt.Fprintf(s.w, "T%d 0 %d 0\n", mtime, mtime)
+	if err != nil {
+		return err
+	}
+	return s.readAck()
+}
+
+func (s *scpSession) sendFile(name string, info fs.FileInfo) error {
+	if err := s.sendTime(info); err != nil {
+		return err
+	}
+	size := info.Size()
+	_, err := fmt.Fprintf(s.w, "C%04o %d %s\n", info.Mode().Perm(), size, path.Base(name))
+	if err != nil {
+		return err
+	}
+	if err = s.readAck(); err != nil {
+		return err
+	}
+
+	// the client expects exactly size bytes, a file that grew is cut and a file that shrank is padded
+	lw := &scpLimitWriter{w: s.w, n: size}
+	n, readErr := s.fs.ReadFile(name, lw)
+	if n < size {
+		if _, err = io.CopyN(lw, zeroReader{}, size-n); err != nil {
+			return err
+		}
+		if readErr == nil {
+			readErr = io.ErrUnexpectedEOF
+		}
+	}
+	if lw.err != nil {
+		return lw.err
+	}
+
+	if readErr != nil {
+		if err = s.warn(fmt.Errorf("%s: %w", name, readErr)); err != nil {
+			return err
+		}
+	} else if err = s.ack(); err != nil {
+		return err
+	}
+	if err = s.readAck(); err != nil {
+		return err
+	}
+	s.logger.Debug("scp file sent", "file", name, "size", size)
+	return nil
+}
+
+func (s *scpSession) sendDir(name string, info fs.FileInfo) error {
+	if err := s.sendTime(info); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(s.w, "D%04o 0 %s\n", info.Mode().Perm(), path.Base(name))
+	if err != nil {
+		return err
+	}
+	if err = s.readAck(); err != nil {
+		return err
+	}
+
+	_, entries, err := s.fs.Dir(name)
+	if err != nil {
+		if err = s.warn(fmt.Errorf("%s: %w", name, err)); err != nil {
+			return err
+		}
+	}
+	for _, entry := range entries {
+		child := path.Join(name, entry.Name())
+		switch {
+		case entry.IsDir():
+			err = s.sendDir(child, entry)
+		case entry.Mode().IsRegular():
+			err = s.sendFile(child, entry)
+		default:
+			s.logger.Debug("scp skipping special file", "file", child)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err = fmt.Fprintf(s.w, "E\n"); err != nil {
+		return err
+	}
+	return s.readAck()
+}
+
+// scpLimitWriter writes at most n bytes to w and silently discards the rest
+type scpLimitWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (l *scpLimitWriter) Write(p []byte) (int, error) {
+	if l.err != nil {
+		return 0, l.err
+	}
+	size := len(p)
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	if len(p) > 0 {
+		_, l.err = l.w.Write(p)
+		l.n -= int64(len(p))
+	}
+	if l.err != nil {
+		return 0, l.err
+	}
+	return size, nil
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
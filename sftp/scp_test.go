@@ -0,0 +1,118 @@
+package sftp
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/telebroad/fileserver/filesystem"
+)
+
+func Test_parseSCPCommand(t *testing.T) {
+	tests := []struct {
+		command string
+		want    *scpCommand
+		wantErr bool
+	}{
+		{command: "scp -t /upload", want: &scpCommand{sink: true, path: "/upload"}},
+		{command: "scp -r -p -f -- dir", want: &scpCommand{source: true, recursive: true, preserve: true, path: "/dir"}},
+		{command: "/usr/bin/scp -dt 'my files'", want: &scpCommand{sink: true, targetDir: true, path: "/my files"}},
+		{command: "scp -t ../../etc", want: &scpCommand{sink: true, path: "/etc"}},
+		{command: "scp -t a b", wantErr: true},
+		{command: "scp -t -f a", wantErr: true},
+		{command: "scp -S prog -t a", wantErr: true},
+		{command: "scp -t a; rm -rf /", wantErr: true},
+		{command: "ls -la", wantErr: true},
+		{command: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			got, err := parseSCPCommand(tt.command)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if *got != *tt.want {
+				t.Fatalf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+type scpTestConn struct {
+	io.Reader
+	out bytes.Buffer
+}
+
+func (c *scpTestConn) Write(p []byte) (int, error) {
+	return c.out.Write(p)
+}
+
+func Test_scpSession(t *testing.T) {
+	dir := t.TempDir()
+	fs := filesystem.NewLocalFS(dir)
+
+	t.Run("receive", func(t *testing.T) {
+		cmd, _ := parseSCPCommand("scp -r -t /")
+		conn := &scpTestConn{Reader: bytes.NewBufferString(
+			"D0755 0 sub\nC0644 5 a.txt\nhello\x00E\nC0600 3 b.txt\nabc\x00",
+		)}
+		err := newSCPSession(fs, slog.Default(), cmd, conn).Run()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got := conn.out.String(); got != "\x00\x00\x00\x00\x00\x00\x00" {
+			t.Fatalf("unexpected responses %q", got)
+		}
+		data, err := os.ReadFile(filepath.Join(dir, "sub", "a.txt"))
+		if err != nil || string(data) != "hello" {
+			t.Fatalf("sub/a.txt = %q, %v", data, err)
+		}
+		data, err = os.ReadFile(filepath.Join(dir, "b.txt"))
+		if err != nil || string(data) != "abc" {
+			t.Fatalf("b.txt = %q, %v", data, err)
+		}
+	})
+
+	t.Run("receive rejects path in name", func(t *testing.T) {
+		cmd, _ := parseSCPCommand("scp -t /")
+		conn := &scpTestConn{Reader: bytes.NewBufferString("C0644 5 ../a.txt\nhello\x00")}
+		err := newSCPSession(fs, slog.Default(), cmd, conn).Run()
+		if err == nil {
+			t.Fatal("expected an error")
+		}
+	})
+
+	t.Run("send", func(t *testing.T) {
+		cmd, _ := parseSCPCommand("scp -r -f /sub")
+		conn := &scpTestConn{Reader: bytes.NewBufferString("\x00\x00\x00\x00\x00")}
+		err := newSCPSession(fs, slog.Default(), cmd, conn).Run()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got, want := conn.out.String(), "D0755 0 sub\nC0644 5 a.txt\nhello\x00E\n"; got != want {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	})
+
+	t.Run("send missing file", func(t *testing.T) {
+		cmd, _ := parseSCPCommand("scp -f /missing")
+		conn := &scpTestConn{Reader: bytes.NewBufferString("\x00")}
+		err := newSCPSession(fs, slog.Default(), cmd, conn).Run()
+		if err == nil {
+			t.Fatal("expected an error")
+		}
+		if got := conn.out.String(); len(got) == 0 || got[0] != 0x02 {
+			t.Fatalf("expected a fatal error response, got %q", got)
+		}
+	})
+}
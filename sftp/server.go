@@ -13,20 +13,38 @@ import (
 	"log/slog"
 	"net"
 	"os"
+	"strings"
 	"sync"
 	"time"
 )
 
 type Server struct {
-	Addr             string
+	Addr string
+	// Banner is sent to the clients before authentication, e.g. a legal notice
+	Banner string
+	// ServerVersion is the version string announced in the handshake, it must start with "SSH-2.0-", empty uses the default
+	ServerVersion string
+	// MaxAuthTries is the number of authentication attempts per connection, 0 uses the default of 6, -1 is unlimited
+	MaxAuthTries int
+	// CryptoPolicy restricts the negotiated algorithms, see ModernCryptoPolicy
+	CryptoPolicy CryptoPolicy
+	// BanHandler, if set, receives the denied forwarding, shell and command attempts and can refuse banned addresses
+	BanHandler BanHandler
+	// UserFS, if set, returns the file system of a user when it logs in, the sessions of the user are served from it
+	// instead of the file system of the server, e.g. the FS of a filesystem.UserQuotas for a quota per user.
+	// an error rejects the login
+	UserFS func(user string) (filesystem.FSWithReadWriteAt, error)
+
 	logger           *slog.Logger
 	fsFileRoot       filesystem.FSWithReadWriteAt
 	privateKey       map[string][]byte
 	privateKeySigner map[string]ssh.Signer
-	sftpServer       *sftp.RequestServer
-	sshServerConn    map[net.Conn]*Sessions
+	sessionManager   *SessionManager
+	lock             sync.Mutex // Protects listener
 	listener         net.Listener
 	users            Users
+	ctx              context.Context
+	cancel           context.CancelCauseFunc
 }
 
 // Users is the interface to find a user by username and password and return it
@@ -38,10 +56,12 @@ type Users interface {
 func NewSFTPServer(addr string, fs filesystem.FSWithReadWriteAt, users Users) *Server {
 
 	s := &Server{
-		Addr:       addr,
-		fsFileRoot: fs,
-		users:      users,
+		Addr:           addr,
+		fsFileRoot:     fs,
+		users:          users,
+		sessionManager: NewSessionManager(),
 	}
+	s.ctx, s.cancel = context.WithCancelCause(context.Background())
 
 	return s
 }
@@ -72,8 +92,11 @@ func (s *Server) SetPrivateKeyFile(pk string) error {
 	return nil
 }
 
+// ListenAndServe listens on Addr and serves ssh connections until the server is closed, then it returns ErrServerClosed.
 func (s *Server) ListenAndServe() error {
-	s.sshServerConn = make(map[net.Conn]*Sessions)
+	if err := s.validateOptions(); err != nil {
+		return err
+	}
 	// Generate a new key pair if not set.
 	if len(s.privateKey) == 0 {
 		pk1, _ := keys.GeneratesED25519Keys()
@@ -93,7 +116,15 @@ func (s *Server) ListenAndServe() error {
 			return err
 		}
 
-		s.privateKeySigner[i] = privateKey
+		signer, ok := s.CryptoPolicy.hostKeySigner(privateKey)
+		if !ok {
+			s.Logger().Warn("Host key not allowed by the crypto policy", "file", i, "type", privateKey.PublicKey().Type())
+			continue
+		}
+		s.privateKeySigner[i] = signer
+	}
+	if len(s.privateKeySigner) == 0 {
+		return errors.New("no host key allowed by the crypto policy")
 	}
 
 	// Start the SSH server.
@@ -104,12 +135,25 @@ func (s *Server) ListenAndServe() error {
 		return err
 	}
 
+	s.lock.Lock()
+	if s.ctx.Err() != nil {
+		s.lock.Unlock()
+		listener.Close()
+		return ErrServerClosed
+	}
+	s.listener = listener
+	s.lock.Unlock()
+
 	s.Logger().Debug("Listening on " + s.Addr)
 
 	for {
 		// Accept incoming connections.
 		conn, err := listener.Accept()
 		if err != nil {
+			if s.ctx.Err() != nil {
+				s.Logger().Info("Listener closed.")
+				return ErrServerClosed
+			}
 			s.Logger().Error("Failed to accept incoming connection", "error", err)
 			continue
 		}
@@ -121,10 +165,10 @@ func (s *Server) ListenAndServe() error {
 
 // TryListenAndServe tries to start the FTP server if there isn't an error after a certain time it returns nil
 func (s *Server) TryListenAndServe(d time.Duration) (err error) {
-	errC := make(chan error)
+	errC := make(chan error, 1)
 
 	go func() {
-		err = s.ListenAndServe()
+		err := s.ListenAndServe()
 		if err != nil {
 			errC <- err
 		}
@@ -138,22 +182,55 @@ func (s *Server) TryListenAndServe(d time.Duration) (err error) {
 	}
 }
 
-// Close closes the server.
+// Close closes the listener and every connection immediately, running transfers are aborted.
 func (s *Server) Close() {
-	s.sftpServer.Close()
-	wg := sync.WaitGroup{}
-	for conn, ctx := range s.sshServerConn {
-		wg.Add(1)
-		go func(conn net.Conn, ctx *Sessions) {
-			conn.Close()
-			ctx.cancel(errors.New("server closed"))
-			delete(s.sshServerConn, conn)
-			wg.Done()
-		}(conn, ctx)
-	}
-	wg.Wait()
-	s.listener.Close()
-	return
+	s.closeListener()
+	s.sessionManager.CloseAll(ErrServerClosed)
+	s.sessionManager.Wait()
+}
+
+// Shutdown stops accepting connections and waits for the running transfers to finish before closing the connections,
+// if the context expires first the remaining connections are closed and the context error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.closeListener()
+
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for s.sessionManager.Transfers() > 0 {
+		select {
+		case <-ctx.Done():
+			s.Close()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	s.Close()
+	return nil
+}
+
+// closeListener cancels the server context, so sessions don't start new transfers, and closes the listener.
+func (s *Server) closeListener() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.cancel(ErrServerClosed)
+	if s.listener != nil {
+		s.listener.Close()
+	}
+}
+
+// ActiveSessions returns the connected sessions.
+func (s *Server) ActiveSessions() []SessionInfo {
+	return s.sessionManager.List()
+}
+
+// KickSession closes the connection of the session with the given id.
+func (s *Server) KickSession(id string) error {
+	err := s.sessionManager.Kick(id, errors.New("session kicked"))
+	if err != nil {
+		return err
+	}
+	s.Logger().Info("Session kicked", "session", id)
+	return nil
 }
 
 // SetLogger sets the logger for the server.
@@ -170,22 +247,31 @@ func (s *Server) Logger() *slog.Logger {
 }
 
 // AuthHandler is called by the SSH server when a client attempts to authenticate.
-func (s *Server) AuthHandler(conn net.Conn) func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+func (s *Server) AuthHandler(session *Sessions) func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
 	return func(m ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
 
-		session, ok := s.sshServerConn[conn]
-		if !ok {
-			s.Logger().Error("Session not found", "user", m.User())
-			return nil, fmt.Errorf("session not found")
-		}
+		session.lock.Lock()
 		session.logger = session.logger.With("user", m.User())
 		session.UserInfo = m
+		session.lock.Unlock()
 		ctx, cancel := context.WithTimeoutCause(session.ctx, 5*time.Second, fmt.Errorf("login timeout"))
 		defer cancel()
 		s.Logger().Debug("Login temp", "user", m.User())
 		_, err := s.users.FindUser(ctx, m.User(), string(pass), m.RemoteAddr().String())
+		if err == nil && s.UserFS != nil {
+			fsys, fsErr := s.UserFS(m.User())
+			if fsErr != nil {
+				s.Logger().Error("Error opening the file system of the user", "user", m.User(), "error", fsErr)
+				return nil, fmt.Errorf("no file system for %q", m.User())
+			}
+			session.lock.Lock()
+			session.fs = fsys
+			session.lock.Unlock()
+		}
 		if err == nil {
+			session.lock.Lock()
 			session.logger = session.logger.With("User authenticated", true)
+			session.lock.Unlock()
 			return nil, nil
 		}
 
@@ -195,18 +281,32 @@ func (s *Server) AuthHandler(conn net.Conn) func(conn ssh.ConnMetadata, password
 
 func (s *Server) sshHandler(conn net.Conn) {
 	defer conn.Close()
-	ctx, cancel := context.WithCancelCause(context.Background())
+	ctx, cancel := context.WithCancelCause(s.ctx)
 	defer cancel(nil)
 
-	session := &Sessions{ctx: ctx, cancel: cancel, logger: s.Logger(), fs: s.fsFileRoot}
-	s.sshServerConn[conn] = session
-	defer delete(s.sshServerConn, conn)
-	sshCfg := &ssh.ServerConfig{
-		PasswordCallback: s.AuthHandler(conn),
+	session := &Sessions{
+		id:        generateSessionID(conn),
+		conn:      conn,
+		connected: time.Now(),
+		ctx:       ctx,
+		cancel:    cancel,
+		fs:        s.fsFileRoot,
 	}
-	for _, key := range s.privateKeySigner {
-		sshCfg.AddHostKey(key)
+	session.logger = s.Logger().With("session", session.id, "ip", remoteIP(conn.RemoteAddr()))
+	if s.BanHandler != nil && s.BanHandler.Banned(remoteIP(conn.RemoteAddr())) {
+		session.logger.Warn("Connection refused, the ip address is banned")
+		return
+	}
+	if err := s.sessionManager.Add(session); err != nil {
+		session.logger.Debug("Connection refused, the server is closing")
+		return
 	}
+	defer s.sessionManager.Remove(session)
+	// the listener may have closed after the accept, a closing server doesn't serve new connections
+	if s.ctx.Err() != nil {
+		return
+	}
+	sshCfg := s.sshConfig(session)
 
 	// Upgrade the connection to an SSH connection.
 	sshConn, chans, reqs, err := ssh.NewServerConn(conn, sshCfg)
@@ -230,7 +330,7 @@ func (s *Server) sshHandler(conn net.Conn) {
 	)
 
 	// The incoming Request channel must be serviced.
-	go ssh.DiscardRequests(reqs)
+	go s.globalRequests(session, reqs)
 
 	// Service the incoming Channel channel.
 	for newChannel := range chans {
@@ -239,7 +339,7 @@ func (s *Server) sshHandler(conn net.Conn) {
 
 		s.Logger().Debug("Incoming channel", "channelType", newChannel.ChannelType())
 		if newChannel.ChannelType() != "session" {
-			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			s.rejectChannel(session, newChannel)
 			continue
 		}
 
@@ -249,41 +349,129 @@ func (s *Server) sshHandler(conn net.Conn) {
 			return
 		}
 
-		// Start an SFTP session.
-		go s.filterHandler(requests)
+		// Start an SFTP or SCP session depending on the channel requests.
+		go s.filterHandler(session, channel, requests)
+	}
+}
 
-		serverOptions := []sftp.RequestServerOption{}
+// serveSFTP serves the sftp subsystem on the channel until the client exits.
+func (s *Server) serveSFTP(session *Sessions, channel ssh.Channel) {
+	defer channel.Close()
 
-		FS := NewFileSys(session)
-		s.sftpServer = sftp.NewRequestServer(channel, FS, serverOptions...)
-		//s.sftpServer, err = sftp.NewServer(channel, serverOptions...)
+	serverOptions := []sftp.RequestServerOption{}
 
-		if err := s.sftpServer.Serve(); err == io.EOF {
-			s.sftpServer.Close()
-			s.Logger().Debug("sftp client exited session.", "user", sshConn.User())
-		} else if err != nil {
-			s.Logger().Error("sftp server completed with error", "error", err)
-		}
+	// every channel gets its own request server, closing it closes the open file handles of the channel
+	FS := NewFileSys(session)
+	server := sftp.NewRequestServer(channel, FS, serverOptions...)
+	defer server.Close()
 
+	if err := server.Serve(); err == io.EOF {
+		session.logger.Debug("sftp client exited session.")
+	} else if err != nil {
+		session.logger.Error("sftp server completed with error", "error", err)
+	}
+}
+
+// execCommand returns the function that runs an exec request, only scp and rsync in server mode are allowed
+func (s *Server) execCommand(session *Sessions, channel ssh.Channel, command string) (func(), error) {
+	if scp, err := parseSCPCommand(command); err == nil {
+		return func() { s.serveExec(session, channel, newSCPSession(session.fs, session.logger, scp, channel)) }, nil
+	} else if !strings.HasPrefix(strings.TrimSpace(command), "rsync") {
+		return nil, err
+	}
+	rsync, err := parseRsyncCommand(command)
+	if err != nil {
+		return nil, err
 	}
+	return func() { s.serveExec(session, channel, newRsyncSession(session.fs, session.logger, rsync, channel)) }, nil
 }
 
-// Start an SFTP session.
-func (s *Server) filterHandler(in <-chan *ssh.Request) {
+// serveExec runs an exec command on the channel and reports the exit status to the client.
+func (s *Server) serveExec(session *Sessions, channel ssh.Channel, cmd interface{ Run() error }) {
+	defer channel.Close()
+
+	status := uint32(0)
+	done, err := session.startTransfer()
+	if err == nil {
+		err = cmd.Run()
+		done()
+	}
+	if err != nil {
+		session.logger.Error("exec command completed with error", "error", err)
+		status = 1
+	}
+
+	_, err = channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+	if err != nil {
+		session.logger.Debug("Failed to send exit status", "error", err)
+	}
+}
+
+// filterHandler services the channel requests, it starts the sftp subsystem or a restricted scp or rsync command
+// and rejects every other request. only one of them can run on a channel.
+func (s *Server) filterHandler(session *Sessions, channel ssh.Channel, in <-chan *ssh.Request) {
+	started := false
 	for req := range in {
 		s.Logger().Debug("Request", "type", req.Type, "payload", tools.IsPrintable(string(req.Payload)))
 
 		ok := false
+		var start func()
 		switch req.Type {
 		case "subsystem":
-			if string(req.Payload[4:]) == "sftp" {
+			name := payloadString(req.Payload)
+			if name != "sftp" {
+				s.denyRequest(session, channel, req.Type, name, "only the sftp subsystem is available")
+				break
+			}
+			if !started {
+				ok = true
+				start = func() { s.serveSFTP(session, channel) }
+			}
+		case "exec":
+			command := payloadString(req.Payload)
+			run, err := s.execCommand(session, channel, command)
+			if err != nil {
+				s.denyRequest(session, channel, req.Type, command, "only scp and rsync commands are allowed: "+err.Error())
+				break
+			}
+			if !started {
 				ok = true
+				start = run
+			}
+		default:
+			if reason, denied := deniedSessionRequests[req.Type]; denied {
+				s.denyRequest(session, channel, req.Type, "", reason)
 			}
 		}
-		err := req.Reply(ok, nil)
-		if err != nil {
-			s.Logger().Error("Failed to reply", "error", err)
-			return
+		if req.WantReply {
+			err := req.Reply(ok, nil)
+			if err != nil {
+				s.Logger().Error("Failed to reply", "error", err)
+				return
+			}
+		}
+		if start != nil {
+			started = true
+			go start()
 		}
 	}
 }
+
+// denyRequest reports a denied session request and tells the reason to the client on stderr, as channel request
+// replies can't carry a message.
+func (s *Server) denyRequest(session *Sessions, channel ssh.Channel, kind, detail, reason string) {
+	fmt.Fprintf(channel.Stderr(), "%s request denied: %s\r\n", kind, reason)
+	s.violation(session, kind, detail, reason)
+}
+
+// payloadString returns the ssh string at the start of a request payload, or an empty string if it is malformed.
+func payloadString(payload []byte) string {
+	var msg struct {
+		Value string
+		Rest  []byte `ssh:"rest"`
+	}
+	if err := ssh.Unmarshal(payload, &msg); err != nil {
+		return ""
+	}
+	return msg.Value
+}
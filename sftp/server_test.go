@@ -0,0 +1,414 @@
+package sftp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/telebroad/fileserver/filesystem"
+	"github.com/telebroad/fileserver/keys"
+	"golang.org/x/crypto/ssh"
+)
+
+type testUsers struct{}
+
+func (testUsers) FindUser(_ context.Context, username, password, _ string) (any, error) {
+	if (username == "user" || username == "other") && password == "pass" {
+		return username, nil
+	}
+	return nil, errors.New("invalid credentials")
+}
+
+// startTestServer starts a server on a free local port and returns it with its address
+func startTestServer(t *testing.T, configure func(s *Server)) (*Server, string, chan error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	s := NewSFTPServer(addr, filesystem.NewMemFS(), testUsers{})
+	pk, _ := keys.GeneratesED25519Keys()
+	s.SetPrivateKey("ED25519.key", pk)
+	if configure != nil {
+		configure(s)
+	}
+	served := make(chan error, 1)
+	go func() { served <- s.ListenAndServe() }()
+	t.Cleanup(s.Close)
+	return s, addr, served
+}
+
+// dialTestServer connects to a test server, retrying until it listens
+func dialTestServer(addr string, config *ssh.ClientConfig) (conn *ssh.Client, err error) {
+	if config == nil {
+		config = &ssh.ClientConfig{}
+	}
+	if config.User == "" {
+		config.User = "user"
+	}
+	config.Auth = []ssh.AuthMethod{ssh.Password("pass")}
+	config.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+	for i := 0; i < 50; i++ {
+		conn, err = ssh.Dial("tcp", addr, config)
+		if err == nil || !errors.Is(err, syscall.ECONNREFUSED) {
+			return conn, err
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return nil, err
+}
+
+func Test_serverShutdown(t *testing.T) {
+	s, addr, served := startTestServer(t, nil)
+	conn, err := dialTestServer(addr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := client.Create("/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	sessions := s.ActiveSessions()
+	if len(sessions) != 1 || sessions[0].User != "user" || sessions[0].Transfers != 1 {
+		t.Fatalf("unexpected sessions %+v", sessions)
+	}
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- s.Shutdown(context.Background()) }()
+	select {
+	case err = <-shutdown:
+		t.Fatalf("shutdown returned before the transfer finished: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	if _, err = client.Create("/b.txt"); err == nil {
+		t.Fatal("expected new transfers to be refused while draining")
+	}
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = <-shutdown; err != nil {
+		t.Fatal(err)
+	}
+	if err = <-served; !errors.Is(err, ErrServerClosed) {
+		t.Fatalf("ListenAndServe returned %v", err)
+	}
+	if len(s.ActiveSessions()) != 0 {
+		t.Fatal("expected no sessions after shutdown")
+	}
+	if err = s.KickSession(sessions[0].ID); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("KickSession returned %v", err)
+	}
+}
+
+func Test_sessionManagerClosed(t *testing.T) {
+	manager := NewSessionManager()
+	server, client := net.Pipe()
+	defer client.Close()
+	ctx, cancel := context.WithCancelCause(context.Background())
+	session := &Sessions{id: "a", conn: server, ctx: ctx, cancel: cancel}
+	if err := manager.Add(session); err != nil {
+		t.Fatal(err)
+	}
+	manager.CloseAll(ErrServerClosed)
+	if !errors.Is(context.Cause(ctx), ErrServerClosed) {
+		t.Fatalf("expected the session to be closed, got %v", context.Cause(ctx))
+	}
+
+	// a connection accepted before the close is refused after it, Wait doesn't wait for it
+	if err := manager.Add(&Sessions{id: "b", conn: server}); !errors.Is(err, ErrServerClosed) {
+		t.Fatalf("expected a late session to be refused, got %v", err)
+	}
+	manager.Remove(session)
+	manager.Wait()
+	if len(manager.List()) != 0 {
+		t.Fatalf("unexpected sessions %+v", manager.List())
+	}
+}
+
+func Test_serverOptions(t *testing.T) {
+	_, addr, _ := startTestServer(t, func(s *Server) {
+		s.Banner = "authorized use only"
+		s.ServerVersion = "SSH-2.0-FileServer"
+		s.CryptoPolicy = ModernCryptoPolicy()
+		pk, _ := keys.GeneratesECDSAKeys(256)
+		s.SetPrivateKey("ECDSA-256.key", pk)
+	})
+
+	var banner string
+	conn, err := dialTestServer(addr, &ssh.ClientConfig{
+		BannerCallback: func(message string) error {
+			banner = message
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if banner != "authorized use only\n" {
+		t.Fatalf("got banner %q", banner)
+	}
+	if got := string(conn.ServerVersion()); got != "SSH-2.0-FileServer" {
+		t.Fatalf("got server version %q", got)
+	}
+
+	for _, config := range []ssh.Config{
+		{Ciphers: []string{"aes128-ctr"}, MACs: []string{"hmac-sha1"}},
+		{Ciphers: []string{"aes128-cbc"}},
+		{KeyExchanges: []string{"diffie-hellman-group14-sha1"}},
+	} {
+		_, err = dialTestServer(addr, &ssh.ClientConfig{Config: config})
+		if err == nil {
+			t.Fatalf("expected %+v to be rejected by the modern policy", config)
+		}
+	}
+
+	if _, err = dialTestServer(addr, &ssh.ClientConfig{HostKeyAlgorithms: []string{ssh.KeyAlgoRSA}}); err == nil {
+		t.Fatal("expected ssh-rsa host keys to be rejected by the modern policy")
+	}
+}
+
+func Test_serverInvalidVersion(t *testing.T) {
+	s := NewSFTPServer("127.0.0.1:0", filesystem.NewLocalFS(t.TempDir()), testUsers{})
+	s.ServerVersion = "FileServer"
+	if err := s.ListenAndServe(); err == nil {
+		t.Fatal("expected an invalid server version error")
+	}
+}
+
+type testBanHandler struct {
+	lock       sync.Mutex
+	violations []PolicyViolation
+	limit      int
+}
+
+func (h *testBanHandler) Banned(ip string) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return len(h.violations) >= h.limit
+}
+
+func (h *testBanHandler) Violation(v PolicyViolation) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.violations = append(h.violations, v)
+	return len(h.violations) >= h.limit
+}
+
+func Test_serverPolicy(t *testing.T) {
+	bans := &testBanHandler{limit: 5}
+	_, addr, _ := startTestServer(t, func(s *Server) {
+		s.BanHandler = bans
+	})
+	conn, err := dialTestServer(addr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err = conn.Listen("tcp", "127.0.0.1:0"); err == nil {
+		t.Fatal("expected tcpip-forward to be denied")
+	}
+	if _, err = conn.Dial("tcp", addr); err == nil {
+		t.Fatal("expected direct-tcpip to be denied")
+	}
+	session, err := conn.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = session.RequestPty("xterm", 80, 40, ssh.TerminalModes{}); err == nil {
+		t.Fatal("expected pty-req to be denied")
+	}
+	if err = session.Shell(); err == nil {
+		t.Fatal("expected shell to be denied")
+	}
+
+	bans.lock.Lock()
+	var kinds []string
+	for _, v := range bans.violations {
+		if v.User != "user" || v.IP != "127.0.0.1" {
+			t.Fatalf("unexpected violation %+v", v)
+		}
+		kinds = append(kinds, v.Kind)
+	}
+	bans.lock.Unlock()
+	if want := []string{"tcpip-forward", "direct-tcpip", "pty-req", "shell"}; !slices.Equal(kinds, want) {
+		t.Fatalf("got violations %v, want %v", kinds, want)
+	}
+
+	// the fifth violation closes the connection and bans the address
+	session, err = conn.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Run("ls -la")
+	if err = conn.Wait(); err == nil {
+		t.Fatal("expected the connection to be closed")
+	}
+	if conn, err = dialTestServer(addr, nil); err == nil {
+		conn.Close()
+		t.Fatal("expected the banned address to be refused")
+	}
+}
+
+func Test_serverReadOnly(t *testing.T) {
+	mem := filesystem.NewMemFS()
+	mem.WriteFile("/a.txt", strings.NewReader("hello"), "I", false)
+	mem.MakeDir("/empty")
+	_, addr, _ := startTestServer(t, func(s *Server) {
+		s.fsFileRoot = filesystem.NewReadOnlyFS(mem)
+	})
+	conn, err := dialTestServer(addr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// the client returns SSH_FX_PERMISSION_DENIED as os.ErrPermission
+	for name, err := range map[string]error{
+		"rmdir":  client.RemoveDirectory("/empty"),
+		"mkdir":  client.Mkdir("/dir"),
+		"rename": client.Rename("/a.txt", "/b.txt"),
+		"chmod":  client.Chmod("/a.txt", 0600),
+	} {
+		if !errors.Is(err, fs.ErrPermission) {
+			t.Errorf("%s: expected a permission error, got %v", name, err)
+		}
+	}
+	if _, err = client.Create("/b.txt"); !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("create: expected a permission error, got %v", err)
+	}
+	f, err := client.Open("/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if data, err := io.ReadAll(f); err != nil || string(data) != "hello" {
+		t.Fatalf("got %q, %v", data, err)
+	}
+}
+
+func Test_serverQuota(t *testing.T) {
+	quota, err := filesystem.NewQuotaFS(filesystem.NewMemFS(), 8192, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, addr, _ := startTestServer(t, func(s *Server) {
+		s.fsFileRoot = quota
+	})
+	conn, err := dialTestServer(addr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	f, err := client.Create("/big.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Write(make([]byte, 10000))
+	f.Close()
+	var status *sftp.StatusError
+	if !errors.As(err, &status) || status.Code != 14 {
+		t.Fatalf("expected SSH_FX_NO_SPACE_ON_FILESYSTEM, got %v", err)
+	}
+	stat, err := client.StatVFS("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.TotalSpace() != 8192 {
+		t.Fatalf("expected the quota as the total space, got %d", stat.TotalSpace())
+	}
+}
+
+func Test_serverUserQuota(t *testing.T) {
+	homes := map[string]*filesystem.MemFS{"user": filesystem.NewMemFS(), "other": filesystem.NewMemFS()}
+	quotas := filesystem.NewUserQuotas(func(user string) (filesystem.FS, error) {
+		if home, ok := homes[user]; ok {
+			return home, nil
+		}
+		return nil, fs.ErrNotExist
+	}, 8192, 0)
+	_, addr, _ := startTestServer(t, func(s *Server) {
+		s.UserFS = func(user string) (filesystem.FSWithReadWriteAt, error) {
+			return quotas.FS(user)
+		}
+	})
+
+	upload := func(user, name string, size int) error {
+		t.Helper()
+		conn, err := dialTestServer(addr, &ssh.ClientConfig{User: user})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		client, err := sftp.NewClient(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		f, err := client.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = f.Write(make([]byte, size))
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	}
+
+	// every user is served from its own file system with a quota of its own
+	if err := upload("user", "/a.bin", 6000); err != nil {
+		t.Fatal(err)
+	}
+	if err := upload("other", "/a.bin", 6000); err != nil {
+		t.Fatalf("expected the files of another user not to count, got %v", err)
+	}
+	var status *sftp.StatusError
+	if err := upload("user", "/b.bin", 6000); !errors.As(err, &status) || status.Code != 14 {
+		t.Fatalf("expected SSH_FX_NO_SPACE_ON_FILESYSTEM, got %v", err)
+	}
+	for user, home := range homes {
+		if _, _, err := home.Stat("/a.bin"); err != nil {
+			t.Fatalf("expected the upload of %s in its file system, got %v", user, err)
+		}
+	}
+	other, err := quotas.FS("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage := other.Usage(); usage.Bytes != 6000 || usage.Files != 1 {
+		t.Fatalf("unexpected usage of other %+v", usage)
+	}
+}
@@ -0,0 +1,205 @@
+package sftp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/telebroad/fileserver/filesystem"
+)
+
+// ErrServerClosed is returned by ListenAndServe after a call to Close or Shutdown
+var ErrServerClosed = errors.New("sftp: server closed")
+
+// ErrSessionNotFound is returned by KickSession when there is no active session with the given id
+var ErrSessionNotFound = errors.New("sftp: session not found")
+
+// SessionInfo is a snapshot of an active ssh connection
+type SessionInfo struct {
+	// ID identifies the session, it is the value to pass to KickSession
+	ID string
+	// User is the ssh user, empty until the client authenticates
+	User string
+	// RemoteAddr is the client address
+	RemoteAddr string
+	// Connected is the time the connection was accepted
+	Connected time.Time
+	// Transfers is the number of open file transfers and running scp or rsync commands
+	Transfers int64
+}
+
+// SessionManager manages all active sessions.
+type SessionManager struct {
+	sessions map[string]*Sessions // Map of active sessions
+	closed   bool                 // Set by CloseAll, no session is added after it
+	lock     sync.RWMutex         // Protects the sessions map and closed
+	wg       sync.WaitGroup       // Tracks the running connection handlers
+}
+
+func NewSessionManager() *SessionManager {
+	return &SessionManager{
+		sessions: make(map[string]*Sessions),
+	}
+}
+
+// Add adds a new session for the client, it returns ErrServerClosed once CloseAll was called.
+func (manager *SessionManager) Add(session *Sessions) error {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	if manager.closed {
+		return ErrServerClosed
+	}
+	manager.sessions[session.id] = session
+	manager.wg.Add(1)
+	return nil
+}
+
+// Get retrieves a session by its ID.
+func (manager *SessionManager) Get(id string) (*Sessions, bool) {
+	manager.lock.RLock()
+	defer manager.lock.RUnlock()
+	session, exists := manager.sessions[id]
+	return session, exists
+}
+
+// Remove removes a session, it must be called once for every successfully added session.
+func (manager *SessionManager) Remove(session *Sessions) {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	if manager.sessions[session.id] == session {
+		delete(manager.sessions, session.id)
+	}
+	manager.wg.Done()
+}
+
+// List returns a snapshot of the active sessions sorted by connection time.
+func (manager *SessionManager) List() []SessionInfo {
+	manager.lock.RLock()
+	list := make([]SessionInfo, 0, len(manager.sessions))
+	for _, session := range manager.sessions {
+		list = append(list, session.Info())
+	}
+	manager.lock.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Connected.Before(list[j].Connected)
+	})
+	return list
+}
+
+// Kick closes the connection of a session.
+func (manager *SessionManager) Kick(id string, cause error) error {
+	session, ok := manager.Get(id)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrSessionNotFound, id)
+	}
+	session.close(cause)
+	return nil
+}
+
+// CloseAll closes the connection of every session, the sessions added later are refused.
+func (manager *SessionManager) CloseAll(cause error) {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	manager.closed = true
+	for _, session := range manager.sessions {
+		session.close(cause)
+	}
+}
+
+// Transfers returns the number of transfers running in all the sessions.
+func (manager *SessionManager) Transfers() int64 {
+	manager.lock.RLock()
+	defer manager.lock.RUnlock()
+	var n int64
+	for _, session := range manager.sessions {
+		n += session.transfers.Load()
+	}
+	return n
+}
+
+// Wait waits until all the connection handlers have returned.
+func (manager *SessionManager) Wait() {
+	manager.wg.Wait()
+}
+
+// Info returns a snapshot of the session.
+func (s *Sessions) Info() SessionInfo {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	info := SessionInfo{
+		ID:         s.id,
+		RemoteAddr: s.conn.RemoteAddr().String(),
+		Connected:  s.connected,
+		Transfers:  s.transfers.Load(),
+	}
+	if s.UserInfo != nil {
+		info.User = s.UserInfo.User()
+	}
+	return info
+}
+
+// close cancels the session context and closes its connection.
+func (s *Sessions) close(cause error) {
+	s.cancel(cause)
+	s.conn.Close()
+}
+
+// startTransfer counts a running transfer until the returned function is called,
+// it fails once the session is closing so that draining transfers don't start new ones.
+func (s *Sessions) startTransfer() (done func(), err error) {
+	if s.ctx.Err() != nil {
+		return nil, fmt.Errorf("session closing: %w", context.Cause(s.ctx))
+	}
+	s.transfers.Add(1)
+	once := sync.Once{}
+	return func() { once.Do(func() { s.transfers.Add(-1) }) }, nil
+}
+
+// generateSessionID returns a unique id for the connection
+func generateSessionID(conn net.Conn) string {
+	return fmt.Sprintf("%s-%d", conn.RemoteAddr().String(), time.Now().UnixNano())
+}
+
+// trackedReaderAt ends its transfer when the sftp request server closes the file handle
+type trackedReaderAt struct {
+	io.ReaderAt
+	done func()
+}
+
+func (t *trackedReaderAt) Close() error {
+	defer t.done()
+	if c, ok := t.ReaderAt.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// trackedWriterAt ends its transfer when the sftp request server closes the file handle
+type trackedWriterAt struct {
+	io.WriterAt
+	done func()
+}
+
+func (t *trackedWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	n, err := t.WriterAt.WriteAt(p, off)
+	return n, statusError(err)
+}
+
+// TransferError tells the file that the connection was lost, e.g. to discard an atomic upload
+func (t *trackedWriterAt) TransferError(err error) {
+	filesystem.ForwardTransferError(t.WriterAt, err)
+}
+
+func (t *trackedWriterAt) Close() error {
+	defer t.done()
+	if c, ok := t.WriterAt.(io.Closer); ok {
+		return statusError(c.Close())
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+package users
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Scope is a permission of a principal
+type Scope string
+
+const (
+	ScopeRead   Scope = "read"
+	ScopeWrite  Scope = "write"
+	ScopeDelete Scope = "delete"
+)
+
+// AllScopes are the permissions of a user authenticated by password
+var AllScopes = []Scope{ScopeRead, ScopeWrite, ScopeDelete}
+
+// ParseScopes parses scopes separated by `+` or spaces, like `read+write`
+func ParseScopes(s string) ([]Scope, error) {
+	var scopes []Scope
+	for _, scope := range strings.FieldsFunc(s, func(r rune) bool { return r == '+' || r == ' ' }) {
+		switch Scope(scope) {
+		case ScopeRead, ScopeWrite, ScopeDelete:
+			scopes = append(scopes, Scope(scope))
+		default:
+			return nil, fmt.Errorf("unknown scope %q, expected read, write or delete", scope)
+		}
+	}
+	return scopes, nil
+}
+
+// Principal is the authenticated caller of a request with its permissions
+type Principal struct {
+	Name string
+	// Method is how the principal was authenticated, basic, jwt or api-key
+	Method string
+	Scopes []Scope
+}
+
+// HasScope reports if the principal has the permission
+func (p *Principal) HasScope(scope string) bool {
+	for _, s := range p.Scopes {
+		if string(s) == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// APIKeys are opaque keys with scopes, only the hashes of the keys are kept
+type APIKeys struct {
+	lock sync.RWMutex
+	keys map[[sha256.Size]byte]*Principal
+}
+
+// NewAPIKeys returns an empty set of API keys
+func NewAPIKeys() *APIKeys {
+	return &APIKeys{keys: map[[sha256.Size]byte]*Principal{}}
+}
+
+// Add adds the key of the name with its scopes
+func (a *APIKeys) Add(name, key string, scopes ...Scope) error {
+	if len(key) < 16 {
+		return fmt.Errorf("API key of %s is shorter than 16 characters", name)
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.keys[sha256.Sum256([]byte(key))] = &Principal{Name: name, Method: "api-key", Scopes: scopes}
+	return nil
+}
+
+// Remove removes the key
+func (a *APIKeys) Remove(key string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	delete(a.keys, sha256.Sum256([]byte(key)))
+}
+
+// Find returns the principal of the key, the key is looked up by its hash
+func (a *APIKeys) Find(key string) (*Principal, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	principal, ok := a.keys[sha256.Sum256([]byte(key))]
+	if !ok {
+		return nil, errors.New("invalid API key")
+	}
+	return principal, nil
+}
+
+// ParseAPIKeys parses keys in the format `name:key:read+write,name:key:read`
+func ParseAPIKeys(s string) (*APIKeys, error) {
+	keys := NewAPIKeys()
+	for i, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		// the entry may be a misplaced key, it isn't in the error
+		parts := strings.SplitN(entry, ":", 3)
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("invalid API key entry %d, expected name:key:scopes", i+1)
+		}
+		scopes, err := ParseScopes(parts[2])
+		if err != nil {
+			return nil, fmt.Errorf("invalid API key of %s: %w", parts[0], err)
+		}
+		if err = keys.Add(parts[0], parts[1], scopes...); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// Authenticator verifies the user of a http request by basic auth, a bearer JWT or an API key,
+// the methods are enabled by setting them, so every handler can be configured with its own
+type Authenticator struct {
+	// Users verifies basic auth, the users have all the scopes
+	Users *LocalUsers
+	// JWT verifies `Authorization: Bearer <jwt>`
+	JWT *JWTVerifier
+	// APIKeys verifies `Authorization: Bearer <key>` and `X-API-Key: <key>`
+	APIKeys *APIKeys
+	logger  *slog.Logger
+}
+
+func (a *Authenticator) SetLogger(l *slog.Logger) {
+	a.logger = l
+}
+
+func (a *Authenticator) Logger() *slog.Logger {
+	if a.logger == nil {
+		a.logger = slog.Default()
+	}
+	return a.logger.With("module", "authenticator")
+}
+
+// VerifyUser returns the *Principal of the request, the credentials are never logged or returned in the error
+func (a *Authenticator) VerifyUser(r *http.Request) (any, error) {
+	principal, method, err := a.verify(r)
+	if err != nil {
+		a.Logger().Debug("access denied", "method", method, "error", err, "remoteAddr", r.RemoteAddr, "user-agent", r.UserAgent())
+		return nil, err
+	}
+	return principal, nil
+}
+
+func (a *Authenticator) verify(r *http.Request) (*Principal, string, error) {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		if a.APIKeys == nil {
+			return nil, "api-key", errors.New("API keys are not accepted")
+		}
+		principal, err := a.APIKeys.Find(key)
+		return principal, "api-key", err
+	}
+	authorization := r.Header.Get("Authorization")
+	scheme, credentials, _ := strings.Cut(authorization, " ")
+	switch {
+	case strings.EqualFold(scheme, "Bearer"):
+		token := strings.TrimSpace(credentials)
+		if isJWT(token) && a.JWT != nil {
+			principal, err := a.JWT.Verify(token)
+			return principal, "jwt", err
+		}
+		if a.APIKeys != nil {
+			principal, err := a.APIKeys.Find(token)
+			return principal, "api-key", err
+		}
+		return nil, "bearer", errors.New("bearer tokens are not accepted")
+	case strings.EqualFold(scheme, "Basic"):
+		if a.Users == nil {
+			return nil, "basic", errors.New("basic authentication is not accepted")
+		}
+		username, password, _ := r.BasicAuth()
+		if _, err := a.Users.FindUser(r.Context(), username, password, r.RemoteAddr); err != nil {
+			return nil, "basic", err
+		}
+		return &Principal{Name: username, Method: "basic", Scopes: AllScopes}, "basic", nil
+	}
+	return nil, "", errors.New("access denied, this resource requires authentication")
+}
@@ -0,0 +1,274 @@
+package users
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrTokenExpired = errors.New("token expired")
+)
+
+// JSONWebKey is a verification key of a JWKS, Key is []byte for HS256,
+// *rsa.PublicKey for RS256 and ed25519.PublicKey for EdDSA
+type JSONWebKey struct {
+	ID        string
+	Algorithm string
+	Key       any
+}
+
+// jwk is a key as written in a JWKS file
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	K   string `json:"k"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+}
+
+// ParseJWKS parses the keys of a JSON Web Key Set, `{"keys": [...]}`,
+// keys of other types and keys for encryption are skipped
+func ParseJWKS(data []byte) ([]JSONWebKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("error parsing JWKS: %w", err)
+	}
+	var keys []JSONWebKey
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key := JSONWebKey{ID: k.Kid, Algorithm: k.Alg}
+		switch k.Kty {
+		case "oct":
+			secret, err := base64.RawURLEncoding.DecodeString(k.K)
+			if err != nil || len(secret) < 32 {
+				return nil, fmt.Errorf("invalid oct key %s, expected a base64url secret of at least 32 bytes", k.Kid)
+			}
+			key.Key, key.Algorithm = secret, defaultAlg(k.Alg, "HS256")
+		case "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(k.N)
+			e, errE := base64.RawURLEncoding.DecodeString(k.E)
+			if errN != nil || errE != nil || len(e) == 0 || len(e) > 4 {
+				return nil, fmt.Errorf("invalid RSA key %s", k.Kid)
+			}
+			public := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+			if public.N.BitLen() < 2048 {
+				return nil, fmt.Errorf("RSA key %s is shorter than 2048 bits", k.Kid)
+			}
+			key.Key, key.Algorithm = public, defaultAlg(k.Alg, "RS256")
+		case "OKP":
+			x, err := base64.RawURLEncoding.DecodeString(k.X)
+			if k.Crv != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+				return nil, fmt.Errorf("invalid OKP key %s, only Ed25519 is supported", k.Kid)
+			}
+			key.Key, key.Algorithm = ed25519.PublicKey(x), defaultAlg(k.Alg, "EdDSA")
+		default:
+			continue
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("the JWKS has no signing keys")
+	}
+	return keys, nil
+}
+
+func defaultAlg(alg, def string) string {
+	if alg == "" {
+		return def
+	}
+	return alg
+}
+
+// LoadJWKS reads the keys of a local JWKS file
+func LoadJWKS(name string) ([]JSONWebKey, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("error reading JWKS: %w", err)
+	}
+	return ParseJWKS(data)
+}
+
+// JWTVerifier verifies HS256, RS256 and EdDSA signed JWTs with the keys of a JWKS
+type JWTVerifier struct {
+	Keys []JSONWebKey
+	// Issuer and Audience are checked if set
+	Issuer   string
+	Audience string
+	// ScopeMap maps the scopes of the tokens to the permissions, by default a scope is the permission of its name
+	ScopeMap map[string][]Scope
+	// Leeway is the allowed clock skew of exp and nbf
+	Leeway time.Duration
+}
+
+// NewJWTVerifier returns a verifier of the keys of the JWKS file
+func NewJWTVerifier(jwksFile, issuer, audience string) (*JWTVerifier, error) {
+	keys, err := LoadJWKS(jwksFile)
+	if err != nil {
+		return nil, err
+	}
+	return &JWTVerifier{Keys: keys, Issuer: issuer, Audience: audience, Leeway: time.Minute}, nil
+}
+
+// jwtClaims are the registered claims and the scopes of a token
+type jwtClaims struct {
+	Subject   string          `json:"sub"`
+	Issuer    string          `json:"iss"`
+	Audience  json.RawMessage `json:"aud"`
+	ExpiresAt *json.Number    `json:"exp"`
+	NotBefore *json.Number    `json:"nbf"`
+	Scope     string          `json:"scope"`
+	Scp       json.RawMessage `json:"scp"`
+}
+
+// isJWT reports if the token looks like a compact JWT, three base64url parts of a json header
+func isJWT(token string) bool {
+	return strings.Count(token, ".") == 2 && strings.HasPrefix(token, "eyJ")
+}
+
+// Verify checks the signature and the claims of the token, it returns the principal of the subject
+func (v *JWTVerifier) Verify(token string) (*Principal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, ErrInvalidToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	// the key decides the algorithm, a token can't switch an RSA key to HMAC or to none
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, key := range v.Keys {
+		if header.Kid != "" && key.ID != header.Kid || key.Algorithm != header.Alg {
+			continue
+		}
+		if verified = verifySignature(key, signed, signature); verified {
+			break
+		}
+	}
+	if !verified {
+		return nil, fmt.Errorf("%w: signature", ErrInvalidToken)
+	}
+
+	var claims jwtClaims
+	if err = decodeSegment(parts[1], &claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+	now := time.Now()
+	if claims.ExpiresAt == nil {
+		return nil, fmt.Errorf("%w: missing exp", ErrInvalidToken)
+	}
+	if exp, err := claims.ExpiresAt.Int64(); err != nil || now.After(time.Unix(exp, 0).Add(v.Leeway)) {
+		return nil, ErrTokenExpired
+	}
+	if claims.NotBefore != nil {
+		if nbf, err := claims.NotBefore.Int64(); err != nil || now.Add(v.Leeway).Before(time.Unix(nbf, 0)) {
+			return nil, fmt.Errorf("%w: not yet valid", ErrInvalidToken)
+		}
+	}
+	if v.Issuer != "" && claims.Issuer != v.Issuer {
+		return nil, fmt.Errorf("%w: issuer", ErrInvalidToken)
+	}
+	if v.Audience != "" && !hasAudience(claims.Audience, v.Audience) {
+		return nil, fmt.Errorf("%w: audience", ErrInvalidToken)
+	}
+
+	scopes := strings.Fields(claims.Scope)
+	if len(claims.Scp) > 0 {
+		var scp []string
+		if json.Unmarshal(claims.Scp, &scp) != nil {
+			var s string
+			json.Unmarshal(claims.Scp, &s)
+			scp = strings.Fields(s)
+		}
+		scopes = append(scopes, scp...)
+	}
+	principal := &Principal{Name: claims.Subject, Method: "jwt"}
+	for _, scope := range scopes {
+		if mapped, ok := v.ScopeMap[scope]; ok {
+			principal.Scopes = append(principal.Scopes, mapped...)
+		} else if v.ScopeMap == nil {
+			principal.Scopes = append(principal.Scopes, Scope(scope))
+		}
+	}
+	return principal, nil
+}
+
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(strings.NewReader(string(data)))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
+func verifySignature(key JSONWebKey, signed, signature []byte) bool {
+	switch key.Algorithm {
+	case "HS256":
+		secret, ok := key.Key.([]byte)
+		if !ok {
+			return false
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(signed)
+		return hmac.Equal(mac.Sum(nil), signature)
+	case "RS256":
+		public, ok := key.Key.(*rsa.PublicKey)
+		if !ok {
+			return false
+		}
+		digest := sha256.Sum256(signed)
+		return rsa.VerifyPKCS1v15(public, crypto.SHA256, digest[:], signature) == nil
+	case "EdDSA":
+		public, ok := key.Key.(ed25519.PublicKey)
+		return ok && ed25519.Verify(public, signed, signature)
+	}
+	return false
+}
+
+// hasAudience reports if the aud claim, a string or a list, has the audience
+func hasAudience(raw json.RawMessage, audience string) bool {
+	var list []string
+	if json.Unmarshal(raw, &list) != nil {
+		var s string
+		if json.Unmarshal(raw, &s) != nil {
+			return false
+		}
+		list = []string{s}
+	}
+	for _, aud := range list {
+		if aud == audience {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,247 @@
+package users
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testKeys are the private keys of the test JWKS
+type testKeys struct {
+	hmac    []byte
+	rsa     *rsa.PrivateKey
+	ed25519 ed25519.PrivateKey
+}
+
+func newTestKeys(t *testing.T) *testKeys {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testKeys{hmac: []byte("0123456789abcdef0123456789abcdef"), rsa: rsaKey, ed25519: edKey}
+}
+
+// jwks returns the public keys as a JWKS, kids hs, rs and ed
+func (k *testKeys) jwks() []byte {
+	encode := base64.RawURLEncoding.EncodeToString
+	set := map[string]any{"keys": []map[string]string{
+		{"kty": "oct", "kid": "hs", "k": encode(k.hmac)},
+		{"kty": "RSA", "kid": "rs", "use": "sig", "n": encode(k.rsa.N.Bytes()), "e": encode(big.NewInt(int64(k.rsa.E)).Bytes())},
+		{"kty": "OKP", "kid": "ed", "crv": "Ed25519", "x": encode(k.ed25519.Public().(ed25519.PublicKey))},
+		{"kty": "RSA", "kid": "enc", "use": "enc", "n": "AQAB", "e": "AQAB"},
+		{"kty": "EC", "kid": "ec", "crv": "P-256"},
+	}}
+	data, _ := json.Marshal(set)
+	return data
+}
+
+// sign returns the token of the claims, alg selects the signature, the key of another algorithm signs a confused token
+func (k *testKeys) sign(t *testing.T, alg, kid string, key any, claims map[string]any) string {
+	t.Helper()
+	header := map[string]string{"alg": alg, "typ": "JWT"}
+	if kid != "" {
+		header["kid"] = kid
+	}
+	h, _ := json.Marshal(header)
+	c, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	var signature []byte
+	switch key := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		digest := sha256.Sum256([]byte(signed))
+		var err error
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(key, []byte(signed))
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// validClaims returns the claims of a valid token, changed by the pairs of name and value
+func validClaims(changes ...any) map[string]any {
+	claims := map[string]any{
+		"sub":   "alice",
+		"iss":   "https://issuer.example",
+		"aud":   "fileserver",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"scope": "read write",
+	}
+	for i := 0; i+1 < len(changes); i += 2 {
+		if changes[i+1] == nil {
+			delete(claims, changes[i].(string))
+			continue
+		}
+		claims[changes[i].(string)] = changes[i+1]
+	}
+	return claims
+}
+
+func newTestVerifier(t *testing.T, keys *testKeys) *JWTVerifier {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(name, keys.jwks(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	v, err := NewJWTVerifier(name, "https://issuer.example", "fileserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestParseJWKS(t *testing.T) {
+	keys := newTestKeys(t)
+	parsed, err := ParseJWKS(keys.jwks())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var algorithms []string
+	for _, key := range parsed {
+		algorithms = append(algorithms, key.ID+":"+key.Algorithm)
+	}
+	if !slices.Equal(algorithms, []string{"hs:HS256", "rs:RS256", "ed:EdDSA"}) {
+		t.Fatalf("unexpected keys %v", algorithms)
+	}
+
+	small, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encode := base64.RawURLEncoding.EncodeToString
+	for _, jwks := range []string{
+		`not json`,
+		`{"keys": []}`,
+		`{"keys": [{"kty": "EC", "kid": "ec"}]}`,
+		`{"keys": [{"kty": "oct", "kid": "short", "k": "` + encode([]byte("0123456789")) + `"}]}`,
+		`{"keys": [{"kty": "RSA", "kid": "small", "n": "` + encode(small.N.Bytes()) + `", "e": "AQAB"}]}`,
+		`{"keys": [{"kty": "OKP", "kid": "x", "crv": "X25519", "x": "` + encode(make([]byte, 32)) + `"}]}`,
+	} {
+		if _, err = ParseJWKS([]byte(jwks)); err == nil {
+			t.Errorf("%s: expected an error", jwks)
+		}
+	}
+}
+
+func TestJWTVerifier(t *testing.T) {
+	keys := newTestKeys(t)
+	v := newTestVerifier(t, keys)
+
+	for alg, token := range map[string]string{
+		"HS256":         keys.sign(t, "HS256", "hs", keys.hmac, validClaims()),
+		"RS256":         keys.sign(t, "RS256", "rs", keys.rsa, validClaims()),
+		"EdDSA":         keys.sign(t, "EdDSA", "ed", keys.ed25519, validClaims()),
+		"without a kid": keys.sign(t, "RS256", "", keys.rsa, validClaims()),
+	} {
+		principal, err := v.Verify(token)
+		if err != nil {
+			t.Errorf("%s: %v", alg, err)
+			continue
+		}
+		if principal.Name != "alice" || principal.Method != "jwt" || !slices.Equal(principal.Scopes, []Scope{ScopeRead, ScopeWrite}) {
+			t.Errorf("%s: unexpected principal %+v", alg, principal)
+		}
+	}
+
+	// the public RSA key as an HMAC secret, the classic algorithm confusion
+	public, err := x509.MarshalPKIXPublicKey(&keys.rsa.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	none := keys.sign(t, "none", "rs", nil, validClaims())
+	other, _ := rsa.GenerateKey(rand.Reader, 2048)
+	changed := strings.Split(keys.sign(t, "HS256", "hs", keys.hmac, validClaims()), ".")
+	escalated := strings.Split(keys.sign(t, "HS256", "hs", nil, validClaims("scope", "read write delete")), ".")
+	for name, token := range map[string]string{
+		"alg none":                   none,
+		"HS256 with the RSA key":     keys.sign(t, "HS256", "rs", public, validClaims()),
+		"HS256 with the RSA modulus": keys.sign(t, "HS256", "rs", keys.rsa.N.Bytes(), validClaims()),
+		"HS256 without a kid":        keys.sign(t, "HS256", "", public, validClaims()),
+		"RS256 of the HMAC kid":      keys.sign(t, "RS256", "hs", keys.rsa, validClaims()),
+		"EdDSA of the RSA kid":       keys.sign(t, "EdDSA", "rs", keys.ed25519, validClaims()),
+		"an unknown kid":             keys.sign(t, "RS256", "other", keys.rsa, validClaims()),
+		"another RSA key":            keys.sign(t, "RS256", "rs", other, validClaims()),
+		"another HMAC secret":        keys.sign(t, "HS256", "hs", []byte("another secret of 32 bytes......"), validClaims()),
+		"a changed payload":          changed[0] + "." + escalated[1] + "." + changed[2],
+		"two parts":                  "eyJhbGciOiJIUzI1NiJ9.e30",
+		"an invalid header":          "eyJ!.e30.AAAA",
+	} {
+		if _, err = v.Verify(token); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("%s: expected an invalid token, got %v", name, err)
+		}
+	}
+
+	now := time.Now()
+	for name, test := range map[string]struct {
+		claims map[string]any
+		want   error
+	}{
+		"no exp":                {validClaims("exp", nil), ErrInvalidToken},
+		"an expired token":      {validClaims("exp", now.Add(-2*time.Minute).Unix()), ErrTokenExpired},
+		"a string exp":          {validClaims("exp", "tomorrow"), ErrInvalidToken},
+		"exp within the leeway": {validClaims("exp", now.Add(-30*time.Second).Unix()), nil},
+		"a future nbf":          {validClaims("nbf", now.Add(2*time.Minute).Unix()), ErrInvalidToken},
+		"nbf within the leeway": {validClaims("nbf", now.Add(30*time.Second).Unix()), nil},
+		"a past nbf":            {validClaims("nbf", now.Add(-time.Hour).Unix()), nil},
+		"another issuer":        {validClaims("iss", "https://other.example"), ErrInvalidToken},
+		"no issuer":             {validClaims("iss", nil), ErrInvalidToken},
+		"another audience":      {validClaims("aud", "other"), ErrInvalidToken},
+		"no audience":           {validClaims("aud", nil), ErrInvalidToken},
+		"an audience list":      {validClaims("aud", []string{"other", "fileserver"}), nil},
+		"another audience list": {validClaims("aud", []string{"other"}), ErrInvalidToken},
+	} {
+		_, err = v.Verify(keys.sign(t, "HS256", "hs", keys.hmac, test.claims))
+		if test.want == nil && err != nil || test.want != nil && !errors.Is(err, test.want) {
+			t.Errorf("%s: expected %v, got %v", name, test.want, err)
+		}
+	}
+}
+
+func TestJWTVerifier_scopes(t *testing.T) {
+	keys := newTestKeys(t)
+	v := newTestVerifier(t, keys)
+
+	for name, test := range map[string]struct {
+		claims   map[string]any
+		scopeMap map[string][]Scope
+		want     []Scope
+	}{
+		"scope":              {validClaims("scope", "read delete"), nil, []Scope{ScopeRead, ScopeDelete}},
+		"scp list":           {validClaims("scope", nil, "scp", []string{"write"}), nil, []Scope{ScopeWrite}},
+		"scp string":         {validClaims("scope", "read", "scp", "delete"), nil, []Scope{ScopeRead, ScopeDelete}},
+		"no scopes":          {validClaims("scope", nil), nil, nil},
+		"mapped scopes":      {validClaims("scope", "files.rw admin"), map[string][]Scope{"files.rw": {ScopeRead, ScopeWrite}}, []Scope{ScopeRead, ScopeWrite}},
+		"unmapped scopes":    {validClaims("scope", "read write"), map[string][]Scope{"files.rw": {ScopeRead, ScopeWrite}}, nil},
+		"an empty scope map": {validClaims("scope", "read"), map[string][]Scope{}, nil},
+	} {
+		v.ScopeMap = test.scopeMap
+		principal, err := v.Verify(keys.sign(t, "EdDSA", "ed", keys.ed25519, test.claims))
+		if err != nil || !slices.Equal(principal.Scopes, test.want) {
+			t.Errorf("%s: expected %v, got %+v %v", name, test.want, principal, err)
+		}
+	}
+}
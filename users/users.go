@@ -2,7 +2,6 @@ package users
 
 import (
 	"context"
-	"encoding/base64"
 	"errors"
 	"fmt"
 	"log/slog"
@@ -153,15 +152,7 @@ func (u *LocalUsers) VerifyUser(r *http.Request) (any, error) {
 	user, pass, ok := r.BasicAuth()
 
 	if !ok {
-		// Inform the client about the required authentication scheme and provide an example
-
-		exampleUser := "exampleUser"
-		examplePass := "examplePass"
-		exampleCredentials := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%s", exampleUser, examplePass)))
-
-		errorMessage := fmt.Errorf("access denied. This resource requires Basic authentication. For example, "+
-			"set the Authorization header as: Authorization: Basic %s or http://%s:%s@example.com",
-			exampleCredentials, exampleUser, examplePass)
+		errorMessage := errors.New("access denied, this resource requires Basic authentication")
 		u.Logger().Debug("access denied", "error", errorMessage, "remoteAddr", r.RemoteAddr, "user-agent", r.UserAgent())
 		return nil, errorMessage
 	}